@@ -0,0 +1,595 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"os/user"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	config "github.com/fufuhu/sql-web-migrate/migrate"
+	migrate "github.com/rubenv/sql-migrate"
+)
+
+const (
+	// DefaultServeAddress WebサーバがListenするデフォルトのアドレス
+	DefaultServeAddress = "0.0.0.0:8080"
+	// ShutdownTimeout 終了時に、中断したマイグレーションの結果を返し終えるまで待つ時間の上限
+	ShutdownTimeout = 30 * time.Second
+)
+
+const usage = `Usage: sql-web-migrate <command> [options]
+
+Commands:
+  serve [--addr ADDRESS]   Start the web server (default command)
+  up [--steps N] [--override REASON]
+                           Apply pending migrations (all by default)
+  down [--steps N] [--override REASON]
+                           Roll back applied migrations (1 by default)
+  status [--schema NAME]   Show which migrations have been applied
+  redo [--steps N] [--override REASON]
+                           Roll back and reapply the latest N migrations
+                           (1 by default)
+  skip [--to ID] [--schema NAME] [ID...]
+                           Mark pending migrations applied without running them
+  unskip [--schema NAME] ID...
+                           Remove the applied record of migrations without
+                           running their down migrations. Both are recorded
+                           in the audit log with the OS user
+  verify [--schema NAME]   Check applied migrations against the checksums
+                           recorded when they were applied
+  lint [--json]            Check the migrations for dangerous statements and
+                           exit non-zero when any would fail or lose data
+  new NAME                 Create a new migration file in the source directory
+  targets                  List the configured targets
+  sign --key FILE [--version V] [DIR]
+                           Write a manifest of the migrations in DIR (the
+                           target's source directory by default) and sign it
+  keygen                   Generate an ed25519 key pair for signing manifests
+  run-once [--output PATH] [--wait DURATION] [--wait-backoff DURATION]
+           [--override REASON]
+                           Wait for the database, apply all pending migrations,
+                           write a JSON summary and exit non-zero on failure
+
+Every command except serve and targets accepts --target NAME to choose one of
+the targets defined in SQL_MIGRATE_TARGETS_FILE ("default" otherwise).
+
+up, down, redo and run-once fail outside the target's maintenance windows or
+during a configured freeze. Freezes started through the web server's API only
+stop the server. --override REASON runs anyway when the OS user is listed in
+SQL_MIGRATE_EMERGENCY_OVERRIDERS, and is recorded in the audit log.
+
+Connection and source settings are read from the same SQL_MIGRATE_* environment
+variables as the web server.
+`
+
+// runCommand 引数で指定されたサブコマンドを実行して終了コードを返す。
+// サブコマンドが指定されていない場合はWebサーバを起動する
+func runCommand(args []string) int {
+	if len(args) == 0 {
+		return serveCommand(args)
+	}
+
+	command, args := args[0], args[1:]
+	switch command {
+	case "serve":
+		return serveCommand(args)
+	case "up":
+		return migrateCommand(migrate.Up, 0, args)
+	case "down":
+		return migrateCommand(migrate.Down, 1, args)
+	case "status":
+		return statusCommand(args)
+	case "redo":
+		return redoCommand(args)
+	case "skip":
+		return skipCommand(args)
+	case "unskip":
+		return unskipCommand(args)
+	case "verify":
+		return verifyCommand(args)
+	case "lint":
+		return lintCommand(args)
+	case "new":
+		return newCommand(args)
+	case "targets":
+		return targetsCommand(args)
+	case "run-once":
+		return runOnceCommand(args)
+	case "sign":
+		return signCommand(args)
+	case "keygen":
+		return keygenCommand(args)
+	case "help", "-h", "--help":
+		fmt.Fprint(os.Stdout, usage)
+		return 0
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command: %s\n\n%s", command, usage)
+	return 2
+}
+
+// newFlagSet サブコマンド用のFlagSetを生成する
+func newFlagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+	}
+	return flags
+}
+
+// exitWithError エラーを標準エラー出力に書き出して終了コードを返す
+func exitWithError(err error) int {
+	fmt.Fprintln(os.Stderr, err)
+	return 1
+}
+
+// addTargetFlag 対象を指定する--targetオプションを追加する
+func addTargetFlag(flags *flag.FlagSet) *string {
+	return flags.String("target", config.DefaultTargetName, "name of the target to operate on")
+}
+
+// addOverrideFlag 時間帯の外や凍結中、承認が必要な対象で承認依頼を通さずに緊急実行する理由を指定する--overrideフラグを追加する
+func addOverrideFlag(flags *flag.FlagSet) *string {
+	return flags.String("override", "",
+		"reason for running outside the maintenance windows, during a freeze, or without an approved request")
+}
+
+// enforcePolicies 時間帯と凍結、承認の要否を確認する。緊急実行の場合はOSの利用者名で監査記録に残す
+func enforcePolicies(target *config.Target, override string) error {
+	identity := localIdentity()
+	if err := config.EnforceSchedule(nil, target, identity, override); err != nil {
+		return err
+	}
+	return config.EnforceApproval(target, identity, override)
+}
+
+// localIdentity コマンドを実行しているOSの利用者名を返す。緊急実行の確認と監査記録に使う
+func localIdentity() string {
+	if current, err := user.Current(); err == nil {
+		return current.Username
+	}
+	return os.Getenv("USER")
+}
+
+// lookupTarget 名前に対応する対象を返す
+func lookupTarget(name string) (*config.Target, error) {
+	targets, err := config.LoadTargets(config.GetTargetsFile())
+	if err != nil {
+		return nil, err
+	}
+	target, ok := targets.Get(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown target: %s", name)
+	}
+	return target, nil
+}
+
+// serveCommand Webサーバを起動する
+func serveCommand(args []string) int {
+	flags := newFlagSet("serve")
+	address := flags.String("addr", DefaultServeAddress, "address to listen on")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	return exitWithError(serve(*address))
+}
+
+// migrateCommand 指定された方向にマイグレーションを実行する
+func migrateCommand(direction migrate.MigrationDirection, defaultSteps int, args []string) int {
+	flags := newFlagSet(config.DirectionName(direction))
+	steps := flags.Int("steps", defaultSteps, "maximum number of migrations to run (0 means all)")
+	override := addOverrideFlag(flags)
+	targetName := addTargetFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *steps < 0 {
+		return exitWithError(fmt.Errorf("--steps should not be negative: %d", *steps))
+	}
+	target, err := lookupTarget(*targetName)
+	if err != nil {
+		return exitWithError(err)
+	}
+	defer target.Close()
+	if err := enforcePolicies(target, *override); err != nil {
+		return exitWithError(err)
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+
+	result, err := config.ExecMigrate(ctx, target, direction, *steps, nil)
+	if result.Backup != nil {
+		fmt.Fprintf(os.Stdout, "Backed up to %s\n", result.Backup.Path)
+	}
+	printHooks(os.Stdout, result.Hooks)
+	printApplied(os.Stdout, direction, result.Applied)
+	printSchemas(os.Stdout, result.Schemas)
+	if err != nil {
+		return exitWithError(err)
+	}
+	return 0
+}
+
+// interruptContext SIGINTかSIGTERMを受け取るとキャンセルされるコンテキストを返す。
+// 実行中のマイグレーションはSQL文をキャンセルして中断する
+func interruptContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// printApplied 適用したマイグレーションのIDを出力する
+func printApplied(w io.Writer, direction migrate.MigrationDirection, applied []string) {
+	verb := "Applied"
+	if direction == migrate.Down {
+		verb = "Rolled back"
+	}
+	for _, id := range applied {
+		fmt.Fprintf(w, "%s %s\n", verb, id)
+	}
+	fmt.Fprintf(w, "%s %d migration(s)\n", verb, len(applied))
+}
+
+// printSchemas スキーマごとに適用した場合のスキーマごとの結果を出力する
+func printSchemas(w io.Writer, schemas []config.SchemaResult) {
+	for _, schema := range schemas {
+		status := "ok"
+		switch {
+		case schema.Skipped:
+			status = "skipped"
+		case !schema.Success:
+			status = "failed: " + schema.Error
+		}
+		fmt.Fprintf(w, "%s: %d migration(s), %s\n", schema.Schema, len(schema.Applied), status)
+	}
+}
+
+// printHooks 実行したフックを1行ずつ出力する。失敗したフックは出力も表示する
+func printHooks(w io.Writer, hooks []config.HookResult) {
+	for _, hook := range hooks {
+		name := hook.Phase + "/" + hook.Name
+		if hook.Schema != "" {
+			name += " [" + hook.Schema + "]"
+		}
+		if hook.Migration != "" {
+			name += " " + hook.Migration
+		}
+		if hook.Success {
+			fmt.Fprintf(w, "Hook %s: ok\n", name)
+			continue
+		}
+		fmt.Fprintf(w, "Hook %s: failed: %s\n", name, hook.Error)
+		if hook.Output != "" {
+			fmt.Fprintln(w, strings.TrimRight(hook.Output, "\n"))
+		}
+	}
+}
+
+// statusCommand マイグレーションの適用状況を表形式で出力する
+func statusCommand(args []string) int {
+	flags := newFlagSet("status")
+	targetName := addTargetFlag(flags)
+	schema := flags.String("schema", "", "schema to report on when the target fans out to schemas")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	target, err := lookupTarget(*targetName)
+	if err != nil {
+		return exitWithError(err)
+	}
+	defer target.Close()
+
+	statuses, err := config.GetMigrationStatus(context.Background(), target, *schema)
+	if err != nil {
+		return exitWithError(err)
+	}
+
+	if source, err := target.SourceInfo(); err == nil {
+		fmt.Fprintf(os.Stdout, "Source: %s\n\n", source)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "MIGRATION\tAPPLIED")
+	for _, status := range statuses {
+		applied := "no"
+		if status.Applied {
+			applied = status.AppliedAt
+		}
+		fmt.Fprintf(writer, "%s\t%s\n", status.ID, applied)
+	}
+	writer.Flush()
+	return 0
+}
+
+// verifyCommand 適用済みのマイグレーションが適用後に変更または削除されていないかを表形式で出力する。
+// 変更または削除されたマイグレーションがある場合は終了コード1を返す
+func verifyCommand(args []string) int {
+	flags := newFlagSet("verify")
+	targetName := addTargetFlag(flags)
+	schema := flags.String("schema", "", "schema to verify when the target fans out to schemas")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	target, err := lookupTarget(*targetName)
+	if err != nil {
+		return exitWithError(err)
+	}
+	defer target.Close()
+
+	report, err := config.VerifyChecksums(context.Background(), target, *schema)
+	if err != nil {
+		return exitWithError(err)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "MIGRATION\tCHECKSUM")
+	for _, migration := range report.Migrations {
+		fmt.Fprintf(writer, "%s\t%s\n", migration.ID, migration.Status)
+	}
+	writer.Flush()
+
+	if !report.OK {
+		return exitWithError(&config.DriftError{Drifted: report.Drifted()})
+	}
+	return 0
+}
+
+// lintCommand マイグレーションに含まれる危険なSQLの指摘を表形式またはJSONで出力する。
+// 重要度errorの指摘がある場合は終了コード1を返す
+func lintCommand(args []string) int {
+	flags := newFlagSet("lint")
+	targetName := addTargetFlag(flags)
+	outputJSON := flags.Bool("json", false, "print the findings as JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	target, err := lookupTarget(*targetName)
+	if err != nil {
+		return exitWithError(err)
+	}
+	defer target.Close()
+
+	report, err := config.LintTarget(context.Background(), target)
+	if err != nil {
+		return exitWithError(err)
+	}
+
+	if *outputJSON {
+		bytes, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Fprintln(os.Stdout, string(bytes))
+	} else {
+		writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(writer, "MIGRATION\tDIRECTION\tSEVERITY\tRULE\tMESSAGE")
+		for _, finding := range report.Findings {
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", finding.ID, finding.Direction, finding.Severity, finding.Rule, finding.Message)
+		}
+		writer.Flush()
+		fmt.Fprintf(os.Stdout, "%d finding(s)\n", len(report.Findings))
+	}
+
+	if !report.OK {
+		return exitWithError(fmt.Errorf("migrations contain statements that will fail or lose data"))
+	}
+	return 0
+}
+
+// redoCommand 最後に適用したマイグレーションを戻してから再適用する
+func redoCommand(args []string) int {
+	flags := newFlagSet("redo")
+	steps := flags.Int("steps", config.DefaultRedoSteps, "number of the latest migrations to roll back and reapply")
+	override := addOverrideFlag(flags)
+	targetName := addTargetFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *steps < 1 {
+		return exitWithError(fmt.Errorf("--steps should be a positive integer: %d", *steps))
+	}
+	target, err := lookupTarget(*targetName)
+	if err != nil {
+		return exitWithError(err)
+	}
+	defer target.Close()
+	if err := enforcePolicies(target, *override); err != nil {
+		return exitWithError(err)
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+
+	result, err := config.ExecRedo(ctx, target, *steps)
+	for _, phase := range []*config.MigrationResult{result.RolledBack, result.Reapplied} {
+		if phase == nil {
+			continue
+		}
+		direction, _ := config.ParseDirection(phase.Direction)
+		if phase.Backup != nil {
+			fmt.Fprintf(os.Stdout, "Backed up to %s\n", phase.Backup.Path)
+		}
+		printHooks(os.Stdout, phase.Hooks)
+		printApplied(os.Stdout, direction, phase.Applied)
+		printSchemas(os.Stdout, phase.Schemas)
+	}
+	if err != nil {
+		return exitWithError(err)
+	}
+	return 0
+}
+
+// skipCommand 未適用のマイグレーションを実行せずに適用済みにし、OSの利用者名で監査記録に残す
+func skipCommand(args []string) int {
+	flags := newFlagSet("skip")
+	to := flags.String("to", "", "mark every pending migration up to and including this ID")
+	schema := flags.String("schema", "", "schema to edit when the target fans out to schemas")
+	targetName := addTargetFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if (*to == "") == (flags.NArg() == 0) {
+		return exitWithError(fmt.Errorf("skip requires either --to or migration IDs"))
+	}
+	target, err := lookupTarget(*targetName)
+	if err != nil {
+		return exitWithError(err)
+	}
+	defer target.Close()
+
+	edit, err := config.SkipMigrations(context.Background(), target, *schema, flags.Args(), *to)
+	config.RecordHistoryEdit(target, localIdentity(), edit, err)
+	if err != nil {
+		return exitWithError(err)
+	}
+	printHistoryEdit(os.Stdout, edit)
+	return 0
+}
+
+// unskipCommand 適用済みのマイグレーションを実行せずに適用記録から削除し、OSの利用者名で監査記録に残す
+func unskipCommand(args []string) int {
+	flags := newFlagSet("unskip")
+	schema := flags.String("schema", "", "schema to edit when the target fans out to schemas")
+	targetName := addTargetFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		return exitWithError(fmt.Errorf("unskip requires migration IDs"))
+	}
+	target, err := lookupTarget(*targetName)
+	if err != nil {
+		return exitWithError(err)
+	}
+	defer target.Close()
+
+	edit, err := config.UnskipMigrations(context.Background(), target, *schema, flags.Args())
+	config.RecordHistoryEdit(target, localIdentity(), edit, err)
+	if err != nil {
+		return exitWithError(err)
+	}
+	printHistoryEdit(os.Stdout, edit)
+	return 0
+}
+
+// printHistoryEdit 適用記録を編集したマイグレーションを出力する
+func printHistoryEdit(w io.Writer, edit config.HistoryEdit) {
+	fmt.Fprintf(w, "%s: %d migration(s)\n", edit.Action, len(edit.Migrations))
+	for _, id := range edit.Migrations {
+		fmt.Fprintf(w, "  %s\n", id)
+	}
+}
+
+// newCommand マイグレーションファイルの雛形を作成する
+func newCommand(args []string) int {
+	flags := newFlagSet("new")
+	targetName := addTargetFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		return exitWithError(fmt.Errorf("new requires exactly one migration name"))
+	}
+	target, err := lookupTarget(*targetName)
+	if err != nil {
+		return exitWithError(err)
+	}
+
+	// 埋め込みのソースはバイナリに含まれるため、新しいファイルを追加できない
+	source, err := target.SourceInfo()
+	if err != nil {
+		return exitWithError(err)
+	}
+	if source.Kind != config.SourceFilesystem {
+		return exitWithError(fmt.Errorf("new requires a filesystem source, but target %s uses %s", target.Name, source.Kind))
+	}
+
+	path, err := config.NewMigrationFile(source.Path, flags.Arg(0), time.Now())
+	if err != nil {
+		return exitWithError(err)
+	}
+
+	fmt.Fprintf(os.Stdout, "Created migration %s\n", path)
+	return 0
+}
+
+// targetsCommand 設定されている対象の一覧を表形式で出力する
+func targetsCommand(args []string) int {
+	flags := newFlagSet("targets")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	targets, err := config.LoadTargets(config.GetTargetsFile())
+	if err != nil {
+		return exitWithError(err)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "TARGET\tHOST\tDATABASE\tSOURCE\tPATH")
+	for _, target := range targets.List() {
+		info := target.Info()
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", info.Name, info.Host, info.DBName, info.Source, info.SourcePath)
+	}
+	writer.Flush()
+	return 0
+}
+
+// signCommand ソースのディレクトリのマニフェストを生成して署名する
+func signCommand(args []string) int {
+	flags := newFlagSet("sign")
+	targetName := addTargetFlag(flags)
+	keyPath := flags.String("key", "", "file containing a base64 ed25519 private key")
+	version := flags.String("version", time.Now().UTC().Format("20060102150405"), "version written to the manifest")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *keyPath == "" {
+		return exitWithError(fmt.Errorf("sign requires --key"))
+	}
+
+	dir := flags.Arg(0)
+	if dir == "" {
+		target, err := lookupTarget(*targetName)
+		if err != nil {
+			return exitWithError(err)
+		}
+		dir = target.SourcePath()
+	}
+
+	key, err := config.ReadPrivateKey(*keyPath)
+	if err != nil {
+		return exitWithError(err)
+	}
+	if err := config.SignSourceDir(dir, *version, key); err != nil {
+		return exitWithError(err)
+	}
+
+	fmt.Fprintf(os.Stdout, "Signed %s and wrote %s\n", config.BundleManifestFile, config.ManifestSignatureFile)
+	return 0
+}
+
+// keygenCommand マニフェストの署名に使う鍵の組を生成して出力する
+func keygenCommand(args []string) int {
+	flags := newFlagSet("keygen")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return exitWithError(err)
+	}
+	fmt.Fprintf(os.Stdout, "private key (keep secret, pass to sign --key): %s\n",
+		base64.StdEncoding.EncodeToString(private.Seed()))
+	fmt.Fprintf(os.Stdout, "public key (add to %s as name:key): %s\n",
+		config.TrustedKeys, base64.StdEncoding.EncodeToString(public))
+	return 0
+}
@@ -0,0 +1,967 @@
+// Package client sql-web-migrateのサーバを呼び出すためのクライアント
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultRetries デフォルトのリトライ回数
+	DefaultRetries = 3
+	// DefaultBackoff デフォルトのリトライ初回待ち時間
+	DefaultBackoff = time.Second
+	// DefaultTarget 対象を指定しない場合に操作するサーバの対象名
+	DefaultTarget = "default"
+)
+
+// LogRecord DDLの適用記録
+// 既存のクライアントとの互換性のため、JSONのキーはフィールド名(ID, AppliedAt)のままにする
+type LogRecord struct {
+	ID        string `json:"ID"`
+	AppliedAt string `json:"AppliedAt"`
+}
+
+// MigrationStatus マイグレーションの適用状況 (GET /migrate/status)
+type MigrationStatus struct {
+	ID        string `json:"id"`
+	Applied   bool   `json:"applied"`
+	AppliedAt string `json:"appliedAt,omitempty"`
+}
+
+// MigrationResult マイグレーションの実行結果 (POST /migrate/up, /migrate/down)
+type MigrationResult struct {
+	Direction      string         `json:"direction"`
+	Success        bool           `json:"success"`
+	Applied        []string       `json:"applied"`
+	Records        []LogRecord    `json:"records"`
+	Schemas        []SchemaResult `json:"schemas,omitempty"`
+	Backup         *BackupInfo    `json:"backup,omitempty"`
+	Hooks          []HookResult   `json:"hooks,omitempty"`
+	Interrupted    *Interruption  `json:"interrupted,omitempty"`
+	StartedAt      time.Time      `json:"startedAt"`
+	DurationMillis int64          `json:"durationMillis"`
+	Error          string         `json:"error,omitempty"`
+}
+
+// RedoResult 最後に適用したマイグレーションを戻して再適用した結果 (POST /migrate/redo)
+type RedoResult struct {
+	Steps          int              `json:"steps"`
+	Success        bool             `json:"success"`
+	RolledBack     *MigrationResult `json:"rolledBack,omitempty"`
+	Reapplied      *MigrationResult `json:"reapplied,omitempty"`
+	StartedAt      time.Time        `json:"startedAt"`
+	DurationMillis int64            `json:"durationMillis"`
+	Error          string           `json:"error,omitempty"`
+}
+
+// BackupInfo downの前にpg_dumpで取得したバックアップ
+type BackupInfo struct {
+	Path           string   `json:"path"`
+	Scope          string   `json:"scope"`
+	Tables         []string `json:"tables,omitempty"`
+	SizeBytes      int64    `json:"sizeBytes"`
+	DurationMillis int64    `json:"durationMillis"`
+}
+
+// Interruption 実行中に中断したマイグレーション。
+// RolledBackがfalseの場合は、トランザクションを使わないマイグレーションが途中まで適用されている可能性がある
+type Interruption struct {
+	Migration  string `json:"migration"`
+	Reason     string `json:"reason"`
+	RolledBack bool   `json:"rolledBack"`
+}
+
+// HookResult マイグレーションの前後に実行したフック1件の実行結果
+type HookResult struct {
+	Phase          string `json:"phase"`
+	Name           string `json:"name"`
+	Schema         string `json:"schema,omitempty"`
+	Migration      string `json:"migration,omitempty"`
+	Success        bool   `json:"success"`
+	Output         string `json:"output,omitempty"`
+	DurationMillis int64  `json:"durationMillis"`
+	Error          string `json:"error,omitempty"`
+}
+
+// SchemaResult スキーマごとに適用した場合のスキーマ1件分の実行結果
+type SchemaResult struct {
+	Schema         string        `json:"schema"`
+	Success        bool          `json:"success"`
+	Skipped        bool          `json:"skipped,omitempty"`
+	Applied        []string      `json:"applied"`
+	Interrupted    *Interruption `json:"interrupted,omitempty"`
+	DurationMillis int64         `json:"durationMillis"`
+	Error          string        `json:"error,omitempty"`
+}
+
+// MigrationPlan 実行予定のマイグレーション (GET /migrate/plan)
+type MigrationPlan struct {
+	Direction  string     `json:"direction"`
+	Migrations []PlanStep `json:"migrations"`
+}
+
+// PlanStep 実行予定のマイグレーション1件分
+type PlanStep struct {
+	ID                 string   `json:"id"`
+	Statements         []string `json:"statements"`
+	DisableTransaction bool     `json:"disableTransaction"`
+}
+
+// TargetInfo マイグレーション対象 (GET /targets)
+type TargetInfo struct {
+	Name            string `json:"name"`
+	Dialect         string `json:"dialect"`
+	Host            string `json:"host"`
+	DBName          string `json:"dbname"`
+	Source          string `json:"source"`
+	SourcePath      string `json:"sourcePath"`
+	RequireApproval bool   `json:"requireApproval"`
+}
+
+// ChecksumStatus 適用済みのマイグレーション1件分のチェックサムの確認結果
+type ChecksumStatus struct {
+	ID       string `json:"id"`
+	Status   string `json:"status"`
+	Recorded string `json:"recorded,omitempty"`
+	Current  string `json:"current,omitempty"`
+}
+
+// ChecksumReport 適用済みのマイグレーションの変更の確認結果 (GET /migrate/verify)
+type ChecksumReport struct {
+	OK         bool             `json:"ok"`
+	Migrations []ChecksumStatus `json:"migrations"`
+}
+
+// LintFinding 危険なSQLの指摘1件分
+type LintFinding struct {
+	ID        string `json:"id"`
+	Direction string `json:"direction"`
+	Rule      string `json:"rule"`
+	Severity  string `json:"severity"`
+	Message   string `json:"message"`
+	Statement string `json:"statement,omitempty"`
+}
+
+// LintReport マイグレーションの検査結果 (GET /migrate/lint)
+type LintReport struct {
+	OK         bool          `json:"ok"`
+	TableStats bool          `json:"tableStats"`
+	Findings   []LintFinding `json:"findings"`
+}
+
+// BundleInfo サーバに格納されたバンドル (GET /bundles)
+type BundleInfo struct {
+	Version    string    `json:"version"`
+	Checksum   string    `json:"checksum"`
+	Migrations []string  `json:"migrations"`
+	UploadedAt time.Time `json:"uploadedAt"`
+	UploadedBy string    `json:"uploadedBy"`
+	Active     bool      `json:"active"`
+}
+
+// BundleUpload バンドルのアップロードの結果 (POST /bundles)
+type BundleUpload struct {
+	Bundle       BundleInfo       `json:"bundle"`
+	Result       *MigrationResult `json:"result,omitempty"`
+	Confirmation *Confirmation    `json:"confirmation,omitempty"`
+}
+
+// Confirmation 実行前に確認が必要な操作の実行予定 (428 Precondition Required)
+// Tokenを付けて同じ操作をもう一度リクエストすると実行される
+type Confirmation struct {
+	Token      string        `json:"token"`
+	ExpiresAt  time.Time     `json:"expiresAt"`
+	Direction  string        `json:"direction"`
+	Steps      int           `json:"steps"`
+	PlanHash   string        `json:"planHash"`
+	Migrations []PlanStep    `json:"migrations"`
+	Reapply    []PlanStep    `json:"reapply,omitempty"`
+	Findings   []LintFinding `json:"findings"`
+}
+
+// ApprovalRequest マイグレーションの承認依頼 (GET /requests)
+type ApprovalRequest struct {
+	ID          string     `json:"id"`
+	Target      string     `json:"target"`
+	Direction   string     `json:"direction"`
+	Steps       int        `json:"steps"`
+	PlanHash    string     `json:"planHash"`
+	Status      string     `json:"status"`
+	RequestedBy string     `json:"requestedBy"`
+	RequestedAt time.Time  `json:"requestedAt"`
+	ExpiresAt   time.Time  `json:"expiresAt"`
+	ReviewedBy  string     `json:"reviewedBy,omitempty"`
+	ReviewedAt  *time.Time `json:"reviewedAt,omitempty"`
+	ExecutedBy  string     `json:"executedBy,omitempty"`
+	ExecutedAt  *time.Time `json:"executedAt,omitempty"`
+	Success     *bool      `json:"success,omitempty"`
+}
+
+// HistoryEdit マイグレーションを実行せずに適用記録を編集した結果 (POST /migrate/skip, /migrate/unskip)
+type HistoryEdit struct {
+	Action     string      `json:"action"`
+	Schema     string      `json:"schema,omitempty"`
+	Migrations []string    `json:"migrations"`
+	Records    []LogRecord `json:"records"`
+}
+
+// Freeze マイグレーションを凍結する期間 (GET /freezes)
+type Freeze struct {
+	ID         string    `json:"id"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	Reason     string    `json:"reason,omitempty"`
+	CreatedBy  string    `json:"createdBy,omitempty"`
+	Configured bool      `json:"configured"`
+}
+
+// ScheduleStatus マイグレーションを実行できる時間帯と凍結の状況 (GET /schedule)
+type ScheduleStatus struct {
+	Allowed     bool       `json:"allowed"`
+	Reason      string     `json:"reason,omitempty"`
+	NextAllowed *time.Time `json:"nextAllowed,omitempty"`
+	TimeZone    string     `json:"timezone"`
+	Windows     []string   `json:"windows"`
+	Freezes     []Freeze   `json:"freezes"`
+}
+
+// ProgressEvent マイグレーションを1件適用するごとにサーバから送られるイベント
+type ProgressEvent struct {
+	ID        string `json:"id"`
+	Direction string `json:"direction"`
+}
+
+// MigrateRequest マイグレーション実行のリクエスト
+// Steps 実行するマイグレーションの最大件数(0はすべて)
+// Progress nilでない場合は、Server-Sent Eventsで進捗を受け取り1件ごとに呼び出す
+// Confirm 確認が必要な操作を実行する場合の、サーバが返した確認トークン
+// Request 承認が必要な対象で実行する場合の、承認済みの承認依頼のID
+// Override 実行できる時間帯の外や凍結中に緊急実行する場合の理由(許可された利用者だけが使える)
+type MigrateRequest struct {
+	Steps    int
+	Progress func(ProgressEvent)
+	Confirm  string
+	Request  string
+	Override string
+}
+
+// RedoRequest 最後に適用したマイグレーションを戻して再適用するリクエスト
+// Steps 戻して再適用するマイグレーションの数(0の場合はサーバのデフォルトの1件)
+// Confirm 戻す操作を実行する場合の、サーバが返した確認トークン
+// Override 実行できる時間帯の外や凍結中に緊急実行する場合の理由(許可された利用者だけが使える)
+type RedoRequest struct {
+	Steps    int
+	Confirm  string
+	Override string
+}
+
+// SkipRequest マイグレーションを実行せずに適用済みにするリクエスト
+// IDs 適用済みにするマイグレーションのID
+// To このIDのマイグレーションまでの未適用のマイグレーションをすべて適用済みにする(IDsとどちらかを指定する)
+// Schema スキーマごとに適用する対象の場合のスキーマ
+type SkipRequest struct {
+	IDs    []string
+	To     string
+	Schema string
+}
+
+// PlanRequest 実行予定のマイグレーション取得のリクエスト
+// Direction マイグレーションの方向(up/down)
+// Steps 実行するマイグレーションの最大件数(0はすべて)
+// Schema スキーマごとに適用する対象の場合のスキーマ
+type PlanRequest struct {
+	Direction string
+	Steps     int
+	Schema    string
+}
+
+// Error サーバがエラーを返した場合のエラー
+// StatusCode HTTPのステータスコード
+// Message サーバが返したエラーメッセージ
+// Result マイグレーションが失敗した場合の実行結果
+// Confirmation 実行前に確認が必要な場合の実行予定
+// NextAllowed 実行できる時間帯の外や凍結中の場合の、次に実行できる時刻 (423 Locked)
+type Error struct {
+	StatusCode   int
+	Message      string
+	Result       *MigrationResult
+	Confirmation *Confirmation
+	NextAllowed  *time.Time
+}
+
+func (e *Error) Error() string {
+	if e.StatusCode == 0 {
+		return e.Message
+	}
+	return fmt.Sprintf("sql-web-migrate: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Client sql-web-migrateのサーバを呼び出すクライアント
+type Client struct {
+	BaseURL    *url.URL
+	Target     string
+	Token      string
+	HTTPClient *http.Client
+	Retries    int
+	Backoff    time.Duration
+
+	tlsConfig *tls.Config
+}
+
+// Option Clientの設定
+type Option func(*Client) error
+
+// WithToken Bearerトークンで認証する
+func WithToken(token string) Option {
+	return func(c *Client) error {
+		c.Token = token
+		return nil
+	}
+}
+
+// WithTarget サーバに設定された対象のうち、名前で指定した対象を操作する。
+// 指定しない場合はdefaultの対象を操作する
+func WithTarget(name string) Option {
+	return func(c *Client) error {
+		c.Target = name
+		return nil
+	}
+}
+
+// WithClientCertificate クライアント証明書で認証する(mTLS)
+func WithClientCertificate(certFile string, keyFile string) Option {
+	return func(c *Client) error {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		c.tlsConfig.Certificates = append(c.tlsConfig.Certificates, certificate)
+		return nil
+	}
+}
+
+// WithCACertificate サーバ証明書をcaFileのCA証明書で検証する
+func WithCACertificate(caFile string) Option {
+	return func(c *Client) error {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return err
+		}
+		if c.tlsConfig.RootCAs == nil {
+			c.tlsConfig.RootCAs = x509.NewCertPool()
+		}
+		if !c.tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", caFile)
+		}
+		return nil
+	}
+}
+
+// WithTLSConfig TLSの設定を指定する
+func WithTLSConfig(tlsConfig *tls.Config) Option {
+	return func(c *Client) error {
+		c.tlsConfig = tlsConfig.Clone()
+		return nil
+	}
+}
+
+// WithRetries 失敗時のリトライ回数と初回待ち時間を指定する
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(c *Client) error {
+		if retries < 0 {
+			return fmt.Errorf("retries should not be negative: %d", retries)
+		}
+		c.Retries = retries
+		c.Backoff = backoff
+		return nil
+	}
+}
+
+// New baseURLのサーバを呼び出すClientを生成する
+func New(baseURL string, options ...Option) (*Client, error) {
+	parsed, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, fmt.Errorf("server URL should start with http:// or https://: %s", baseURL)
+	}
+
+	c := &Client{
+		BaseURL:   parsed,
+		Retries:   DefaultRetries,
+		Backoff:   DefaultBackoff,
+		tlsConfig: &tls.Config{MinVersion: tls.VersionTLS12},
+	}
+	for _, option := range options {
+		if err := option(c); err != nil {
+			return nil, err
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = c.tlsConfig
+	c.HTTPClient = &http.Client{Transport: transport}
+
+	return c, nil
+}
+
+// Up 未適用のマイグレーションを適用する
+func (c *Client) Up(ctx context.Context, request MigrateRequest) (*MigrationResult, error) {
+	return c.migrate(ctx, "up", request)
+}
+
+// Down 適用済みのマイグレーションを戻す
+func (c *Client) Down(ctx context.Context, request MigrateRequest) (*MigrationResult, error) {
+	return c.migrate(ctx, "down", request)
+}
+
+// Redo 最後に適用したマイグレーションを戻してから、現在のファイルで再適用する。
+// 戻す操作の確認が必要な場合は、実行予定を格納したErrorを返す
+func (c *Client) Redo(ctx context.Context, request RedoRequest) (*RedoResult, error) {
+	query := url.Values{}
+	if request.Steps > 0 {
+		query.Set("steps", strconv.Itoa(request.Steps))
+	}
+	if request.Confirm != "" {
+		query.Set("confirm", request.Confirm)
+	}
+	if request.Override != "" {
+		query.Set("override", request.Override)
+	}
+
+	response, err := c.do(ctx, http.MethodPost, c.migratePath("redo"), query, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusPreconditionRequired {
+		return nil, readConfirmation(response)
+	}
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusInternalServerError {
+		return nil, readError(response)
+	}
+
+	var result RedoResult
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if !result.Success {
+		failed := result.Reapplied
+		if failed == nil {
+			failed = result.RolledBack
+		}
+		return &result, &Error{StatusCode: response.StatusCode, Message: result.Error, Result: failed}
+	}
+	return &result, nil
+}
+
+// Status マイグレーションの適用状況を取得する
+func (c *Client) Status(ctx context.Context) ([]MigrationStatus, error) {
+	return c.SchemaStatus(ctx, "")
+}
+
+// SchemaStatus スキーマごとに適用する対象の、指定したスキーマのマイグレーションの適用状況を取得する
+func (c *Client) SchemaStatus(ctx context.Context, schema string) ([]MigrationStatus, error) {
+	query := url.Values{}
+	if schema != "" {
+		query.Set("schema", schema)
+	}
+
+	var statuses []MigrationStatus
+	err := c.getJSON(ctx, c.migratePath("status"), query, &statuses)
+	return statuses, err
+}
+
+// Verify 適用済みのマイグレーションが適用後に変更または削除されていないかを確認する。
+// スキーマごとに適用する対象の場合はschemaでスキーマを指定する
+func (c *Client) Verify(ctx context.Context, schema string) (*ChecksumReport, error) {
+	query := url.Values{}
+	if schema != "" {
+		query.Set("schema", schema)
+	}
+
+	var report ChecksumReport
+	if err := c.getJSON(ctx, c.migratePath("verify"), query, &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// Lint 対象のソースのマイグレーションに含まれる危険なSQLを検査する
+func (c *Client) Lint(ctx context.Context) (*LintReport, error) {
+	var report LintReport
+	if err := c.getJSON(ctx, c.migratePath("lint"), nil, &report); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// Targets 操作できる対象の一覧を取得する
+func (c *Client) Targets(ctx context.Context) ([]TargetInfo, error) {
+	var targets []TargetInfo
+	err := c.getJSON(ctx, "/targets", nil, &targets)
+	return targets, err
+}
+
+// Plan マイグレーションを実行せずに、実行予定のマイグレーションを取得する
+func (c *Client) Plan(ctx context.Context, request PlanRequest) (*MigrationPlan, error) {
+	query := url.Values{}
+	if request.Direction != "" {
+		query.Set("direction", request.Direction)
+	}
+	if request.Steps > 0 {
+		query.Set("steps", strconv.Itoa(request.Steps))
+	}
+	if request.Schema != "" {
+		query.Set("schema", request.Schema)
+	}
+
+	var plan MigrationPlan
+	if err := c.getJSON(ctx, c.migratePath("plan"), query, &plan); err != nil {
+		return nil, err
+	}
+	return &plan, nil
+}
+
+// migrate マイグレーションを実行する。
+// 確認が必要な操作の場合は、実行予定を格納したErrorを返す
+func (c *Client) migrate(ctx context.Context, direction string, request MigrateRequest) (*MigrationResult, error) {
+	query := url.Values{}
+	if request.Steps > 0 {
+		query.Set("steps", strconv.Itoa(request.Steps))
+	}
+	if request.Confirm != "" {
+		query.Set("confirm", request.Confirm)
+	}
+	if request.Request != "" {
+		query.Set("request", request.Request)
+	}
+	if request.Override != "" {
+		query.Set("override", request.Override)
+	}
+
+	header := http.Header{}
+	if request.Progress != nil {
+		header.Set("Accept", "text/event-stream")
+	}
+
+	response, err := c.do(ctx, http.MethodPost, c.migratePath(direction), query, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusPreconditionRequired {
+		return nil, readConfirmation(response)
+	}
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusInternalServerError {
+		return nil, readError(response)
+	}
+
+	var result MigrationResult
+	if strings.HasPrefix(response.Header.Get("Content-Type"), "text/event-stream") {
+		err = readEvents(response.Body, request.Progress, &result)
+	} else {
+		err = json.NewDecoder(response.Body).Decode(&result)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !result.Success {
+		return &result, &Error{StatusCode: response.StatusCode, Message: result.Error, Result: &result}
+	}
+	return &result, nil
+}
+
+// UploadBundle tar.gzまたはzipのバンドルをアップロードし、有効なバンドルにする。
+// applyにtrueを指定した場合は、格納したバンドルのマイグレーションをそのまま適用する。
+// 適用に確認が必要な場合は適用されず、BundleUpload.Confirmationに実行予定が格納される
+func (c *Client) UploadBundle(ctx context.Context, bundle []byte, apply bool) (*BundleUpload, error) {
+	query := url.Values{}
+	if apply {
+		query.Set("apply", "true")
+	}
+	sum := sha256.Sum256(bundle)
+	header := http.Header{}
+	header.Set("X-Bundle-Checksum", hex.EncodeToString(sum[:]))
+
+	response, err := c.do(ctx, http.MethodPost, c.bundlePath(""), query, header, bundle)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusCreated && response.StatusCode != http.StatusAccepted &&
+		response.StatusCode != http.StatusInternalServerError {
+		return nil, readError(response)
+	}
+
+	var upload BundleUpload
+	if err := json.NewDecoder(response.Body).Decode(&upload); err != nil {
+		return nil, err
+	}
+	if upload.Result != nil && !upload.Result.Success {
+		return &upload, &Error{StatusCode: response.StatusCode, Message: upload.Result.Error, Result: upload.Result}
+	}
+	return &upload, nil
+}
+
+// Bundles サーバに格納されているバンドルを新しい順に取得する
+func (c *Client) Bundles(ctx context.Context) ([]BundleInfo, error) {
+	var bundles []BundleInfo
+	err := c.getJSON(ctx, c.bundlePath(""), nil, &bundles)
+	return bundles, err
+}
+
+// ActivateBundle 格納済みのバンドルを有効なバンドルにする。以前のバンドルに戻す場合に使う
+func (c *Client) ActivateBundle(ctx context.Context, version string) (*BundleInfo, error) {
+	response, err := c.do(ctx, http.MethodPost, c.bundlePath("/"+url.PathEscape(version)+"/activate"), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, readError(response)
+	}
+	var info BundleInfo
+	err = json.NewDecoder(response.Body).Decode(&info)
+	return &info, err
+}
+
+// SubmitRequest マイグレーションの承認依頼を登録する。
+// 承認依頼は依頼者とは別の利用者が承認した後、MigrateRequest.Requestに指定して実行する
+func (c *Client) SubmitRequest(ctx context.Context, direction string, steps int) (*ApprovalRequest, error) {
+	query := url.Values{}
+	query.Set("direction", direction)
+	if steps > 0 {
+		query.Set("steps", strconv.Itoa(steps))
+	}
+	return c.postApproval(ctx, c.requestPath(""), query, http.StatusCreated)
+}
+
+// Requests 承認依頼を新しい順に取得する
+func (c *Client) Requests(ctx context.Context) ([]ApprovalRequest, error) {
+	var requests []ApprovalRequest
+	err := c.getJSON(ctx, c.requestPath(""), nil, &requests)
+	return requests, err
+}
+
+// ApproveRequest 承認依頼を承認する
+func (c *Client) ApproveRequest(ctx context.Context, id string) (*ApprovalRequest, error) {
+	return c.postApproval(ctx, c.requestPath("/"+url.PathEscape(id)+"/approve"), nil, http.StatusOK)
+}
+
+// RejectRequest 承認依頼を却下する
+func (c *Client) RejectRequest(ctx context.Context, id string) (*ApprovalRequest, error) {
+	return c.postApproval(ctx, c.requestPath("/"+url.PathEscape(id)+"/reject"), nil, http.StatusOK)
+}
+
+// postApproval 承認依頼を操作するPOSTリクエストを送り、更新後の承認依頼を返す
+func (c *Client) postApproval(ctx context.Context, path string, query url.Values, status int) (*ApprovalRequest, error) {
+	response, err := c.do(ctx, http.MethodPost, path, query, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != status {
+		return nil, readError(response)
+	}
+	var request ApprovalRequest
+	err = json.NewDecoder(response.Body).Decode(&request)
+	return &request, err
+}
+
+// Schedule マイグレーションを実行できる時間帯と凍結の状況を取得する
+func (c *Client) Schedule(ctx context.Context) (*ScheduleStatus, error) {
+	var status ScheduleStatus
+	if err := c.getJSON(ctx, c.targetPath("/schedule"), nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// Freezes 現在と今後の凍結を取得する
+func (c *Client) Freezes(ctx context.Context) ([]Freeze, error) {
+	var freezes []Freeze
+	err := c.getJSON(ctx, c.targetPath("/freezes"), nil, &freezes)
+	return freezes, err
+}
+
+// StartFreeze 今からuntilまでマイグレーションを凍結する
+func (c *Client) StartFreeze(ctx context.Context, until time.Time, reason string) (*Freeze, error) {
+	query := url.Values{}
+	query.Set("until", until.Format(time.RFC3339))
+	if reason != "" {
+		query.Set("reason", reason)
+	}
+	return c.postFreeze(ctx, c.targetPath("/freezes"), query, http.StatusCreated)
+}
+
+// LiftFreeze StartFreezeで開始した凍結を解除する
+func (c *Client) LiftFreeze(ctx context.Context, id string) (*Freeze, error) {
+	return c.postFreeze(ctx, c.targetPath("/freezes/"+url.PathEscape(id)+"/lift"), nil, http.StatusOK)
+}
+
+// Skip マイグレーションのSQLを実行せずに適用済みとして記録する。
+// 適用記録の編集を許可された利用者だけが実行できる
+func (c *Client) Skip(ctx context.Context, request SkipRequest) (*HistoryEdit, error) {
+	query := url.Values{}
+	if len(request.IDs) > 0 {
+		query.Set("ids", strings.Join(request.IDs, ","))
+	}
+	if request.To != "" {
+		query.Set("to", request.To)
+	}
+	if request.Schema != "" {
+		query.Set("schema", request.Schema)
+	}
+	return c.editHistory(ctx, "skip", query)
+}
+
+// Unskip マイグレーションのSQLを実行せずにidsの適用記録を削除する。
+// 適用記録の編集を許可された利用者だけが実行できる
+func (c *Client) Unskip(ctx context.Context, ids []string, schema string) (*HistoryEdit, error) {
+	query := url.Values{}
+	query.Set("ids", strings.Join(ids, ","))
+	if schema != "" {
+		query.Set("schema", schema)
+	}
+	return c.editHistory(ctx, "unskip", query)
+}
+
+// editHistory 適用記録を編集するPOSTリクエストを送り、編集の結果を返す
+func (c *Client) editHistory(ctx context.Context, operation string, query url.Values) (*HistoryEdit, error) {
+	response, err := c.do(ctx, http.MethodPost, c.migratePath(operation), query, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, readError(response)
+	}
+	var edit HistoryEdit
+	err = json.NewDecoder(response.Body).Decode(&edit)
+	return &edit, err
+}
+
+// postFreeze 凍結を操作するPOSTリクエストを送り、凍結を返す
+func (c *Client) postFreeze(ctx context.Context, path string, query url.Values, status int) (*Freeze, error) {
+	response, err := c.do(ctx, http.MethodPost, path, query, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != status {
+		return nil, readError(response)
+	}
+	var freeze Freeze
+	err = json.NewDecoder(response.Body).Decode(&freeze)
+	return &freeze, err
+}
+
+// targetPath 操作する対象のsuffixのパスを返す
+func (c *Client) targetPath(suffix string) string {
+	if c.Target == "" {
+		return suffix
+	}
+	return "/targets/" + url.PathEscape(c.Target) + suffix
+}
+
+// requestPath 操作する対象の/requestsに続くパスを返す
+func (c *Client) requestPath(suffix string) string {
+	if c.Target == "" {
+		return "/requests" + suffix
+	}
+	return "/targets/" + url.PathEscape(c.Target) + "/requests" + suffix
+}
+
+// bundlePath 操作する対象の/bundlesに続くパスを返す
+func (c *Client) bundlePath(suffix string) string {
+	if c.Target == "" {
+		return "/bundles" + suffix
+	}
+	return "/targets/" + url.PathEscape(c.Target) + "/bundles" + suffix
+}
+
+// migratePath 操作する対象の/migrate/operationのパスを返す。
+// 対象の前置きのない/migrate/up,downは従来の形式で応答するため、対象を指定しない場合もdefaultの対象のパスを使う
+func (c *Client) migratePath(operation string) string {
+	target := c.Target
+	if target == "" {
+		target = DefaultTarget
+	}
+	return "/targets/" + url.PathEscape(target) + "/migrate/" + operation
+}
+
+// getJSON GETリクエストを送り、レスポンスのJSONをvに格納する
+func (c *Client) getJSON(ctx context.Context, path string, query url.Values, v interface{}) error {
+	response, err := c.do(ctx, http.MethodGet, path, query, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return readError(response)
+	}
+	return json.NewDecoder(response.Body).Decode(v)
+}
+
+// do リクエストを送る。
+// サーバに届かなかった場合や、プロキシが502/503/504を返した場合はリトライする。
+// GETの場合は500の場合もリトライする
+func (c *Client) do(ctx context.Context, method string, path string,
+	query url.Values, header http.Header, body []byte) (*http.Response, error) {
+
+	target := *c.BaseURL
+	target.Path = c.BaseURL.Path + path
+	target.RawQuery = query.Encode()
+
+	backoff := c.Backoff
+	for attempt := 0; ; attempt++ {
+		var reader io.Reader
+		if body != nil {
+			reader = bytes.NewReader(body)
+		}
+		request, err := http.NewRequestWithContext(ctx, method, target.String(), reader)
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range header {
+			request.Header[key] = values
+		}
+		if c.Token != "" {
+			request.Header.Set("Authorization", "Bearer "+c.Token)
+		}
+
+		response, err := c.HTTPClient.Do(request)
+		if attempt >= c.Retries || !retryable(method, response, err) {
+			return response, err
+		}
+		if response != nil {
+			io.Copy(ioutil.Discard, response.Body)
+			response.Body.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// retryable リトライしてよい失敗かどうかを判定する。
+// マイグレーションの重複実行を避けるため、POSTはサーバに届いていないと判断できる場合のみリトライする
+func retryable(method string, response *http.Response, err error) bool {
+	if err != nil {
+		var opError *net.OpError
+		if errors.As(err, &opError) && opError.Op == "dial" {
+			return true
+		}
+		return method == http.MethodGet
+	}
+
+	switch response.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	case http.StatusInternalServerError:
+		return method == http.MethodGet
+	}
+	return false
+}
+
+// readError エラーのレスポンスをErrorに変換する
+func readError(response *http.Response) error {
+	body, _ := ioutil.ReadAll(response.Body)
+
+	var errorResponse struct {
+		Error       string     `json:"error"`
+		NextAllowed *time.Time `json:"nextAllowed"`
+	}
+	message := strings.TrimSpace(string(body))
+	if json.Unmarshal(body, &errorResponse) == nil && errorResponse.Error != "" {
+		message = errorResponse.Error
+	}
+	return &Error{StatusCode: response.StatusCode, Message: message, NextAllowed: errorResponse.NextAllowed}
+}
+
+// readConfirmation 確認が必要な操作のレスポンスを、実行予定を格納したErrorに変換する
+func readConfirmation(response *http.Response) error {
+	var confirmation Confirmation
+	if err := json.NewDecoder(response.Body).Decode(&confirmation); err != nil {
+		return err
+	}
+	return &Error{
+		StatusCode:   response.StatusCode,
+		Message:      "confirmation required; repeat the request with the confirmation token",
+		Confirmation: &confirmation,
+	}
+}
+
+// readEvents Server-Sent Eventsを読み、進捗をprogressに渡して実行結果をresultに格納する
+func readEvents(body io.Reader, progress func(ProgressEvent), result *MigrationResult) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	var event, data string
+	received := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data += strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		case line == "":
+			switch event {
+			case "migration":
+				var progressEvent ProgressEvent
+				if err := json.Unmarshal([]byte(data), &progressEvent); err != nil {
+					return err
+				}
+				if progress != nil {
+					progress(progressEvent)
+				}
+			case "result":
+				if err := json.Unmarshal([]byte(data), result); err != nil {
+					return err
+				}
+				received = true
+			}
+			event, data = "", ""
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if !received {
+		return errors.New("event stream ended without a result")
+	}
+	return nil
+}
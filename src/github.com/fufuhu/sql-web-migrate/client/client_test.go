@@ -0,0 +1,653 @@
+package client
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fufuhu/sql-web-migrate/migrate"
+)
+
+// setupServer 実際のハンドラを動かすhttptestサーバ向けの環境変数を設定する。
+// DBには接続できない設定にしているため、DBに到達したリクエストは500を返す
+func setupServer(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "00-test.sql"),
+		[]byte("-- +migrate Up\nCREATE TABLE test (id int);\n-- +migrate Down\nDROP TABLE test;\n"), 0644)
+
+	env := map[string]string{
+		migrate.DBHost:                    "127.0.0.1",
+		migrate.DBPort:                    "1",
+		migrate.DBMigrationSourcePath:     dir,
+		migrate.SQLMigrateAllowedNetworks: "127.0.0.0/8",
+		migrate.APITokens:                 "deployer:secret-token",
+		migrate.FreezeFile:                filepath.Join(dir, "freezes.json"),
+	}
+	for key, value := range env {
+		os.Setenv(key, value)
+	}
+	if err := migrate.LoadFreezes(); err != nil {
+		t.Fatal(err)
+	}
+
+	return func() {
+		for key := range env {
+			os.Unsetenv(key)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+// newServeMux 環境変数の設定を対象とするServeMuxを生成する
+func newServeMux(t *testing.T) *http.ServeMux {
+	targets, err := migrate.LoadTargets("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return migrate.NewServeMux(targets)
+}
+
+// newTestClient リトライの待ち時間を短くしたClientを生成する
+func newTestClient(t *testing.T, url string, options ...Option) *Client {
+	options = append([]Option{WithRetries(2, time.Millisecond)}, options...)
+	c, err := New(url, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// statusCode errがErrorの場合はそのステータスコードを返す
+func statusCode(err error) int {
+	var apiError *Error
+	if errors.As(err, &apiError) {
+		return apiError.StatusCode
+	}
+	return -1
+}
+
+// TestStatusUnauthorized トークンなし、または誤ったトークンの場合に
+// 401のErrorが返ることを確認する。
+func TestStatusUnauthorized(t *testing.T) {
+	defer setupServer(t)()
+	server := httptest.NewServer(newServeMux(t))
+	defer server.Close()
+
+	for _, c := range []*Client{
+		newTestClient(t, server.URL),
+		newTestClient(t, server.URL, WithToken("wrong-token")),
+	} {
+		_, err := c.Status(context.Background())
+		if statusCode(err) != http.StatusUnauthorized {
+			t.Log(err)
+			t.Fail()
+		}
+	}
+}
+
+// TestStatusForbidden 許可されていないネットワークからのリクエストに
+// 403のErrorが返ることを確認する。
+func TestStatusForbidden(t *testing.T) {
+	defer setupServer(t)()
+	os.Setenv(migrate.SQLMigrateAllowedNetworks, "10.0.0.0/8")
+	server := httptest.NewServer(newServeMux(t))
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, WithToken("secret-token"))
+	_, err := c.Status(context.Background())
+
+	if statusCode(err) != http.StatusForbidden {
+		t.Log(err)
+		t.Fail()
+	}
+}
+
+// TestUpDatabaseUnavailable DBに接続できない場合に
+// 失敗した実行結果とErrorの両方が返ることを確認する。
+func TestUpDatabaseUnavailable(t *testing.T) {
+	defer setupServer(t)()
+	server := httptest.NewServer(newServeMux(t))
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, WithToken("secret-token"))
+	result, err := c.Up(context.Background(), MigrateRequest{})
+
+	if statusCode(err) != http.StatusInternalServerError {
+		t.Log(err)
+		t.Fail()
+	}
+	if result == nil || result.Success || result.Direction != "up" ||
+		!strings.Contains(result.Error, "connection refused") {
+		t.Log(result)
+		t.Fail()
+	}
+}
+
+// TestUpAndStatus SQLiteを対象にマイグレーションを適用し、
+// 進捗と適用状況を受け取れることを確認する。
+func TestUpAndStatus(t *testing.T) {
+	defer setupServer(t)()
+	os.Setenv(migrate.DBDialect, migrate.DialectSQLite)
+	os.Setenv(migrate.DBName, os.Getenv(migrate.DBMigrationSourcePath)+"/test.db")
+	defer os.Unsetenv(migrate.DBDialect)
+	defer os.Unsetenv(migrate.DBName)
+
+	server := httptest.NewServer(newServeMux(t))
+	defer server.Close()
+
+	var ids []string
+	c := newTestClient(t, server.URL, WithToken("secret-token"))
+	result, err := c.Up(context.Background(), MigrateRequest{
+		Progress: func(event ProgressEvent) { ids = append(ids, event.ID) },
+	})
+	if err != nil || !result.Success || len(ids) != 1 || ids[0] != "00-test.sql" {
+		t.Log(result, err)
+		t.Fail()
+	}
+
+	statuses, err := c.Status(context.Background())
+	if err != nil || len(statuses) != 1 || !statuses[0].Applied {
+		t.Log(statuses, err)
+		t.Fail()
+	}
+}
+
+// makeBundle マニフェストを含むzipのバンドルを作成する
+func makeBundle(t *testing.T, version string, migrations map[string]string) []byte {
+	manifest := migrate.BundleManifest{Version: version, Files: map[string]string{}}
+	var buffer bytes.Buffer
+	archive := zip.NewWriter(&buffer)
+	for name, content := range migrations {
+		manifest.Files[name] = migrate.ChecksumBundle([]byte(content))
+		writer, _ := archive.Create(name)
+		writer.Write([]byte(content))
+	}
+	writer, _ := archive.Create(migrate.BundleManifestFile)
+	json.NewEncoder(writer).Encode(manifest)
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+// TestUploadBundle バンドルをアップロードして適用し、一覧の取得と
+// 存在しないバンドルへの切り替えのエラーが返ることを確認する。
+func TestUploadBundle(t *testing.T) {
+	defer setupServer(t)()
+	dir := os.Getenv(migrate.DBMigrationSourcePath)
+	os.Setenv(migrate.DBDialect, migrate.DialectSQLite)
+	os.Setenv(migrate.DBName, dir+"/test.db")
+	os.Setenv(migrate.MigrationSourceKind, migrate.SourceBundle)
+	os.Setenv(migrate.BundleDir, dir+"/bundles")
+	defer os.Unsetenv(migrate.DBDialect)
+	defer os.Unsetenv(migrate.DBName)
+	defer os.Unsetenv(migrate.MigrationSourceKind)
+	defer os.Unsetenv(migrate.BundleDir)
+
+	server := httptest.NewServer(newServeMux(t))
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, WithToken("secret-token"))
+	bundle := makeBundle(t, "2026.10.19", map[string]string{
+		"01-bundle.sql": "-- +migrate Up\nCREATE TABLE bundle (id int);\n-- +migrate Down\nDROP TABLE bundle;\n",
+	})
+	upload, err := c.UploadBundle(context.Background(), bundle, true)
+	if err != nil || !upload.Bundle.Active || upload.Result == nil || len(upload.Result.Applied) != 1 {
+		t.Log(upload, err)
+		t.Fail()
+	}
+
+	bundles, err := c.Bundles(context.Background())
+	if err != nil || len(bundles) != 1 || bundles[0].Version != "2026.10.19" || bundles[0].UploadedBy != "deployer" {
+		t.Log(bundles, err)
+		t.Fail()
+	}
+
+	if _, err := c.UploadBundle(context.Background(), bundle, false); statusCode(err) != http.StatusConflict {
+		t.Log(err)
+		t.Fail()
+	}
+	if _, err := c.ActivateBundle(context.Background(), "missing"); statusCode(err) != http.StatusNotFound {
+		t.Log(err)
+		t.Fail()
+	}
+}
+
+// TestDownConfirmation downが実行予定を格納したErrorを返し、
+// 確認トークンを付けたリクエストで実行されることを確認する。
+func TestDownConfirmation(t *testing.T) {
+	defer setupServer(t)()
+	dir := os.Getenv(migrate.DBMigrationSourcePath)
+	os.Setenv(migrate.DBDialect, migrate.DialectSQLite)
+	os.Setenv(migrate.DBName, dir+"/test.db")
+	defer os.Unsetenv(migrate.DBDialect)
+	defer os.Unsetenv(migrate.DBName)
+
+	server := httptest.NewServer(newServeMux(t))
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, WithToken("secret-token"))
+	if _, err := c.Up(context.Background(), MigrateRequest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := c.Down(context.Background(), MigrateRequest{Steps: 1})
+	var apiError *Error
+	if !errors.As(err, &apiError) || apiError.StatusCode != http.StatusPreconditionRequired ||
+		apiError.Confirmation == nil || len(apiError.Confirmation.Migrations) != 1 {
+		t.Fatal(err)
+	}
+
+	result, err := c.Down(context.Background(), MigrateRequest{Steps: 1, Confirm: apiError.Confirmation.Token})
+	if err != nil || len(result.Applied) != 1 || result.Applied[0] != "00-test.sql" {
+		t.Log(result, err)
+		t.Fail()
+	}
+}
+
+// TestRedoConfirmation redoが戻す操作の実行予定を格納したErrorを返し、
+// 確認トークンを付けたリクエストで戻してから再適用することを確認する。
+func TestRedoConfirmation(t *testing.T) {
+	defer setupServer(t)()
+	dir := os.Getenv(migrate.DBMigrationSourcePath)
+	os.Setenv(migrate.DBDialect, migrate.DialectSQLite)
+	os.Setenv(migrate.DBName, dir+"/test.db")
+	defer os.Unsetenv(migrate.DBDialect)
+	defer os.Unsetenv(migrate.DBName)
+
+	server := httptest.NewServer(newServeMux(t))
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, WithToken("secret-token"))
+	if _, err := c.Up(context.Background(), MigrateRequest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := c.Redo(context.Background(), RedoRequest{})
+	var apiError *Error
+	if !errors.As(err, &apiError) || apiError.StatusCode != http.StatusPreconditionRequired ||
+		apiError.Confirmation == nil || apiError.Confirmation.Direction != "down" {
+		t.Fatal(err)
+	}
+
+	result, err := c.Redo(context.Background(), RedoRequest{Confirm: apiError.Confirmation.Token})
+	if err != nil || !result.Success || result.RolledBack == nil || len(result.RolledBack.Applied) != 1 ||
+		result.Reapplied == nil || len(result.Reapplied.Applied) != 1 || result.Reapplied.Applied[0] != "00-test.sql" {
+		t.Log(result, err)
+		t.Fail()
+	}
+
+	if _, err := c.Redo(context.Background(), RedoRequest{Steps: 2}); statusCode(err) != http.StatusConflict {
+		t.Log(err)
+		t.Fail()
+	}
+}
+
+// TestSkipAndUnskip 許可された利用者だけが、マイグレーションを実行せずに
+// 適用済みにでき、その適用記録を削除できることを確認する。
+func TestSkipAndUnskip(t *testing.T) {
+	defer setupServer(t)()
+	dir := os.Getenv(migrate.DBMigrationSourcePath)
+	os.Setenv(migrate.DBDialect, migrate.DialectSQLite)
+	os.Setenv(migrate.DBName, dir+"/test.db")
+	defer os.Unsetenv(migrate.DBDialect)
+	defer os.Unsetenv(migrate.DBName)
+
+	server := httptest.NewServer(newServeMux(t))
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, WithToken("secret-token"))
+	if _, err := c.Skip(context.Background(), SkipRequest{To: "00-test.sql"}); statusCode(err) != http.StatusForbidden {
+		t.Fatal(err)
+	}
+
+	os.Setenv(migrate.HistoryEditors, "deployer")
+	defer os.Unsetenv(migrate.HistoryEditors)
+	edit, err := c.Skip(context.Background(), SkipRequest{To: "00-test.sql"})
+	if err != nil || len(edit.Migrations) != 1 || len(edit.Records) != 1 {
+		t.Fatal(edit, err)
+	}
+
+	edit, err = c.Unskip(context.Background(), []string{"00-test.sql"}, "")
+	if err != nil || len(edit.Migrations) != 1 || len(edit.Records) != 0 {
+		t.Log(edit, err)
+		t.Fail()
+	}
+}
+
+// TestApprovalRequest 承認が必要な対象で、別の利用者が承認した承認依頼を指定して
+// upが実行され、承認依頼が実行済みになることを確認する。
+func TestApprovalRequest(t *testing.T) {
+	defer setupServer(t)()
+	dir := os.Getenv(migrate.DBMigrationSourcePath)
+	env := map[string]string{
+		migrate.DBDialect:       migrate.DialectSQLite,
+		migrate.DBName:          dir + "/test.db",
+		migrate.RequireApproval: "true",
+		migrate.APITokens:       "deployer:secret-token,reviewer:review-token",
+	}
+	for key, value := range env {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+
+	server := httptest.NewServer(newServeMux(t))
+	defer server.Close()
+
+	deployer := newTestClient(t, server.URL, WithToken("secret-token"))
+	reviewer := newTestClient(t, server.URL, WithToken("review-token"))
+	if _, err := deployer.Up(context.Background(), MigrateRequest{}); statusCode(err) != http.StatusForbidden {
+		t.Fatal(err)
+	}
+
+	request, err := deployer.SubmitRequest(context.Background(), "up", 0)
+	if err != nil || request.Status != "pending" || request.RequestedBy != "deployer" {
+		t.Fatal(request, err)
+	}
+	if _, err := deployer.ApproveRequest(context.Background(), request.ID); statusCode(err) != http.StatusForbidden {
+		t.Fatal(err)
+	}
+	if request, err = reviewer.ApproveRequest(context.Background(), request.ID); err != nil || request.Status != "approved" {
+		t.Fatal(request, err)
+	}
+
+	result, err := deployer.Up(context.Background(), MigrateRequest{Request: request.ID})
+	if err != nil || len(result.Applied) != 1 {
+		t.Fatal(result, err)
+	}
+
+	requests, err := reviewer.Requests(context.Background())
+	if err != nil || len(requests) == 0 || requests[0].ID != request.ID || requests[0].Status != "executed" {
+		t.Log(requests, err)
+		t.Fail()
+	}
+}
+
+// TestScheduleLocked 実行できる時間帯の外では次に実行できる時刻を格納したErrorが返り、
+// 凍結の開始と解除ができることを確認する。
+func TestScheduleLocked(t *testing.T) {
+	defer setupServer(t)()
+	later := strings.ToLower(time.Now().UTC().AddDate(0, 0, 2).Weekday().String()[:3])
+	os.Setenv(migrate.MaintenanceWindows, later+" 00:00-24:00")
+	defer os.Unsetenv(migrate.MaintenanceWindows)
+
+	server := httptest.NewServer(newServeMux(t))
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, WithToken("secret-token"))
+	_, err := c.Up(context.Background(), MigrateRequest{})
+	var apiError *Error
+	if !errors.As(err, &apiError) || apiError.StatusCode != http.StatusLocked || apiError.NextAllowed == nil {
+		t.Fatal(err)
+	}
+
+	freeze, err := c.StartFreeze(context.Background(), time.Now().Add(time.Hour), "incident")
+	if err != nil || freeze.CreatedBy != "deployer" {
+		t.Fatal(freeze, err)
+	}
+	status, err := c.Schedule(context.Background())
+	if err != nil || status.Allowed || len(status.Freezes) != 1 || status.Freezes[0].ID != freeze.ID {
+		t.Log(status, err)
+		t.Fail()
+	}
+	if _, err := c.LiftFreeze(context.Background(), freeze.ID); err != nil {
+		t.Log(err)
+		t.Fail()
+	}
+	if freezes, err := c.Freezes(context.Background()); err != nil || len(freezes) != 0 {
+		t.Log(freezes, err)
+		t.Fail()
+	}
+}
+
+// TestUpWithProgressDatabaseUnavailable 進捗を受け取る場合も
+// Server-Sent Eventsの実行結果から失敗が返ることを確認する。
+func TestUpWithProgressDatabaseUnavailable(t *testing.T) {
+	defer setupServer(t)()
+	server := httptest.NewServer(newServeMux(t))
+	defer server.Close()
+
+	events := 0
+	c := newTestClient(t, server.URL, WithToken("secret-token"))
+	result, err := c.Up(context.Background(), MigrateRequest{
+		Progress: func(ProgressEvent) { events++ },
+	})
+
+	if statusCode(err) != http.StatusOK || result == nil || result.Success || events != 0 {
+		t.Log(result, err)
+		t.Fail()
+	}
+}
+
+// TestPlanBadRequest 不正な方向を指定した場合に400のErrorが返ることを確認する。
+func TestPlanBadRequest(t *testing.T) {
+	defer setupServer(t)()
+	server := httptest.NewServer(newServeMux(t))
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, WithToken("secret-token"))
+	_, err := c.Plan(context.Background(), PlanRequest{Direction: "sideways"})
+
+	if statusCode(err) != http.StatusBadRequest || !strings.Contains(err.Error(), "sideways") {
+		t.Log(err)
+		t.Fail()
+	}
+}
+
+// TestRetryUnavailable プロキシが503を返した場合にリトライして
+// 実際のハンドラまで到達することを確認する。
+func TestRetryUnavailable(t *testing.T) {
+	defer setupServer(t)()
+	mux := newServeMux(t)
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, WithToken("secret-token"))
+	_, err := c.Plan(context.Background(), PlanRequest{Direction: "sideways"})
+
+	if attempts != 3 || statusCode(err) != http.StatusBadRequest {
+		t.Log(attempts, err)
+		t.Fail()
+	}
+}
+
+// TestNoRetryForFailedMigration マイグレーションの失敗(500)は
+// 重複実行を避けるためにリトライしないことを確認する。
+func TestNoRetryForFailedMigration(t *testing.T) {
+	defer setupServer(t)()
+	mux := newServeMux(t)
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		mux.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, WithToken("secret-token"))
+	c.Down(context.Background(), MigrateRequest{Steps: 1})
+
+	if attempts != 1 {
+		t.Log(attempts)
+		t.Fail()
+	}
+}
+
+// TestTargets 対象の一覧には接続元のネットワークからアクセスできる対象だけが含まれ、
+// 名前で指定した対象ごとにネットワークの制限が適用されることを確認する。
+func TestTargets(t *testing.T) {
+	defer setupServer(t)()
+
+	file, err := ioutil.TempFile("", "targets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`{"targets": [
+		{"name": "orders", "host": "127.0.0.1", "port": 1, "dbname": "orders",
+		 "sourcePath": "/tmp", "allowedNetworks": ["127.0.0.0/8"]},
+		{"name": "internal", "host": "127.0.0.1", "port": 1, "dbname": "internal",
+		 "sourcePath": "/tmp", "allowedNetworks": ["10.0.0.0/8"]}
+	]}`)
+	file.Close()
+
+	targets, err := migrate.LoadTargets(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(migrate.NewServeMux(targets))
+	defer server.Close()
+
+	c := newTestClient(t, server.URL, WithToken("secret-token"))
+	infos, err := c.Targets(context.Background())
+	if err != nil || len(infos) != 1 || infos[0].Name != "orders" || infos[0].DBName != "orders" {
+		t.Log(infos, err)
+		t.Fail()
+	}
+
+	for name, expected := range map[string]int{
+		"orders":   http.StatusBadRequest,
+		"internal": http.StatusForbidden,
+		"missing":  http.StatusNotFound,
+		"default":  http.StatusNotFound,
+	} {
+		c := newTestClient(t, server.URL, WithToken("secret-token"), WithTarget(name))
+		_, err := c.Plan(context.Background(), PlanRequest{Direction: "sideways"})
+		if statusCode(err) != expected {
+			t.Log(name, err)
+			t.Fail()
+		}
+	}
+
+	legacy := newTestClient(t, server.URL, WithToken("secret-token"))
+	if _, err := legacy.Status(context.Background()); statusCode(err) != http.StatusNotFound {
+		t.Log(err)
+		t.Fail()
+	}
+}
+
+// newCertificate テスト用の証明書を生成する。parentがnilの場合は自己署名のCA証明書を生成する
+func newCertificate(t *testing.T, commonName string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	signer, signerKey := template, interface{}(key)
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// TestClientCertificate 検証済みのクライアント証明書を提示した場合に
+// トークンなしで認証されることを確認する。
+func TestClientCertificate(t *testing.T) {
+	defer setupServer(t)()
+
+	ca := newCertificate(t, "test-ca", nil)
+	clientCertificate := newCertificate(t, "deployer", &ca)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	server := httptest.NewUnstartedServer(newServeMux(t))
+	server.TLS = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	server.StartTLS()
+	defer server.Close()
+
+	serverTLS := server.Client().Transport.(*http.Transport).TLSClientConfig
+
+	withoutCertificate := newTestClient(t, server.URL, WithTLSConfig(serverTLS))
+	if _, err := withoutCertificate.Plan(context.Background(), PlanRequest{Direction: "sideways"}); statusCode(err) != http.StatusUnauthorized {
+		t.Log(err)
+		t.Fail()
+	}
+
+	tlsConfig := serverTLS.Clone()
+	tlsConfig.Certificates = []tls.Certificate{clientCertificate}
+	withCertificate := newTestClient(t, server.URL, WithTLSConfig(tlsConfig))
+	if _, err := withCertificate.Plan(context.Background(), PlanRequest{Direction: "sideways"}); statusCode(err) != http.StatusBadRequest {
+		t.Log(err)
+		t.Fail()
+	}
+}
+
+// TestReadEvents Server-Sent Eventsの進捗と実行結果を読み取れることを確認する。
+func TestReadEvents(t *testing.T) {
+	stream := "event: migration\ndata: {\"id\":\"00-test.sql\",\"direction\":\"up\"}\n\n" +
+		"event: migration\ndata: {\"id\":\"01-test.sql\",\"direction\":\"up\"}\n\n" +
+		"event: result\ndata: {\"direction\":\"up\",\"success\":true,\"applied\":[\"00-test.sql\",\"01-test.sql\"]}\n\n"
+
+	var ids []string
+	var result MigrationResult
+	err := readEvents(strings.NewReader(stream), func(event ProgressEvent) {
+		ids = append(ids, event.ID)
+	}, &result)
+
+	if err != nil || len(ids) != 2 || ids[1] != "01-test.sql" || !result.Success || len(result.Applied) != 2 {
+		t.Log(ids, result, err)
+		t.Fail()
+	}
+}
+
+// TestReadEventsWithoutResult 実行結果を受け取る前にストリームが終わった場合に
+// エラーとなることを確認する。
+func TestReadEventsWithoutResult(t *testing.T) {
+	stream := "event: migration\ndata: {\"id\":\"00-test.sql\",\"direction\":\"up\"}\n\n"
+
+	var result MigrationResult
+	if err := readEvents(strings.NewReader(stream), nil, &result); err == nil {
+		t.Fail()
+	}
+}
+
+// TestNewInvalidURL http/https以外のURLを指定した場合にエラーとなることを確認する。
+func TestNewInvalidURL(t *testing.T) {
+	if _, err := New("localhost:8080"); err == nil {
+		t.Fail()
+	}
+}
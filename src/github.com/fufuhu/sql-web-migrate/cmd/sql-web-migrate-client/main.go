@@ -0,0 +1,770 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fufuhu/sql-web-migrate/client"
+)
+
+const (
+	// ServerURL 呼び出すサーバのURLを指定するための環境変数
+	ServerURL = "SQL_MIGRATE_SERVER_URL"
+	// ClientToken サーバの認証に使うBearerトークンを指定するための環境変数
+	ClientToken = "SQL_MIGRATE_CLIENT_TOKEN"
+	// ClientTarget 操作する対象の名前を指定するための環境変数
+	ClientTarget = "SQL_MIGRATE_CLIENT_TARGET"
+	// DefaultServerURL デフォルトのサーバのURL
+	DefaultServerURL = "http://localhost:8080"
+)
+
+const usage = `Usage: sql-web-migrate-client [options] <command> [command options]
+
+Commands:
+  up [--steps N] [--yes] [--request ID] [--override REASON]
+                                        Apply pending migrations on the server
+  down [--steps N] [--yes] [--request ID] [--override REASON]
+                                        Roll back migrations on the server
+  redo [--steps N] [--yes] [--override REASON]
+                                        Roll back the latest N migrations and apply them again
+  status [--schema NAME]                Show which migrations have been applied
+  plan [--direction up|down] [--steps N] [--schema NAME]
+                                        Show what up or down would run
+  verify [--schema NAME]                Check applied migrations for edits since they ran
+  lint                                  Check the migrations for dangerous statements
+  targets                               List the targets you can reach
+  upload [--apply] [--yes] FILE         Upload a tar.gz or zip migration bundle
+  bundles                               List the bundles stored on the server
+  activate VERSION                      Switch back to a previously uploaded bundle
+  request [--direction up|down] [--steps N]
+                                        Ask another engineer to approve a migration run
+  requests                              List migration requests and their status
+  approve ID                            Approve someone else's migration request
+  reject ID                             Reject someone else's migration request
+  schedule                              Show the maintenance windows and freezes
+  freeze (--for DURATION | --until TIME) [--reason TEXT]
+                                        Stop migrations from running until TIME
+  unfreeze ID                           Lift a freeze started with freeze
+  skip [--to ID] [--schema NAME] [ID...]
+                                        Mark pending migrations applied without running them
+  unskip [--schema NAME] ID...          Remove the applied record of migrations without running them
+
+Down, redo, and any run that drops tables or columns, shows the plan and asks
+for confirmation before it runs. --yes confirms without asking.
+
+Targets that require approval only run up or down with --request ID, where ID
+is a request that a different engineer has approved. They cannot run redo.
+
+Outside the maintenance windows or during a freeze, up, down and redo fail and
+show when migrations are next allowed. Engineers authorized for emergencies can
+run anyway with --override and a reason, which is recorded in the audit log.
+
+skip and unskip only edit the migration history. They need history editor
+permission on the server and are recorded in the audit log.
+
+Options:
+`
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// getEnv 環境変数の値を返す。未定義の場合はdefaultValueを返す
+func getEnv(key string, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// run 引数で指定されたコマンドを実行して終了コードを返す
+func run(args []string) int {
+	flags := flag.NewFlagSet("sql-web-migrate-client", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+	server := flags.String("server", getEnv(ServerURL, DefaultServerURL), "server URL (env "+ServerURL+")")
+	token := flags.String("token", os.Getenv(ClientToken), "bearer token (env "+ClientToken+")")
+	target := flags.String("target", os.Getenv(ClientTarget), "target to operate on (env "+ClientTarget+")")
+	certFile := flags.String("cert", "", "client certificate for mTLS")
+	keyFile := flags.String("key", "", "client certificate key for mTLS")
+	caFile := flags.String("ca", "", "CA certificate to verify the server")
+	retries := flags.Int("retries", client.DefaultRetries, "retries when the server is unreachable")
+	outputJSON := flags.Bool("json", false, "print raw JSON responses")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	options := []client.Option{
+		client.WithToken(*token),
+		client.WithTarget(*target),
+		client.WithRetries(*retries, client.DefaultBackoff),
+	}
+	if *certFile != "" {
+		options = append(options, client.WithClientCertificate(*certFile, *keyFile))
+	}
+	if *caFile != "" {
+		options = append(options, client.WithCACertificate(*caFile))
+	}
+	c, err := client.New(*server, options...)
+	if err != nil {
+		return exitWithError(err)
+	}
+
+	ctx := context.Background()
+	command, args := flags.Arg(0), flags.Args()[1:]
+	switch command {
+	case "up", "down":
+		return migrateCommand(ctx, c, command, args, *outputJSON)
+	case "redo":
+		return redoCommand(ctx, c, args, *outputJSON)
+	case "status":
+		return statusCommand(ctx, c, args, *outputJSON)
+	case "plan":
+		return planCommand(ctx, c, args, *outputJSON)
+	case "verify":
+		return verifyCommand(ctx, c, args, *outputJSON)
+	case "lint":
+		return lintCommand(ctx, c, *outputJSON)
+	case "targets":
+		return targetsCommand(ctx, c, *outputJSON)
+	case "upload":
+		return uploadCommand(ctx, c, args, *outputJSON)
+	case "bundles":
+		return bundlesCommand(ctx, c, *outputJSON)
+	case "activate":
+		return activateCommand(ctx, c, args, *outputJSON)
+	case "request":
+		return requestCommand(ctx, c, args, *outputJSON)
+	case "requests":
+		return requestsCommand(ctx, c, *outputJSON)
+	case "approve", "reject":
+		return reviewCommand(ctx, c, command, args, *outputJSON)
+	case "schedule":
+		return scheduleCommand(ctx, c, *outputJSON)
+	case "freeze":
+		return freezeCommand(ctx, c, args, *outputJSON)
+	case "unfreeze":
+		return unfreezeCommand(ctx, c, args, *outputJSON)
+	case "skip":
+		return skipCommand(ctx, c, args, *outputJSON)
+	case "unskip":
+		return unskipCommand(ctx, c, args, *outputJSON)
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command: %s\n", command)
+	flags.Usage()
+	return 2
+}
+
+// exitWithError エラーを標準エラー出力に書き出して終了コードを返す
+func exitWithError(err error) int {
+	fmt.Fprintln(os.Stderr, err)
+	return 1
+}
+
+// printJSON vをJSONで標準出力に書き出す
+func printJSON(v interface{}) {
+	bytes, _ := json.MarshalIndent(v, "", "  ")
+	fmt.Println(string(bytes))
+}
+
+// migrateCommand サーバでマイグレーションを実行し、進捗を標準エラー出力に書き出す
+func migrateCommand(ctx context.Context, c *client.Client, direction string, args []string, outputJSON bool) int {
+	flags := flag.NewFlagSet(direction, flag.ContinueOnError)
+	steps := flags.Int("steps", 0, "maximum number of migrations to run (0 means all)")
+	yes := flags.Bool("yes", false, "run destructive migrations without asking for confirmation")
+	requestID := flags.String("request", "", "ID of an approved migration request to run")
+	override := flags.String("override", "", "reason for running outside the maintenance windows or during a freeze")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	request := client.MigrateRequest{
+		Steps:    *steps,
+		Request:  *requestID,
+		Override: *override,
+		Progress: func(event client.ProgressEvent) {
+			fmt.Fprintf(os.Stderr, "%s %s\n", event.Direction, event.ID)
+		},
+	}
+
+	run := c.Up
+	if direction == "down" {
+		run = c.Down
+	}
+	result, err := run(ctx, request)
+
+	// 確認が必要な場合は実行予定を見せてから、確認トークンを付けてもう一度リクエストする
+	var apiError *client.Error
+	if errors.As(err, &apiError) && apiError.Confirmation != nil {
+		if !confirm(apiError.Confirmation, *yes) {
+			return exitWithError(fmt.Errorf("%s cancelled", direction))
+		}
+		request.Confirm = apiError.Confirmation.Token
+		result, err = run(ctx, request)
+	}
+
+	if result != nil {
+		if outputJSON {
+			printJSON(result)
+		} else {
+			printResult(direction, result)
+		}
+	}
+	if err != nil {
+		return exitWithError(err)
+	}
+	return 0
+}
+
+// printResult マイグレーションの実行結果を出力する
+func printResult(direction string, result *client.MigrationResult) {
+	fmt.Printf("%s: %d migration(s) in %s\n", direction, len(result.Applied),
+		time.Duration(result.DurationMillis)*time.Millisecond)
+	if result.Backup != nil {
+		fmt.Printf("  backup: %s (%d bytes)\n", result.Backup.Path, result.Backup.SizeBytes)
+	}
+	for _, hook := range result.Hooks {
+		status := "ok"
+		if !hook.Success {
+			status = "failed: " + hook.Error
+		}
+		fmt.Printf("  hook %s/%s %s: %s\n", hook.Phase, hook.Name, hook.Migration, status)
+	}
+	for _, schema := range result.Schemas {
+		status := "ok"
+		switch {
+		case schema.Skipped:
+			status = "skipped"
+		case !schema.Success:
+			status = "failed: " + schema.Error
+		}
+		fmt.Printf("  %s: %d migration(s), %s\n", schema.Schema, len(schema.Applied), status)
+	}
+}
+
+// redoCommand サーバで最後に適用したマイグレーションを戻してから再適用する
+func redoCommand(ctx context.Context, c *client.Client, args []string, outputJSON bool) int {
+	flags := flag.NewFlagSet("redo", flag.ContinueOnError)
+	steps := flags.Int("steps", 1, "number of the latest migrations to roll back and reapply")
+	yes := flags.Bool("yes", false, "roll back without asking for confirmation")
+	override := flags.String("override", "", "reason for running outside the maintenance windows or during a freeze")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *steps < 1 {
+		return exitWithError(fmt.Errorf("--steps should be a positive integer: %d", *steps))
+	}
+
+	request := client.RedoRequest{Steps: *steps, Override: *override}
+	result, err := c.Redo(ctx, request)
+
+	// 戻す操作の実行予定を見せてから、確認トークンを付けてもう一度リクエストする
+	var apiError *client.Error
+	if errors.As(err, &apiError) && apiError.Confirmation != nil {
+		if !confirm(apiError.Confirmation, *yes) {
+			return exitWithError(fmt.Errorf("redo cancelled"))
+		}
+		request.Confirm = apiError.Confirmation.Token
+		result, err = c.Redo(ctx, request)
+	}
+
+	if result != nil {
+		if outputJSON {
+			printJSON(result)
+		} else {
+			if result.RolledBack != nil {
+				printResult("down", result.RolledBack)
+			}
+			if result.Reapplied != nil {
+				printResult("up", result.Reapplied)
+			}
+		}
+	}
+	if err != nil {
+		return exitWithError(err)
+	}
+	return 0
+}
+
+// statusCommand マイグレーションの適用状況を表形式で出力する
+func statusCommand(ctx context.Context, c *client.Client, args []string, outputJSON bool) int {
+	flags := flag.NewFlagSet("status", flag.ContinueOnError)
+	schema := flags.String("schema", "", "schema to report on when the target fans out to schemas")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	statuses, err := c.SchemaStatus(ctx, *schema)
+	if err != nil {
+		return exitWithError(err)
+	}
+	if outputJSON {
+		printJSON(statuses)
+		return 0
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "MIGRATION\tAPPLIED")
+	for _, status := range statuses {
+		applied := "no"
+		if status.Applied {
+			applied = status.AppliedAt
+		}
+		fmt.Fprintf(writer, "%s\t%s\n", status.ID, applied)
+	}
+	writer.Flush()
+	return 0
+}
+
+// planCommand 実行予定のマイグレーションを出力する
+func planCommand(ctx context.Context, c *client.Client, args []string, outputJSON bool) int {
+	flags := flag.NewFlagSet("plan", flag.ContinueOnError)
+	direction := flags.String("direction", "up", "up or down")
+	steps := flags.Int("steps", 0, "maximum number of migrations (0 means all)")
+	schema := flags.String("schema", "", "schema to plan for when the target fans out to schemas")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	plan, err := c.Plan(ctx, client.PlanRequest{Direction: *direction, Steps: *steps, Schema: *schema})
+	if err != nil {
+		return exitWithError(err)
+	}
+	if outputJSON {
+		printJSON(plan)
+		return 0
+	}
+
+	for _, step := range plan.Migrations {
+		fmt.Printf("-- %s %s (%d statement(s))\n", plan.Direction, step.ID, len(step.Statements))
+		for _, statement := range step.Statements {
+			fmt.Println(statement)
+		}
+	}
+	fmt.Printf("%d migration(s) would be run\n", len(plan.Migrations))
+	return 0
+}
+
+// verifyCommand 適用済みのマイグレーションのチェックサムの確認結果を出力する。
+// 変更または削除されたマイグレーションがある場合は終了コード1を返す
+func verifyCommand(ctx context.Context, c *client.Client, args []string, outputJSON bool) int {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	schema := flags.String("schema", "", "schema to verify when the target fans out to schemas")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	report, err := c.Verify(ctx, *schema)
+	if err != nil {
+		return exitWithError(err)
+	}
+	if outputJSON {
+		printJSON(report)
+	} else {
+		writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(writer, "MIGRATION\tCHECKSUM")
+		for _, migration := range report.Migrations {
+			fmt.Fprintf(writer, "%s\t%s\n", migration.ID, migration.Status)
+		}
+		writer.Flush()
+	}
+
+	if !report.OK {
+		return exitWithError(fmt.Errorf("applied migrations have drifted from the source"))
+	}
+	return 0
+}
+
+// lintCommand マイグレーションの検査結果を出力する。
+// 重要度errorの指摘がある場合は終了コード1を返す
+func lintCommand(ctx context.Context, c *client.Client, outputJSON bool) int {
+	report, err := c.Lint(ctx)
+	if err != nil {
+		return exitWithError(err)
+	}
+	if outputJSON {
+		printJSON(report)
+	} else {
+		writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(writer, "MIGRATION\tDIRECTION\tSEVERITY\tRULE\tMESSAGE")
+		for _, finding := range report.Findings {
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", finding.ID, finding.Direction, finding.Severity, finding.Rule, finding.Message)
+		}
+		writer.Flush()
+		fmt.Printf("%d finding(s)\n", len(report.Findings))
+	}
+
+	if !report.OK {
+		return exitWithError(fmt.Errorf("migrations contain statements that will fail or lose data"))
+	}
+	return 0
+}
+
+// targetsCommand 操作できる対象の一覧を表形式で出力する
+func targetsCommand(ctx context.Context, c *client.Client, outputJSON bool) int {
+	targets, err := c.Targets(ctx)
+	if err != nil {
+		return exitWithError(err)
+	}
+	if outputJSON {
+		printJSON(targets)
+		return 0
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "TARGET\tHOST\tDATABASE\tSOURCE\tPATH")
+	for _, target := range targets {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", target.Name, target.Host, target.DBName, target.Source, target.SourcePath)
+	}
+	writer.Flush()
+	return 0
+}
+
+// uploadCommand バンドルのファイルをアップロードする
+func uploadCommand(ctx context.Context, c *client.Client, args []string, outputJSON bool) int {
+	flags := flag.NewFlagSet("upload", flag.ContinueOnError)
+	apply := flags.Bool("apply", false, "apply the bundle right after uploading it")
+	yes := flags.Bool("yes", false, "apply destructive migrations without asking for confirmation")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		return exitWithError(fmt.Errorf("upload requires exactly one bundle file"))
+	}
+
+	bundle, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		return exitWithError(err)
+	}
+
+	upload, err := c.UploadBundle(ctx, bundle, *apply)
+	if outputJSON && upload != nil {
+		printJSON(upload)
+	} else if upload != nil {
+		fmt.Printf("Uploaded bundle %s (%d migration(s), sha256 %s)\n",
+			upload.Bundle.Version, len(upload.Bundle.Migrations), upload.Bundle.Checksum)
+		if upload.Result != nil {
+			for _, id := range upload.Result.Applied {
+				fmt.Printf("Applied %s\n", id)
+			}
+			fmt.Printf("Applied %d migration(s)\n", len(upload.Result.Applied))
+		}
+	}
+	if err != nil {
+		return exitWithError(err)
+	}
+
+	// 適用に確認が必要な場合は、バンドルは格納済みなので確認トークンを付けてupを実行する
+	if upload.Confirmation != nil {
+		if !confirm(upload.Confirmation, *yes) {
+			return exitWithError(fmt.Errorf("bundle %s uploaded but not applied", upload.Bundle.Version))
+		}
+		result, err := c.Up(ctx, client.MigrateRequest{Confirm: upload.Confirmation.Token})
+		if outputJSON && result != nil {
+			printJSON(result)
+		} else if result != nil {
+			for _, id := range result.Applied {
+				fmt.Printf("Applied %s\n", id)
+			}
+			fmt.Printf("Applied %d migration(s)\n", len(result.Applied))
+		}
+		if err != nil {
+			return exitWithError(err)
+		}
+	}
+	return 0
+}
+
+// confirm 確認が必要な操作の実行予定と指摘を標準エラー出力に書き出し、実行してよいかを尋ねる。
+// yesがtrueの場合は尋ねずに実行する
+func confirm(confirmation *client.Confirmation, yes bool) bool {
+	fmt.Fprintf(os.Stderr, "This %s needs confirmation. It will run:\n", confirmation.Direction)
+	for _, step := range confirmation.Migrations {
+		fmt.Fprintf(os.Stderr, "  %s (%d statement(s))\n", step.ID, len(step.Statements))
+	}
+	for _, finding := range confirmation.Findings {
+		fmt.Fprintf(os.Stderr, "  %s %s: %s [%s]\n", finding.Severity, finding.ID, finding.Message, finding.Rule)
+	}
+	if yes {
+		return true
+	}
+
+	fmt.Fprintf(os.Stderr, "Proceed before %s? [y/N] ", confirmation.ExpiresAt.Local().Format(time.Kitchen))
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// bundlesCommand サーバに格納されているバンドルを表形式で出力する
+func bundlesCommand(ctx context.Context, c *client.Client, outputJSON bool) int {
+	bundles, err := c.Bundles(ctx)
+	if err != nil {
+		return exitWithError(err)
+	}
+	if outputJSON {
+		printJSON(bundles)
+		return 0
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "VERSION\tACTIVE\tMIGRATIONS\tUPLOADED\tBY")
+	for _, bundle := range bundles {
+		active := ""
+		if bundle.Active {
+			active = "*"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%d\t%s\t%s\n", bundle.Version, active, len(bundle.Migrations),
+			bundle.UploadedAt.Format(time.RFC3339), bundle.UploadedBy)
+	}
+	writer.Flush()
+	return 0
+}
+
+// activateCommand 格納済みのバンドルを有効なバンドルにする
+func activateCommand(ctx context.Context, c *client.Client, args []string, outputJSON bool) int {
+	if len(args) != 1 {
+		return exitWithError(fmt.Errorf("activate requires exactly one bundle version"))
+	}
+
+	info, err := c.ActivateBundle(ctx, args[0])
+	if err != nil {
+		return exitWithError(err)
+	}
+	if outputJSON {
+		printJSON(info)
+		return 0
+	}
+	fmt.Printf("Activated bundle %s\n", info.Version)
+	return 0
+}
+
+// requestCommand マイグレーションの承認依頼を登録し、そのIDを出力する
+func requestCommand(ctx context.Context, c *client.Client, args []string, outputJSON bool) int {
+	flags := flag.NewFlagSet("request", flag.ContinueOnError)
+	direction := flags.String("direction", "up", "direction of the migrations to request (up or down)")
+	steps := flags.Int("steps", 0, "maximum number of migrations to run (0 means all)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	request, err := c.SubmitRequest(ctx, *direction, *steps)
+	if err != nil {
+		return exitWithError(err)
+	}
+	if outputJSON {
+		printJSON(request)
+		return 0
+	}
+	fmt.Printf("Submitted request %s (%s, expires %s)\n", request.ID, request.Status, request.ExpiresAt.Format(time.RFC3339))
+	fmt.Printf("Once approved, run: %s --request %s\n", request.Direction, request.ID)
+	return 0
+}
+
+// requestsCommand 承認依頼を表形式で出力する
+func requestsCommand(ctx context.Context, c *client.Client, outputJSON bool) int {
+	requests, err := c.Requests(ctx)
+	if err != nil {
+		return exitWithError(err)
+	}
+	if outputJSON {
+		printJSON(requests)
+		return 0
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tDIRECTION\tSTEPS\tSTATUS\tREQUESTED BY\tREVIEWED BY\tEXPIRES")
+	for _, request := range requests {
+		fmt.Fprintf(writer, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n", request.ID, request.Direction, request.Steps, request.Status,
+			request.RequestedBy, request.ReviewedBy, request.ExpiresAt.Format(time.RFC3339))
+	}
+	writer.Flush()
+	return 0
+}
+
+// reviewCommand 承認依頼を承認または却下する
+func reviewCommand(ctx context.Context, c *client.Client, action string, args []string, outputJSON bool) int {
+	if len(args) != 1 {
+		return exitWithError(fmt.Errorf("%s requires exactly one request ID", action))
+	}
+
+	review := c.ApproveRequest
+	if action == "reject" {
+		review = c.RejectRequest
+	}
+	request, err := review(ctx, args[0])
+	if err != nil {
+		return exitWithError(err)
+	}
+	if outputJSON {
+		printJSON(request)
+		return 0
+	}
+	fmt.Printf("Request %s is %s\n", request.ID, request.Status)
+	return 0
+}
+
+// scheduleCommand マイグレーションを実行できる時間帯と凍結の状況を出力する
+func scheduleCommand(ctx context.Context, c *client.Client, outputJSON bool) int {
+	status, err := c.Schedule(ctx)
+	if err != nil {
+		return exitWithError(err)
+	}
+	if outputJSON {
+		printJSON(status)
+		return 0
+	}
+
+	if status.Allowed {
+		fmt.Println("Migrations are allowed now")
+	} else {
+		fmt.Printf("Migrations are not allowed now: %s\n", status.Reason)
+		if status.NextAllowed != nil {
+			fmt.Printf("Next allowed at %s\n", status.NextAllowed.Format(time.RFC3339))
+		}
+	}
+	if len(status.Windows) == 0 {
+		fmt.Println("Windows: any time")
+	} else {
+		fmt.Printf("Windows (%s): %s\n", status.TimeZone, strings.Join(status.Windows, "; "))
+	}
+	if len(status.Freezes) > 0 {
+		fmt.Println()
+		printFreezes(status.Freezes)
+	}
+	return 0
+}
+
+// printFreezes 凍結を表形式で出力する
+func printFreezes(freezes []client.Freeze) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tSTART\tEND\tBY\tREASON")
+	for _, freeze := range freezes {
+		by := freeze.CreatedBy
+		if freeze.Configured {
+			by = "(config)"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", freeze.ID, freeze.Start.Format(time.RFC3339),
+			freeze.End.Format(time.RFC3339), by, freeze.Reason)
+	}
+	writer.Flush()
+}
+
+// freezeCommand 今から指定した時刻までマイグレーションを凍結する
+func freezeCommand(ctx context.Context, c *client.Client, args []string, outputJSON bool) int {
+	flags := flag.NewFlagSet("freeze", flag.ContinueOnError)
+	duration := flags.Duration("for", 0, "how long to freeze migrations")
+	until := flags.String("until", "", "end of the freeze (RFC3339)")
+	reason := flags.String("reason", "", "why migrations are frozen")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	var end time.Time
+	switch {
+	case *until != "" && *duration == 0:
+		var err error
+		if end, err = time.Parse(time.RFC3339, *until); err != nil {
+			return exitWithError(err)
+		}
+	case *until == "" && *duration > 0:
+		end = time.Now().Add(*duration)
+	default:
+		return exitWithError(fmt.Errorf("freeze requires either --for or --until"))
+	}
+
+	freeze, err := c.StartFreeze(ctx, end, *reason)
+	if err != nil {
+		return exitWithError(err)
+	}
+	if outputJSON {
+		printJSON(freeze)
+		return 0
+	}
+	fmt.Printf("Froze migrations until %s (freeze %s)\n", freeze.End.Format(time.RFC3339), freeze.ID)
+	return 0
+}
+
+// unfreezeCommand freezeで開始した凍結を解除する
+func unfreezeCommand(ctx context.Context, c *client.Client, args []string, outputJSON bool) int {
+	if len(args) != 1 {
+		return exitWithError(fmt.Errorf("unfreeze requires exactly one freeze ID"))
+	}
+
+	freeze, err := c.LiftFreeze(ctx, args[0])
+	if err != nil {
+		return exitWithError(err)
+	}
+	if outputJSON {
+		printJSON(freeze)
+		return 0
+	}
+	fmt.Printf("Lifted freeze %s\n", freeze.ID)
+	return 0
+}
+
+// skipCommand 未適用のマイグレーションを実行せずに適用済みにする
+func skipCommand(ctx context.Context, c *client.Client, args []string, outputJSON bool) int {
+	flags := flag.NewFlagSet("skip", flag.ContinueOnError)
+	to := flags.String("to", "", "mark every pending migration up to and including this ID")
+	schema := flags.String("schema", "", "schema to edit when the target fans out to schemas")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if (*to == "") == (flags.NArg() == 0) {
+		return exitWithError(fmt.Errorf("skip requires either --to or migration IDs"))
+	}
+
+	edit, err := c.Skip(ctx, client.SkipRequest{IDs: flags.Args(), To: *to, Schema: *schema})
+	if err != nil {
+		return exitWithError(err)
+	}
+	printHistoryEdit(edit, outputJSON)
+	return 0
+}
+
+// unskipCommand 適用済みのマイグレーションを実行せずに適用記録から削除する
+func unskipCommand(ctx context.Context, c *client.Client, args []string, outputJSON bool) int {
+	flags := flag.NewFlagSet("unskip", flag.ContinueOnError)
+	schema := flags.String("schema", "", "schema to edit when the target fans out to schemas")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		return exitWithError(fmt.Errorf("unskip requires migration IDs"))
+	}
+
+	edit, err := c.Unskip(ctx, flags.Args(), *schema)
+	if err != nil {
+		return exitWithError(err)
+	}
+	printHistoryEdit(edit, outputJSON)
+	return 0
+}
+
+// printHistoryEdit 適用記録を編集したマイグレーションを出力する
+func printHistoryEdit(edit *client.HistoryEdit, outputJSON bool) {
+	if outputJSON {
+		printJSON(edit)
+		return
+	}
+	fmt.Printf("%s: %d migration(s)\n", edit.Action, len(edit.Migrations))
+	for _, id := range edit.Migrations {
+		fmt.Printf("  %s\n", id)
+	}
+}
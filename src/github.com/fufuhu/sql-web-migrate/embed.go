@@ -0,0 +1,23 @@
+//go:build embed_migrations
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+
+	config "github.com/fufuhu/sql-web-migrate/migrate"
+)
+
+// embeddedMigrations ビルド時にバイナリに埋め込むマイグレーション
+//
+//go:embed migrations
+var embeddedMigrations embed.FS
+
+func init() {
+	migrations, err := fs.Sub(embeddedMigrations, "migrations")
+	if err != nil {
+		panic(err)
+	}
+	config.RegisterEmbeddedMigrations(migrations)
+}
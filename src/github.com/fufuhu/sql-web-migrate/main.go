@@ -1,290 +1,94 @@
 package main
 
 import (
-	"database/sql"
-	"encoding/json"
-	"fmt"
+	"context"
 	"net"
 	"net/http"
-	"strings"
-	"time"
+	"os"
 
 	config "github.com/fufuhu/sql-web-migrate/migrate"
-	_ "github.com/lib/pq"
-	migrate "github.com/rubenv/sql-migrate"
 	"go.uber.org/zap"
 )
 
 func main() {
 
-	// URLパスと関数の関係を定義
-	http.HandleFunc("/migrate/up", execMigrateUp)
-	http.HandleFunc("/migrate/down", execMigrateDown)
-
-	// ListenするIPアドレスを定義
-	err := http.ListenAndServe("0.0.0.0:8080", nil)
-
-	if err != nil {
-		fmt.Println(err)
-	}
-
-}
-
-// LogRecord DDLの適用記録を格納するための構造体
-// ID SQLのID
-// AppliedAt SQLの適用タイムスタンプ
-type LogRecord struct {
-	ID        string `json:id`
-	AppliedAt string `json:appliedAt`
-}
-
-const (
-	// ErrorKey Logger output key attribure
-	ErrorKey = "err"
-)
-
-// 一旦Postgre固定
-func getConnection(connectionConfig config.DBConnectionConfig, dialect string) (*sql.DB, error) {
-
-	logger, _ := zap.NewProduction()
-	defer logger.Sync()
-
-	host := connectionConfig.Host()
-	port, err := connectionConfig.Port()
+	// トレースの設定。設定が不正な場合はinit containerやCIで失敗として扱われるように終了コード1で終了する
+	shutdownTracing, err := config.SetupTracing(config.TraceConfig)
 	if err != nil {
+		logger, _ := zap.NewProduction()
 		logger.Error(
-			"Failed to get TCP port config",
+			"Tracing setup failed",
 			zap.Error(err))
-	}
-	sslMode, err := connectionConfig.SSLMode()
-	if err != nil {
-		logger.Error(
-			"Failed to get SSL mode config",
-			zap.Error(err))
-	}
-
-	var connectionString string
-	if host[:1] == "/" {
-		connectionString = config.BuildConnectionStringForUnixDomainSocket(
-			host,
-			connectionConfig.User(),
-			connectionConfig.Password(),
-			connectionConfig.DBName())
-	} else {
-		connectionString = config.BuildConnectionString(
-			host,
-			port,
-			connectionConfig.User(),
-			connectionConfig.Password(),
-			connectionConfig.DBName(),
-			sslMode)
+		logger.Sync()
+		os.Exit(1)
 	}
 
-	db, err := sql.Open(config.DialectPostgres, connectionString)
+	// サブコマンドの実行
+	code := runCommand(os.Args[1:])
 
-	return db, err
+	shutdownTracing(context.Background())
+	os.Exit(code)
 }
 
-func execMigrate(direction migrate.MigrationDirection) ([]LogRecord, error) {
-
-	sourcePath := config.GetMigrationSourcePath()
-
-	logger, _ := zap.NewProduction()
-	defer logger.Sync()
-	logger.Info(
-		"Setup source file path to migrate",
-		zap.String("sourcePath", sourcePath))
-
-	source := migrate.FileMigrationSource{
-		Dir: sourcePath,
-	}
-
-	db, err := getConnection(
-		config.ConnectionConfig,
-		config.DialectPostgres)
+// serve Webサーバを起動する。
+// サーバ証明書が設定されている場合はHTTPSで待ち受ける
+func serve(address string) error {
 
+	tlsConfig, err := config.NewServerTLSConfig(config.AuthConfig)
 	if err != nil {
-		logger.Error(
-			"DB connection open failure",
-			zap.Error(err))
+		return err
 	}
 
-	n, err := migrate.ExecMax(db, config.DialectPostgres, source, direction, 0)
-	if err != nil {
-		logger.Error(
-			"Migration failed",
-			zap.Error(err))
-	}
-
-	logger.Info(fmt.Sprintf("Applied %d migrations!", n))
-
-	// クエリを投げる
-
-	statement, err := db.Prepare("select id, applied_at from gorp_migrations")
-
+	// マイグレーション対象の読み込み
+	targets, err := config.LoadTargets(config.GetTargetsFile())
 	if err != nil {
-		logger.Error(
-			"Result check failed",
-			zap.Error(err))
-	}
-	defer statement.Close()
-
-	var (
-		id        string
-		appliedAt time.Time
-	)
-
-	rows, err := statement.Query()
-
-	// 結果の取得と構造体への格納
-	records := []LogRecord{}
-	for rows.Next() {
-		err := rows.Scan(&id, &appliedAt)
-		if err != nil {
-			fmt.Println(err)
-		}
-		fmt.Println(id, appliedAt)
-		record := LogRecord{
-			ID:        id,
-			AppliedAt: appliedAt.String(),
-		}
-
-		records = append(records, record)
+		return err
 	}
 
-	return records, err
-}
-
-const (
-	// XForwardedFor X-Forwarded-For constant for IDE
-	XForwardedFor = "X-Forwarded-For"
-	// RemoteAddr RemoteAddr constant for IDE
-	RemoteAddr = "RemoteAddr"
-)
-
-func getXForwardedFor(r *http.Request) string {
-	logger, _ := zap.NewProduction()
-	defer logger.Sync()
-
-	addresses := r.Header.Get(XForwardedFor)
-	logger.Info(
-		"Checking HTTP Request Header, X-Forwarded-For",
-		zap.String(XForwardedFor, addresses),
-	)
-
-	return addresses
-}
-
-func getRemoteAddr(r *http.Request) string {
-	logger, _ := zap.NewProduction()
-	defer logger.Sync()
-
-	remote := r.RemoteAddr
-	logger.Info(
-		"Checking HTTP Request Header, RemoteAddr",
-		zap.String("RemoteAddr", remote),
-	)
-	return remote
-}
-
-func execMigrateUp(w http.ResponseWriter, r *http.Request) {
-
-	logger, _ := zap.NewProduction()
-	defer logger.Sync()
+	defer targets.Close()
 
-	// addresses check
-
-	networks := config.NetworkConfig.AllowedNetworks()
-
-	addresses := strings.Split(getXForwardedFor(r), ",")
-	remoteAddr := strings.Split(getRemoteAddr(r), ":")[0]
-	addresses = append(addresses, remoteAddr)
-
-	var ips []net.IP
-	for _, address := range addresses {
-		ips = append(ips, net.ParseIP(address))
+	// APIで開始した凍結は再起動しても解けないように、保存したものを読み込む
+	if err := config.LoadFreezes(); err != nil {
+		return err
 	}
 
-	isAllowed := false
-	for _, ip := range ips {
-		logger.Info("Checking IP Addresss", zap.String("IPAddress", ip.String()))
-		isAllowed = networks.IsAllowed(ip)
-		if isAllowed {
-			break
-		}
-	}
+	// 対象のDBに接続し、適用済みのマイグレーションが変更されていないかを確認する。
+	// DBへの接続に時間がかかっても起動を遅らせないように並行して実行する
+	go func() {
+		config.ConnectTargets(context.Background(), targets)
+		config.CheckTargetsDrift(context.Background(), targets)
+	}()
 
-	if !isAllowed {
-		logger.Warn(
-			"Access forbidden",
-		)
-		w.WriteHeader(http.StatusForbidden)
-		return
-	}
-
-	// migrationの実行
-	records, err := execMigrate(migrate.Up)
-	if err != nil {
-		logger.Error(
-			"Migration failed",
-			zap.Error(err))
-	}
+	// 終了のシグナルを受け取ったら、実行中のマイグレーションを中断する
+	ctx, stop := interruptContext()
+	defer stop()
 
-	bytes, _ := json.Marshal(records)
-
-	recordString := string(bytes)
-
-	fmt.Fprintf(w, "%s\n", recordString)
-
-}
-
-func execMigrateDown(w http.ResponseWriter, r *http.Request) {
-
-	logger, _ := zap.NewProduction()
-	defer logger.Sync()
-
-	// addresses check
-
-	networks := config.NetworkConfig.AllowedNetworks()
-
-	addresses := strings.Split(getXForwardedFor(r), " ")
-	remoteAddr := strings.Split(getRemoteAddr(r), ":")[0]
-	addresses = append(addresses, remoteAddr)
-
-	var ips []net.IP
-	for _, address := range addresses {
-		ips = append(ips, net.ParseIP(address))
+	// URLパスと関数の関係を定義
+	server := &http.Server{
+		Addr:        address,
+		Handler:     config.NewServeMux(targets),
+		TLSConfig:   tlsConfig,
+		BaseContext: func(net.Listener) context.Context { return ctx },
 	}
 
-	isAllowed := false
-	for _, ip := range ips {
-		isAllowed = networks.IsAllowed(ip)
-		if isAllowed {
-			break
+	// ListenするIPアドレスを定義
+	errs := make(chan error, 1)
+	go func() {
+		if tlsConfig != nil {
+			errs <- server.ListenAndServeTLS("", "")
+			return
 		}
-	}
+		errs <- server.ListenAndServe()
+	}()
 
-	if !isAllowed {
-		logger.Warn(
-			"Access forbidden",
-		)
-		w.WriteHeader(http.StatusForbidden)
-		return
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
 	}
 
-	// migrationの実行
-
-	records, err := execMigrate(migrate.Down)
-	if err != nil {
-		logger.Error(
-			"Migration failed",
-			zap.Error(err))
-	}
-
-	bytes, _ := json.Marshal(records)
-
-	recordString := string(bytes)
-
-	fmt.Fprintf(w, "%s\n", recordString)
-
+	// 中断したマイグレーションの結果を返し終えるまで待ってから終了する
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	return server.Shutdown(shutdownCtx)
 }
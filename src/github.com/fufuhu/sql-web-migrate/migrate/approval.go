@@ -0,0 +1,382 @@
+package migrate
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	sqlmigrate "github.com/rubenv/sql-migrate"
+	"go.uber.org/zap"
+)
+
+const (
+	// RequireApproval 環境変数で設定した対象(default)のマイグレーションに承認を必要とするかを指定するための環境変数
+	RequireApproval = "SQL_MIGRATE_REQUIRE_APPROVAL"
+	// ApprovalTTL 承認依頼の有効期間を指定するための環境変数
+	ApprovalTTL = "SQL_MIGRATE_APPROVAL_TTL"
+	// Approvers 承認できる利用者名をカンマ区切りで指定するための環境変数
+	Approvers = "SQL_MIGRATE_APPROVERS"
+)
+
+const (
+	// DefaultRequireApproval デフォルトでは承認を必要としない
+	DefaultRequireApproval = false
+	// DefaultApprovalTTL デフォルトの承認依頼の有効期間
+	DefaultApprovalTTL = 24 * time.Hour
+)
+
+const (
+	// ApprovalPending 承認待ち
+	ApprovalPending = "pending"
+	// ApprovalApproved 承認済み(未実行)
+	ApprovalApproved = "approved"
+	// ApprovalRejected 却下
+	ApprovalRejected = "rejected"
+	// ApprovalExpired 実行されないまま有効期間が過ぎた
+	ApprovalExpired = "expired"
+	// ApprovalExecuted 実行済み
+	ApprovalExecuted = "executed"
+)
+
+const (
+	// RequireApprovalSettingFormatErrorMessage 承認を必要とするかの設定値が不正な場合のエラーメッセージです
+	RequireApprovalSettingFormatErrorMessage = "Require approval should be true or false"
+	// ApprovalTTLSettingFormatErrorMessage 承認依頼の有効期間の設定値が不正な場合のエラーメッセージです
+	ApprovalTTLSettingFormatErrorMessage = "Approval TTL should be a positive duration"
+	// ApprovalRequiredErrorMessage 承認が必要な対象で承認依頼が指定されていない場合のエラーメッセージです
+	ApprovalRequiredErrorMessage = "This target requires an approved migration request; submit one and have another engineer approve it"
+	// ApprovalNotFoundErrorMessage 承認依頼が見つからない場合のエラーメッセージです
+	ApprovalNotFoundErrorMessage = "Migration request not found"
+	// ApprovalNotApprovedErrorMessage 承認依頼が実行できる状態でない場合のエラーメッセージです
+	ApprovalNotApprovedErrorMessage = "Migration request is not approved for this operation"
+	// ApprovalNotPendingErrorMessage 承認待ちでない承認依頼を承認または却下しようとした場合のエラーメッセージです
+	ApprovalNotPendingErrorMessage = "Migration request is no longer pending"
+	// SelfApprovalErrorMessage 依頼者が自分の承認依頼を承認しようとした場合のエラーメッセージです
+	SelfApprovalErrorMessage = "A migration request must be reviewed by someone other than its requester"
+	// NotApproverErrorMessage 承認者として設定されていない利用者が承認しようとした場合のエラーメッセージです
+	NotApproverErrorMessage = "You are not allowed to review migration requests"
+	// ApprovalPlanChangedErrorMessage 依頼後に実行予定のマイグレーションやソースが変わった場合のエラーメッセージです
+	ApprovalPlanChangedErrorMessage = "The plan or the migration source changed after the migration request was submitted; submit a new request"
+)
+
+var (
+	// ErrApprovalRequired 承認が必要な対象で承認依頼が指定されていないことを表すエラー
+	ErrApprovalRequired = errors.New(ApprovalRequiredErrorMessage)
+	// ErrApprovalNotFound 承認依頼が見つからないことを表すエラー
+	ErrApprovalNotFound = errors.New(ApprovalNotFoundErrorMessage)
+	// ErrApprovalNotApproved 承認依頼が承認されていない、期限切れ、実行済み、または操作が異なることを表すエラー
+	ErrApprovalNotApproved = errors.New(ApprovalNotApprovedErrorMessage)
+	// ErrApprovalNotPending 承認待ちでない承認依頼を承認または却下しようとしたことを表すエラー
+	ErrApprovalNotPending = errors.New(ApprovalNotPendingErrorMessage)
+	// ErrSelfApproval 依頼者が自分の承認依頼を承認または却下しようとしたことを表すエラー
+	ErrSelfApproval = errors.New(SelfApprovalErrorMessage)
+	// ErrNotApprover 承認者として設定されていない利用者が承認または却下しようとしたことを表すエラー
+	ErrNotApprover = errors.New(NotApproverErrorMessage)
+	// ErrApprovalPlanChanged 依頼後に実行予定のマイグレーションやソースが変わったことを表すエラー
+	ErrApprovalPlanChanged = errors.New(ApprovalPlanChangedErrorMessage)
+)
+
+// GetRequireApproval 環境変数で設定した対象のマイグレーションに承認を必要とするかを取得する。
+// 環境変数が設定されていない場合は、DefaultRequireApprovalの値を返す。
+// 不正な値が設定されている場合はエラーとtrueを返す(設定を誤っても承認なしでは実行しない)
+func GetRequireApproval() (bool, error) {
+	required, err := strconv.ParseBool(getValue(RequireApproval, strconv.FormatBool(DefaultRequireApproval)))
+	if err != nil {
+		return true, errors.New(RequireApprovalSettingFormatErrorMessage)
+	}
+	return required, nil
+}
+
+// GetApprovalTTL 承認依頼の有効期間を取得する。
+// 環境変数が設定されていない場合は、DefaultApprovalTTLの値を返す。
+// 不正な値が設定されている場合はエラーとDefaultApprovalTTLの値を返す
+func GetApprovalTTL() (time.Duration, error) {
+	ttl, err := getDuration(ApprovalTTL, DefaultApprovalTTL)
+	if err != nil || ttl <= 0 {
+		return DefaultApprovalTTL, errors.New(ApprovalTTLSettingFormatErrorMessage)
+	}
+	return ttl, nil
+}
+
+// GetApprovers 承認できる利用者名を取得する。
+// 環境変数が設定されていない場合は空のスライスを返し、認証された依頼者以外の誰でも承認できる
+func GetApprovers() []string {
+	approvers := []string{}
+	for _, name := range strings.Split(getValue(Approvers, ""), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			approvers = append(approvers, name)
+		}
+	}
+	return approvers
+}
+
+// ApprovalConfigStruct 承認の設定
+// TTL 承認依頼の有効期間
+// Approvers 承認できる利用者名(空の場合は依頼者以外の誰でも承認できる)
+type ApprovalConfigStruct struct {
+	TTL       func() (time.Duration, error)
+	Approvers func() []string
+}
+
+// ApprovalConfig 承認の設定です
+var ApprovalConfig ApprovalConfigStruct
+
+// ApprovalRequest マイグレーションの承認依頼
+// ID 依頼のID
+// Target 対象の名前
+// Direction マイグレーションの方向
+// Steps 実行するマイグレーションの最大件数(0はすべて)
+// PlanHash 依頼した時点の実行予定とソースのSHA-256(承認した内容と異なるものは実行しない)
+// Status 状態(pending/approved/rejected/expired/executed)
+// RequestedBy 依頼者
+// RequestedAt 依頼した時刻
+// ExpiresAt 有効期限(この時刻までに承認と実行が必要)
+// ReviewedBy 承認または却下した利用者
+// ReviewedAt 承認または却下した時刻
+// ExecutedBy 実行した利用者
+// ExecutedAt 実行した時刻
+// Success 実行が成功したかどうか
+type ApprovalRequest struct {
+	ID          string     `json:"id"`
+	Target      string     `json:"target"`
+	Direction   string     `json:"direction"`
+	Steps       int        `json:"steps"`
+	PlanHash    string     `json:"planHash"`
+	Status      string     `json:"status"`
+	RequestedBy string     `json:"requestedBy"`
+	RequestedAt time.Time  `json:"requestedAt"`
+	ExpiresAt   time.Time  `json:"expiresAt"`
+	ReviewedBy  string     `json:"reviewedBy,omitempty"`
+	ReviewedAt  *time.Time `json:"reviewedAt,omitempty"`
+	ExecutedBy  string     `json:"executedBy,omitempty"`
+	ExecutedAt  *time.Time `json:"executedAt,omitempty"`
+	Success     *bool      `json:"success,omitempty"`
+}
+
+// expire 有効期限を過ぎた未実行の依頼を期限切れにする
+func (request *ApprovalRequest) expire(now time.Time) {
+	if (request.Status == ApprovalPending || request.Status == ApprovalApproved) && now.After(request.ExpiresAt) {
+		request.Status = ApprovalExpired
+	}
+}
+
+// approvalStore サーバが受け付けた承認依頼
+type approvalStore struct {
+	mu       sync.Mutex
+	requests map[string]*ApprovalRequest
+}
+
+// approvals サーバが受け付けた承認依頼です
+var approvals = &approvalStore{requests: map[string]*ApprovalRequest{}}
+
+// SubmitApproval マイグレーションの承認依頼を登録する。
+// 承認者が確認した内容だけを実行できるように、依頼した時点の実行予定とソースのハッシュを記録する
+func SubmitApproval(ctx context.Context, target *Target, identity string, direction sqlmigrate.MigrationDirection,
+	steps int) (ApprovalRequest, error) {
+
+	ttl, err := ApprovalConfig.TTL()
+	if err != nil {
+		return ApprovalRequest{}, err
+	}
+	hash, err := currentPlanHash(ctx, target, direction, steps)
+	if err != nil {
+		return ApprovalRequest{}, err
+	}
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return ApprovalRequest{}, err
+	}
+
+	now := time.Now()
+	request := &ApprovalRequest{
+		ID:          hex.EncodeToString(random),
+		Target:      target.Name,
+		Direction:   DirectionName(direction),
+		Steps:       steps,
+		PlanHash:    hash,
+		Status:      ApprovalPending,
+		RequestedBy: identity,
+		RequestedAt: now,
+		ExpiresAt:   now.Add(ttl),
+	}
+
+	approvals.mu.Lock()
+	approvals.requests[request.ID] = request
+	approvals.mu.Unlock()
+
+	RecordAudit(AuditEvent{
+		Action: AuditRequestSubmitted, Target: target.Name, Identity: identity, RequestID: request.ID,
+		Direction: request.Direction, Steps: steps, Success: true,
+	})
+	return *request, nil
+}
+
+// ReviewApproval 承認依頼を承認または却下する。
+// 依頼者自身や、承認者が設定されている場合に承認者でない利用者は承認も却下もできない
+func ReviewApproval(target *Target, id string, identity string, approve bool) (ApprovalRequest, error) {
+	action := AuditRequestRejected
+	if approve {
+		action = AuditRequestApproved
+	}
+
+	request, err := reviewApproval(target, id, identity, approve)
+	event := AuditEvent{Action: action, Target: target.Name, Identity: identity, RequestID: id, Success: err == nil}
+	if err != nil {
+		event.Detail = err.Error()
+	} else {
+		event.Direction, event.Steps = request.Direction, request.Steps
+	}
+	RecordAudit(event)
+	return request, err
+}
+
+// reviewApproval 承認依頼の状態を承認済みまたは却下に変更する
+func reviewApproval(target *Target, id string, identity string, approve bool) (ApprovalRequest, error) {
+	if approvers := ApprovalConfig.Approvers(); len(approvers) > 0 {
+		allowed := false
+		for _, approver := range approvers {
+			allowed = allowed || approver == identity
+		}
+		if !allowed {
+			return ApprovalRequest{}, ErrNotApprover
+		}
+	}
+
+	approvals.mu.Lock()
+	defer approvals.mu.Unlock()
+
+	request, ok := approvals.requests[id]
+	if !ok || request.Target != target.Name {
+		return ApprovalRequest{}, ErrApprovalNotFound
+	}
+	now := time.Now()
+	request.expire(now)
+	if request.Status != ApprovalPending {
+		return *request, ErrApprovalNotPending
+	}
+	if request.RequestedBy == identity {
+		return *request, ErrSelfApproval
+	}
+
+	request.Status = ApprovalRejected
+	if approve {
+		request.Status = ApprovalApproved
+	}
+	request.ReviewedBy = identity
+	request.ReviewedAt = &now
+	return *request, nil
+}
+
+// ListApprovals 対象の承認依頼を新しい順に返す
+func ListApprovals(target *Target) []ApprovalRequest {
+	approvals.mu.Lock()
+	defer approvals.mu.Unlock()
+
+	now := time.Now()
+	list := []ApprovalRequest{}
+	for _, request := range approvals.requests {
+		if request.Target == target.Name {
+			request.expire(now)
+			list = append(list, *request)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].RequestedAt.After(list[j].RequestedAt) })
+	return list
+}
+
+// findApproval 対象の承認依頼を返す
+func findApproval(target *Target, id string) (ApprovalRequest, error) {
+	approvals.mu.Lock()
+	defer approvals.mu.Unlock()
+
+	request, ok := approvals.requests[id]
+	if !ok || request.Target != target.Name {
+		return ApprovalRequest{}, ErrApprovalNotFound
+	}
+	request.expire(time.Now())
+	return *request, nil
+}
+
+// checkApproval 承認依頼が承認済みで期限内であり、依頼した操作と一致することを確認する。
+// 依頼後に実行予定やソースが変わった場合はErrApprovalPlanChangedを返す。
+// 呼び出し元で対象の実行権(TryLock)を取得しておくこと
+func checkApproval(ctx context.Context, target *Target, id string, direction sqlmigrate.MigrationDirection, steps int) error {
+	if id == "" {
+		return ErrApprovalRequired
+	}
+	request, err := findApproval(target, id)
+	if err != nil {
+		return err
+	}
+	if request.Status != ApprovalApproved || request.Direction != DirectionName(direction) || request.Steps != steps {
+		return ErrApprovalNotApproved
+	}
+	hash, err := currentPlanHash(ctx, target, direction, steps)
+	if err != nil {
+		return err
+	}
+	if hash != request.PlanHash {
+		return ErrApprovalPlanChanged
+	}
+	return nil
+}
+
+// EnforceApproval CLIやrun-onceから承認依頼を通さずに対象のマイグレーションを実行してよいかを確認する。
+// 承認が必要な対象では、reasonが指定されAuthorizeOverrideで許可された場合だけ実行でき、承認の省略を監査記録に残す
+func EnforceApproval(target *Target, identity string, reason string) error {
+	logger, _ := zap.NewProduction()
+	defer logger.Sync()
+
+	required, err := target.ApprovalRequired()
+	if err != nil || !required {
+		return err
+	}
+	if reason == "" {
+		return ErrApprovalRequired
+	}
+
+	overrideErr := AuthorizeOverride(nil, identity)
+	RecordAudit(AuditEvent{
+		Action: AuditApprovalOverride, Target: target.Name, Identity: identity, Success: overrideErr == nil,
+		Detail: reason,
+	})
+	if overrideErr != nil {
+		return overrideErr
+	}
+	logger.Warn(
+		"Migration approval overridden",
+		zap.String("target", target.Name),
+		zap.String("identity", identity),
+		zap.String("reason", reason))
+	return nil
+}
+
+// completeApproval 承認依頼を実行済みにする。同じ依頼では二度と実行できない
+func completeApproval(id string, identity string, result MigrationResult) {
+	approvals.mu.Lock()
+	defer approvals.mu.Unlock()
+
+	request, ok := approvals.requests[id]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	success := result.Success
+	request.Status = ApprovalExecuted
+	request.ExecutedBy = identity
+	request.ExecutedAt = &now
+	request.Success = &success
+}
+
+func init() {
+	ApprovalConfig = ApprovalConfigStruct{
+		TTL:       GetApprovalTTL,
+		Approvers: GetApprovers,
+	}
+}
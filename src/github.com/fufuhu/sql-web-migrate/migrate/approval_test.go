@@ -0,0 +1,363 @@
+package migrate
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestGetRequireApproval 承認の要否の既定値と、不正な値の場合は承認を必要とすることを確認する。
+func TestGetRequireApproval(t *testing.T) {
+	os.Unsetenv(RequireApproval)
+	if required, err := GetRequireApproval(); err != nil || required != DefaultRequireApproval {
+		t.Log(required, err)
+		t.Fail()
+	}
+
+	defer os.Unsetenv(RequireApproval)
+	os.Setenv(RequireApproval, "sometimes")
+	if required, err := GetRequireApproval(); err == nil || !required {
+		t.Log(required, err)
+		t.Fail()
+	}
+}
+
+// TestGetApprovalTTL 承認依頼の有効期間の既定値と、不正な値がエラーになることを確認する。
+func TestGetApprovalTTL(t *testing.T) {
+	os.Unsetenv(ApprovalTTL)
+	if ttl, err := GetApprovalTTL(); err != nil || ttl != DefaultApprovalTTL {
+		t.Log(ttl, err)
+		t.Fail()
+	}
+
+	defer os.Unsetenv(ApprovalTTL)
+	for _, value := range []string{"tomorrow", "0s", "-1h"} {
+		os.Setenv(ApprovalTTL, value)
+		if ttl, err := GetApprovalTTL(); err == nil || ttl != DefaultApprovalTTL {
+			t.Log(value, ttl, err)
+			t.Fail()
+		}
+	}
+}
+
+// TestGetApprovers 承認者をカンマ区切りで指定でき、空白や空の要素が無視されることを確認する。
+func TestGetApprovers(t *testing.T) {
+	os.Setenv(Approvers, " alice, ,bob ")
+	defer os.Unsetenv(Approvers)
+
+	approvers := GetApprovers()
+	if len(approvers) != 2 || approvers[0] != "alice" || approvers[1] != "bob" {
+		t.Log(approvers)
+		t.Fail()
+	}
+}
+
+// setupApprovalTargets 承認が必要な対象と、利用者ごとのAPIトークンを用意する。
+// 対象の名前がテストごとに同じため、受け付けた承認依頼は空にする
+func setupApprovalTargets(t *testing.T) (*Targets, *http.ServeMux, func()) {
+	approvals = &approvalStore{requests: map[string]*ApprovalRequest{}}
+	targets, cleanup := setupSQLiteTargets(t, nil)
+	target, _ := targets.Get("local")
+	target.RequireApproval = func() (bool, error) { return true, nil }
+	os.Setenv(APITokens, "alice:token-a,bob:token-b")
+	return targets, NewServeMux(targets), func() {
+		os.Unsetenv(APITokens)
+		cleanup()
+	}
+}
+
+// as 指定したAPIトークンのAuthorizationヘッダを返す
+func as(token string) http.Header {
+	return http.Header{"Authorization": []string{"Bearer " + token}}
+}
+
+// TestHandlerApprovalFlow 承認が必要な対象では、依頼者以外が承認した依頼でだけ実行でき、
+// 実行した依頼は再利用できず、一覧に状態が残ることを確認する。
+func TestHandlerApprovalFlow(t *testing.T) {
+	_, mux, cleanup := setupApprovalTargets(t)
+	defer cleanup()
+
+	// 承認依頼なしでは実行できない
+	if w := serve(mux, http.MethodPost, "/targets/local/migrate/up", as("token-a")); w.Code != http.StatusForbidden {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+
+	w := serve(mux, http.MethodPost, "/targets/local/requests?direction=up", as("token-a"))
+	var request ApprovalRequest
+	decode(t, w, &request)
+	if w.Code != http.StatusCreated || request.Status != ApprovalPending || request.RequestedBy != "alice" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+
+	// 承認前の依頼では実行できず、依頼者自身は承認できない
+	if w := serve(mux, http.MethodPost, "/targets/local/migrate/up?request="+request.ID, as("token-a")); w.Code != http.StatusConflict {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+	if w := serve(mux, http.MethodPost, "/targets/local/requests/"+request.ID+"/approve", as("token-a")); w.Code != http.StatusForbidden {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+
+	w = serve(mux, http.MethodPost, "/targets/local/requests/"+request.ID+"/approve", as("token-b"))
+	decode(t, w, &request)
+	if w.Code != http.StatusOK || request.Status != ApprovalApproved || request.ReviewedBy != "bob" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+
+	// 依頼と異なる操作には使えない
+	if w := serve(mux, http.MethodPost, "/targets/local/migrate/up?steps=1&request="+request.ID, as("token-a")); w.Code != http.StatusConflict {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+
+	w = serve(mux, http.MethodPost, "/targets/local/migrate/up?request="+request.ID, as("token-a"))
+	var result MigrationResult
+	decode(t, w, &result)
+	if w.Code != http.StatusOK || len(result.Applied) != 2 {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+
+	// 実行済みの依頼は再利用できない
+	if w := serve(mux, http.MethodPost, "/targets/local/migrate/up?request="+request.ID, as("token-a")); w.Code != http.StatusConflict {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+
+	w = serve(mux, http.MethodGet, "/targets/local/requests", as("token-b"))
+	var list []ApprovalRequest
+	decode(t, w, &list)
+	if w.Code != http.StatusOK || len(list) != 1 || list[0].Status != ApprovalExecuted ||
+		list[0].ExecutedBy != "alice" || list[0].Success == nil || !*list[0].Success {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+}
+
+// TestHandlerApprovalPlanChanged 依頼後にソースが変わった場合は、
+// 承認済みの依頼でも実行できないことを確認する。
+func TestHandlerApprovalPlanChanged(t *testing.T) {
+	targets, mux, cleanup := setupApprovalTargets(t)
+	defer cleanup()
+	target, _ := targets.Get("local")
+
+	w := serve(mux, http.MethodPost, "/targets/local/requests?direction=up", as("token-a"))
+	var request ApprovalRequest
+	decode(t, w, &request)
+	if w.Code != http.StatusCreated || request.PlanHash == "" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	if w := serve(mux, http.MethodPost, "/targets/local/requests/"+request.ID+"/approve", as("token-b")); w.Code != http.StatusOK {
+		t.Fatal(w.Code, w.Body.String())
+	}
+
+	ioutil.WriteFile(filepath.Join(target.SourcePath(), "03-tags.sql"),
+		[]byte("-- +migrate Up\nCREATE TABLE tags (id integer);\n-- +migrate Down\nDROP TABLE tags;\n"), 0644)
+	w = serve(mux, http.MethodPost, "/targets/local/migrate/up?request="+request.ID, as("token-a"))
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), ApprovalPlanChangedErrorMessage) {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+
+	w = serve(mux, http.MethodGet, "/targets/local/migrate/status", as("token-a"))
+	var statuses []MigrationStatus
+	decode(t, w, &statuses)
+	for _, status := range statuses {
+		if status.Applied {
+			t.Log(w.Body.String())
+			t.Fail()
+		}
+	}
+}
+
+// TestHandlerApprovalReject 却下した依頼では実行できず、却下後は承認もできないことを確認する。
+func TestHandlerApprovalReject(t *testing.T) {
+	_, mux, cleanup := setupApprovalTargets(t)
+	defer cleanup()
+
+	w := serve(mux, http.MethodPost, "/targets/local/requests?direction=up", as("token-a"))
+	var request ApprovalRequest
+	decode(t, w, &request)
+
+	if w := serve(mux, http.MethodPost, "/targets/local/requests/"+request.ID+"/reject", as("token-b")); w.Code != http.StatusOK {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+	if w := serve(mux, http.MethodPost, "/targets/local/requests/"+request.ID+"/approve", as("token-b")); w.Code != http.StatusConflict {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+	if w := serve(mux, http.MethodPost, "/targets/local/migrate/up?request="+request.ID, as("token-a")); w.Code != http.StatusConflict {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+	if w := serve(mux, http.MethodPost, "/targets/local/requests/unknown/approve", as("token-b")); w.Code != http.StatusNotFound {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+}
+
+// TestHandlerApprovalExpired 有効期間を過ぎた依頼は期限切れになり、承認できないことを確認する。
+func TestHandlerApprovalExpired(t *testing.T) {
+	_, mux, cleanup := setupApprovalTargets(t)
+	defer cleanup()
+
+	os.Setenv(ApprovalTTL, "1ms")
+	w := serve(mux, http.MethodPost, "/targets/local/requests?direction=up", as("token-a"))
+	os.Unsetenv(ApprovalTTL)
+	var request ApprovalRequest
+	decode(t, w, &request)
+	time.Sleep(10 * time.Millisecond)
+
+	if w := serve(mux, http.MethodPost, "/targets/local/requests/"+request.ID+"/approve", as("token-b")); w.Code != http.StatusConflict {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+	w = serve(mux, http.MethodGet, "/targets/local/requests", as("token-b"))
+	var list []ApprovalRequest
+	decode(t, w, &list)
+	if len(list) != 1 || list[0].Status != ApprovalExpired {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+}
+
+// TestHandlerApprovalApprovers 承認者が設定されている場合は、承認者以外が承認できないことを確認する。
+func TestHandlerApprovalApprovers(t *testing.T) {
+	_, mux, cleanup := setupApprovalTargets(t)
+	defer cleanup()
+	os.Setenv(APITokens, "alice:token-a,bob:token-b,carol:token-c")
+	os.Setenv(Approvers, "carol")
+	defer os.Unsetenv(Approvers)
+
+	w := serve(mux, http.MethodPost, "/targets/local/requests?direction=up", as("token-a"))
+	var request ApprovalRequest
+	decode(t, w, &request)
+
+	if w := serve(mux, http.MethodPost, "/targets/local/requests/"+request.ID+"/approve", as("token-b")); w.Code != http.StatusForbidden {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+	if w := serve(mux, http.MethodPost, "/targets/local/requests/"+request.ID+"/approve", as("token-c")); w.Code != http.StatusOK {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+}
+
+// TestHandlerApprovalCredentials 認証情報が設定されていない場合は、依頼と承認を受け付けないことを確認する。
+func TestHandlerApprovalCredentials(t *testing.T) {
+	targets, cleanup := setupSQLiteTargets(t, nil)
+	defer cleanup()
+	mux := NewServeMux(targets)
+
+	if w := serve(mux, http.MethodPost, "/targets/local/requests?direction=up", nil); w.Code != http.StatusUnauthorized {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+}
+
+// TestEnforceApproval 承認が必要な対象では、CLIやrun-onceからは許可された利用者が理由を指定した場合だけ実行でき、
+// 承認の省略が監査記録に残ることを確認する。
+func TestEnforceApproval(t *testing.T) {
+	targets, _, cleanup := setupApprovalTargets(t)
+	defer cleanup()
+	target, _ := targets.Get("local")
+	file, err := ioutil.TempFile("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+	os.Setenv(AuditLog, file.Name())
+	defer os.Unsetenv(AuditLog)
+	os.Setenv(EmergencyOverriders, "bob")
+	defer os.Unsetenv(EmergencyOverriders)
+
+	if err := EnforceApproval(target, "bob", ""); !errors.Is(err, ErrApprovalRequired) {
+		t.Log(err)
+		t.Fail()
+	}
+	if err := EnforceApproval(target, "alice", "hotfix"); !errors.Is(err, ErrOverrideNotAuthorized) {
+		t.Log(err)
+		t.Fail()
+	}
+	if err := EnforceApproval(target, "bob", "hotfix"); err != nil {
+		t.Log(err)
+		t.Fail()
+	}
+
+	events := readAuditEvents(t, file.Name())
+	if len(events) != 2 || events[0].Action != AuditApprovalOverride || events[0].Identity != "alice" || events[0].Success ||
+		events[1].Identity != "bob" || !events[1].Success || events[1].Detail != "hotfix" {
+		t.Log(events)
+		t.Fail()
+	}
+
+	// 承認が不要な対象では理由がなくても実行できる
+	target.RequireApproval = func() (bool, error) { return false, nil }
+	if err := EnforceApproval(target, "alice", ""); err != nil {
+		t.Log(err)
+		t.Fail()
+	}
+}
+
+// TestRecordAudit 監査記録がファイルにJSON Linesで追記されることを確認する。
+func TestRecordAudit(t *testing.T) {
+	file, err := ioutil.TempFile("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+	os.Setenv(AuditLog, file.Name())
+	defer os.Unsetenv(AuditLog)
+
+	RecordAudit(AuditEvent{Action: AuditRequestSubmitted, Target: "local", Identity: "alice", Success: true})
+	RecordAudit(AuditEvent{Action: AuditRequestApproved, Target: "local", Identity: "bob", Detail: SelfApprovalErrorMessage})
+
+	file, _ = os.Open(file.Name())
+	defer file.Close()
+	events := []AuditEvent{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatal(scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+	if len(events) != 2 || events[0].Identity != "alice" || events[1].Action != AuditRequestApproved ||
+		events[0].Time.IsZero() || !strings.Contains(events[1].Detail, "requester") {
+		t.Log(events)
+		t.Fail()
+	}
+}
+
+// readAuditEvents 監査記録のファイルからすべての記録を読み込む
+func readAuditEvents(t *testing.T, path string) []AuditEvent {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	events := []AuditEvent{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatal(scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
@@ -0,0 +1,136 @@
+package migrate
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// AuditLog 監査記録をJSON Linesで追記するファイルのパスを指定するための環境変数
+	AuditLog = "SQL_MIGRATE_AUDIT_LOG"
+)
+
+const (
+	// DefaultAuditLog デフォルトの監査記録のファイル(空文字の場合はログにだけ出力する)
+	DefaultAuditLog = ""
+)
+
+const (
+	// AuditRequestSubmitted マイグレーションの承認依頼を登録した
+	AuditRequestSubmitted = "request.submitted"
+	// AuditRequestApproved マイグレーションの承認依頼を承認した
+	AuditRequestApproved = "request.approved"
+	// AuditRequestRejected マイグレーションの承認依頼を却下した
+	AuditRequestRejected = "request.rejected"
+	// AuditMigrationRun マイグレーションを実行した
+	AuditMigrationRun = "migration.run"
+	// AuditScheduleOverride 時間帯の外や凍結中に緊急実行した
+	AuditScheduleOverride = "schedule.override"
+	// AuditApprovalOverride 承認が必要な対象で承認依頼を通さずに緊急実行した
+	AuditApprovalOverride = "approval.override"
+	// AuditFreezeStarted マイグレーションを凍結した
+	AuditFreezeStarted = "freeze.started"
+	// AuditFreezeLifted マイグレーションの凍結を解除した
+	AuditFreezeLifted = "freeze.lifted"
+	// AuditHistorySkip マイグレーションを実行せずに適用済みにした
+	AuditHistorySkip = "history.skip"
+	// AuditHistoryUnskip マイグレーションを実行せずに適用記録を削除した
+	AuditHistoryUnskip = "history.unskip"
+)
+
+// GetAuditLog 監査記録のファイルのパスを取得する。
+// 環境変数が設定されていない場合は、DefaultAuditLogの値を返す
+func GetAuditLog() string {
+	return getValue(AuditLog, DefaultAuditLog)
+}
+
+// AuditConfigStruct 監査記録の設定
+// Path 監査記録を追記するファイルのパス
+type AuditConfigStruct struct {
+	Path func() string
+}
+
+// AuditConfig 監査記録の設定です
+var AuditConfig AuditConfigStruct
+
+// AuditEvent 監査記録1件分
+// Time 記録した時刻
+// Action 操作の種類
+// Target 対象の名前
+// Identity 操作した利用者名
+// RequestID 承認依頼のID
+// Direction マイグレーションの方向
+// Steps 実行するマイグレーションの最大件数
+// Success 操作が成功したかどうか
+// Backup 実行前に取得したバックアップのパス
+// Detail 補足(失敗した理由など)
+type AuditEvent struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target"`
+	Identity  string    `json:"identity"`
+	RequestID string    `json:"requestId,omitempty"`
+	Direction string    `json:"direction,omitempty"`
+	Steps     int       `json:"steps,omitempty"`
+	Success   bool      `json:"success"`
+	Backup    string    `json:"backup,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+// auditMutex 監査記録のファイルへの追記を直列にする
+var auditMutex sync.Mutex
+
+// RecordAudit 監査記録をログに出力し、ファイルが設定されている場合はファイルに追記する。
+// 記録の失敗で操作を止めないように、失敗はログに出力するだけにする
+func RecordAudit(event AuditEvent) {
+
+	logger, _ := zap.NewProduction()
+	defer logger.Sync()
+
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	logger.Info(
+		"Audit",
+		zap.String("action", event.Action),
+		zap.String("target", event.Target),
+		zap.String("identity", event.Identity),
+		zap.String("requestId", event.RequestID),
+		zap.Bool("success", event.Success),
+		zap.String("backup", event.Backup),
+		zap.String("detail", event.Detail))
+
+	path := AuditConfig.Path()
+	if path == "" {
+		return
+	}
+	line, _ := json.Marshal(event)
+
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		logger.Error(
+			"Audit record failed",
+			zap.String("path", path),
+			zap.Error(err))
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		logger.Error(
+			"Audit record failed",
+			zap.String("path", path),
+			zap.Error(err))
+	}
+}
+
+func init() {
+	AuditConfig = AuditConfigStruct{
+		Path: GetAuditLog,
+	}
+}
@@ -0,0 +1,189 @@
+package migrate
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const (
+	// APITokens APIトークンを利用者名とトークンの組(name:token)のカンマ区切りで指定するための環境変数
+	APITokens = "SQL_MIGRATE_API_TOKENS"
+	// TLSCertPath HTTPSで待ち受ける際のサーバ証明書のパスを指定するための環境変数
+	TLSCertPath = "SQL_MIGRATE_TLS_CERT"
+	// TLSKeyPath HTTPSで待ち受ける際のサーバ証明書の秘密鍵のパスを指定するための環境変数
+	TLSKeyPath = "SQL_MIGRATE_TLS_KEY"
+	// TLSClientCAPath クライアント証明書を検証するCA証明書のパスを指定するための環境変数
+	TLSClientCAPath = "SQL_MIGRATE_TLS_CLIENT_CA"
+)
+
+const (
+	// APITokensSettingFormatErrorMessage APIトークンの設定を誤っている際のエラーメッセージです
+	APITokensSettingFormatErrorMessage = "API tokens should be comma separated name:token pairs"
+	// UnauthorizedErrorMessage 認証に失敗した際のエラーメッセージです
+	UnauthorizedErrorMessage = "A valid bearer token or client certificate is required"
+	// CredentialsRequiredErrorMessage 接続元のアドレスだけでは許可しない操作を認証せずに行おうとした際のエラーメッセージです
+	CredentialsRequiredErrorMessage = "This operation requires a bearer token or client certificate"
+)
+
+// APITokenMap APIトークンと利用者名の対応
+type APITokenMap map[string]string
+
+// GetAPITokens APIトークンと利用者名の対応を取得する。
+// 環境変数が設定されていない場合は、空の対応を返す
+// 不正な値が設定されている場合はエラーと空の対応を返す
+func GetAPITokens() (APITokenMap, error) {
+	tokens := APITokenMap{}
+
+	value := getValue(APITokens, "")
+	if value == "" {
+		return tokens, nil
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return APITokenMap{}, errors.New(APITokensSettingFormatErrorMessage)
+		}
+		tokens[parts[1]] = parts[0]
+	}
+	return tokens, nil
+}
+
+// Lookup トークンに対応する利用者名を返す
+func (tokens APITokenMap) Lookup(token string) (string, bool) {
+	for candidate, name := range tokens {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// GetTLSCertPath サーバ証明書のパスを取得する。
+// 環境変数が設定されていない場合はHTTPで待ち受ける
+func GetTLSCertPath() string {
+	return getValue(TLSCertPath, "")
+}
+
+// GetTLSKeyPath サーバ証明書の秘密鍵のパスを取得する
+func GetTLSKeyPath() string {
+	return getValue(TLSKeyPath, "")
+}
+
+// GetTLSClientCAPath クライアント証明書を検証するCA証明書のパスを取得する。
+// 環境変数が設定されていない場合はクライアント証明書を検証しない
+func GetTLSClientCAPath() string {
+	return getValue(TLSClientCAPath, "")
+}
+
+// AuthConfigStruct 認証の設定を格納したもの
+type AuthConfigStruct struct {
+	Tokens       func() (APITokenMap, error)
+	CertPath     func() string
+	KeyPath      func() string
+	ClientCAPath func() string
+}
+
+// AuthConfig 認証の設定です
+var AuthConfig AuthConfigStruct
+
+// NewServerTLSConfig HTTPSで待ち受けるためのTLSの設定を生成する。
+// クライアントのCA証明書が設定されている場合は、提示されたクライアント証明書を検証する。
+// サーバ証明書が設定されていない場合はnilを返す
+func NewServerTLSConfig(authConfig AuthConfigStruct) (*tls.Config, error) {
+	certPath, keyPath := authConfig.CertPath(), authConfig.KeyPath()
+	if certPath == "" {
+		return nil, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if caPath := authConfig.ClientCAPath(); caPath != "" {
+		pem, err := ioutil.ReadFile(caPath)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caPath)
+		}
+		tlsConfig.ClientCAs = pool
+		// トークンで認証するクライアントも受け付けるため、証明書は提示された場合のみ検証する
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return tlsConfig, nil
+}
+
+type identityKey struct{}
+
+// WithIdentity 利用者名をcontextに格納する
+func WithIdentity(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// IdentityFromContext contextに格納された利用者名を返す
+func IdentityFromContext(ctx context.Context) string {
+	identity, _ := ctx.Value(identityKey{}).(string)
+	return identity
+}
+
+// Authenticate リクエストの利用者を特定する。
+// 検証済みのクライアント証明書があればそのCommonNameを、正しいBearerトークンがあればその利用者名を返す。
+// APIトークンが設定されていない場合は、どちらもなければ接続元のアドレスを利用者名として返す
+func Authenticate(r *http.Request, authConfig AuthConfigStruct) (string, error) {
+	tokens, err := authConfig.Tokens()
+	if err != nil {
+		return "", err
+	}
+
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		return r.TLS.VerifiedChains[0][0].Subject.CommonName, nil
+	}
+
+	if len(tokens) == 0 {
+		return getRequester(r), nil
+	}
+
+	header := r.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		if name, ok := tokens.Lookup(strings.TrimPrefix(header, "Bearer ")); ok {
+			return name, nil
+		}
+	}
+	return "", errors.New(UnauthorizedErrorMessage)
+}
+
+// HasCredentials リクエストがクライアント証明書かBearerトークンで認証されているかを返す。
+// Authenticateで認証済みのリクエストに対して使う。
+// APIトークンが設定されていない場合の接続元のアドレスによる利用者名は認証とみなさない
+func HasCredentials(r *http.Request, authConfig AuthConfigStruct) bool {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return true
+	}
+	tokens, err := authConfig.Tokens()
+	return err == nil && len(tokens) > 0
+}
+
+func init() {
+	AuthConfig = AuthConfigStruct{
+		Tokens:       GetAPITokens,
+		CertPath:     GetTLSCertPath,
+		KeyPath:      GetTLSKeyPath,
+		ClientCAPath: GetTLSClientCAPath,
+	}
+}
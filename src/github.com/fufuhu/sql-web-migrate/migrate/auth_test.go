@@ -0,0 +1,108 @@
+package migrate
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// TestGetAPITokens 利用者名とトークンの組を解釈できることを確認する。
+func TestGetAPITokens(t *testing.T) {
+	os.Setenv(APITokens, "alice:token-a, bob:token:b")
+	defer os.Unsetenv(APITokens)
+
+	tokens, err := GetAPITokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name, ok := tokens.Lookup("token-a"); !ok || name != "alice" {
+		t.Fail()
+	}
+	if name, ok := tokens.Lookup("token:b"); !ok || name != "bob" {
+		t.Fail()
+	}
+	if _, ok := tokens.Lookup("token-c"); ok {
+		t.Fail()
+	}
+}
+
+// TestGetAPITokensError 利用者名のないトークンが設定されている場合に
+// エラーとなることを確認する。
+func TestGetAPITokensError(t *testing.T) {
+	os.Setenv(APITokens, "alice:token-a,token-b")
+	defer os.Unsetenv(APITokens)
+
+	tokens, err := GetAPITokens()
+
+	if err == nil || err.Error() != APITokensSettingFormatErrorMessage || len(tokens) != 0 {
+		t.Fail()
+	}
+}
+
+// TestAuthenticateWithoutTokens APIトークンが設定されていない場合は
+// 接続元のアドレスが利用者名になり、X-Forwarded-Forは無視されることを確認する。
+func TestAuthenticateWithoutTokens(t *testing.T) {
+	os.Unsetenv(APITokens)
+	os.Unsetenv(SQLMigrateTrustedProxies)
+
+	r := httptest.NewRequest("POST", "/migrate/up", nil)
+	r.RemoteAddr = "192.168.0.1:54321"
+	r.Header.Set(XForwardedFor, "10.0.0.1")
+
+	identity, err := Authenticate(r, AuthConfig)
+
+	if err != nil || identity != "192.168.0.1" {
+		t.Log(identity, err)
+		t.Fail()
+	}
+}
+
+// TestAuthenticateTrustedProxies 信頼するプロキシからのリクエストでは
+// X-Forwarded-Forを右から辿った最初の信頼しないアドレスが利用者名になることを確認する。
+func TestAuthenticateTrustedProxies(t *testing.T) {
+	os.Unsetenv(APITokens)
+	os.Setenv(SQLMigrateTrustedProxies, "192.168.0.0/24")
+	defer os.Unsetenv(SQLMigrateTrustedProxies)
+
+	r := httptest.NewRequest("POST", "/migrate/up", nil)
+	r.RemoteAddr = "192.168.0.1:54321"
+	r.Header.Set(XForwardedFor, "172.16.0.9, 10.0.0.1, 192.168.0.2")
+
+	identity, err := Authenticate(r, AuthConfig)
+
+	if err != nil || identity != "10.0.0.1" {
+		t.Log(identity, err)
+		t.Fail()
+	}
+
+	r.RemoteAddr = "172.16.0.1:54321"
+	identity, err = Authenticate(r, AuthConfig)
+
+	if err != nil || identity != "172.16.0.1" {
+		t.Log(identity, err)
+		t.Fail()
+	}
+}
+
+// TestAuthenticateWithTokens APIトークンが設定されている場合は
+// 正しいBearerトークンの利用者名が返り、それ以外はエラーとなることを確認する。
+func TestAuthenticateWithTokens(t *testing.T) {
+	os.Setenv(APITokens, "alice:token-a")
+	defer os.Unsetenv(APITokens)
+
+	r := httptest.NewRequest("POST", "/migrate/up", nil)
+	if _, err := Authenticate(r, AuthConfig); err == nil {
+		t.Fail()
+	}
+
+	r.Header.Set("Authorization", "Bearer token-b")
+	if _, err := Authenticate(r, AuthConfig); err == nil {
+		t.Fail()
+	}
+
+	r.Header.Set("Authorization", "Bearer token-a")
+	if identity, err := Authenticate(r, AuthConfig); err != nil || identity != "alice" {
+		t.Fail()
+	}
+}
@@ -0,0 +1,301 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	sqlmigrate "github.com/rubenv/sql-migrate"
+	"go.uber.org/zap"
+)
+
+const (
+	// BackupDir downの前にpg_dumpで取得したバックアップを格納するディレクトリを指定するための環境変数。
+	// バックアップはこのディレクトリの下の対象の名前のディレクトリに格納する
+	BackupDir = "SQL_MIGRATE_BACKUP_DIR"
+	// BackupScope バックアップの範囲(database/tables)を指定するための環境変数
+	BackupScope = "SQL_MIGRATE_BACKUP_SCOPE"
+	// BackupRetention 対象ごとに残すバックアップの数を指定するための環境変数
+	BackupRetention = "SQL_MIGRATE_BACKUP_RETENTION"
+	// PgDumpCommand pg_dumpのコマンドを指定するための環境変数
+	PgDumpCommand = "SQL_MIGRATE_PG_DUMP"
+)
+
+const (
+	// BackupScopeDatabase DB全体をバックアップする
+	BackupScopeDatabase = "database"
+	// BackupScopeTables 実行予定のマイグレーションが操作するテーブルだけをバックアップする
+	BackupScopeTables = "tables"
+)
+
+const (
+	// DefaultBackupDir デフォルトのバックアップのディレクトリ(空文字の場合はバックアップしない)
+	DefaultBackupDir = ""
+	// DefaultBackupScope デフォルトのバックアップの範囲
+	DefaultBackupScope = BackupScopeDatabase
+	// DefaultBackupRetention デフォルトの対象ごとに残すバックアップの数(0はすべて残す)
+	DefaultBackupRetention = 10
+	// DefaultPgDumpCommand デフォルトのpg_dumpのコマンド
+	DefaultPgDumpCommand = "pg_dump"
+)
+
+const (
+	// BackupScopeSettingFormatErrorMessage バックアップの範囲の設定値が不正な場合のエラーメッセージです
+	BackupScopeSettingFormatErrorMessage = "Backup scope should be database or tables"
+	// BackupRetentionSettingFormatErrorMessage 残すバックアップの数の設定値が不正な場合のエラーメッセージです
+	BackupRetentionSettingFormatErrorMessage = "Backup retention should be a non-negative integer"
+	// BackupUnsupportedErrorMessage PostgreSQL以外の対象でバックアップが設定されている場合のエラーメッセージです
+	BackupUnsupportedErrorMessage = "Backups before down migrations are only supported for postgres targets"
+)
+
+// ErrBackupUnsupported PostgreSQL以外の対象ではバックアップできないことを表すエラー
+var ErrBackupUnsupported = errors.New(BackupUnsupportedErrorMessage)
+
+// backupTablePattern SQL文が操作するテーブル名を取り出すためのパターン
+var backupTablePattern = regexp.MustCompile(
+	`(?i)\b(?:TABLE(?:\s+IF\s+EXISTS)?|INTO|FROM|UPDATE|TRUNCATE)\s+(?:ONLY\s+)?((?:"[^"]+"|[A-Za-z_][\w$]*)(?:\.(?:"[^"]+"|[A-Za-z_][\w$]*))?)`)
+
+// GetBackupDir バックアップを格納するディレクトリを取得する。
+// 環境変数が設定されていない場合は、DefaultBackupDirの値を返す
+func GetBackupDir() string {
+	return getValue(BackupDir, DefaultBackupDir)
+}
+
+// GetBackupScope バックアップの範囲を取得する。
+// 不正な値が設定されている場合はエラーとDefaultBackupScopeの値を返す
+func GetBackupScope() (string, error) {
+	return parseBackupScope(getValue(BackupScope, DefaultBackupScope))
+}
+
+// parseBackupScope バックアップの範囲を解釈する
+func parseBackupScope(value string) (string, error) {
+	if value != BackupScopeDatabase && value != BackupScopeTables {
+		return DefaultBackupScope, errors.New(BackupScopeSettingFormatErrorMessage)
+	}
+	return value, nil
+}
+
+// GetBackupRetention 対象ごとに残すバックアップの数を取得する。
+// 不正な値が設定されている場合はエラーとDefaultBackupRetentionの値を返す
+func GetBackupRetention() (int, error) {
+	retention, err := strconv.Atoi(getValue(BackupRetention, strconv.Itoa(DefaultBackupRetention)))
+	if err != nil || retention < 0 {
+		return DefaultBackupRetention, errors.New(BackupRetentionSettingFormatErrorMessage)
+	}
+	return retention, nil
+}
+
+// GetPgDumpCommand pg_dumpのコマンドを取得する。
+// 環境変数が設定されていない場合は、DefaultPgDumpCommandの値を返す
+func GetPgDumpCommand() string {
+	return getValue(PgDumpCommand, DefaultPgDumpCommand)
+}
+
+// BackupConfigStruct downの前のバックアップの設定
+// Dir バックアップを格納するディレクトリ(空文字の場合はバックアップしない)
+// Scope バックアップの範囲(database/tables)
+// Retention 対象ごとに残すバックアップの数(0はすべて残す)
+// Command pg_dumpのコマンド
+type BackupConfigStruct struct {
+	Dir       func() string
+	Scope     func() (string, error)
+	Retention func() (int, error)
+	Command   func() string
+}
+
+// BackupConfig 環境変数で設定した対象(default)のバックアップの設定です
+var BackupConfig BackupConfigStruct
+
+// Enabled バックアップが設定されているかを返す
+func (config BackupConfigStruct) Enabled() bool {
+	return config.Dir != nil && config.Dir() != ""
+}
+
+// BackupInfo downの前に取得したバックアップ
+// Path バックアップのファイルのパス
+// Scope バックアップの範囲
+// Tables 範囲がtablesの場合にバックアップしたテーブル
+// SizeBytes ファイルのサイズ
+// DurationMillis 所要時間(ミリ秒)
+type BackupInfo struct {
+	Path           string   `json:"path"`
+	Scope          string   `json:"scope"`
+	Tables         []string `json:"tables,omitempty"`
+	SizeBytes      int64    `json:"sizeBytes"`
+	DurationMillis int64    `json:"durationMillis"`
+}
+
+// backupBeforeMigrate 設定されている場合に、downで実行予定のマイグレーションがある対象をバックアップする。
+// バックアップしなかった場合はnilを返す
+func backupBeforeMigrate(ctx context.Context, target *Target, dialect string, source sqlmigrate.MigrationSource,
+	direction sqlmigrate.MigrationDirection, max int) (*BackupInfo, error) {
+
+	if direction != sqlmigrate.Down || !target.Backup.Enabled() {
+		return nil, nil
+	}
+	if dialect != DialectPostgres {
+		return nil, ErrBackupUnsupported
+	}
+	scope, err := target.Backup.Scope()
+	if err != nil {
+		return nil, err
+	}
+	plans, err := planTarget(ctx, target, dialect, source, direction, max)
+	if err != nil {
+		return nil, err
+	}
+
+	tables, planned := touchedTables(plans)
+	if planned == 0 {
+		return nil, nil
+	}
+	// 操作するテーブルがわからない場合はDB全体をバックアップする
+	if scope == BackupScopeTables && len(tables) == 0 {
+		scope = BackupScopeDatabase
+	}
+	if scope == BackupScopeDatabase {
+		tables = nil
+	}
+	return runBackup(ctx, target, scope, tables)
+}
+
+// touchedTables 実行予定のマイグレーションが操作するテーブルと、実行予定の件数を返す。
+// スキーマごとに適用する対象ではスキーマで修飾したテーブル名を返す
+func touchedTables(plans []schemaPlan) ([]string, int) {
+	seen := map[string]bool{}
+	tables := []string{}
+	planned := 0
+	for _, plan := range plans {
+		planned += len(plan.planned)
+		for _, migration := range plan.planned {
+			for _, query := range migration.Queries {
+				for _, match := range backupTablePattern.FindAllStringSubmatch(query, -1) {
+					table := match[1]
+					if plan.schema != "" && !strings.Contains(table, ".") {
+						table = plan.schema + "." + table
+					}
+					if !seen[table] {
+						seen[table] = true
+						tables = append(tables, table)
+					}
+				}
+			}
+		}
+	}
+	sort.Strings(tables)
+	return tables, planned
+}
+
+// runBackup pg_dumpで対象をバックアップし、古いバックアップを削除する
+func runBackup(ctx context.Context, target *Target, scope string, tables []string) (*BackupInfo, error) {
+	logger, _ := zap.NewProduction()
+	defer logger.Sync()
+
+	_, span := Tracer().Start(ctx, "backup")
+	defer span.End()
+
+	dir := filepath.Join(target.Backup.Dir(), target.Name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		EndSpan(span, err)
+		return nil, err
+	}
+	started := time.Now()
+	path := filepath.Join(dir, started.UTC().Format("20060102T150405.000Z")+".dump")
+
+	port, err := target.Connection.Port()
+	if err != nil {
+		EndSpan(span, err)
+		return nil, err
+	}
+	args := []string{
+		"--format=custom",
+		"--file=" + path,
+		"--host=" + target.Connection.Host(),
+		"--port=" + strconv.Itoa(port),
+		"--username=" + target.Connection.User(),
+		"--dbname=" + target.Connection.DBName(),
+	}
+	for _, table := range tables {
+		args = append(args, "--table="+table)
+	}
+	command := exec.CommandContext(ctx, target.Backup.Command(), args...)
+	command.Env = append(os.Environ(), "PGPASSWORD="+target.Connection.Password())
+	if sslMode, err := target.Connection.SSLMode(); err == nil {
+		command.Env = append(command.Env, "PGSSLMODE="+sslMode)
+	}
+	var stderr bytes.Buffer
+	command.Stderr = &stderr
+	if err := command.Run(); err != nil {
+		os.Remove(path)
+		err = fmt.Errorf("backup failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+		EndSpan(span, err)
+		return nil, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		err = fmt.Errorf("backup failed: %v", err)
+		EndSpan(span, err)
+		return nil, err
+	}
+	backup := &BackupInfo{
+		Path:           path,
+		Scope:          scope,
+		Tables:         tables,
+		SizeBytes:      info.Size(),
+		DurationMillis: int64(time.Since(started) / time.Millisecond),
+	}
+	logger.Info(
+		"Backup created",
+		zap.String("target", target.Name),
+		zap.String("path", path),
+		zap.Strings("tables", tables),
+		zap.Int64("size", backup.SizeBytes))
+
+	if err := pruneBackups(target); err != nil {
+		logger.Warn(
+			"Backup pruning failed",
+			zap.String("target", target.Name),
+			zap.Error(err))
+	}
+	return backup, nil
+}
+
+// pruneBackups 対象のバックアップのうち、残す数を超えた古いものを削除する
+func pruneBackups(target *Target) error {
+	retention, err := target.Backup.Retention()
+	if err != nil || retention == 0 {
+		return err
+	}
+	paths, err := filepath.Glob(filepath.Join(target.Backup.Dir(), target.Name, "*.dump"))
+	if err != nil {
+		return err
+	}
+	// ファイル名の時刻の順に並ぶ
+	sort.Strings(paths)
+	for len(paths) > retention {
+		if err := os.Remove(paths[0]); err != nil {
+			return err
+		}
+		paths = paths[1:]
+	}
+	return nil
+}
+
+func init() {
+	BackupConfig = BackupConfigStruct{
+		Dir:       GetBackupDir,
+		Scope:     GetBackupScope,
+		Retention: GetBackupRetention,
+		Command:   GetPgDumpCommand,
+	}
+}
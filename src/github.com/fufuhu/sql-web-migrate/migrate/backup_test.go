@@ -0,0 +1,203 @@
+package migrate
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	sqlmigrate "github.com/rubenv/sql-migrate"
+)
+
+// TestGetBackupSettings バックアップの範囲と残す数の既定値と、不正な値がエラーになることを確認する。
+func TestGetBackupSettings(t *testing.T) {
+	os.Unsetenv(BackupScope)
+	os.Unsetenv(BackupRetention)
+	if scope, err := GetBackupScope(); err != nil || scope != DefaultBackupScope {
+		t.Log(scope, err)
+		t.Fail()
+	}
+	if retention, err := GetBackupRetention(); err != nil || retention != DefaultBackupRetention {
+		t.Log(retention, err)
+		t.Fail()
+	}
+
+	defer os.Unsetenv(BackupScope)
+	defer os.Unsetenv(BackupRetention)
+	os.Setenv(BackupScope, "schema")
+	os.Setenv(BackupRetention, "-1")
+	if scope, err := GetBackupScope(); err == nil || scope != DefaultBackupScope {
+		t.Log(scope, err)
+		t.Fail()
+	}
+	if retention, err := GetBackupRetention(); err == nil || retention != DefaultBackupRetention {
+		t.Log(retention, err)
+		t.Fail()
+	}
+}
+
+// TestTouchedTables 実行予定のSQL文から操作するテーブルを重複なく取り出し、
+// スキーマごとに適用する対象ではスキーマで修飾することを確認する。
+func TestTouchedTables(t *testing.T) {
+	plans := []schemaPlan{
+		{planned: []*sqlmigrate.PlannedMigration{{
+			Migration: &sqlmigrate.Migration{Id: "02-posts.sql"},
+			Queries: []string{
+				"DROP TABLE IF EXISTS posts;",
+				"ALTER TABLE ONLY public.users DROP COLUMN nickname;",
+				"DELETE FROM users WHERE id IN (SELECT user_id FROM \"Banned\");",
+			},
+		}}},
+		{schema: "tenant_a", planned: []*sqlmigrate.PlannedMigration{{
+			Migration: &sqlmigrate.Migration{Id: "01-users.sql"},
+			Queries:   []string{"TRUNCATE users;", "DROP INDEX users_name;"},
+		}}},
+	}
+
+	tables, planned := touchedTables(plans)
+	expected := []string{"\"Banned\"", "posts", "public.users", "tenant_a.users", "users"}
+	if planned != 2 || strings.Join(tables, ",") != strings.Join(expected, ",") {
+		t.Log(tables, planned)
+		t.Fail()
+	}
+}
+
+// fakePgDump 引数とPGPASSWORDを--fileに書き込むpg_dumpの代わりのスクリプトを作成する
+func fakePgDump(t *testing.T, dir string) string {
+	path := filepath.Join(dir, "pg_dump")
+	script := "#!/bin/sh\n" +
+		"for arg in \"$@\"; do case \"$arg\" in --file=*) file=\"${arg#--file=}\";; esac; done\n" +
+		"echo \"$@ $PGPASSWORD\" > \"$file\"\n"
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// TestRunBackup pg_dumpに接続先とテーブルを渡してバックアップを作成し、
+// 残す数を超えた古いバックアップを削除することを確認する。
+func TestRunBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	command := fakePgDump(t, dir)
+	target := &Target{
+		Name: "prod",
+		Connection: DBConnectionConfig{
+			Host:     func() string { return "db.example.com" },
+			Port:     func() (int, error) { return 5432, nil },
+			User:     func() string { return "postgres" },
+			Password: func() string { return "secret" },
+			DBName:   func() string { return "app" },
+			SSLMode:  func() (string, error) { return "require", nil },
+		},
+		Backup: BackupConfigStruct{
+			Dir:       func() string { return filepath.Join(dir, "backups") },
+			Scope:     func() (string, error) { return BackupScopeTables, nil },
+			Retention: func() (int, error) { return 2, nil },
+			Command:   func() string { return command },
+		},
+	}
+
+	var backups []*BackupInfo
+	for i := 0; i < 3; i++ {
+		backup, err := runBackup(context.Background(), target, BackupScopeTables, []string{"posts", "users"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		backups = append(backups, backup)
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	content, err := ioutil.ReadFile(backups[2].Path)
+	for _, expected := range []string{"--format=custom", "--host=db.example.com", "--port=5432", "--username=postgres",
+		"--dbname=app", "--table=posts", "--table=users", "secret"} {
+		if err != nil || !strings.Contains(string(content), expected) {
+			t.Log(expected, string(content), err)
+			t.Fail()
+		}
+	}
+	if backups[2].SizeBytes != int64(len(content)) || filepath.Dir(backups[2].Path) != filepath.Join(dir, "backups", "prod") {
+		t.Log(backups[2])
+		t.Fail()
+	}
+
+	// 残す数を超えた一番古いバックアップは削除される
+	if _, err := os.Stat(backups[0].Path); !os.IsNotExist(err) {
+		t.Log(err)
+		t.Fail()
+	}
+	if _, err := os.Stat(backups[1].Path); err != nil {
+		t.Log(err)
+		t.Fail()
+	}
+}
+
+// TestRunBackupFailure pg_dumpが失敗した場合は、標準エラー出力を含むエラーを返して
+// 途中のファイルを残さないことを確認する。
+func TestRunBackupFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	command := filepath.Join(dir, "pg_dump")
+	ioutil.WriteFile(command, []byte("#!/bin/sh\necho 'connection refused' >&2\nexit 1\n"), 0755)
+	target := &Target{
+		Name: "prod",
+		Connection: DBConnectionConfig{
+			Host:     func() string { return "127.0.0.1" },
+			Port:     func() (int, error) { return 1, nil },
+			User:     func() string { return "postgres" },
+			Password: func() string { return "" },
+			DBName:   func() string { return "app" },
+			SSLMode:  func() (string, error) { return "disable", nil },
+		},
+		Backup: BackupConfigStruct{
+			Dir:       func() string { return dir },
+			Scope:     func() (string, error) { return BackupScopeDatabase, nil },
+			Retention: func() (int, error) { return 0, nil },
+			Command:   func() string { return command },
+		},
+	}
+
+	if _, err := runBackup(context.Background(), target, BackupScopeDatabase, nil); err == nil ||
+		!strings.Contains(err.Error(), "connection refused") {
+		t.Log(err)
+		t.Fail()
+	}
+	if paths, _ := filepath.Glob(filepath.Join(dir, "prod", "*.dump")); len(paths) != 0 {
+		t.Log(paths)
+		t.Fail()
+	}
+}
+
+// TestHandlerBackupUnsupported PostgreSQL以外の対象でバックアップが設定されている場合は、
+// downを実行せずに失敗することを確認する。
+func TestHandlerBackupUnsupported(t *testing.T) {
+	targets, cleanup := setupSQLiteTargets(t, nil)
+	defer cleanup()
+	target, _ := targets.Get("local")
+	mux := NewServeMux(targets)
+
+	if w := serve(mux, http.MethodPost, "/targets/local/migrate/up", nil); w.Code != http.StatusOK {
+		t.Fatal(w.Body.String())
+	}
+	target.Backup = BackupConfigStruct{Dir: func() string { return os.TempDir() }}
+
+	w := serveConfirmed(t, mux, "/targets/local/migrate/down?steps=1")
+	var result MigrationResult
+	decode(t, w, &result)
+	if w.Code != http.StatusInternalServerError || result.Error != BackupUnsupportedErrorMessage || len(result.Applied) != 0 {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+}
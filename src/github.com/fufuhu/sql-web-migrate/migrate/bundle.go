@@ -0,0 +1,528 @@
+package migrate
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	sqlmigrate "github.com/rubenv/sql-migrate"
+	"go.uber.org/zap"
+)
+
+const (
+	// BundleDir アップロードしたバンドルを格納するディレクトリパスを指定するための環境変数
+	BundleDir = "SQL_MIGRATE_BUNDLE_DIR"
+	// BundleKeep 対象ごとに保持するバンドルの数を指定するための環境変数
+	BundleKeep = "SQL_MIGRATE_BUNDLE_KEEP"
+)
+
+const (
+	// DefaultBundleDir デフォルトのバンドルを格納するディレクトリパス
+	DefaultBundleDir = "/var/lib/sql-web-migrate/bundles"
+	// DefaultBundleKeep デフォルトの保持するバンドルの数
+	DefaultBundleKeep = 5
+	// MaxBundleSize アップロードできるバンドルの最大サイズ(バイト)
+	MaxBundleSize = 32 << 20
+	// maxBundleExtractedSize 展開後のバンドルの最大サイズ(バイト)
+	maxBundleExtractedSize = 4 * MaxBundleSize
+)
+
+const (
+	// BundleManifestFile バンドルに含めるマニフェストのファイル名
+	BundleManifestFile = "manifest.json"
+	// bundleInfoFile 格納したバンドルの情報を書き込むファイル名
+	bundleInfoFile = "bundle.json"
+	// activeBundleFile 有効なバンドルのバージョンを書き込むファイル名
+	activeBundleFile = ".active"
+)
+
+const (
+	// BundleKeepSettingFormatErrorMessage 保持するバンドルの数の設定値が不正な場合のエラーメッセージです
+	BundleKeepSettingFormatErrorMessage = "Bundle keep should be a positive integer"
+	// BundleExistsErrorMessage 同じバージョンのバンドルが格納済みの場合のエラーメッセージです
+	BundleExistsErrorMessage = "A bundle with this version has already been uploaded"
+	// BundleNotFoundErrorMessage 指定したバージョンのバンドルが格納されていない場合のエラーメッセージです
+	BundleNotFoundErrorMessage = "No bundle with this version has been uploaded"
+	// NoActiveBundleErrorMessage 有効なバンドルがない場合のエラーメッセージです
+	NoActiveBundleErrorMessage = "No bundle has been uploaded for this target"
+	// NotBundleSourceErrorMessage バンドルを使わない対象にアップロードした場合のエラーメッセージです
+	NotBundleSourceErrorMessage = "This target does not use the bundle source"
+)
+
+var (
+	// ErrBundleExists 同じバージョンのバンドルが格納済みであることを表すエラー
+	ErrBundleExists = errors.New(BundleExistsErrorMessage)
+	// ErrBundleNotFound 指定したバージョンのバンドルが格納されていないことを表すエラー
+	ErrBundleNotFound = errors.New(BundleNotFoundErrorMessage)
+	// ErrNotBundleSource バンドルを使わない対象であることを表すエラー
+	ErrNotBundleSource = errors.New(NotBundleSourceErrorMessage)
+)
+
+// BundleError バンドルの内容が不正であることを表すエラー
+type BundleError struct {
+	Message string
+}
+
+func (e *BundleError) Error() string {
+	return "invalid bundle: " + e.Message
+}
+
+// bundleErrorf 書式を指定してBundleErrorを生成する
+func bundleErrorf(format string, args ...interface{}) error {
+	return &BundleError{Message: fmt.Sprintf(format, args...)}
+}
+
+// bundleVersionPattern バンドルのバージョンとして使える文字列(ディレクトリ名になる)
+var bundleVersionPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// GetBundleDir バンドルを格納するディレクトリパスを取得する。
+// 環境変数が設定されていない場合は、DefaultBundleDirの値を返す
+func GetBundleDir() string {
+	return getValue(BundleDir, DefaultBundleDir)
+}
+
+// GetBundleKeep 対象ごとに保持するバンドルの数を取得する。
+// 環境変数が設定されていない場合は、DefaultBundleKeepの値を返す。
+// 不正な値(正の整数以外)が設定されている場合はエラーとDefaultBundleKeepの値を返す
+func GetBundleKeep() (int, error) {
+	keep, err := strconv.Atoi(getValue(BundleKeep, strconv.Itoa(DefaultBundleKeep)))
+	if err != nil || keep < 1 {
+		return DefaultBundleKeep, errors.New(BundleKeepSettingFormatErrorMessage)
+	}
+	return keep, nil
+}
+
+// BundleConfigStruct バンドルの格納の設定
+// Dir バンドルを格納するディレクトリパス
+// Keep 対象ごとに保持するバンドルの数
+type BundleConfigStruct struct {
+	Dir  func() string
+	Keep func() (int, error)
+}
+
+// BundleConfig バンドルの格納の設定です
+var BundleConfig BundleConfigStruct
+
+// BundleManifest バンドルに含めるマニフェスト
+// Version バンドルのバージョン
+// Files マイグレーションのファイル名とSHA-256(16進数)の対応
+type BundleManifest struct {
+	Version string            `json:"version"`
+	Files   map[string]string `json:"files"`
+}
+
+// BundleInfo 格納したバンドルの情報
+// Version バンドルのバージョン
+// Checksum アップロードされたバンドル全体のSHA-256(16進数)
+// Migrations バンドルに含まれるマイグレーションのID
+// UploadedAt アップロードした日時
+// UploadedBy アップロードした利用者名
+// Active 対象のソースとして有効なバンドルかどうか
+type BundleInfo struct {
+	Version    string    `json:"version"`
+	Checksum   string    `json:"checksum"`
+	Migrations []string  `json:"migrations"`
+	UploadedAt time.Time `json:"uploadedAt"`
+	UploadedBy string    `json:"uploadedBy"`
+	Active     bool      `json:"active"`
+}
+
+// bundleDir 対象のバンドルを格納するディレクトリパスを返す
+func (target *Target) bundleDir() string {
+	if target.BundleDir != "" {
+		return target.BundleDir
+	}
+	return filepath.Join(BundleConfig.Dir(), target.Name)
+}
+
+// activeBundle 対象の有効なバンドルのバージョンを返す
+func (target *Target) activeBundle() (string, error) {
+	content, err := ioutil.ReadFile(filepath.Join(target.bundleDir(), activeBundleFile))
+	if os.IsNotExist(err) {
+		return "", errors.New(NoActiveBundleErrorMessage)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// usesBundles 対象がバンドルをソースとして使うかを返す
+func (target *Target) usesBundles() bool {
+	if target.SourceKind == nil {
+		return false
+	}
+	kind, err := target.SourceKind()
+	return err == nil && kind == SourceBundle
+}
+
+// ChecksumBundle バンドル全体のSHA-256を16進数で返す
+func ChecksumBundle(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// readBundle tar.gzまたはzipのバンドルを展開し、ファイル名と内容の対応を返す。
+// ディレクトリを含むファイル名は受け付けない
+func readBundle(data []byte) (map[string][]byte, error) {
+	files := map[string][]byte{}
+	var total int64
+
+	add := func(name string, r io.Reader) error {
+		name = path.Clean(name)
+		if strings.Contains(name, "/") || strings.HasPrefix(name, ".") {
+			return bundleErrorf("unexpected file %s (files must be at the top level)", name)
+		}
+		if _, ok := files[name]; ok {
+			return bundleErrorf("duplicate file %s", name)
+		}
+		content, err := ioutil.ReadAll(io.LimitReader(r, maxBundleExtractedSize-total+1))
+		if err != nil {
+			return bundleErrorf("%s: %v", name, err)
+		}
+		total += int64(len(content))
+		if total > maxBundleExtractedSize {
+			return bundleErrorf("extracted size exceeds %d bytes", maxBundleExtractedSize)
+		}
+		files[name] = content
+		return nil
+	}
+
+	switch {
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")):
+		archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, bundleErrorf("%v", err)
+		}
+		for _, file := range archive.File {
+			if file.FileInfo().IsDir() {
+				continue
+			}
+			r, err := file.Open()
+			if err != nil {
+				return nil, bundleErrorf("%s: %v", file.Name, err)
+			}
+			err = add(file.Name, r)
+			r.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, bundleErrorf("%v", err)
+		}
+		archive := tar.NewReader(gz)
+		for {
+			header, err := archive.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, bundleErrorf("%v", err)
+			}
+			switch header.Typeflag {
+			case tar.TypeDir:
+				continue
+			case tar.TypeReg:
+			default:
+				return nil, bundleErrorf("unexpected entry %s (only regular files are allowed)", header.Name)
+			}
+			if err := add(header.Name, archive); err != nil {
+				return nil, err
+			}
+		}
+
+	default:
+		return nil, bundleErrorf("bundle should be a tar.gz or zip archive")
+	}
+	return files, nil
+}
+
+// validateBundle バンドルのマニフェストを読み、すべてのファイルのチェックサムが一致し
+// sql-migrateのマイグレーションとして解釈できることを確認する。
+// 公開鍵が設定されている場合はマニフェストの署名も検証する。
+// バンドルに含まれるマイグレーションのIDを実行順で返す
+func validateBundle(files map[string][]byte) (manifest BundleManifest, migrations []string, err error) {
+	content, ok := files[BundleManifestFile]
+	if !ok {
+		return manifest, nil, bundleErrorf("%s is missing", BundleManifestFile)
+	}
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return manifest, nil, bundleErrorf("%s: %v", BundleManifestFile, err)
+	}
+	if !bundleVersionPattern.MatchString(manifest.Version) {
+		return manifest, nil, bundleErrorf("invalid version %q", manifest.Version)
+	}
+	if len(manifest.Files) == 0 {
+		return manifest, nil, bundleErrorf("%s lists no files", BundleManifestFile)
+	}
+
+	// 公開鍵が設定されている場合は、リリースのパイプラインで署名されたバンドルだけを受け付ける
+	keys, err := SignatureConfig.TrustedKeys()
+	if err != nil {
+		return manifest, nil, err
+	}
+	if len(keys) > 0 {
+		signature, ok := files[ManifestSignatureFile]
+		if !ok {
+			return manifest, nil, bundleErrorf("%s is missing", ManifestSignatureFile)
+		}
+		if _, err := VerifyManifestSignature(content, signature, keys); err != nil {
+			return manifest, nil, bundleErrorf("%v", err)
+		}
+	}
+
+	migrationFiles := map[string][]byte{}
+	for name, content := range files {
+		if name != BundleManifestFile && name != ManifestSignatureFile {
+			migrationFiles[name] = content
+		}
+	}
+	if err := verifyManifestFiles(manifest, migrationFiles); err != nil {
+		return manifest, nil, bundleErrorf("%v", err)
+	}
+
+	parsed := []*sqlmigrate.Migration{}
+	for name := range manifest.Files {
+		if !strings.HasSuffix(name, ".sql") {
+			return manifest, nil, bundleErrorf("%s is not a .sql file", name)
+		}
+		migration, err := sqlmigrate.ParseMigration(name, bytes.NewReader(files[name]))
+		if err != nil {
+			return manifest, nil, bundleErrorf("%s: %v", name, err)
+		}
+		parsed = append(parsed, migration)
+	}
+
+	sort.Slice(parsed, func(i, j int) bool { return parsed[i].Less(parsed[j]) })
+	for _, migration := range parsed {
+		migrations = append(migrations, migration.Id)
+	}
+	return manifest, migrations, nil
+}
+
+// StoreBundle バンドルを検証して対象のバージョンごとのディレクトリに格納し、有効なバンドルにする。
+// 格納は一時ディレクトリに書き込んでからリネームするため、途中で失敗しても不完全なバンドルは残らない。
+// 保持する数を超えた古いバンドルは削除するが、適用に失敗した場合に戻せるように直前に有効だったバンドルは残す。
+// 呼び出し元で対象の実行権(TryLock)を取得しておくこと
+func StoreBundle(target *Target, data []byte, uploader string) (BundleInfo, error) {
+
+	logger, _ := zap.NewProduction()
+	defer logger.Sync()
+
+	if !target.usesBundles() {
+		return BundleInfo{}, ErrNotBundleSource
+	}
+
+	files, err := readBundle(data)
+	if err != nil {
+		return BundleInfo{}, err
+	}
+	manifest, migrations, err := validateBundle(files)
+	if err != nil {
+		return BundleInfo{}, err
+	}
+
+	info := BundleInfo{
+		Version:    manifest.Version,
+		Checksum:   ChecksumBundle(data),
+		Migrations: migrations,
+		UploadedAt: time.Now().UTC(),
+		UploadedBy: uploader,
+	}
+
+	dir := target.bundleDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return info, err
+	}
+	versionDir := filepath.Join(dir, manifest.Version)
+	if _, err := os.Stat(versionDir); err == nil {
+		return info, ErrBundleExists
+	}
+
+	tmp, err := ioutil.TempDir(dir, ".upload-")
+	if err != nil {
+		return info, err
+	}
+	defer os.RemoveAll(tmp)
+
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(tmp, name), content, 0644); err != nil {
+			return info, err
+		}
+	}
+	encoded, _ := json.MarshalIndent(info, "", "  ")
+	if err := ioutil.WriteFile(filepath.Join(tmp, bundleInfoFile), encoded, 0644); err != nil {
+		return info, err
+	}
+	if err := os.Rename(tmp, versionDir); err != nil {
+		return info, err
+	}
+
+	previous, _ := target.activeBundle()
+	if err := activateBundle(target, manifest.Version); err != nil {
+		return info, err
+	}
+	info.Active = true
+
+	logger.Info(
+		"Bundle stored",
+		zap.String("target", target.Name),
+		zap.String("version", info.Version),
+		zap.String("checksum", info.Checksum),
+		zap.String("uploadedBy", uploader))
+
+	if err := pruneBundles(target, previous); err != nil {
+		logger.Warn(
+			"Bundle pruning failed",
+			zap.String("target", target.Name),
+			zap.Error(err))
+	}
+	return info, nil
+}
+
+// ActivateBundle 格納済みのバンドルを対象の有効なバンドルにする。
+// 以前のバンドルに戻す場合に使う。
+// 呼び出し元で対象の実行権(TryLock)を取得しておくこと
+func ActivateBundle(target *Target, version string) (BundleInfo, error) {
+	if !target.usesBundles() {
+		return BundleInfo{}, ErrNotBundleSource
+	}
+	info, err := readBundleInfo(target, version)
+	if err != nil {
+		return info, err
+	}
+	if err := activateBundle(target, version); err != nil {
+		return info, err
+	}
+	info.Active = true
+	return info, nil
+}
+
+// restoreBundle 有効なバンドルをpreviousに戻す。previousが空の場合は有効なバンドルをなくす。
+// アップロードしたバンドルの適用に失敗した場合に、以前のソースに戻すために使う
+func restoreBundle(target *Target, previous string) error {
+	if previous == "" {
+		err := os.Remove(filepath.Join(target.bundleDir(), activeBundleFile))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return activateBundle(target, previous)
+}
+
+// activateBundle 有効なバンドルのバージョンを書き換える。
+// 一時ファイルに書き込んでからリネームするため、読み込む側が書きかけの内容を読むことはない
+func activateBundle(target *Target, version string) error {
+	dir := target.bundleDir()
+	file, err := ioutil.TempFile(dir, activeBundleFile+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString(version + "\n")
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), filepath.Join(dir, activeBundleFile))
+}
+
+// readBundleInfo 格納したバンドルの情報を読み込む
+func readBundleInfo(target *Target, version string) (BundleInfo, error) {
+	var info BundleInfo
+	if !bundleVersionPattern.MatchString(version) {
+		return info, ErrBundleNotFound
+	}
+	content, err := ioutil.ReadFile(filepath.Join(target.bundleDir(), version, bundleInfoFile))
+	if os.IsNotExist(err) {
+		return info, ErrBundleNotFound
+	}
+	if err != nil {
+		return info, err
+	}
+	err = json.Unmarshal(content, &info)
+	return info, err
+}
+
+// ListBundles 対象に格納されているバンドルを新しい順に返す
+func ListBundles(target *Target) ([]BundleInfo, error) {
+	if !target.usesBundles() {
+		return nil, ErrNotBundleSource
+	}
+
+	bundles := []BundleInfo{}
+	entries, err := ioutil.ReadDir(target.bundleDir())
+	if os.IsNotExist(err) {
+		return bundles, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	active, _ := target.activeBundle()
+	for _, entry := range entries {
+		if !entry.IsDir() || !bundleVersionPattern.MatchString(entry.Name()) {
+			continue
+		}
+		info, err := readBundleInfo(target, entry.Name())
+		if err != nil {
+			continue
+		}
+		info.Active = info.Version == active
+		bundles = append(bundles, info)
+	}
+	sort.Slice(bundles, func(i, j int) bool { return bundles[i].UploadedAt.After(bundles[j].UploadedAt) })
+	return bundles, nil
+}
+
+// pruneBundles 保持する数を超えた古いバンドルを削除する。有効なバンドルとpreviousのバンドルは削除しない
+func pruneBundles(target *Target, previous string) error {
+	keep, err := BundleConfig.Keep()
+	if err != nil {
+		return err
+	}
+	bundles, err := ListBundles(target)
+	if err != nil {
+		return err
+	}
+	for i, bundle := range bundles {
+		if i < keep || bundle.Active || bundle.Version == previous {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(target.bundleDir(), bundle.Version)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func init() {
+	BundleConfig = BundleConfigStruct{
+		Dir:  GetBundleDir,
+		Keep: GetBundleKeep,
+	}
+}
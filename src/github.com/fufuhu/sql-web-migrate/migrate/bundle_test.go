@@ -0,0 +1,361 @@
+package migrate
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// manifestFor ファイルのチェックサムを記載したマニフェストを生成する
+func manifestFor(version string, files map[string]string) string {
+	manifest := BundleManifest{Version: version, Files: map[string]string{}}
+	for name, content := range files {
+		manifest.Files[name] = ChecksumBundle([]byte(content))
+	}
+	bytes, _ := json.Marshal(manifest)
+	return string(bytes)
+}
+
+// makeTarGz ファイル名と内容からtar.gzのバンドルを作成する
+func makeTarGz(t *testing.T, files map[string]string) []byte {
+	var buffer bytes.Buffer
+	gz := gzip.NewWriter(&buffer)
+	archive := tar.NewWriter(gz)
+	for name, content := range files {
+		header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		if err := archive.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		archive.Write([]byte(content))
+	}
+	archive.Close()
+	gz.Close()
+	return buffer.Bytes()
+}
+
+// makeZip ファイル名と内容からzipのバンドルを作成する
+func makeZip(t *testing.T, files map[string]string) []byte {
+	var buffer bytes.Buffer
+	archive := zip.NewWriter(&buffer)
+	for name, content := range files {
+		writer, err := archive.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer.Write([]byte(content))
+	}
+	archive.Close()
+	return buffer.Bytes()
+}
+
+// bundleFiles マイグレーションにマニフェストを加えたバンドルの中身を返す
+func bundleFiles(version string, migrations map[string]string) map[string]string {
+	files := map[string]string{BundleManifestFile: manifestFor(version, migrations)}
+	for name, content := range migrations {
+		files[name] = content
+	}
+	return files
+}
+
+// TestValidateBundle 正しいバンドルからマイグレーションのIDが実行順で返ることを確認する。
+func TestValidateBundle(t *testing.T) {
+	for _, data := range [][]byte{
+		makeTarGz(t, bundleFiles("v1", testMigrations)),
+		makeZip(t, bundleFiles("v1", testMigrations)),
+	} {
+		files, err := readBundle(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifest, migrations, err := validateBundle(files)
+		if err != nil || manifest.Version != "v1" || len(migrations) != 2 ||
+			migrations[0] != "01-users.sql" || migrations[1] != "02-posts.sql" {
+			t.Log(manifest, migrations, err)
+			t.Fail()
+		}
+	}
+}
+
+// TestValidateBundleInvalid マニフェストがない、チェックサムが一致しない、
+// マニフェストにないファイルがある、マイグレーションとして解釈できないバンドルがエラーになることを確認する。
+func TestValidateBundleInvalid(t *testing.T) {
+	migration := "-- +migrate Up\nCREATE TABLE a (id integer);\n"
+	mismatch := bundleFiles("v1", map[string]string{"01-a.sql": migration})
+	mismatch["01-a.sql"] = migration + "DROP TABLE a;\n"
+	unlisted := bundleFiles("v1", map[string]string{"01-a.sql": migration})
+	unlisted["02-b.sql"] = migration
+
+	for name, files := range map[string]map[string]string{
+		"no manifest":    {"01-a.sql": migration},
+		"mismatch":       mismatch,
+		"unlisted":       unlisted,
+		"not migration":  bundleFiles("v1", map[string]string{"01-a.sql": "CREATE TABLE a (id integer);\n"}),
+		"not sql":        bundleFiles("v1", map[string]string{"README.md": "-- +migrate Up\n"}),
+		"bad version":    bundleFiles("../v1", map[string]string{"01-a.sql": migration}),
+		"nested file":    {BundleManifestFile: manifestFor("v1", nil), "sub/01-a.sql": migration},
+		"hidden file":    {BundleManifestFile: manifestFor("v1", nil), ".active": "v0"},
+		"empty manifest": {BundleManifestFile: manifestFor("v1", nil)},
+	} {
+		files, err := readBundle(makeTarGz(t, files))
+		if err == nil {
+			_, _, err = validateBundle(files)
+		}
+		if _, ok := err.(*BundleError); !ok {
+			t.Log(name, err)
+			t.Fail()
+		}
+	}
+
+	if _, err := readBundle([]byte("plain text")); err == nil {
+		t.Fail()
+	}
+}
+
+// setupBundleTarget バンドルをソースとするSQLiteの対象と、トークンを設定したServeMuxを返す
+func setupBundleTarget(t *testing.T) (*Targets, *http.ServeMux, func()) {
+	dir, err := ioutil.TempDir("", "bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bytes, _ := json.Marshal(map[string]interface{}{
+		"targets": []map[string]interface{}{{
+			"name":            "local",
+			"dialect":         DialectSQLite,
+			"dbname":          filepath.Join(dir, "local.db"),
+			"source":          SourceBundle,
+			"bundleDir":       filepath.Join(dir, "bundles"),
+			"allowedNetworks": []string{"192.0.2.0/24"},
+		}},
+	})
+	path := writeTargetsFile(t, string(bytes))
+	defer os.Remove(path)
+
+	targets, err := LoadTargets(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(APITokens, "deploy:secret")
+	return targets, NewServeMux(targets), func() {
+		os.Unsetenv(APITokens)
+		os.RemoveAll(dir)
+	}
+}
+
+// upload バンドルをアップロードする
+func upload(mux *http.ServeMux, path string, data []byte, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(data))
+	r.Header.Set("Authorization", "Bearer secret")
+	for key, values := range header {
+		r.Header[key] = values
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+// TestHandlerBundleUpload バンドルをアップロードして適用し、
+// 新しいバンドルの格納、以前のバンドルへの切り替え、同じバージョンの拒否ができることを確認する。
+func TestHandlerBundleUpload(t *testing.T) {
+	_, mux, cleanup := setupBundleTarget(t)
+	defer cleanup()
+	auth := http.Header{"Authorization": {"Bearer secret"}}
+
+	if w := serve(mux, http.MethodGet, "/targets/local/migrate/status", auth); w.Code != http.StatusInternalServerError ||
+		!strings.Contains(w.Body.String(), NoActiveBundleErrorMessage) {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+
+	v1 := makeTarGz(t, bundleFiles("v1", testMigrations))
+	w := upload(mux, "/targets/local/bundles?apply=true", v1, http.Header{BundleChecksumHeader: {ChecksumBundle(v1)}})
+	var result BundleUpload
+	decode(t, w, &result)
+	if w.Code != http.StatusCreated || !result.Bundle.Active || result.Bundle.UploadedBy != "deploy" ||
+		result.Result == nil || len(result.Result.Applied) != 2 {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+
+	migrations := map[string]string{"03-tags.sql": "-- +migrate Up\nCREATE TABLE tags (id integer);\n-- +migrate Down\nDROP TABLE tags;\n"}
+	for name, content := range testMigrations {
+		migrations[name] = content
+	}
+	w = upload(mux, "/targets/local/bundles", makeZip(t, bundleFiles("v2", migrations)), nil)
+	result = BundleUpload{}
+	decode(t, w, &result)
+	if w.Code != http.StatusCreated || result.Result != nil || len(result.Bundle.Migrations) != 3 {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+
+	w = serve(mux, http.MethodGet, "/targets/local/migrate/status", auth)
+	var statuses []MigrationStatus
+	decode(t, w, &statuses)
+	if len(statuses) != 3 || statuses[2].Applied || !strings.HasSuffix(w.Header().Get(MigrationSourceHeader), "v2") {
+		t.Log(w.Header(), w.Body.String())
+		t.Fail()
+	}
+
+	w = upload(mux, "/targets/local/bundles/v1/activate", nil, nil)
+	if w.Code != http.StatusOK {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+	w = serve(mux, http.MethodGet, "/targets/local/bundles", auth)
+	var bundles []BundleInfo
+	decode(t, w, &bundles)
+	if len(bundles) != 2 || bundles[0].Version != "v2" || bundles[0].Active || !bundles[1].Active {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+
+	if w := upload(mux, "/targets/local/bundles", v1, nil); w.Code != http.StatusConflict {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+	if w := upload(mux, "/targets/local/bundles/v9/activate", nil, nil); w.Code != http.StatusNotFound {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+}
+
+// TestHandlerBundleUploadAudit アップロードしたバンドルの適用が、
+// 利用者と適用したマイグレーションとともに監査記録に残ることを確認する。
+func TestHandlerBundleUploadAudit(t *testing.T) {
+	_, mux, cleanup := setupBundleTarget(t)
+	defer cleanup()
+	file, err := ioutil.TempFile("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+	os.Setenv(AuditLog, file.Name())
+	defer os.Unsetenv(AuditLog)
+
+	if w := upload(mux, "/targets/local/bundles?apply=true", makeTarGz(t, bundleFiles("v1", testMigrations)), nil); w.Code != http.StatusCreated {
+		t.Fatal(w.Code, w.Body.String())
+	}
+
+	events := readAuditEvents(t, file.Name())
+	if len(events) != 1 || events[0].Action != AuditMigrationRun || events[0].Identity != "deploy" ||
+		events[0].Direction != "up" || !events[0].Success || events[0].Detail != "bundle v1: 01-users.sql,02-posts.sql" {
+		t.Log(events)
+		t.Fail()
+	}
+}
+
+// TestHandlerBundleUploadApplyFailure 適用に失敗したバンドルは有効にならず、
+// アップロード前に有効だったバンドルのままになることを確認する。
+func TestHandlerBundleUploadApplyFailure(t *testing.T) {
+	targets, mux, cleanup := setupBundleTarget(t)
+	defer cleanup()
+	target, _ := targets.Get("local")
+
+	// 有効なバンドルがない状態で失敗した場合は、有効なバンドルがないままになる
+	broken := map[string]string{"01-broken.sql": "-- +migrate Up\nCREATE TABLE broken (;\n-- +migrate Down\nDROP TABLE broken;\n"}
+	w := upload(mux, "/targets/local/bundles?apply=true", makeTarGz(t, bundleFiles("v0", broken)), nil)
+	var result BundleUpload
+	decode(t, w, &result)
+	if w.Code != http.StatusInternalServerError || result.Bundle.Active || result.Result == nil || result.Result.Success {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+	if active, err := target.activeBundle(); err == nil {
+		t.Log(active)
+		t.Fail()
+	}
+
+	if w := upload(mux, "/targets/local/bundles?apply=true", makeTarGz(t, bundleFiles("v1", testMigrations)), nil); w.Code != http.StatusCreated {
+		t.Fatal(w.Code, w.Body.String())
+	}
+
+	// 適用済みのテーブルを作り直そうとするバンドルは適用に失敗する
+	migrations := map[string]string{"03-users.sql": "-- +migrate Up\nCREATE TABLE users (id integer);\n-- +migrate Down\nDROP TABLE users;\n"}
+	for name, content := range testMigrations {
+		migrations[name] = content
+	}
+	w = upload(mux, "/targets/local/bundles?apply=true", makeTarGz(t, bundleFiles("v2", migrations)), nil)
+	result = BundleUpload{}
+	decode(t, w, &result)
+	if w.Code != http.StatusInternalServerError || result.Bundle.Active || result.Result == nil || result.Result.Success {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+
+	bundles, err := ListBundles(target)
+	if err != nil || len(bundles) != 3 || bundles[0].Version != "v2" || bundles[0].Active || !bundles[1].Active {
+		t.Log(bundles, err)
+		t.Fail()
+	}
+	w = serve(mux, http.MethodGet, "/targets/local/migrate/status", http.Header{"Authorization": {"Bearer secret"}})
+	if !strings.HasSuffix(w.Header().Get(MigrationSourceHeader), "v1") {
+		t.Log(w.Header(), w.Body.String())
+		t.Fail()
+	}
+}
+
+// TestHandlerBundleUploadRejected 不正なバンドル、チェックサムの不一致、
+// 認証情報のないアップロードが拒否され、何も格納されないことを確認する。
+func TestHandlerBundleUploadRejected(t *testing.T) {
+	targets, mux, cleanup := setupBundleTarget(t)
+	defer cleanup()
+
+	broken := bundleFiles("v1", testMigrations)
+	broken["01-users.sql"] = "tampered"
+	if w := upload(mux, "/targets/local/bundles", makeTarGz(t, broken), nil); w.Code != http.StatusBadRequest {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+
+	v1 := makeTarGz(t, bundleFiles("v1", testMigrations))
+	if w := upload(mux, "/targets/local/bundles", v1, http.Header{BundleChecksumHeader: {"0000"}}); w.Code != http.StatusBadRequest {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+
+	// トークンが設定されていない場合は接続元のアドレスだけでは受け付けない
+	os.Unsetenv(APITokens)
+	if w := upload(mux, "/targets/local/bundles", v1, nil); w.Code != http.StatusUnauthorized ||
+		!strings.Contains(w.Body.String(), CredentialsRequiredErrorMessage) {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+
+	target, _ := targets.Get("local")
+	if bundles, err := ListBundles(target); err != nil || len(bundles) != 0 {
+		t.Log(bundles, err)
+		t.Fail()
+	}
+}
+
+// TestPruneBundles 保持する数を超えた古いバンドルが削除され、有効なバンドルは残ることを確認する。
+func TestPruneBundles(t *testing.T) {
+	targets, _, cleanup := setupBundleTarget(t)
+	defer cleanup()
+	target, _ := targets.Get("local")
+
+	os.Setenv(BundleKeep, "2")
+	defer os.Unsetenv(BundleKeep)
+
+	for _, version := range []string{"v1", "v2", "v3"} {
+		if _, err := StoreBundle(target, makeTarGz(t, bundleFiles(version, testMigrations)), "deploy"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bundles, err := ListBundles(target)
+	if err != nil || len(bundles) != 2 || bundles[0].Version != "v3" || !bundles[0].Active || bundles[1].Version != "v2" {
+		t.Log(bundles, err)
+		t.Fail()
+	}
+}
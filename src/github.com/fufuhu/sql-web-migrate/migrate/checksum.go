@@ -0,0 +1,350 @@
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+	sqlmigrate "github.com/rubenv/sql-migrate"
+	"go.uber.org/zap"
+)
+
+const (
+	// DriftCheck 適用済みのマイグレーションの変更を検知した際の方針(off/warn/block)を指定するための環境変数
+	DriftCheck = "SQL_MIGRATE_DRIFT_CHECK"
+)
+
+const (
+	// DriftCheckOff チェックサムを記録せず、変更も検知しない
+	DriftCheckOff = "off"
+	// DriftCheckWarn 変更を検知した場合は警告をログに出力する
+	DriftCheckWarn = "warn"
+	// DriftCheckBlock 変更を検知した場合はマイグレーションを実行しない
+	DriftCheckBlock = "block"
+	// DefaultDriftCheck デフォルトの変更を検知した際の方針
+	DefaultDriftCheck = DriftCheckWarn
+)
+
+const (
+	// ChecksumOK 適用時と内容が一致している
+	ChecksumOK = "ok"
+	// ChecksumChanged 適用後に内容が変更されている
+	ChecksumChanged = "changed"
+	// ChecksumMissing 適用済みだがソースにない
+	ChecksumMissing = "missing"
+	// ChecksumUnrecorded 適用時のチェックサムが記録されていない(チェックサムの記録を始める前に適用した)
+	ChecksumUnrecorded = "unrecorded"
+)
+
+const (
+	// DriftCheckSettingFormatErrorMessage 変更を検知した際の方針の設定値が不正な場合のエラーメッセージです
+	DriftCheckSettingFormatErrorMessage = "Drift check should be off, warn or block"
+)
+
+// checksumTableSuffix チェックサムを記録するテーブル名の、適用記録のテーブル名に続く部分
+const checksumTableSuffix = "_checksums"
+
+// GetDriftCheck 適用済みのマイグレーションの変更を検知した際の方針を取得する。
+// 環境変数が設定されていない場合は、DefaultDriftCheckの値を返す。
+// 不正な値(off/warn/block以外)が設定されている場合はエラーとDefaultDriftCheckの値を返す
+func GetDriftCheck() (string, error) {
+	value := getValue(DriftCheck, DefaultDriftCheck)
+	if value != DriftCheckOff && value != DriftCheckWarn && value != DriftCheckBlock {
+		return DefaultDriftCheck, errors.New(DriftCheckSettingFormatErrorMessage)
+	}
+	return value, nil
+}
+
+// DriftConfigStruct 適用済みのマイグレーションの変更の検知の設定
+// Mode 変更を検知した際の方針(off/warn/block)
+type DriftConfigStruct struct {
+	Mode func() (string, error)
+}
+
+// DriftConfig 適用済みのマイグレーションの変更の検知の設定です
+var DriftConfig DriftConfigStruct
+
+// ChecksumStatus 適用済みのマイグレーション1件分のチェックサムの確認結果
+// ID SQLのID
+// Status 確認結果(ok/changed/missing/unrecorded)
+// Recorded 適用時に記録したチェックサム
+// Current 現在のソースのチェックサム
+type ChecksumStatus struct {
+	ID       string `json:"id"`
+	Status   string `json:"status"`
+	Recorded string `json:"recorded,omitempty"`
+	Current  string `json:"current,omitempty"`
+}
+
+// ChecksumReport 適用済みのマイグレーションの変更の確認結果
+// OK 変更または削除されたマイグレーションがないかどうか
+// Migrations 適用済みのマイグレーションごとの確認結果
+type ChecksumReport struct {
+	OK         bool             `json:"ok"`
+	Migrations []ChecksumStatus `json:"migrations"`
+}
+
+// Drifted 変更または削除されたマイグレーションを返す
+func (report ChecksumReport) Drifted() []ChecksumStatus {
+	drifted := []ChecksumStatus{}
+	for _, migration := range report.Migrations {
+		if migration.Status == ChecksumChanged || migration.Status == ChecksumMissing {
+			drifted = append(drifted, migration)
+		}
+	}
+	return drifted
+}
+
+// DriftError 適用済みのマイグレーションが変更または削除されているためマイグレーションを実行しないことを表すエラー
+type DriftError struct {
+	Drifted []ChecksumStatus
+}
+
+func (e *DriftError) Error() string {
+	descriptions := []string{}
+	for _, migration := range e.Drifted {
+		descriptions = append(descriptions, migration.ID+" ("+migration.Status+")")
+	}
+	return "applied migrations have drifted from the source: " + strings.Join(descriptions, ", ")
+}
+
+// MigrationChecksum マイグレーションのSQL文とトランザクションの設定のSHA-256を16進数で返す。
+// 埋め込み、ファイル、バンドルのどのソースでも同じ値になるように、解釈後のSQL文から計算する
+func MigrationChecksum(migration *sqlmigrate.Migration) string {
+	hash := sha256.New()
+	for _, statements := range [][]string{migration.Up, migration.Down} {
+		hash.Write([]byte(strconv.Itoa(len(statements)) + "\n"))
+		for _, statement := range statements {
+			hash.Write([]byte(strconv.Itoa(len(statement)) + ":" + statement))
+		}
+	}
+	hash.Write([]byte(fmt.Sprintf("%t %t", migration.DisableTransactionUp, migration.DisableTransactionDown)))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// quoteIdentifier DBの種類に合わせて識別子を引用符で囲む
+func quoteIdentifier(dialect string, name string) string {
+	if dialect == DialectMySQL {
+		return "`" + strings.Replace(name, "`", "``", -1) + "`"
+	}
+	return pq.QuoteIdentifier(name)
+}
+
+// placeholder DBの種類に合わせてn番目のパラメータのプレースホルダを返す
+func placeholder(dialect string, n int) string {
+	if dialect == DialectPostgres {
+		return "$" + strconv.Itoa(n)
+	}
+	return "?"
+}
+
+// checksumTable setの適用記録のテーブルの隣に作成するチェックサムのテーブル名を返す
+func checksumTable(dialect string, set sqlmigrate.MigrationSet) string {
+	table := set.TableName
+	if table == "" {
+		table = DefaultMigrationTable
+	}
+	name := quoteIdentifier(dialect, table+checksumTableSuffix)
+	if set.SchemaName != "" {
+		name = quoteIdentifier(dialect, set.SchemaName) + "." + name
+	}
+	return name
+}
+
+// ensureChecksumTable チェックサムのテーブルが存在しない場合は作成する
+func ensureChecksumTable(ctx context.Context, db *sql.DB, dialect string, set sqlmigrate.MigrationSet) error {
+	_, err := db.ExecContext(ctx, "create table if not exists "+checksumTable(dialect, set)+
+		" (id varchar(255) not null primary key, checksum varchar(64) not null)")
+	return err
+}
+
+// recordChecksum 適用したマイグレーションのチェックサムを記録する。ロールバックした場合は記録を削除する
+func recordChecksum(ctx context.Context, db *sql.DB, dialect string, set sqlmigrate.MigrationSet,
+	migration *sqlmigrate.Migration, direction sqlmigrate.MigrationDirection) error {
+
+	table := checksumTable(dialect, set)
+	if _, err := db.ExecContext(ctx, "delete from "+table+" where id = "+placeholder(dialect, 1), migration.Id); err != nil {
+		return err
+	}
+	if direction == sqlmigrate.Down {
+		return nil
+	}
+	_, err := db.ExecContext(ctx, "insert into "+table+" (id, checksum) values ("+
+		placeholder(dialect, 1)+", "+placeholder(dialect, 2)+")", migration.Id, MigrationChecksum(migration))
+	return err
+}
+
+// checkChecksums 適用済みのマイグレーションのチェックサムを記録と比較する
+func checkChecksums(ctx context.Context, db *sql.DB, dialect string, set sqlmigrate.MigrationSet,
+	source sqlmigrate.MigrationSource) (report ChecksumReport, err error) {
+
+	ctx, span := Tracer().Start(ctx, "checksum check")
+	defer func() { EndSpan(span, err) }()
+
+	report = ChecksumReport{OK: true, Migrations: []ChecksumStatus{}}
+
+	migrations, err := source.FindMigrations()
+	if err != nil {
+		return report, err
+	}
+	current := map[string]string{}
+	for _, migration := range migrations {
+		current[migration.Id] = MigrationChecksum(migration)
+	}
+
+	if err = ensureChecksumTable(ctx, db, dialect, set); err != nil {
+		return report, err
+	}
+	rows, err := db.QueryContext(ctx, "select id, checksum from "+checksumTable(dialect, set))
+	if err != nil {
+		return report, err
+	}
+	defer rows.Close()
+	recorded := map[string]string{}
+	for rows.Next() {
+		var id, checksum string
+		if err = rows.Scan(&id, &checksum); err != nil {
+			return report, err
+		}
+		recorded[id] = checksum
+	}
+	if err = rows.Err(); err != nil {
+		return report, err
+	}
+
+	records, err := set.GetMigrationRecords(db, dialect)
+	if err != nil {
+		return report, err
+	}
+	for _, record := range records {
+		status := ChecksumStatus{ID: record.Id, Recorded: recorded[record.Id], Current: current[record.Id]}
+		switch {
+		case status.Current == "":
+			status.Status = ChecksumMissing
+		case status.Recorded == "":
+			status.Status = ChecksumUnrecorded
+		case status.Recorded != status.Current:
+			status.Status = ChecksumChanged
+		default:
+			status.Status = ChecksumOK
+		}
+		report.Migrations = append(report.Migrations, status)
+	}
+	report.OK = len(report.Drifted()) == 0
+	return report, nil
+}
+
+// checkDrift 設定された方針に従って適用済みのマイグレーションの変更を確認する。
+// 変更があった場合、warnでは警告をログに出力し、blockではDriftErrorを返す
+func checkDrift(ctx context.Context, db *sql.DB, dialect string, set sqlmigrate.MigrationSet,
+	source sqlmigrate.MigrationSource, mode string) error {
+
+	if mode == DriftCheckOff {
+		return nil
+	}
+	report, err := checkChecksums(ctx, db, dialect, set, source)
+	if err != nil {
+		return err
+	}
+	if report.OK {
+		return nil
+	}
+
+	driftError := &DriftError{Drifted: report.Drifted()}
+	if mode == DriftCheckBlock {
+		return driftError
+	}
+	logger, _ := zap.NewProduction()
+	defer logger.Sync()
+	logger.Warn(
+		"Applied migrations have drifted",
+		zap.String("schema", set.SchemaName),
+		zap.Error(driftError))
+	return nil
+}
+
+// VerifyChecksums 対象の適用済みのマイグレーションが、適用後に変更または削除されていないかを確認する。
+// スキーマごとに適用する対象の場合はschemaでスキーマを指定する
+func VerifyChecksums(ctx context.Context, target *Target, schema string) (ChecksumReport, error) {
+
+	logger, _ := zap.NewProduction()
+	defer logger.Sync()
+
+	source, err := target.Source()
+	if err != nil {
+		return ChecksumReport{}, err
+	}
+	dialect, err := target.Dialect()
+	if err != nil {
+		return ChecksumReport{}, err
+	}
+
+	db, set, release, err := connectSchema(ctx, target, dialect, schema)
+	if err != nil {
+		logger.Error(
+			"DB connection open failure",
+			zap.Error(err))
+		return ChecksumReport{}, err
+	}
+	defer release()
+
+	if err := ensureHistorySchema(ctx, db, dialect, set); err != nil {
+		return ChecksumReport{}, err
+	}
+	return checkChecksums(ctx, db, dialect, set, source)
+}
+
+// CheckTargetsDrift 起動時にすべての対象の適用済みのマイグレーションの変更を確認し、ログに出力する。
+// スキーマごとに適用する対象はスキーマの数が多くなりうるため確認しない
+func CheckTargetsDrift(ctx context.Context, targets *Targets) {
+
+	logger, _ := zap.NewProduction()
+	defer logger.Sync()
+
+	mode, err := DriftConfig.Mode()
+	if err != nil || mode == DriftCheckOff {
+		return
+	}
+
+	for _, target := range targets.List() {
+		if target.FanOut.Enabled() {
+			continue
+		}
+		report, err := VerifyChecksums(ctx, target, "")
+		if err != nil {
+			logger.Warn(
+				"Drift check skipped",
+				zap.String("target", target.Name),
+				zap.Error(err))
+			continue
+		}
+		if report.OK {
+			continue
+		}
+
+		driftError := &DriftError{Drifted: report.Drifted()}
+		if mode == DriftCheckBlock {
+			logger.Error(
+				"Applied migrations have drifted; migrations to this target are blocked",
+				zap.String("target", target.Name),
+				zap.Error(driftError))
+			continue
+		}
+		logger.Warn(
+			"Applied migrations have drifted",
+			zap.String("target", target.Name),
+			zap.Error(driftError))
+	}
+}
+
+func init() {
+	DriftConfig = DriftConfigStruct{
+		Mode: GetDriftCheck,
+	}
+}
@@ -0,0 +1,128 @@
+package migrate
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	sqlmigrate "github.com/rubenv/sql-migrate"
+)
+
+// TestGetDriftCheck 変更を検知した際の方針の既定値と、不正な値がエラーになることを確認する。
+func TestGetDriftCheck(t *testing.T) {
+	os.Unsetenv(DriftCheck)
+	if mode, err := GetDriftCheck(); err != nil || mode != DriftCheckWarn {
+		t.Log(mode, err)
+		t.Fail()
+	}
+
+	os.Setenv(DriftCheck, "ignore")
+	defer os.Unsetenv(DriftCheck)
+	if mode, err := GetDriftCheck(); err == nil || mode != DefaultDriftCheck {
+		t.Log(mode, err)
+		t.Fail()
+	}
+}
+
+// TestMigrationChecksum SQL文やトランザクションの設定が変わるとチェックサムが変わることを確認する。
+func TestMigrationChecksum(t *testing.T) {
+	base := &sqlmigrate.Migration{Id: "01.sql", Up: []string{"CREATE TABLE a (id int);"}, Down: []string{"DROP TABLE a;"}}
+	for _, other := range []*sqlmigrate.Migration{
+		{Id: "01.sql", Up: []string{"CREATE TABLE a (id bigint);"}, Down: []string{"DROP TABLE a;"}},
+		{Id: "01.sql", Up: []string{"CREATE TABLE a (id int);", "DROP TABLE a;"}},
+		{Id: "01.sql", Up: []string{"CREATE TABLE a (id int);"}, Down: []string{"DROP TABLE a;"}, DisableTransactionUp: true},
+	} {
+		if MigrationChecksum(base) == MigrationChecksum(other) {
+			t.Log(other)
+			t.Fail()
+		}
+	}
+
+	same := &sqlmigrate.Migration{Id: "01.sql", Up: []string{"CREATE TABLE a (id int);"}, Down: []string{"DROP TABLE a;"}}
+	if MigrationChecksum(base) != MigrationChecksum(same) {
+		t.Fail()
+	}
+}
+
+// TestHandlerVerify 適用済みのマイグレーションの変更と削除を検知し、
+// ロールバックしたマイグレーションの記録が削除されることを確認する。
+func TestHandlerVerify(t *testing.T) {
+	targets, cleanup := setupSQLiteTargets(t, nil)
+	defer cleanup()
+	target, _ := targets.Get("local")
+	mux := NewServeMux(targets)
+
+	serve(mux, http.MethodPost, "/targets/local/migrate/up", nil)
+
+	w := serve(mux, http.MethodGet, "/targets/local/migrate/verify", nil)
+	var report ChecksumReport
+	decode(t, w, &report)
+	if w.Code != http.StatusOK || !report.OK || len(report.Migrations) != 2 || report.Migrations[0].Status != ChecksumOK {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+
+	ioutil.WriteFile(filepath.Join(target.SourcePath(), "01-users.sql"),
+		[]byte("-- +migrate Up\nCREATE TABLE users (id integer primary key, name text);\n-- +migrate Down\nDROP TABLE users;\n"), 0644)
+	os.Remove(filepath.Join(target.SourcePath(), "02-posts.sql"))
+
+	w = serve(mux, http.MethodGet, "/targets/local/migrate/verify", nil)
+	report = ChecksumReport{}
+	decode(t, w, &report)
+	if report.OK || len(report.Drifted()) != 2 || report.Migrations[0].Status != ChecksumChanged ||
+		report.Migrations[1].Status != ChecksumMissing {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+
+	// 元に戻してロールバックすると記録が削除される
+	for name, content := range testMigrations {
+		ioutil.WriteFile(filepath.Join(target.SourcePath(), name), []byte(content), 0644)
+	}
+	serveConfirmed(t, mux, "/targets/local/migrate/down?steps=1")
+	serve(mux, http.MethodPost, "/targets/local/migrate/up", nil)
+	w = serve(mux, http.MethodGet, "/targets/local/migrate/verify", nil)
+	report = ChecksumReport{}
+	decode(t, w, &report)
+	if !report.OK || len(report.Migrations) != 2 || report.Migrations[1].Status != ChecksumOK {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+}
+
+// TestHandlerDriftBlock blockの場合は適用済みのマイグレーションが変更されていると
+// 409でマイグレーションが拒否され、warnの場合は実行されることを確認する。
+func TestHandlerDriftBlock(t *testing.T) {
+	targets, cleanup := setupSQLiteTargets(t, nil)
+	defer cleanup()
+	target, _ := targets.Get("local")
+	mux := NewServeMux(targets)
+
+	serve(mux, http.MethodPost, "/targets/local/migrate/up", nil)
+	ioutil.WriteFile(filepath.Join(target.SourcePath(), "01-users.sql"),
+		[]byte("-- +migrate Up\nCREATE TABLE users (id integer primary key, name text);\n"), 0644)
+	ioutil.WriteFile(filepath.Join(target.SourcePath(), "03-tags.sql"),
+		[]byte("-- +migrate Up\nCREATE TABLE tags (id integer);\n"), 0644)
+
+	os.Setenv(DriftCheck, DriftCheckBlock)
+	defer os.Unsetenv(DriftCheck)
+	w := serve(mux, http.MethodPost, "/targets/local/migrate/up", nil)
+	var result MigrationResult
+	decode(t, w, &result)
+	if w.Code != http.StatusConflict || len(result.Applied) != 0 || !strings.Contains(result.Error, "01-users.sql (changed)") {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+
+	os.Setenv(DriftCheck, DriftCheckWarn)
+	w = serve(mux, http.MethodPost, "/targets/local/migrate/up", nil)
+	result = MigrationResult{}
+	decode(t, w, &result)
+	if w.Code != http.StatusOK || len(result.Applied) != 1 {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+}
@@ -16,12 +16,16 @@ const (
 	DBUser = "SQL_MIGRATE_USER"
 	// DBPassword DBのパスワードを指定するための環境変数
 	DBPassword = "SQL_MIGRATE_PASSWORD"
-	// DBName DBの名前を指定するための環境変数
+	// DBName DBの名前を指定するための環境変数(sqlite3の場合はDBファイルのパス)
 	DBName = "SQL_MIGRATE_DBNAME"
 	// DBSSLMode SSLモードの有効・向こうを指定するための環境変数
 	DBSSLMode = "SQL_MIGRATE_SSL_MODE"
 	// DBMigrationSourcePath DBのマイグレーションファイルの含まれているディレクトリパス
 	DBMigrationSourcePath = "SQL_MIGRATE_MIGRATION_SOURCE_PATH"
+	// DBDialect DBの種類(postgres/mysql/sqlite3)を指定するための環境変数
+	DBDialect = "SQL_MIGRATE_DIALECT"
+	// DBSQLitePragmas sqlite3の接続時に設定するプラグマ(name=value,...)を指定するための環境変数
+	DBSQLitePragmas = "SQL_MIGRATE_SQLITE_PRAGMAS"
 )
 
 const (
@@ -29,6 +33,8 @@ const (
 	DefaultDBHost = "localhost"
 	// DefaultDBPort DBがListenしているデフォルトのTCPポート番号
 	DefaultDBPort = 5432
+	// DefaultDBMySQLPort MySQLがListenしているデフォルトのTCPポート番号
+	DefaultDBMySQLPort = 3306
 	// DefaultDBUser デフォルトのDBユーザ
 	DefaultDBUser = ""
 	// DefaultDBPassword デフォルトのDBパスワード
@@ -39,6 +45,10 @@ const (
 	DefaultDBSSLMode = "disable"
 	// DefaultDBMigrationSourcePath デフォルトのマイグレーションのソースパス
 	DefaultDBMigrationSourcePath = "/etc/migrate"
+	// DefaultDBDialect デフォルトのDBの種類
+	DefaultDBDialect = DialectPostgres
+	// DefaultDBSQLitePragmas デフォルトのsqlite3のプラグマ
+	DefaultDBSQLitePragmas = "foreign_keys=on"
 )
 
 // GetHost DBホスト名を取得する。
@@ -48,10 +58,11 @@ func GetHost() string {
 }
 
 // GetPort DBのTCPポート番号を取得する。
-// 環境変数が設定されていない場合は、DefaultDBPortの値を返す
+// 環境変数が設定されていない場合は、DBの種類のデフォルトのポート番号(defaultPort)を返す
 // 環境変数に数字以外が設定されている場合はerrorとポート番号として-1を返す
 func GetPort() (int, error) {
-	portString := getValue(DBPort, strconv.Itoa(DefaultDBPort))
+	dialect, _ := GetDialect()
+	portString := getValue(DBPort, strconv.Itoa(defaultPort(dialect)))
 	port, err := strconv.Atoi(portString)
 
 	if err != nil {
@@ -96,6 +107,40 @@ func GetSSLMode() (string, error) {
 	return mode, nil
 }
 
+const (
+	// DialectSettingFormatErrorMessage DBの種類の設定を誤っている際のエラーメッセージです
+	DialectSettingFormatErrorMessage = "Dialect should be postgres, mysql or sqlite3"
+)
+
+// GetDialect DBの種類を取得する。
+// 環境変数が設定されていない場合は、DefaultDBDialectの値を返す
+// 不正な値(postgres/mysql/sqlite3以外)が設定されている場合はエラーとDefaultDBDialectの値を返す
+func GetDialect() (string, error) {
+	return parseDialect(getValue(DBDialect, DefaultDBDialect))
+}
+
+// defaultPort DBの種類のデフォルトのTCPポート番号を返す。MySQLはDefaultDBMySQLPort、それ以外はDefaultDBPort
+func defaultPort(dialect string) int {
+	if dialect == DialectMySQL {
+		return DefaultDBMySQLPort
+	}
+	return DefaultDBPort
+}
+
+// parseDialect DBの種類を解釈する
+func parseDialect(dialect string) (string, error) {
+	if dialect != DialectPostgres && dialect != DialectMySQL && dialect != DialectSQLite {
+		return DefaultDBDialect, errors.New(DialectSettingFormatErrorMessage)
+	}
+	return dialect, nil
+}
+
+// GetSQLitePragmas sqlite3の接続時に設定するプラグマを取得する。
+// 環境変数が設定されていない場合は、DefaultDBSQLitePragmasの値を返す
+func GetSQLitePragmas() string {
+	return getValue(DBSQLitePragmas, DefaultDBSQLitePragmas)
+}
+
 // getValue envKeyに指定された環境変数の値を返す。
 // envKeyに指定された環境変数が未定義だった場合はdefaultValueを返す。
 func getValue(envKey string, defaultValue string) string {
@@ -114,13 +159,17 @@ func GetMigrationSourcePath() string {
 }
 
 // DBConnectionConfig DBの接続情報を格納したもの
+// Name 接続する対象の名前。SQLiteのインメモリDBを対象ごとに分けるために使う(nilの場合はDefaultTargetName)
 type DBConnectionConfig struct {
+	Name     func() string
 	Host     func() string
 	Port     func() (int, error)
 	User     func() string
 	Password func() string
 	DBName   func() string
 	SSLMode  func() (string, error)
+	Dialect  func() (string, error)
+	Pragmas  func() string
 }
 
 // ConnectionConfig Databaseへの接続設定です
@@ -134,5 +183,20 @@ func init() {
 		Password: GetPassword,
 		DBName:   GetDBName,
 		SSLMode:  GetSSLMode,
+		Dialect:  GetDialect,
+		Pragmas:  GetSQLitePragmas,
 	}
 }
+
+const (
+	// SummaryPath run-onceモードの実行結果(JSON)の出力先を指定するための環境変数
+	SummaryPath = "SQL_MIGRATE_SUMMARY_PATH"
+	// DefaultSummaryPath デフォルトの実行結果の出力先("-"は標準出力)
+	DefaultSummaryPath = "-"
+)
+
+// GetSummaryPath run-onceモードの実行結果の出力先を取得する。
+// 環境変数が設定されていない場合は、DefaultSummaryPathの値を返す
+func GetSummaryPath() string {
+	return getValue(SummaryPath, DefaultSummaryPath)
+}
@@ -68,6 +68,21 @@ func TestGetPortDefaultValue(t *testing.T) {
 	}
 }
 
+// TestGetPortMySQLDefaultValue DBの種類にMySQLを指定し、ポートの環境変数が
+// 指定されていない場合にMySQLのデフォルト値が取得できることを確認する。
+func TestGetPortMySQLDefaultValue(t *testing.T) {
+	os.Unsetenv(DBPort)
+	os.Setenv(DBDialect, DialectMySQL)
+	defer os.Unsetenv(DBDialect)
+
+	port, err := GetPort()
+
+	if err != nil || port != DefaultDBMySQLPort {
+		t.Log(port, err)
+		t.Fail()
+	}
+}
+
 func TestGetPortWrongTypeFormatError(t *testing.T) {
 	os.Setenv(DBPort, "hogehoge")
 
@@ -270,3 +285,45 @@ func TestGetMigrationSourcePathDefaultValue(t *testing.T) {
 	}
 
 }
+
+// TestGetDialect DBの種類として環境変数に指定した値を取得でき、
+// 未指定の場合はPostgreSQLとなることを確認する。
+func TestGetDialect(t *testing.T) {
+	os.Unsetenv(DBDialect)
+	if dialect, err := GetDialect(); err != nil || dialect != DialectPostgres {
+		t.Fail()
+	}
+
+	os.Setenv(DBDialect, DialectMySQL)
+	defer os.Unsetenv(DBDialect)
+	if dialect, err := GetDialect(); err != nil || dialect != DialectMySQL {
+		t.Fail()
+	}
+}
+
+// TestGetDialectFormatError DBの種類として不正な値が指定された場合に
+// エラーとデフォルト値が返ることを確認する。
+func TestGetDialectFormatError(t *testing.T) {
+	os.Setenv(DBDialect, "oracle")
+	defer os.Unsetenv(DBDialect)
+
+	dialect, err := GetDialect()
+	if err == nil || err.Error() != DialectSettingFormatErrorMessage || dialect != DefaultDBDialect {
+		t.Fail()
+	}
+}
+
+// TestGetSQLitePragmas sqlite3のプラグマとして環境変数に指定した値を取得でき、
+// 未指定の場合は外部キー制約を有効にすることを確認する。
+func TestGetSQLitePragmas(t *testing.T) {
+	os.Unsetenv(DBSQLitePragmas)
+	if GetSQLitePragmas() != DefaultDBSQLitePragmas {
+		t.Fail()
+	}
+
+	os.Setenv(DBSQLitePragmas, "journal_mode=wal")
+	defer os.Unsetenv(DBSQLitePragmas)
+	if GetSQLitePragmas() != "journal_mode=wal" {
+		t.Fail()
+	}
+}
@@ -0,0 +1,375 @@
+package migrate
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	sqlmigrate "github.com/rubenv/sql-migrate"
+)
+
+const (
+	// ConfirmationTTL 破壊的な操作の確認トークンの有効期間を指定するための環境変数
+	ConfirmationTTL = "SQL_MIGRATE_CONFIRMATION_TTL"
+)
+
+const (
+	// DefaultConfirmationTTL デフォルトの確認トークンの有効期間
+	DefaultConfirmationTTL = 5 * time.Minute
+)
+
+const (
+	// ConfirmationInvalidErrorMessage 確認トークンが不正または期限切れの場合のエラーメッセージです
+	ConfirmationInvalidErrorMessage = "Confirmation token is invalid or expired; request a new plan"
+	// PlanChangedErrorMessage 確認後に実行予定のマイグレーションやソースが変わった場合のエラーメッセージです
+	PlanChangedErrorMessage = "The plan or the migration source changed after confirmation was requested; request a new plan"
+)
+
+var (
+	// ErrConfirmationInvalid 確認トークンが不正または期限切れであることを表すエラー
+	ErrConfirmationInvalid = errors.New(ConfirmationInvalidErrorMessage)
+	// ErrPlanChanged 確認後に実行予定のマイグレーションやソースが変わったことを表すエラー
+	ErrPlanChanged = errors.New(PlanChangedErrorMessage)
+)
+
+// GetConfirmationTTL 確認トークンの有効期間を取得する。
+// 環境変数が設定されていない場合は、DefaultConfirmationTTLの値を返す。
+// 環境変数の値がtime.ParseDurationで解釈できない場合はerrorとDefaultConfirmationTTLの値を返す
+func GetConfirmationTTL() (time.Duration, error) {
+	ttl, err := getDuration(ConfirmationTTL, DefaultConfirmationTTL)
+	if err == nil && ttl <= 0 {
+		return DefaultConfirmationTTL, fmt.Errorf("%s should be positive", ConfirmationTTL)
+	}
+	return ttl, err
+}
+
+// ConfirmationConfigStruct 破壊的な操作の確認の設定
+// TTL 確認トークンの有効期間
+type ConfirmationConfigStruct struct {
+	TTL func() (time.Duration, error)
+}
+
+// ConfirmationConfig 破壊的な操作の確認の設定です
+var ConfirmationConfig ConfirmationConfigStruct
+
+// Confirmation 実行前に確認が必要な操作の実行予定
+// Token 実行する際にクエリパラメータconfirmで渡すトークン
+// ExpiresAt トークンの有効期限
+// Direction マイグレーションの方向
+// Steps 実行するマイグレーションの最大件数(0はすべて)
+// PlanHash トークンを紐づけた実行予定とソースのSHA-256
+// Migrations 実行予定のマイグレーション(スキーマごとに適用する対象の場合はいずれかのスキーマで実行されるもの)
+// Reapply redoで戻した後に再適用するマイグレーション(Upの文)
+// Findings 実行予定の文に対する検査の指摘
+type Confirmation struct {
+	Token      string        `json:"token"`
+	ExpiresAt  time.Time     `json:"expiresAt"`
+	Direction  string        `json:"direction"`
+	Steps      int           `json:"steps"`
+	PlanHash   string        `json:"planHash"`
+	Migrations []PlanStep    `json:"migrations"`
+	Reapply    []PlanStep    `json:"reapply,omitempty"`
+	Findings   []LintFinding `json:"findings"`
+}
+
+// pendingConfirmation 発行済みの確認トークンに紐づけた操作
+type pendingConfirmation struct {
+	target    string
+	identity  string
+	direction sqlmigrate.MigrationDirection
+	steps     int
+	redo      bool
+	planHash  string
+	expiresAt time.Time
+}
+
+// confirmationStore 発行済みの確認トークン。トークンは1回だけ使える
+type confirmationStore struct {
+	mu      sync.Mutex
+	pending map[string]pendingConfirmation
+}
+
+// confirmations サーバが発行した確認トークンです
+var confirmations = &confirmationStore{pending: map[string]pendingConfirmation{}}
+
+// issue 確認トークンを発行する。期限切れのトークンはここで破棄する
+func (store *confirmationStore) issue(confirmation pendingConfirmation) (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(random)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	now := time.Now()
+	for key, pending := range store.pending {
+		if now.After(pending.expiresAt) {
+			delete(store.pending, key)
+		}
+	}
+	store.pending[token] = confirmation
+	return token, nil
+}
+
+// consume 確認トークンを使用済みにして、紐づけた操作と一致することを確認する。
+// 操作が一致しない場合はErrConfirmationInvalidを、実行予定が変わった場合はErrPlanChangedを返す
+func (store *confirmationStore) consume(token string, confirmation pendingConfirmation) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	pending, ok := store.pending[token]
+	if !ok {
+		return ErrConfirmationInvalid
+	}
+	delete(store.pending, token)
+
+	if time.Now().After(pending.expiresAt) || pending.target != confirmation.target ||
+		pending.identity != confirmation.identity || pending.direction != confirmation.direction ||
+		pending.steps != confirmation.steps || pending.redo != confirmation.redo {
+		return ErrConfirmationInvalid
+	}
+	if pending.planHash != confirmation.planHash {
+		return ErrPlanChanged
+	}
+	return nil
+}
+
+// schemaPlan スキーマ1件分の実行予定
+type schemaPlan struct {
+	schema  string
+	planned []*sqlmigrate.PlannedMigration
+}
+
+// planTarget 対象の実行予定を取得する。スキーマごとに適用する対象の場合はすべてのスキーマの実行予定を返す
+func planTarget(ctx context.Context, target *Target, dialect string, source sqlmigrate.MigrationSource,
+	direction sqlmigrate.MigrationDirection, max int) ([]schemaPlan, error) {
+
+	schemas := []string{""}
+	if target.FanOut.Enabled() {
+		db, err := target.DB(ctx, dialect)
+		if err != nil {
+			return nil, err
+		}
+		schemas, err = FindSchemas(ctx, db, target.FanOut)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	plans := []schemaPlan{}
+	for _, schema := range schemas {
+		planned, err := planSchema(ctx, target, dialect, schema, source, direction, max)
+		if err != nil {
+			return nil, err
+		}
+		plans = append(plans, schemaPlan{schema: schema, planned: planned})
+	}
+	return plans, nil
+}
+
+// planSchema スキーマ1件(schemaが空文字の場合は対象)の実行予定を取得する
+func planSchema(ctx context.Context, target *Target, dialect string, schema string, source sqlmigrate.MigrationSource,
+	direction sqlmigrate.MigrationDirection, max int) ([]*sqlmigrate.PlannedMigration, error) {
+
+	db, release, err := target.schemaDB(ctx, dialect, schema, false)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	set := target.migrationSet(schema)
+	if err := ensureHistorySchema(ctx, db, dialect, set); err != nil {
+		return nil, err
+	}
+	planned, _, err := set.PlanMigration(db, dialect, source, direction, max)
+	return planned, err
+}
+
+// planHash 実行予定と再適用するマイグレーション、ソースのすべてのマイグレーションのSHA-256を16進数で返す
+func planHash(target *Target, direction sqlmigrate.MigrationDirection, max int, plans []schemaPlan,
+	reapply []PlanStep, migrations []*sqlmigrate.Migration) string {
+
+	hash := sha256.New()
+	hash.Write([]byte(target.Name + "\n" + DirectionName(direction) + "\n" + strconv.Itoa(max) + "\n"))
+	writeStep := func(id string, disableTransaction bool, queries []string) {
+		hash.Write([]byte(fmt.Sprintf("%s %t %d\n", id, disableTransaction, len(queries))))
+		for _, query := range queries {
+			hash.Write([]byte(strconv.Itoa(len(query)) + ":" + query))
+		}
+	}
+	for _, plan := range plans {
+		hash.Write([]byte("schema " + plan.schema + "\n"))
+		for _, migration := range plan.planned {
+			writeStep(migration.Id, migration.DisableTransaction, migration.Queries)
+		}
+	}
+	if reapply != nil {
+		hash.Write([]byte("reapply\n"))
+		for _, step := range reapply {
+			writeStep(step.ID, step.DisableTransaction, step.Statements)
+		}
+	}
+
+	checksums := []string{}
+	for _, migration := range migrations {
+		checksums = append(checksums, migration.Id+" "+MigrationChecksum(migration))
+	}
+	sort.Strings(checksums)
+	for _, checksum := range checksums {
+		hash.Write([]byte(checksum + "\n"))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// currentPlanHash 対象の現在の実行予定とソースのハッシュを返す
+func currentPlanHash(ctx context.Context, target *Target, direction sqlmigrate.MigrationDirection, max int) (string, error) {
+	source, err := target.Source()
+	if err != nil {
+		return "", err
+	}
+	migrations, err := source.FindMigrations()
+	if err != nil {
+		return "", err
+	}
+	dialect, err := target.Dialect()
+	if err != nil {
+		return "", err
+	}
+	plans, err := planTarget(ctx, target, dialect, source, direction, max)
+	if err != nil {
+		return "", err
+	}
+	return planHash(target, direction, max, plans, nil, migrations), nil
+}
+
+// CheckConfirmation 操作に確認が必要かを判定する。
+// Downと、検査でテーブルや列の削除を指摘された文を含む操作は、実行するマイグレーションがあれば確認が必要になる。
+// 確認が必要でtokenが空の場合は確認トークンを発行してConfirmationを返す。
+// tokenが指定された場合はトークンを使用済みにし、発行時と実行予定やソースが変わっていないことを確認してnilを返す。
+// 呼び出し元で対象の実行権(TryLock)を取得しておくこと
+func CheckConfirmation(ctx context.Context, target *Target, identity string, direction sqlmigrate.MigrationDirection,
+	max int, token string) (*Confirmation, error) {
+	return checkConfirmation(ctx, target, identity, direction, max, false, token)
+}
+
+// CheckRedoConfirmation redoで最後に適用したsteps件のマイグレーションを戻して再適用する操作の確認を判定する。
+// downと同じ実行予定に加えて、再適用するマイグレーションのUpの文を検査し、確認の内容とハッシュに含める。
+// 呼び出し元で対象の実行権(TryLock)を取得しておくこと
+func CheckRedoConfirmation(ctx context.Context, target *Target, identity string, steps int,
+	token string) (*Confirmation, error) {
+	return checkConfirmation(ctx, target, identity, sqlmigrate.Down, steps, true, token)
+}
+
+// checkConfirmation 操作に確認が必要かを判定する。redoの場合は戻したマイグレーションの再適用も確認する
+func checkConfirmation(ctx context.Context, target *Target, identity string, direction sqlmigrate.MigrationDirection,
+	max int, redo bool, token string) (*Confirmation, error) {
+
+	source, err := target.Source()
+	if err != nil {
+		return nil, err
+	}
+	migrations, err := source.FindMigrations()
+	if err != nil {
+		return nil, err
+	}
+	dialect, err := target.Dialect()
+	if err != nil {
+		return nil, err
+	}
+	plans, err := planTarget(ctx, target, dialect, source, direction, max)
+	if err != nil {
+		return nil, err
+	}
+
+	// スキーマごとの実行予定をまとめ、実行される文を検査する
+	steps := []PlanStep{}
+	var reapply []PlanStep
+	findings := []LintFinding{}
+	seen := map[string]bool{}
+	destructive := false
+	lint := func(id string, direction sqlmigrate.MigrationDirection, statements []string, noTransaction bool) {
+		for _, finding := range lintStatements(id, direction, statements, noTransaction, map[string]bool{}, LintOptions{}) {
+			findings = append(findings, finding)
+			destructive = destructive || finding.Destructive()
+		}
+	}
+	for _, plan := range plans {
+		for _, migration := range plan.planned {
+			if seen[migration.Id] {
+				continue
+			}
+			seen[migration.Id] = true
+			steps = append(steps, PlanStep{
+				ID:                 migration.Id,
+				Statements:         migration.Queries,
+				DisableTransaction: migration.DisableTransaction,
+			})
+			lint(migration.Id, direction, migration.Queries, migration.DisableTransaction)
+		}
+	}
+	if redo {
+		// 戻したマイグレーションは古い順に、現在のファイルのUpの文で再適用される
+		reapply = []PlanStep{}
+		for i := len(steps) - 1; i >= 0; i-- {
+			for _, migration := range migrations {
+				if migration.Id == steps[i].ID {
+					reapply = append(reapply, PlanStep{
+						ID:                 migration.Id,
+						Statements:         migration.Up,
+						DisableTransaction: migration.DisableTransactionUp,
+					})
+					lint(migration.Id, sqlmigrate.Up, migration.Up, migration.DisableTransactionUp)
+				}
+			}
+		}
+	}
+	if len(steps) == 0 || (direction != sqlmigrate.Down && !destructive) {
+		return nil, nil
+	}
+
+	pending := pendingConfirmation{
+		target:    target.Name,
+		identity:  identity,
+		direction: direction,
+		steps:     max,
+		redo:      redo,
+		planHash:  planHash(target, direction, max, plans, reapply, migrations),
+	}
+	if token != "" {
+		return nil, confirmations.consume(token, pending)
+	}
+
+	ttl, err := ConfirmationConfig.TTL()
+	if err != nil {
+		return nil, err
+	}
+	pending.expiresAt = time.Now().Add(ttl)
+	issued, err := confirmations.issue(pending)
+	if err != nil {
+		return nil, err
+	}
+	return &Confirmation{
+		Token:      issued,
+		ExpiresAt:  pending.expiresAt,
+		Direction:  DirectionName(direction),
+		Steps:      max,
+		PlanHash:   pending.planHash,
+		Migrations: steps,
+		Reapply:    reapply,
+		Findings:   findings,
+	}, nil
+}
+
+func init() {
+	ConfirmationConfig = ConfirmationConfigStruct{
+		TTL: GetConfirmationTTL,
+	}
+}
@@ -0,0 +1,142 @@
+package migrate
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestGetConfirmationTTL 確認トークンの有効期間の既定値と、不正な値がエラーになることを確認する。
+func TestGetConfirmationTTL(t *testing.T) {
+	os.Unsetenv(ConfirmationTTL)
+	if ttl, err := GetConfirmationTTL(); err != nil || ttl != DefaultConfirmationTTL {
+		t.Log(ttl, err)
+		t.Fail()
+	}
+
+	defer os.Unsetenv(ConfirmationTTL)
+	for _, value := range []string{"soon", "0s", "-1m"} {
+		os.Setenv(ConfirmationTTL, value)
+		if ttl, err := GetConfirmationTTL(); err == nil || ttl != DefaultConfirmationTTL {
+			t.Log(value, ttl, err)
+			t.Fail()
+		}
+	}
+}
+
+// TestHandlerConfirmation downに確認トークンが必要で、トークンは操作に紐づき1回だけ使え、
+// 発行後にソースが変わった場合や期限切れの場合は409で拒否されることを確認する。
+func TestHandlerConfirmation(t *testing.T) {
+	targets, cleanup := setupSQLiteTargets(t, nil)
+	defer cleanup()
+	target, _ := targets.Get("local")
+	mux := NewServeMux(targets)
+
+	// テーブルを削除しないupは確認なしで実行される
+	if w := serve(mux, http.MethodPost, "/targets/local/migrate/up", nil); w.Code != http.StatusOK {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+
+	requestToken := func(path string) string {
+		w := serve(mux, http.MethodPost, path, nil)
+		var confirmation Confirmation
+		decode(t, w, &confirmation)
+		if w.Code != http.StatusPreconditionRequired || confirmation.Token == "" {
+			t.Fatal(w.Code, w.Body.String())
+		}
+		return confirmation.Token
+	}
+
+	// 発行時と異なる件数には使えず、失敗したトークンも使用済みになる
+	token := requestToken("/targets/local/migrate/down?steps=1")
+	for _, path := range []string{"/targets/local/migrate/down?steps=2", "/targets/local/migrate/down?steps=1"} {
+		w := serve(mux, http.MethodPost, path+"&confirm="+token, nil)
+		if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), ConfirmationInvalidErrorMessage) {
+			t.Log(path, w.Code, w.Body.String())
+			t.Fail()
+		}
+	}
+
+	// 発行後にソースが変わった場合は実行しない
+	token = requestToken("/targets/local/migrate/down?steps=1")
+	original := testMigrations["01-users.sql"]
+	ioutil.WriteFile(filepath.Join(target.SourcePath(), "01-users.sql"), []byte(original+"-- edited\nSELECT 1;\n"), 0644)
+	w := serve(mux, http.MethodPost, "/targets/local/migrate/down?steps=1&confirm="+token, nil)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), PlanChangedErrorMessage) {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+	ioutil.WriteFile(filepath.Join(target.SourcePath(), "01-users.sql"), []byte(original), 0644)
+
+	// 期限切れのトークンは使えない
+	os.Setenv(ConfirmationTTL, "1ms")
+	token = requestToken("/targets/local/migrate/down?steps=1")
+	os.Unsetenv(ConfirmationTTL)
+	time.Sleep(10 * time.Millisecond)
+	if w := serve(mux, http.MethodPost, "/targets/local/migrate/down?steps=1&confirm="+token, nil); w.Code != http.StatusConflict {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+
+	token = requestToken("/targets/local/migrate/down?steps=1")
+	w = serve(mux, http.MethodPost, "/targets/local/migrate/down?steps=1&confirm="+token, nil)
+	var result MigrationResult
+	decode(t, w, &result)
+	if w.Code != http.StatusOK || len(result.Applied) != 1 || result.Applied[0] != "02-posts.sql" {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+}
+
+// TestHandlerConfirmDestructiveUp テーブルを削除する文を含むupに確認が必要で、
+// 実行予定と指摘が返ることを確認する。
+func TestHandlerConfirmDestructiveUp(t *testing.T) {
+	targets, cleanup := setupSQLiteTargets(t, map[string]string{
+		"03-drop.sql": "-- +migrate Up\nDROP TABLE posts;\n",
+	})
+	defer cleanup()
+	mux := NewServeMux(targets)
+
+	w := serve(mux, http.MethodPost, "/targets/local/migrate/up", nil)
+	var confirmation Confirmation
+	decode(t, w, &confirmation)
+	if w.Code != http.StatusPreconditionRequired || confirmation.Direction != "up" || len(confirmation.Migrations) != 3 ||
+		len(confirmation.Findings) != 1 || confirmation.Findings[0].Rule != RuleDropTable {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+
+	w = serve(mux, http.MethodPost, "/targets/local/migrate/up?confirm="+confirmation.Token, nil)
+	var result MigrationResult
+	decode(t, w, &result)
+	if w.Code != http.StatusOK || len(result.Applied) != 3 {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+}
+
+// TestHandlerBundleUploadConfirmation テーブルを削除するバンドルをapply付きでアップロードした場合は、
+// 格納だけして202と確認トークンを返すことを確認する。
+func TestHandlerBundleUploadConfirmation(t *testing.T) {
+	_, mux, cleanup := setupBundleTarget(t)
+	defer cleanup()
+
+	migrations := map[string]string{}
+	for name, content := range testMigrations {
+		migrations[name] = content
+	}
+	migrations["03-drop.sql"] = "-- +migrate Up\nDROP TABLE posts;\n-- +migrate Down\n"
+
+	w := upload(mux, "/targets/local/bundles?apply=true", makeTarGz(t, bundleFiles("v1", migrations)), nil)
+	var result BundleUpload
+	decode(t, w, &result)
+	if w.Code != http.StatusAccepted || result.Result != nil || result.Confirmation == nil || !result.Bundle.Active {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+}
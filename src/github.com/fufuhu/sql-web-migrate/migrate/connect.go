@@ -1,6 +1,14 @@
 package migrate
 
-import "fmt"
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+)
 
 const (
 	// ConnectionStringTemplate 接続文字列のテンプレート
@@ -12,8 +20,34 @@ const (
 const (
 	// DialectPostgres PostgreSQLを使う際の指定子
 	DialectPostgres = "postgres"
+	// DialectMySQL MySQLを使う際の指定子
+	DialectMySQL = "mysql"
+	// DialectSQLite SQLiteを使う際の指定子
+	DialectSQLite = "sqlite3"
 )
 
+const (
+	// SQLiteMemoryPath SQLiteのインメモリDBを使う際のパス
+	SQLiteMemoryPath = ":memory:"
+)
+
+// sqlitePragmas go-sqlite3が接続文字列で受け付けるプラグマ
+var sqlitePragmas = map[string]bool{
+	"auto_vacuum":              true,
+	"busy_timeout":             true,
+	"cache_size":               true,
+	"case_sensitive_like":      true,
+	"defer_foreign_keys":       true,
+	"foreign_keys":             true,
+	"ignore_check_constraints": true,
+	"journal_mode":             true,
+	"locking_mode":             true,
+	"query_only":               true,
+	"recursive_triggers":       true,
+	"secure_delete":            true,
+	"synchronous":              true,
+}
+
 // BuildConnectionString PostgreSQLの接続文字列を生成する
 func BuildConnectionString(host string, port int, user string,
 	password string, dbname string, sslmode string) string {
@@ -32,3 +66,89 @@ func BuildConnectionStringForUnixDomainSocket(socketDirectoryPath string, user s
 
 	return connectionString
 }
+
+// BuildSearchPathOption 接続後のsearch_pathをschemaにするための接続文字列のオプションを生成する
+func BuildSearchPathOption(schema string) string {
+	value := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(pq.QuoteIdentifier(schema))
+	return fmt.Sprintf(" search_path='%s'", value)
+}
+
+// BuildMySQLConnectionString MySQLの接続文字列(DSN)を生成する。
+// sslmodeはPostgreSQLと同じ値(disable/require/verify-ca/verify-full)で指定する
+func BuildMySQLConnectionString(host string, port int, user string,
+	password string, dbname string, sslmode string) string {
+
+	config := newMySQLConfig(user, password, dbname)
+	config.Net = "tcp"
+	config.Addr = host + ":" + strconv.Itoa(port)
+	config.TLSConfig = mySQLTLSConfig(sslmode)
+
+	return config.FormatDSN()
+}
+
+// BuildMySQLConnectionStringForUnixDomainSocket Unixドメインソケットを使うMySQLの接続文字列(DSN)を生成する。
+// PostgreSQLと異なり、socketPathにはディレクトリではなくソケットファイルのパスを指定する
+func BuildMySQLConnectionStringForUnixDomainSocket(socketPath string, user string,
+	password string, dbname string) string {
+
+	config := newMySQLConfig(user, password, dbname)
+	config.Net = "unix"
+	config.Addr = socketPath
+
+	return config.FormatDSN()
+}
+
+// newMySQLConfig MySQLの接続設定を生成する。
+// 適用記録のapplied_atをtime.Timeとして読めるようにparseTimeを有効にする
+func newMySQLConfig(user string, password string, dbname string) *mysql.Config {
+	config := mysql.NewConfig()
+	config.User = user
+	config.Passwd = password
+	config.DBName = dbname
+	config.ParseTime = true
+	return config
+}
+
+// mySQLTLSConfig SSLモードをMySQLドライバのtlsパラメータに変換する。
+// MySQLドライバは証明書の検証時にホスト名も検証するため、verify-caはverify-fullと同じ扱いになる
+func mySQLTLSConfig(sslmode string) string {
+	switch sslmode {
+	case "require":
+		return "skip-verify"
+	case "verify-ca", "verify-full":
+		return "true"
+	}
+	return ""
+}
+
+// BuildSQLiteConnectionString SQLiteの接続文字列を生成する。
+// pragmasには"foreign_keys=on,journal_mode=wal"の形式でプラグマを指定する。
+// pathにSQLiteMemoryPathを指定した場合は、同じプロセス内の同じnameの接続で共有するインメモリDBを使う。
+// nameには対象の名前を指定し、対象ごとに別のインメモリDBにする
+func BuildSQLiteConnectionString(path string, pragmas string, name string) (string, error) {
+	query := url.Values{}
+	for _, pragma := range strings.Split(pragmas, ",") {
+		pragma = strings.TrimSpace(pragma)
+		if pragma == "" {
+			continue
+		}
+		parts := strings.SplitN(pragma, "=", 2)
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		if len(parts) != 2 || !sqlitePragmas[name] {
+			return "", fmt.Errorf("unsupported sqlite pragma: %s", pragma)
+		}
+		query.Set("_"+name, strings.TrimSpace(parts[1]))
+	}
+
+	if path == SQLiteMemoryPath {
+		path = url.PathEscape(name)
+		query.Set("mode", "memory")
+		query.Set("cache", "shared")
+	}
+
+	connectionString := "file:" + path
+	if len(query) > 0 {
+		connectionString += "?" + query.Encode()
+	}
+	return connectionString, nil
+}
@@ -1,7 +1,14 @@
 package migrate
 
 import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	sqlmigrate "github.com/rubenv/sql-migrate"
 )
 
 func TestBuildConnectionString(t *testing.T) {
@@ -40,3 +47,126 @@ func TestBuildConnectionStringForUnixDomainSocket(t *testing.T) {
 		t.Fail()
 	}
 }
+
+// TestBuildMySQLConnectionString MySQLのDSNにTCPのアドレス、parseTime、
+// SSLモードに対応するtlsパラメータが含まれることを確認する。
+func TestBuildMySQLConnectionString(t *testing.T) {
+	for sslmode, expected := range map[string]string{
+		"disable":     "user:password@tcp(host:3306)/dbname?parseTime=true",
+		"require":     "user:password@tcp(host:3306)/dbname?parseTime=true&tls=skip-verify",
+		"verify-ca":   "user:password@tcp(host:3306)/dbname?parseTime=true&tls=true",
+		"verify-full": "user:password@tcp(host:3306)/dbname?parseTime=true&tls=true",
+	} {
+		connectionString := BuildMySQLConnectionString("host", 3306, "user", "password", "dbname", sslmode)
+
+		if connectionString != expected {
+			t.Log(sslmode, connectionString)
+			t.Fail()
+		}
+	}
+}
+
+// TestBuildMySQLConnectionStringForUnixDomainSocket
+// UnixDomainSocket用のMySQLのDSNが正常に生成できることを確認する。
+func TestBuildMySQLConnectionStringForUnixDomainSocket(t *testing.T) {
+	connectionString := BuildMySQLConnectionStringForUnixDomainSocket(
+		"/var/run/mysqld/mysqld.sock", "user", "password", "dbname")
+
+	if connectionString != "user:password@unix(/var/run/mysqld/mysqld.sock)/dbname?parseTime=true" {
+		t.Log(connectionString)
+		t.Fail()
+	}
+}
+
+// TestBuildMySQLConnectionStringEscape 記号を含むパスワードでも
+// ドライバが元の値として解釈できるDSNになることを確認する。
+func TestBuildMySQLConnectionStringEscape(t *testing.T) {
+	connectionString := BuildMySQLConnectionString("host", 3306, "user", "p@ss/w:rd?", "dbname", "disable")
+
+	config, err := mysql.ParseDSN(connectionString)
+	if err != nil || config.Passwd != "p@ss/w:rd?" || config.DBName != "dbname" || !config.ParseTime {
+		t.Log(connectionString, err)
+		t.Fail()
+	}
+}
+
+// TestGetConnectionMySQLSearchPath MySQLではsearch_pathを指定できないことを確認する。
+func TestGetConnectionMySQLSearchPath(t *testing.T) {
+	if _, err := GetSchemaConnection(context.Background(), ConnectionConfig, DialectMySQL, "tenant_a"); err == nil {
+		t.Fail()
+	}
+	if _, err := GetConnection(context.Background(), ConnectionConfig, "oracle"); err == nil {
+		t.Fail()
+	}
+}
+
+// TestBuildSQLiteConnectionString SQLiteの接続文字列にプラグマが
+// go-sqlite3のパラメータとして含まれることを確認する。
+func TestBuildSQLiteConnectionString(t *testing.T) {
+	connectionString, err := BuildSQLiteConnectionString("/var/lib/app.db", "foreign_keys=on, journal_mode=WAL", "local")
+
+	if err != nil || connectionString != "file:/var/lib/app.db?_foreign_keys=on&_journal_mode=WAL" {
+		t.Log(connectionString, err)
+		t.Fail()
+	}
+}
+
+// TestBuildSQLiteConnectionStringMemory インメモリDBを指定した場合に
+// 対象ごとにプロセス内で共有するインメモリDBの接続文字列になることを確認する。
+func TestBuildSQLiteConnectionStringMemory(t *testing.T) {
+	connectionString, err := BuildSQLiteConnectionString(SQLiteMemoryPath, "", "orders")
+
+	if err != nil || connectionString != "file:orders?cache=shared&mode=memory" {
+		t.Log(connectionString, err)
+		t.Fail()
+	}
+	if other, _ := BuildSQLiteConnectionString(SQLiteMemoryPath, "", "billing"); other == connectionString {
+		t.Log(other)
+		t.Fail()
+	}
+}
+
+// TestBuildSQLiteConnectionStringUnsupportedPragma 対応していないプラグマや
+// 値のないプラグマがエラーになることを確認する。
+func TestBuildSQLiteConnectionStringUnsupportedPragma(t *testing.T) {
+	for _, pragmas := range []string{"mmap_size=0", "foreign_keys", "=on"} {
+		if _, err := BuildSQLiteConnectionString("app.db", pragmas, "local"); err == nil {
+			t.Log(pragmas)
+			t.Fail()
+		}
+	}
+}
+
+// TestSQLiteMemoryTargets インメモリDBを使う対象が2つあっても、
+// DBと適用記録を共有しないことを確認する。
+func TestSQLiteMemoryTargets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, content := range testMigrations {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+	}
+	path := writeTargetsFile(t, `{"targets": [
+		{"name": "orders", "dialect": "sqlite3", "dbname": ":memory:", "sourcePath": "`+dir+`"},
+		{"name": "billing", "dialect": "sqlite3", "dbname": ":memory:", "sourcePath": "`+dir+`"}
+	]}`)
+	defer os.Remove(path)
+	targets, err := LoadTargets(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer targets.Close()
+	orders, _ := targets.Get("orders")
+	billing, _ := targets.Get("billing")
+
+	if _, err := ExecMigrate(context.Background(), orders, sqlmigrate.Up, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	statuses, err := GetMigrationStatus(context.Background(), billing, "")
+	if err != nil || len(statuses) != 2 || statuses[0].Applied || statuses[1].Applied {
+		t.Log(statuses, err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,696 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	// PostgreSQL、MySQL、SQLiteのドライバを登録する
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	sqlmigrate "github.com/rubenv/sql-migrate"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+// LogRecord DDLの適用記録を格納するための構造体
+// ID SQLのID
+// AppliedAt SQLの適用タイムスタンプ
+// 既存のクライアントとの互換性のため、JSONのキーはフィールド名(ID, AppliedAt)のままにする
+type LogRecord struct {
+	ID        string `json:"ID"`
+	AppliedAt string `json:"AppliedAt"`
+}
+
+// MigrationStatus マイグレーションの適用状況を格納するための構造体
+// ID SQLのID
+// Applied 適用済みかどうか
+// AppliedAt SQLの適用タイムスタンプ
+type MigrationStatus struct {
+	ID        string `json:"id"`
+	Applied   bool   `json:"applied"`
+	AppliedAt string `json:"appliedAt,omitempty"`
+}
+
+// MigrationResult マイグレーションの実行結果を格納するための構造体
+// Direction マイグレーションの方向
+// Success マイグレーションが成功したかどうか
+// Applied 今回適用したマイグレーションのID
+// Records 実行後の適用記録
+// Schemas スキーマごとに適用した場合のスキーマごとの実行結果
+// Backup downの前にバックアップした場合のバックアップ
+// Hooks 実行したフックの結果
+// Interrupted 実行中に中断した場合の、中断したマイグレーション
+// StartedAt 開始時刻
+// DurationMillis 所要時間(ミリ秒)
+// Error 失敗した場合のエラーメッセージ
+type MigrationResult struct {
+	Direction      string         `json:"direction"`
+	Success        bool           `json:"success"`
+	Applied        []string       `json:"applied"`
+	Records        []LogRecord    `json:"records"`
+	Schemas        []SchemaResult `json:"schemas,omitempty"`
+	Backup         *BackupInfo    `json:"backup,omitempty"`
+	Hooks          []HookResult   `json:"hooks,omitempty"`
+	Interrupted    *Interruption  `json:"interrupted,omitempty"`
+	StartedAt      time.Time      `json:"startedAt"`
+	DurationMillis int64          `json:"durationMillis"`
+	Error          string         `json:"error,omitempty"`
+}
+
+// NewMigrationResult 開始時刻を記録したMigrationResultを生成する
+func NewMigrationResult(direction sqlmigrate.MigrationDirection) MigrationResult {
+	return MigrationResult{
+		Direction: DirectionName(direction),
+		Applied:   []string{},
+		Records:   []LogRecord{},
+		StartedAt: time.Now(),
+	}
+}
+
+// Finish 所要時間と成否を記録する
+func (result *MigrationResult) Finish(err error) {
+	result.DurationMillis = int64(time.Since(result.StartedAt) / time.Millisecond)
+	result.Success = err == nil
+	if err != nil {
+		result.Error = err.Error()
+	}
+	var interrupted *InterruptedError
+	if errors.As(err, &interrupted) {
+		result.Interrupted = &interrupted.Interruption
+	}
+}
+
+const (
+	// InterruptReasonDeadline 実行時間の上限を過ぎたため中断した
+	InterruptReasonDeadline = "deadline"
+	// InterruptReasonCanceled リクエストの切断やサーバの終了のため中断した
+	InterruptReasonCanceled = "canceled"
+)
+
+// Interruption 実行中に中断したマイグレーション
+// Migration 中断したマイグレーションのID
+// Reason 中断した理由(deadline/canceled)
+// RolledBack マイグレーションのトランザクションをロールバックしたかどうか。
+// トランザクションを使わないマイグレーションは途中まで適用されている可能性がある
+type Interruption struct {
+	Migration  string `json:"migration"`
+	Reason     string `json:"reason"`
+	RolledBack bool   `json:"rolledBack"`
+}
+
+// InterruptedError マイグレーションの実行中に中断したことを表すエラー
+type InterruptedError struct {
+	Interruption
+	Err error
+}
+
+func (e *InterruptedError) Error() string {
+	message := fmt.Sprintf("migration %s was interrupted: %v", e.Migration, e.Err)
+	if e.RolledBack {
+		return message + "; its transaction was rolled back"
+	}
+	return message + "; it runs without a transaction and may be partially applied"
+}
+
+func (e *InterruptedError) Unwrap() error {
+	return e.Err
+}
+
+// newInterruptedError 中断したコンテキストのエラーからInterruptedErrorを生成する
+func newInterruptedError(migration *sqlmigrate.PlannedMigration, err error) *InterruptedError {
+	reason := InterruptReasonCanceled
+	if errors.Is(err, context.DeadlineExceeded) {
+		reason = InterruptReasonDeadline
+	}
+	return &InterruptedError{
+		Interruption: Interruption{Migration: migration.Id, Reason: reason, RolledBack: !migration.DisableTransaction},
+		Err:          err,
+	}
+}
+
+// MigrationPlan 実行予定のマイグレーションを格納するための構造体
+// Direction マイグレーションの方向
+// Migrations 実行予定のマイグレーション(実行順)
+type MigrationPlan struct {
+	Direction  string     `json:"direction"`
+	Migrations []PlanStep `json:"migrations"`
+}
+
+// PlanStep 実行予定のマイグレーション1件分
+// ID SQLのID
+// Statements 実行されるSQL文
+// DisableTransaction トランザクションを使わずに実行されるかどうか
+type PlanStep struct {
+	ID                 string   `json:"id"`
+	Statements         []string `json:"statements"`
+	DisableTransaction bool     `json:"disableTransaction"`
+}
+
+// DirectionName マイグレーションの方向を文字列で返す
+func DirectionName(direction sqlmigrate.MigrationDirection) string {
+	if direction == sqlmigrate.Down {
+		return "down"
+	}
+	return "up"
+}
+
+// ParseDirection 文字列からマイグレーションの方向を返す
+func ParseDirection(name string) (sqlmigrate.MigrationDirection, error) {
+	switch name {
+	case "up", "":
+		return sqlmigrate.Up, nil
+	case "down":
+		return sqlmigrate.Down, nil
+	}
+	return sqlmigrate.Up, fmt.Errorf("direction should be up or down: %s", name)
+}
+
+// GetConnection dialectで指定された種類のDBへの接続を開く。
+// 開いた接続は呼び出し元で閉じる。対象の接続を使い回す場合はTarget.DBを使う
+func GetConnection(ctx context.Context, connectionConfig DBConnectionConfig, dialect string) (db *sql.DB, err error) {
+	return GetSchemaConnection(ctx, connectionConfig, dialect, "")
+}
+
+// GetSchemaConnection search_pathをschemaにしたDBへの接続を開く。
+// schemaが空文字の場合はsearch_pathを変更しない。search_pathはPostgreSQLでのみ指定できる
+func GetSchemaConnection(ctx context.Context, connectionConfig DBConnectionConfig, dialect string,
+	schema string) (db *sql.DB, err error) {
+
+	logger, _ := zap.NewProduction()
+	defer logger.Sync()
+
+	_, span := Tracer().Start(ctx, "getConnection")
+	defer func() { EndSpan(span, err) }()
+
+	host := connectionConfig.Host()
+	port, err := connectionConfig.Port()
+	if err != nil {
+		logger.Error(
+			"Failed to get TCP port config",
+			zap.Error(err))
+	}
+	sslMode, err := connectionConfig.SSLMode()
+	if err != nil {
+		logger.Error(
+			"Failed to get SSL mode config",
+			zap.Error(err))
+	}
+
+	span.SetAttributes(
+		attribute.String("db.system", dialect),
+		attribute.String("db.name", connectionConfig.DBName()))
+	if schema != "" {
+		span.SetAttributes(attribute.String("db.schema", schema))
+	}
+
+	var connectionString string
+	switch dialect {
+	case DialectPostgres:
+		if host[:1] == "/" {
+			connectionString = BuildConnectionStringForUnixDomainSocket(
+				host,
+				connectionConfig.User(),
+				connectionConfig.Password(),
+				connectionConfig.DBName())
+		} else {
+			connectionString = BuildConnectionString(
+				host,
+				port,
+				connectionConfig.User(),
+				connectionConfig.Password(),
+				connectionConfig.DBName(),
+				sslMode)
+		}
+		if schema != "" {
+			connectionString += BuildSearchPathOption(schema)
+		}
+	case DialectMySQL:
+		if schema != "" {
+			return nil, fmt.Errorf("search_path is not supported by %s", dialect)
+		}
+		if host[:1] == "/" {
+			connectionString = BuildMySQLConnectionStringForUnixDomainSocket(
+				host,
+				connectionConfig.User(),
+				connectionConfig.Password(),
+				connectionConfig.DBName())
+		} else {
+			connectionString = BuildMySQLConnectionString(
+				host,
+				port,
+				connectionConfig.User(),
+				connectionConfig.Password(),
+				connectionConfig.DBName(),
+				sslMode)
+		}
+	case DialectSQLite:
+		if schema != "" {
+			return nil, fmt.Errorf("search_path is not supported by %s", dialect)
+		}
+		pragmas := DefaultDBSQLitePragmas
+		if connectionConfig.Pragmas != nil {
+			pragmas = connectionConfig.Pragmas()
+		}
+		name := DefaultTargetName
+		if connectionConfig.Name != nil {
+			name = connectionConfig.Name()
+		}
+		connectionString, err = BuildSQLiteConnectionString(connectionConfig.DBName(), pragmas, name)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New(DialectSettingFormatErrorMessage)
+	}
+
+	return sql.Open(dialect, connectionString)
+}
+
+// connectSchema 対象のDBに接続し、対象の適用記録のテーブルを使うMigrationSetを返す。
+// スキーマごとに適用する対象の場合、schemaはその対象のスキーマでなければならない。
+// 返したreleaseは接続を使い終えたら呼び出す
+func connectSchema(ctx context.Context, target *Target, dialect string,
+	schema string) (*sql.DB, sqlmigrate.MigrationSet, func(), error) {
+
+	set := target.migrationSet("")
+	release := func() {}
+
+	if !target.FanOut.Enabled() {
+		if schema != "" {
+			return nil, set, release, fmt.Errorf("target %s does not fan out to schemas", target.Name)
+		}
+		db, err := target.DB(ctx, dialect)
+		if err != nil {
+			return nil, set, release, err
+		}
+		return db, set, release, ensureHistorySchema(ctx, db, dialect, set)
+	}
+
+	if schema == "" {
+		return nil, set, release, ErrSchemaRequired
+	}
+
+	db, err := target.DB(ctx, dialect)
+	if err != nil {
+		return nil, set, release, err
+	}
+	schemas, err := FindSchemas(ctx, db, target.FanOut)
+	if err != nil {
+		return nil, set, release, err
+	}
+	for _, candidate := range schemas {
+		if candidate == schema {
+			set = target.migrationSet(schema)
+			db, release, err := target.schemaDB(ctx, dialect, schema, false)
+			return db, set, release, err
+		}
+	}
+	return nil, set, release, fmt.Errorf("schema %s is not a schema of target %s", schema, target.Name)
+}
+
+// ExecMigrate 対象にマイグレーションを実行する。
+// maxに0を指定した場合はすべてのマイグレーションを適用する。
+// progressがnilでない場合は、マイグレーションを1件適用するごとにそのIDを渡して呼び出す。
+// 同じ対象のマイグレーションが実行中の場合はErrMigrationInProgressを返す
+func ExecMigrate(ctx context.Context, target *Target, direction sqlmigrate.MigrationDirection, max int,
+	progress func(id string)) (MigrationResult, error) {
+
+	if err := target.TryLock(); err != nil {
+		logger, _ := zap.NewProduction()
+		defer logger.Sync()
+		logger.Warn(
+			"Migration rejected",
+			zap.String("target", target.Name),
+			zap.Error(err))
+
+		result := NewMigrationResult(direction)
+		result.Finish(err)
+		return result, err
+	}
+	defer target.Unlock()
+
+	return execMigrate(ctx, target, direction, max, progress)
+}
+
+// execMigrate 対象にマイグレーションを実行する。
+// 呼び出し元で対象の実行権(TryLock)を取得しておくこと
+func execMigrate(ctx context.Context, target *Target, direction sqlmigrate.MigrationDirection, max int,
+	progress func(id string)) (result MigrationResult, err error) {
+
+	logger, _ := zap.NewProduction()
+	defer logger.Sync()
+
+	result = NewMigrationResult(direction)
+	defer func() { result.Finish(err) }()
+
+	source, err := target.Source()
+	if err != nil {
+		logger.Error(
+			"Migration source setup failed",
+			zap.Error(err))
+		return result, err
+	}
+
+	dialect, err := target.Dialect()
+	if err != nil {
+		return result, err
+	}
+
+	// 実行時間の上限を過ぎた場合は、実行中のSQL文をキャンセルして中断する
+	if target.Timeouts.RunTimeout != nil {
+		var runTimeout time.Duration
+		if runTimeout, err = target.Timeouts.RunTimeout(); err != nil {
+			return result, err
+		}
+		if runTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, runTimeout)
+			defer cancel()
+		}
+	}
+
+	timeouts, err := newTimeoutPolicy(target, dialect, source)
+	if err != nil {
+		return result, err
+	}
+
+	// 実行前のフックが失敗した場合は実行しない
+	hooks, err := newHookRunner(target, dialect, direction, max)
+	if err != nil {
+		return result, err
+	}
+	defer func() { result.Hooks = hooks.Results() }()
+	if err = hooks.run(ctx, HookPreRun, "", "", nil); err != nil {
+		return result, err
+	}
+
+	// downの前にバックアップする。バックアップに失敗した場合は実行しない
+	if result.Backup, err = backupBeforeMigrate(ctx, target, dialect, source, direction, max); err != nil {
+		logger.Error(
+			"Backup failed",
+			zap.String("target", target.Name),
+			zap.Error(err))
+		return result, err
+	}
+
+	// スキーマごとに適用する
+	if target.FanOut.Enabled() {
+		err = execFanOut(ctx, target, dialect, source, direction, max, timeouts, hooks, progress, &result)
+		if err == nil {
+			err = hooks.run(ctx, HookPostRun, "", "", result.Applied)
+		}
+		return result, err
+	}
+
+	db, err := target.sessionDB(ctx, dialect)
+	if err != nil {
+		logger.Error(
+			"DB connection open failure",
+			zap.Error(err))
+		return result, err
+	}
+
+	set := target.migrationSet("")
+	if err = ensureHistorySchema(ctx, db, dialect, set); err != nil {
+		logger.Error(
+			"History schema setup failed",
+			zap.Error(err))
+		return result, err
+	}
+
+	err = execMigrationSet(ctx, db, dialect, set, source, direction, max, timeouts, hooks.forSchema(""), func(id string) {
+		result.Applied = append(result.Applied, id)
+		if progress != nil {
+			progress(id)
+		}
+	})
+	if err != nil {
+		logger.Error(
+			"Migration failed",
+			zap.Error(err))
+		return result, err
+	}
+
+	logger.Info(fmt.Sprintf("Applied %d migrations!", len(result.Applied)))
+
+	// クエリを投げる
+	records, err := getLogRecords(ctx, db, dialect, set)
+	if err != nil {
+		logger.Error(
+			"Result check failed",
+			zap.Error(err))
+		return result, err
+	}
+	result.Records = records
+
+	// 実行後のフックが失敗した場合は、適用済みのまま実行結果を失敗にする
+	if err = hooks.run(ctx, HookPostRun, "", "", result.Applied); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// execMigrationSet setの適用記録を使ってマイグレーションを実行する。
+// マイグレーションを1件適用するごとにそのIDを渡してappliedを呼び出す。
+// 適用したマイグレーションのチェックサムを記録し、適用済みのマイグレーションの変更をDriftConfigに従って確認する。
+// マイグレーション1件ごとのタイムアウトはtimeoutsに従ってセッションに設定し、フックはhooksで実行する
+func execMigrationSet(ctx context.Context, db *sql.DB, dialect string, set sqlmigrate.MigrationSet,
+	source sqlmigrate.MigrationSource, direction sqlmigrate.MigrationDirection, max int,
+	timeouts *timeoutPolicy, hooks migrationHooks, applied func(id string)) (err error) {
+
+	logger, _ := zap.NewProduction()
+	defer logger.Sync()
+
+	// 適用済みのマイグレーションが変更されていないかを確認する
+	mode, err := DriftConfig.Mode()
+	if err != nil {
+		return err
+	}
+	if err = checkDrift(ctx, db, dialect, set, source, mode); err != nil {
+		return err
+	}
+
+	// 今回適用されるマイグレーションのIDを控えておく
+	planned, _, err := set.PlanMigration(db, dialect, source, direction, max)
+	if err != nil {
+		return err
+	}
+
+	// どのマイグレーションに時間がかかったかわかるように1件ずつ適用する
+	done := 0
+	ids := []string{}
+	// 前のマイグレーションでセッションにタイムアウトを設定したかどうか。
+	// 接続は実行をまたいで使い回すため、前の実行で設定したタイムアウトが残っている可能性がある
+	configured := dialect == DialectPostgres
+	for done < len(planned) {
+		next := planned[done]
+		if err = hooks.before(ctx, next.Id, ids); err != nil {
+			break
+		}
+		var sessionTimeouts SessionTimeouts
+		if sessionTimeouts, err = timeouts.forMigration(next.Id); err != nil {
+			break
+		}
+
+		var n int
+		for attempt := 1; ; attempt++ {
+			if len(sessionTimeouts) > 0 || configured {
+				if err = timeouts.apply(ctx, db, sessionTimeouts); err != nil {
+					break
+				}
+				configured = len(sessionTimeouts) > 0
+			}
+
+			stepCtx, span := Tracer().Start(ctx, "migration "+next.Id)
+			span.SetAttributes(
+				attribute.String("migration.id", next.Id),
+				attribute.String("migration.direction", DirectionName(direction)),
+				attribute.Int("migration.statements", len(next.Queries)),
+				attribute.Int("migration.attempt", attempt))
+			if set.SchemaName != "" {
+				span.SetAttributes(attribute.String("migration.schema", set.SchemaName))
+			}
+
+			n, err = set.ExecMaxContext(stepCtx, db, dialect, source, direction, 1)
+			// リクエストの切断、サーバの終了、実行時間の上限で中断した場合は、中断したマイグレーションを返す
+			if err != nil && n == 0 && ctx.Err() != nil {
+				err = newInterruptedError(next, ctx.Err())
+			}
+			EndSpan(span, err)
+
+			// ロールバックされたトランザクション内のマイグレーションがロック待ちで失敗した場合は再試行する
+			if err == nil || n > 0 || !timeouts.retry(ctx, next, attempt, err) {
+				break
+			}
+		}
+
+		end := done + n
+		if end > len(planned) {
+			end = len(planned)
+		}
+		for _, migration := range planned[done:end] {
+			if mode != DriftCheckOff {
+				if recordErr := recordChecksum(ctx, db, dialect, set, migration.Migration, direction); recordErr != nil {
+					logger.Warn(
+						"Checksum record failed",
+						zap.String("id", migration.Id),
+						zap.Error(recordErr))
+				}
+			}
+			applied(migration.Id)
+			ids = append(ids, migration.Id)
+			if err == nil {
+				err = hooks.after(ctx, migration.Id, ids)
+			}
+		}
+		done = end
+		if err != nil || n == 0 {
+			break
+		}
+	}
+	return err
+}
+
+// getLogRecords setの適用記録のテーブルからDDLの適用記録を取得する
+func getLogRecords(ctx context.Context, db *sql.DB, dialect string,
+	set sqlmigrate.MigrationSet) (records []LogRecord, err error) {
+	_, span := Tracer().Start(ctx, "history query")
+	defer func() { EndSpan(span, err) }()
+
+	migrationRecords, err := set.GetMigrationRecords(db, dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	// 結果の構造体への格納
+	records = []LogRecord{}
+	for _, migrationRecord := range migrationRecords {
+		records = append(records, LogRecord{
+			ID:        migrationRecord.Id,
+			AppliedAt: migrationRecord.AppliedAt.String(),
+		})
+	}
+
+	return records, nil
+}
+
+// GetMigrationStatus 対象のソースに含まれるマイグレーションごとの適用状況を取得する。
+// スキーマごとに適用する対象の場合はschemaでスキーマを指定する
+func GetMigrationStatus(ctx context.Context, target *Target, schema string) ([]MigrationStatus, error) {
+
+	logger, _ := zap.NewProduction()
+	defer logger.Sync()
+
+	source, err := target.Source()
+	if err != nil {
+		logger.Error(
+			"Migration source setup failed",
+			zap.Error(err))
+		return nil, err
+	}
+
+	migrations, err := source.FindMigrations()
+	if err != nil {
+		logger.Error(
+			"Migration source read failed",
+			zap.Error(err))
+		return nil, err
+	}
+
+	dialect, err := target.Dialect()
+	if err != nil {
+		return nil, err
+	}
+
+	db, set, release, err := connectSchema(ctx, target, dialect, schema)
+	if err != nil {
+		logger.Error(
+			"DB connection open failure",
+			zap.Error(err))
+		return nil, err
+	}
+	defer release()
+
+	records, err := set.GetMigrationRecords(db, dialect)
+	if err != nil {
+		logger.Error(
+			"Result check failed",
+			zap.Error(err))
+		return nil, err
+	}
+
+	appliedAt := map[string]time.Time{}
+	for _, record := range records {
+		appliedAt[record.Id] = record.AppliedAt
+	}
+
+	statuses := []MigrationStatus{}
+	for _, migration := range migrations {
+		status := MigrationStatus{ID: migration.Id}
+		if at, ok := appliedAt[migration.Id]; ok {
+			status.Applied = true
+			status.AppliedAt = at.String()
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+// GetMigrationPlan 対象にマイグレーションを実行せずに、実行予定のマイグレーションを取得する。
+// スキーマごとに適用する対象の場合はschemaでスキーマを指定する
+func GetMigrationPlan(ctx context.Context, target *Target, schema string,
+	direction sqlmigrate.MigrationDirection, max int) (MigrationPlan, error) {
+
+	logger, _ := zap.NewProduction()
+	defer logger.Sync()
+
+	plan := MigrationPlan{
+		Direction:  DirectionName(direction),
+		Migrations: []PlanStep{},
+	}
+
+	source, err := target.Source()
+	if err != nil {
+		logger.Error(
+			"Migration source setup failed",
+			zap.Error(err))
+		return plan, err
+	}
+
+	dialect, err := target.Dialect()
+	if err != nil {
+		return plan, err
+	}
+
+	db, set, release, err := connectSchema(ctx, target, dialect, schema)
+	if err != nil {
+		logger.Error(
+			"DB connection open failure",
+			zap.Error(err))
+		return plan, err
+	}
+	defer release()
+
+	planned, _, err := set.PlanMigration(db, dialect, source, direction, max)
+	if err != nil {
+		logger.Error(
+			"Migration planning failed",
+			zap.Error(err))
+		return plan, err
+	}
+
+	for _, migration := range planned {
+		plan.Migrations = append(plan.Migrations, PlanStep{
+			ID:                 migration.Id,
+			Statements:         migration.Queries,
+			DisableTransaction: migration.DisableTransaction,
+		})
+	}
+
+	return plan, nil
+}
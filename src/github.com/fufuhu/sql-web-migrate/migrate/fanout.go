@@ -0,0 +1,319 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	sqlmigrate "github.com/rubenv/sql-migrate"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+const (
+	// SchemaPattern マイグレーションを適用するスキーマをLIKEのパターンで指定するための環境変数
+	SchemaPattern = "SQL_MIGRATE_SCHEMA_PATTERN"
+	// SchemaQuery マイグレーションを適用するスキーマの一覧を返すクエリを指定するための環境変数
+	SchemaQuery = "SQL_MIGRATE_SCHEMA_QUERY"
+	// FanOutParallelism 同時にマイグレーションを適用するスキーマの数を指定するための環境変数
+	FanOutParallelism = "SQL_MIGRATE_FANOUT_PARALLELISM"
+	// FanOutOnError スキーマへの適用が失敗した際の方針(stop/continue)を指定するための環境変数
+	FanOutOnError = "SQL_MIGRATE_FANOUT_ON_ERROR"
+)
+
+const (
+	// FanOutOnErrorStop 失敗した時点で新たなスキーマへの適用を始めない
+	FanOutOnErrorStop = "stop"
+	// FanOutOnErrorContinue 失敗しても残りのスキーマへの適用を続ける
+	FanOutOnErrorContinue = "continue"
+)
+
+const (
+	// DefaultSchemaPattern デフォルトのスキーマのパターン(スキーマごとには適用しない)
+	DefaultSchemaPattern = ""
+	// DefaultSchemaQuery デフォルトのスキーマの一覧を返すクエリ(スキーマごとには適用しない)
+	DefaultSchemaQuery = ""
+	// DefaultFanOutParallelism デフォルトの同時に適用するスキーマの数
+	DefaultFanOutParallelism = 1
+	// DefaultFanOutOnError デフォルトの失敗時の方針
+	DefaultFanOutOnError = FanOutOnErrorStop
+)
+
+const (
+	// FanOutParallelismSettingFormatErrorMessage 同時に適用するスキーマの数の設定値が不正な場合のエラーメッセージです
+	FanOutParallelismSettingFormatErrorMessage = "Fan-out parallelism should be a positive integer"
+	// FanOutOnErrorSettingFormatErrorMessage 失敗時の方針の設定値が不正な場合のエラーメッセージです
+	FanOutOnErrorSettingFormatErrorMessage = "Fan-out on-error policy should be stop or continue"
+	// SchemaRequiredErrorMessage スキーマごとに適用する対象でスキーマが指定されていない場合のエラーメッセージです
+	SchemaRequiredErrorMessage = "This target fans out to schemas; specify a schema"
+)
+
+// ErrSchemaRequired スキーマごとに適用する対象でスキーマが指定されていないことを表すエラー
+var ErrSchemaRequired = errors.New(SchemaRequiredErrorMessage)
+
+// schemaPatternQuery パターンに一致するスキーマを探すクエリ
+const schemaPatternQuery = "select schema_name from information_schema.schemata where schema_name like $1 order by schema_name"
+
+// GetSchemaPattern マイグレーションを適用するスキーマのパターンを取得する。
+// 環境変数が設定されていない場合は、DefaultSchemaPatternの値を返す
+func GetSchemaPattern() string {
+	return getValue(SchemaPattern, DefaultSchemaPattern)
+}
+
+// GetSchemaQuery マイグレーションを適用するスキーマの一覧を返すクエリを取得する。
+// 環境変数が設定されていない場合は、DefaultSchemaQueryの値を返す
+func GetSchemaQuery() string {
+	return getValue(SchemaQuery, DefaultSchemaQuery)
+}
+
+// GetFanOutParallelism 同時にマイグレーションを適用するスキーマの数を取得する。
+// 環境変数が設定されていない場合は、DefaultFanOutParallelismの値を返す。
+// 不正な値(正の整数以外)が設定されている場合はエラーとDefaultFanOutParallelismの値を返す
+func GetFanOutParallelism() (int, error) {
+	return parseFanOutParallelism(getValue(FanOutParallelism, strconv.Itoa(DefaultFanOutParallelism)))
+}
+
+// GetFanOutOnError スキーマへの適用が失敗した際の方針を取得する。
+// 環境変数が設定されていない場合は、DefaultFanOutOnErrorの値を返す。
+// 不正な値(stop/continue以外)が設定されている場合はエラーとDefaultFanOutOnErrorの値を返す
+func GetFanOutOnError() (string, error) {
+	return parseFanOutOnError(getValue(FanOutOnError, DefaultFanOutOnError))
+}
+
+// parseFanOutParallelism 同時に適用するスキーマの数を解釈する
+func parseFanOutParallelism(value string) (int, error) {
+	parallelism, err := strconv.Atoi(value)
+	if err != nil || parallelism < 1 {
+		return DefaultFanOutParallelism, errors.New(FanOutParallelismSettingFormatErrorMessage)
+	}
+	return parallelism, nil
+}
+
+// parseFanOutOnError 失敗時の方針を解釈する
+func parseFanOutOnError(value string) (string, error) {
+	if value != FanOutOnErrorStop && value != FanOutOnErrorContinue {
+		return DefaultFanOutOnError, errors.New(FanOutOnErrorSettingFormatErrorMessage)
+	}
+	return value, nil
+}
+
+// FanOutConfigStruct スキーマごとに適用する際の設定
+// SchemaPattern 適用するスキーマのLIKEのパターン
+// SchemaQuery 適用するスキーマの一覧を返すクエリ(指定された場合はSchemaPatternより優先する)
+// Parallelism 同時に適用するスキーマの数
+// OnError 失敗時の方針(stop/continue)
+type FanOutConfigStruct struct {
+	SchemaPattern func() string
+	SchemaQuery   func() string
+	Parallelism   func() (int, error)
+	OnError       func() (string, error)
+}
+
+// FanOutConfig スキーマごとに適用する際の設定です
+var FanOutConfig FanOutConfigStruct
+
+// Enabled スキーマごとに適用する設定がされているかを返す
+func (config FanOutConfigStruct) Enabled() bool {
+	return config.SchemaPattern != nil && (config.SchemaPattern() != "" || config.SchemaQuery() != "")
+}
+
+// SchemaResult スキーマ1件分の実行結果
+// Schema スキーマ名
+// Success マイグレーションが成功したかどうか
+// Skipped 他のスキーマの失敗または中断により適用しなかったかどうか
+// Applied 今回適用したマイグレーションのID
+// Interrupted 実行中に中断した場合の、中断したマイグレーション
+// DurationMillis 所要時間(ミリ秒)
+// Error 失敗した場合のエラーメッセージ
+type SchemaResult struct {
+	Schema         string        `json:"schema"`
+	Success        bool          `json:"success"`
+	Skipped        bool          `json:"skipped,omitempty"`
+	Applied        []string      `json:"applied"`
+	Interrupted    *Interruption `json:"interrupted,omitempty"`
+	DurationMillis int64         `json:"durationMillis"`
+	Error          string        `json:"error,omitempty"`
+}
+
+// FindSchemas マイグレーションを適用するスキーマの一覧を取得する
+func FindSchemas(ctx context.Context, db *sql.DB, config FanOutConfigStruct) (schemas []string, err error) {
+	ctx, span := Tracer().Start(ctx, "schema query")
+	defer func() { EndSpan(span, err) }()
+
+	var rows *sql.Rows
+	if query := config.SchemaQuery(); query != "" {
+		rows, err = db.QueryContext(ctx, query)
+	} else {
+		rows, err = db.QueryContext(ctx, schemaPatternQuery, config.SchemaPattern())
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schemas = []string{}
+	for rows.Next() {
+		var schema string
+		if err := rows.Scan(&schema); err != nil {
+			return nil, err
+		}
+		schemas = append(schemas, schema)
+	}
+
+	span.SetAttributes(attribute.Int("migration.schemas", len(schemas)))
+	return schemas, rows.Err()
+}
+
+// execFanOut 対象のスキーマごとにマイグレーションを適用し、結果をresultに格納する。
+// 適用したマイグレーションのIDは"スキーマ名/ID"の形式でprogressに渡す
+func execFanOut(ctx context.Context, target *Target, dialect string, source sqlmigrate.MigrationSource,
+	direction sqlmigrate.MigrationDirection, max int, timeouts *timeoutPolicy, hooks *hookRunner,
+	progress func(id string), result *MigrationResult) error {
+
+	logger, _ := zap.NewProduction()
+	defer logger.Sync()
+
+	// スキーマの切り替えにsearch_pathを使うため、PostgreSQLのみ対応する
+	if dialect != DialectPostgres {
+		return fmt.Errorf("fan-out to schemas is not supported by %s", dialect)
+	}
+
+	parallelism, err := target.FanOut.Parallelism()
+	if err != nil {
+		return err
+	}
+	onError, err := target.FanOut.OnError()
+	if err != nil {
+		return err
+	}
+
+	db, err := target.DB(ctx, dialect)
+	if err != nil {
+		return err
+	}
+	schemas, err := FindSchemas(ctx, db, target.FanOut)
+	if err != nil {
+		logger.Error(
+			"Schema lookup failed",
+			zap.Error(err))
+		return err
+	}
+
+	result.Schemas = make([]SchemaResult, len(schemas))
+
+	var (
+		mutex     sync.Mutex
+		waitGroup sync.WaitGroup
+		stopped   bool
+	)
+	slots := make(chan struct{}, parallelism)
+
+	for i, schema := range schemas {
+		slots <- struct{}{}
+
+		mutex.Lock()
+		skip := stopped || ctx.Err() != nil
+		mutex.Unlock()
+		if skip {
+			<-slots
+			result.Schemas[i] = SchemaResult{Schema: schema, Skipped: true, Applied: []string{}}
+			continue
+		}
+
+		waitGroup.Add(1)
+		go func(i int, schema string) {
+			defer waitGroup.Done()
+			defer func() { <-slots }()
+
+			schemaResult := execSchema(ctx, target, dialect, schema, source, direction, max, timeouts, hooks.forSchema(schema), func(id string) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				result.Applied = append(result.Applied, schema+"/"+id)
+				if progress != nil {
+					progress(schema + "/" + id)
+				}
+			})
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			result.Schemas[i] = schemaResult
+			if !schemaResult.Success && onError == FanOutOnErrorStop {
+				stopped = true
+			}
+		}(i, schema)
+	}
+	waitGroup.Wait()
+
+	failed := 0
+	for _, schemaResult := range result.Schemas {
+		if !schemaResult.Success && !schemaResult.Skipped {
+			failed++
+			logger.Error(
+				"Schema migration failed",
+				zap.String("schema", schemaResult.Schema),
+				zap.String("error", schemaResult.Error))
+		}
+	}
+	logger.Info(fmt.Sprintf("Applied %d migrations to %d schemas!", len(result.Applied), len(schemas)))
+
+	if ctx.Err() != nil {
+		return fmt.Errorf("migration interrupted after %d of %d schemas failed: %w", failed, len(schemas), ctx.Err())
+	}
+	if failed > 0 {
+		return fmt.Errorf("migration failed for %d of %d schemas", failed, len(schemas))
+	}
+	return nil
+}
+
+// execSchema スキーマ1件にマイグレーションを適用する。
+// 適用記録のテーブルはスキーマごとに作成する
+func execSchema(ctx context.Context, target *Target, dialect string, schema string, source sqlmigrate.MigrationSource,
+	direction sqlmigrate.MigrationDirection, max int, timeouts *timeoutPolicy, hooks migrationHooks,
+	applied func(id string)) (result SchemaResult) {
+
+	ctx, span := Tracer().Start(ctx, "schema "+schema)
+	span.SetAttributes(attribute.String("migration.schema", schema))
+
+	startedAt := time.Now()
+	result = SchemaResult{Schema: schema, Applied: []string{}}
+
+	var err error
+	defer func() {
+		EndSpan(span, err)
+		result.DurationMillis = int64(time.Since(startedAt) / time.Millisecond)
+		result.Success = err == nil
+		if err != nil {
+			result.Error = err.Error()
+		}
+		var interrupted *InterruptedError
+		if errors.As(err, &interrupted) {
+			result.Interrupted = &interrupted.Interruption
+		}
+	}()
+
+	db, release, err := target.schemaDB(ctx, dialect, schema, true)
+	if err != nil {
+		return result
+	}
+	defer release()
+
+	set := target.migrationSet(schema)
+	err = execMigrationSet(ctx, db, dialect, set, source, direction, max, timeouts, hooks, func(id string) {
+		result.Applied = append(result.Applied, id)
+		applied(id)
+	})
+	return result
+}
+
+func init() {
+	FanOutConfig = FanOutConfigStruct{
+		SchemaPattern: GetSchemaPattern,
+		SchemaQuery:   GetSchemaQuery,
+		Parallelism:   GetFanOutParallelism,
+		OnError:       GetFanOutOnError,
+	}
+}
@@ -0,0 +1,153 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	sqlmigrate "github.com/rubenv/sql-migrate"
+)
+
+// TestGetFanOutSettings スキーマごとに適用する際の設定値の取得と
+// 不正な値の場合のデフォルト値を確認する。
+func TestGetFanOutSettings(t *testing.T) {
+	defer os.Unsetenv(FanOutParallelism)
+	defer os.Unsetenv(FanOutOnError)
+
+	if parallelism, err := GetFanOutParallelism(); err != nil || parallelism != DefaultFanOutParallelism {
+		t.Fail()
+	}
+	if onError, err := GetFanOutOnError(); err != nil || onError != FanOutOnErrorStop {
+		t.Fail()
+	}
+
+	os.Setenv(FanOutParallelism, "4")
+	os.Setenv(FanOutOnError, FanOutOnErrorContinue)
+	if parallelism, err := GetFanOutParallelism(); err != nil || parallelism != 4 {
+		t.Fail()
+	}
+	if onError, err := GetFanOutOnError(); err != nil || onError != FanOutOnErrorContinue {
+		t.Fail()
+	}
+
+	os.Setenv(FanOutParallelism, "0")
+	os.Setenv(FanOutOnError, "ignore")
+	if parallelism, err := GetFanOutParallelism(); err == nil || parallelism != DefaultFanOutParallelism {
+		t.Fail()
+	}
+	if onError, err := GetFanOutOnError(); err == nil || onError != DefaultFanOutOnError {
+		t.Fail()
+	}
+}
+
+// TestFanOutEnabled パターンかクエリのどちらかが設定されている場合に
+// スキーマごとに適用することを確認する。
+func TestFanOutEnabled(t *testing.T) {
+	defer os.Unsetenv(SchemaPattern)
+	defer os.Unsetenv(SchemaQuery)
+
+	if FanOutConfig.Enabled() || (FanOutConfigStruct{}).Enabled() {
+		t.Fail()
+	}
+
+	os.Setenv(SchemaPattern, "tenant_%")
+	if !FanOutConfig.Enabled() {
+		t.Fail()
+	}
+
+	os.Unsetenv(SchemaPattern)
+	os.Setenv(SchemaQuery, "select name from tenants")
+	if !FanOutConfig.Enabled() {
+		t.Fail()
+	}
+}
+
+// TestBuildSearchPathOption スキーマ名が識別子として引用符で囲まれ、
+// 接続文字列の値としてエスケープされることを確認する。
+func TestBuildSearchPathOption(t *testing.T) {
+	for schema, expected := range map[string]string{
+		"tenant_a":   ` search_path='"tenant_a"'`,
+		`we"ird`:     ` search_path='"we""ird"'`,
+		`o'reilly\x`: ` search_path='"o\'reilly\\x"'`,
+	} {
+		if option := BuildSearchPathOption(schema); option != expected {
+			t.Log(option)
+			t.Fail()
+		}
+	}
+}
+
+// TestLoadTargetsFanOut ファイルで対象ごとにスキーマごとに適用する設定ができ、
+// 不正な値はエラーになることを確認する。
+func TestLoadTargetsFanOut(t *testing.T) {
+	path := writeTargetsFile(t, `{"targets": [
+		{"name": "saas", "sourcePath": "/migrations/saas",
+		 "fanOut": {"schemaPattern": "tenant_%", "parallelism": 8, "onError": "continue"}},
+		{"name": "single", "sourcePath": "/migrations/single"}
+	]}`)
+	defer os.Remove(path)
+
+	targets, err := LoadTargets(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saas, _ := targets.Get("saas")
+	parallelism, _ := saas.FanOut.Parallelism()
+	onError, _ := saas.FanOut.OnError()
+	if !saas.FanOut.Enabled() || saas.FanOut.SchemaPattern() != "tenant_%" ||
+		parallelism != 8 || onError != FanOutOnErrorContinue {
+		t.Fail()
+	}
+
+	single, _ := targets.Get("single")
+	if single.FanOut.Enabled() {
+		t.Fail()
+	}
+
+	for _, content := range []string{
+		`{"targets": [{"name": "a", "sourcePath": "/a", "fanOut": {"schemaPattern": "t_%", "parallelism": -1}}]}`,
+		`{"targets": [{"name": "a", "sourcePath": "/a", "fanOut": {"schemaPattern": "t_%", "onError": "ignore"}}]}`,
+	} {
+		path := writeTargetsFile(t, content)
+		if _, err := LoadTargets(path); err == nil {
+			t.Log(content)
+			t.Fail()
+		}
+		os.Remove(path)
+	}
+}
+
+// TestSchemaArgument スキーマごとに適用する対象ではスキーマの指定が必要で、
+// それ以外の対象ではスキーマを指定できないことを確認する。
+func TestSchemaArgument(t *testing.T) {
+	path := writeTargetsFile(t, `{"targets": [
+		{"name": "saas", "host": "127.0.0.1", "port": 1, "sourcePath": "/nonexistent",
+		 "fanOut": {"schemaPattern": "tenant_%"}},
+		{"name": "single", "host": "127.0.0.1", "port": 1, "sourcePath": "/nonexistent"}
+	]}`)
+	defer os.Remove(path)
+
+	targets, err := LoadTargets(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saas, _ := targets.Get("saas")
+	single, _ := targets.Get("single")
+
+	if _, err := GetMigrationPlan(context.Background(), saas, "", sqlmigrate.Up, 0); !errors.Is(err, ErrSchemaRequired) {
+		t.Log(err)
+		t.Fail()
+	}
+	if _, err := GetMigrationPlan(context.Background(), single, "tenant_a", sqlmigrate.Up, 0); err == nil {
+		t.Fail()
+	}
+
+	// スキーマの一覧を取得できない場合は実行全体が失敗する
+	result, err := ExecMigrate(context.Background(), saas, sqlmigrate.Up, 0, nil)
+	if err == nil || result.Success || len(result.Schemas) != 0 {
+		t.Log(result, err)
+		t.Fail()
+	}
+}
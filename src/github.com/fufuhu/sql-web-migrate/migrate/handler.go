@@ -0,0 +1,1057 @@
+package migrate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	sqlmigrate "github.com/rubenv/sql-migrate"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+// ErrorResponse エラー時のレスポンスを格納するための構造体
+// NextAllowed 時間帯の外や凍結中のため実行できない場合の、次に実行できる時刻
+type ErrorResponse struct {
+	Error       string     `json:"error"`
+	NextAllowed *time.Time `json:"nextAllowed,omitempty"`
+}
+
+// BundleUpload バンドルのアップロードの結果
+// Bundle 格納したバンドル
+// Result applyを指定した場合のマイグレーションの実行結果
+// Confirmation applyを指定したが、適用の前に確認が必要な場合の実行予定
+type BundleUpload struct {
+	Bundle       BundleInfo       `json:"bundle"`
+	Result       *MigrationResult `json:"result,omitempty"`
+	Confirmation *Confirmation    `json:"confirmation,omitempty"`
+}
+
+// MigrationEvent マイグレーションの進捗としてServer-Sent Eventsで送るイベント
+// ID 適用したマイグレーションのID
+// Direction マイグレーションの方向
+type MigrationEvent struct {
+	ID        string `json:"id"`
+	Direction string `json:"direction"`
+}
+
+const (
+	// MigrationSourceHeader 適用状況の取得に使ったマイグレーションのソース("kind:path")を返すヘッダ
+	MigrationSourceHeader = "X-Migration-Source"
+	// BundleChecksumHeader アップロードするバンドル全体のSHA-256(16進数)を指定するヘッダ
+	BundleChecksumHeader = "X-Bundle-Checksum"
+)
+
+const (
+	// EventMigration マイグレーションを1件適用するごとに送るイベント名
+	EventMigration = "migration"
+	// EventResult 実行結果を送るイベント名
+	EventResult = "result"
+)
+
+// targetHandler 対象を受け取るハンドラ
+type targetHandler func(w http.ResponseWriter, r *http.Request, target *Target)
+
+// NewServeMux URLパスとハンドラの関係を定義したServeMuxを返す。
+// /targets/{name}/migrate/...、/targets/{name}/bundles...、/targets/{name}/requests...、
+// /targets/{name}/schedule、/targets/{name}/freezes... は名前で指定した対象を、
+// /migrate/...、/bundles...、/requests...、/schedule、/freezes... はdefaultの対象を操作する。
+// /migrate/up,downの成功時の応答は、従来通り適用記録(ID, AppliedAt)の配列とする
+func NewServeMux(targets *Targets) *http.ServeMux {
+	handlers := map[string]targetHandler{
+		"up":     execMigrateHandler(sqlmigrate.Up),
+		"down":   execMigrateHandler(sqlmigrate.Down),
+		"redo":   redoHandler,
+		"skip":   historyEditHandler(HistorySkip),
+		"unskip": historyEditHandler(HistoryUnskip),
+		"status": statusHandler,
+		"plan":   planHandler,
+		"verify": verifyHandler,
+		"lint":   lintHandler,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/targets", targetsHandler(targets))
+	mux.HandleFunc("/targets/", func(w http.ResponseWriter, r *http.Request) {
+		// /targets/{name}/migrate/{operation}
+		// /targets/{name}/bundles[/{version}/activate]
+		// /targets/{name}/requests[/{id}/{approve|reject}]
+		// /targets/{name}/schedule
+		// /targets/{name}/freezes[/{id}/lift]
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/targets/"), "/")
+		var handler targetHandler
+		switch {
+		case len(parts) == 3 && parts[1] == "migrate":
+			handler = handlers[parts[2]]
+		case len(parts) >= 2 && parts[1] == "bundles":
+			handler = bundleRoute(parts[2:])
+		case len(parts) >= 2 && parts[1] == "requests":
+			handler = approvalRoute(parts[2:])
+		case len(parts) == 2 && parts[1] == "schedule":
+			handler = scheduleHandler
+		case len(parts) >= 2 && parts[1] == "freezes":
+			handler = freezeRoute(parts[2:])
+		}
+		if handler == nil {
+			http.NotFound(w, r)
+			return
+		}
+		serveTarget(w, r, targets, parts[0], handler)
+	})
+	// 対象の前置きのない/migrate/up,downは、複数の対象に対応する前と同じ適用記録の配列を返す
+	legacy := map[string]targetHandler{
+		"up":   legacyMigrateHandler(sqlmigrate.Up),
+		"down": legacyMigrateHandler(sqlmigrate.Down),
+	}
+	for operation, handler := range handlers {
+		handler := handler
+		if legacyHandler, ok := legacy[operation]; ok {
+			handler = legacyHandler
+		}
+		mux.HandleFunc("/migrate/"+operation, func(w http.ResponseWriter, r *http.Request) {
+			serveTarget(w, r, targets, DefaultTargetName, handler)
+		})
+	}
+	mux.HandleFunc("/schedule", func(w http.ResponseWriter, r *http.Request) {
+		serveTarget(w, r, targets, DefaultTargetName, scheduleHandler)
+	})
+	for prefix, route := range map[string]func(parts []string) targetHandler{
+		"/bundles":  bundleRoute,
+		"/requests": approvalRoute,
+		"/freezes":  freezeRoute,
+	} {
+		serveDefault := defaultRoute(targets, prefix, route)
+		mux.HandleFunc(prefix, serveDefault)
+		mux.HandleFunc(prefix+"/", serveDefault)
+	}
+	return mux
+}
+
+// defaultRoute prefix以下のパスをrouteで解決し、defaultの対象を操作するハンドラを返す
+func defaultRoute(targets *Targets, prefix string, route func(parts []string) targetHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// {prefix}[/...]
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, prefix), "/")
+		handler := route(parts[1:])
+		if parts[0] != "" || handler == nil {
+			http.NotFound(w, r)
+			return
+		}
+		serveTarget(w, r, targets, DefaultTargetName, handler)
+	}
+}
+
+// serveTarget 名前に対応する対象を探してハンドラに渡す
+func serveTarget(w http.ResponseWriter, r *http.Request, targets *Targets, name string, handler targetHandler) {
+	target, ok := targets.Get(name)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, ErrorResponse{Error: "Unknown target: " + name})
+		return
+	}
+	handler(w, r, target)
+}
+
+// targetsHandler 接続元のネットワークからアクセスできる対象の一覧を返す
+func targetsHandler(targets *Targets) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := StartRequestSpan(r, "targets")
+		defer span.End()
+		r = r.WithContext(ctx)
+
+		var networks AllowedNetworks
+		infos := []TargetInfo{}
+		for _, target := range targets.List() {
+			if IsAllowedRequest(r, target.AllowedNetworks()) {
+				networks = append(networks, target.AllowedNetworks()...)
+				infos = append(infos, target.Info())
+			}
+		}
+
+		if _, ok := authorize(w, r, networks); !ok {
+			return
+		}
+		writeJSON(w, http.StatusOK, infos)
+	}
+}
+
+// authorize 接続元のネットワークと利用者を確認する。
+// 許可されない場合はレスポンスを書き込んでfalseを返す。
+// 許可された場合は利用者名をcontextに格納したリクエストを返す
+func authorize(w http.ResponseWriter, r *http.Request, networks AllowedNetworks) (*http.Request, bool) {
+	logger, _ := zap.NewProduction()
+	defer logger.Sync()
+
+	if !IsAllowedRequest(r, networks) {
+		logger.Warn(
+			"Access forbidden",
+		)
+		writeJSON(w, http.StatusForbidden, ErrorResponse{Error: "Access forbidden"})
+		return r, false
+	}
+
+	identity, err := Authenticate(r, AuthConfig)
+	if err != nil {
+		logger.Warn(
+			"Authentication failed",
+			zap.Error(err))
+		writeJSON(w, http.StatusUnauthorized, ErrorResponse{Error: err.Error()})
+		return r, false
+	}
+
+	return r.WithContext(WithIdentity(r.Context(), identity)), true
+}
+
+// writeJSON ステータスコードとJSONのレスポンスを書き込む
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	bytes, _ := json.Marshal(v)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%s\n", bytes)
+}
+
+// parseSteps クエリパラメータstepsを解釈する。指定がない場合はdefaultStepsを返す
+func parseSteps(r *http.Request, defaultSteps int) (int, error) {
+	value := r.URL.Query().Get("steps")
+	if value == "" {
+		return defaultSteps, nil
+	}
+
+	steps, err := strconv.Atoi(value)
+	if err != nil || steps < 0 {
+		return 0, fmt.Errorf("steps should be a non-negative integer: %s", value)
+	}
+	return steps, nil
+}
+
+// errorStatus エラーに対応するステータスコードを返す
+func errorStatus(err error) int {
+	var bundleError *BundleError
+	var driftError *DriftError
+	var scheduleError *ScheduleError
+	switch {
+	case errors.Is(err, ErrSchemaRequired), errors.Is(err, ErrNotBundleSource), errors.As(err, &bundleError),
+		errors.Is(err, ErrFreezePeriod), errors.Is(err, ErrRedoSteps),
+		errors.Is(err, ErrHistoryEditMigrations):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrApprovalRequired), errors.Is(err, ErrSelfApproval), errors.Is(err, ErrNotApprover),
+		errors.Is(err, ErrOverrideNotAuthorized), errors.Is(err, ErrHistoryEditNotAuthorized):
+		return http.StatusForbidden
+	case errors.Is(err, ErrBundleNotFound), errors.Is(err, ErrApprovalNotFound), errors.Is(err, ErrFreezeNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrBundleExists), errors.Is(err, ErrMigrationInProgress), errors.As(err, &driftError),
+		errors.Is(err, ErrConfirmationInvalid), errors.Is(err, ErrPlanChanged),
+		errors.Is(err, ErrApprovalNotApproved), errors.Is(err, ErrApprovalNotPending), errors.Is(err, ErrApprovalPlanChanged),
+		errors.Is(err, ErrFreezeConfigured),
+		errors.Is(err, ErrNotEnoughApplied), errors.Is(err, ErrRedoOrder),
+		errors.Is(err, ErrMigrationNotPending), errors.Is(err, ErrMigrationNotApplied):
+		return http.StatusConflict
+	case errors.As(err, &scheduleError):
+		return http.StatusLocked
+	case errors.Is(err, context.Canceled):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+// wantsEventStream クライアントがServer-Sent Eventsでの進捗の受け取りを求めているかを確認する
+func wantsEventStream(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// eventWriter Server-Sent Eventsを書き込む
+type eventWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+// newEventWriter Server-Sent Eventsのレスポンスを開始する。
+// ResponseWriterがFlushに対応していない場合はエラーを返す
+func newEventWriter(w http.ResponseWriter) (*eventWriter, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, errors.New("streaming is not supported")
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	return &eventWriter{w: w, flusher: flusher}, nil
+}
+
+// send イベントを1件書き込む
+func (writer *eventWriter) send(event string, v interface{}) {
+	bytes, _ := json.Marshal(v)
+	fmt.Fprintf(writer.w, "event: %s\ndata: %s\n\n", event, bytes)
+	writer.flusher.Flush()
+}
+
+// resultWriter マイグレーションの実行結果をレスポンスに書き込む関数
+type resultWriter func(w http.ResponseWriter, status int, result MigrationResult)
+
+// writeResult 実行結果をMigrationResultのJSONで書き込む
+func writeResult(w http.ResponseWriter, status int, result MigrationResult) {
+	writeJSON(w, status, result)
+}
+
+// writeLegacyResult 対象の前置きのない/migrate/up,downの従来の形式に合わせて、
+// 実行結果のうち適用記録の配列だけを書き込む
+func writeLegacyResult(w http.ResponseWriter, status int, result MigrationResult) {
+	writeJSON(w, status, result.Records)
+}
+
+// execMigrateHandler 指定された方向のマイグレーションを実行し、結果をMigrationResultで返すハンドラを返す
+func execMigrateHandler(direction sqlmigrate.MigrationDirection) targetHandler {
+	return migrateHandler(direction, writeResult)
+}
+
+// legacyMigrateHandler 指定された方向のマイグレーションを実行し、結果を適用記録の配列で返すハンドラを返す
+func legacyMigrateHandler(direction sqlmigrate.MigrationDirection) targetHandler {
+	return migrateHandler(direction, writeLegacyResult)
+}
+
+// migrateHandler 指定された方向のマイグレーションを実行し、結果をwriteで書き込むハンドラを返す。
+// 実行できる時間帯の外や凍結中は423を返す。クエリパラメータoverrideに理由を指定すると、許可された利用者は緊急実行できる。
+// 承認が必要な対象では、クエリパラメータrequestで承認済みの承認依頼を指定した場合だけ実行する。
+// 確認が必要な操作は実行せずに428と確認トークンを返し、クエリパラメータconfirmでトークンが指定された場合に実行する。
+// Acceptにtext/event-streamが指定された場合は、進捗をServer-Sent Eventsで返す
+func migrateHandler(direction sqlmigrate.MigrationDirection, write resultWriter) targetHandler {
+	return func(w http.ResponseWriter, r *http.Request, target *Target) {
+
+		logger, _ := zap.NewProduction()
+		defer logger.Sync()
+
+		ctx, span := StartRequestSpan(r, "migrate "+DirectionName(direction))
+		defer span.End()
+		span.SetAttributes(attribute.String("migration.target", target.Name))
+
+		// addresses check
+		r, ok := authorize(w, r.WithContext(ctx), target.AllowedNetworks())
+		if !ok {
+			return
+		}
+
+		// 承認依頼を指定してstepsを省略した場合は、依頼した件数を使う
+		requestID := r.URL.Query().Get("request")
+		defaultSteps := 0
+		if requestID != "" {
+			if request, err := findApproval(target, requestID); err == nil {
+				defaultSteps = request.Steps
+			}
+		}
+		steps, err := parseSteps(r, defaultSteps)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// 確認してから実行するまでに他の操作でソースや適用状況が変わらないように、先に実行権を取得する
+		if err := target.TryLock(); err != nil {
+			logger.Warn(
+				"Migration rejected",
+				zap.String("target", target.Name),
+				zap.Error(err))
+			result := NewMigrationResult(direction)
+			result.Finish(err)
+			write(w, http.StatusConflict, result)
+			return
+		}
+		defer target.Unlock()
+
+		if !checkSchedule(w, r, target) {
+			return
+		}
+
+		// 承認が必要な対象は、別の利用者が承認した承認依頼でだけ実行する
+		identity := IdentityFromContext(r.Context())
+		required, err := target.ApprovalRequired()
+		if err == nil && (required || requestID != "") {
+			err = checkApproval(r.Context(), target, requestID, direction, steps)
+		}
+		if err != nil {
+			logger.Warn(
+				"Migration rejected",
+				zap.String("target", target.Name),
+				zap.Error(err))
+			RecordAudit(AuditEvent{
+				Action: AuditMigrationRun, Target: target.Name, Identity: identity, RequestID: requestID,
+				Direction: DirectionName(direction), Steps: steps, Detail: err.Error(),
+			})
+			writeJSON(w, errorStatus(err), ErrorResponse{Error: err.Error()})
+			return
+		}
+
+		// Downとデータを失う文を含む操作は、実行予定を確認したトークンが指定された場合だけ実行する
+		confirmation, err := CheckConfirmation(r.Context(), target, identity,
+			direction, steps, r.URL.Query().Get("confirm"))
+		if confirmation != nil {
+			writeJSON(w, http.StatusPreconditionRequired, confirmation)
+			return
+		}
+
+		// migrationの実行
+		var progress func(id string)
+		var events *eventWriter
+		if wantsEventStream(r) {
+			var streamErr error
+			if events, streamErr = newEventWriter(w); streamErr != nil {
+				writeJSON(w, http.StatusNotAcceptable, ErrorResponse{Error: streamErr.Error()})
+				return
+			}
+			progress = func(id string) {
+				events.send(EventMigration, MigrationEvent{ID: id, Direction: DirectionName(direction)})
+			}
+		}
+
+		result := NewMigrationResult(direction)
+		if err != nil {
+			// 確認に失敗した場合も、実行結果として失敗を返す
+			result.Finish(err)
+		} else {
+			result, err = execMigrate(r.Context(), target, direction, steps, progress)
+			notifyMigration(target.Name, identity, result)
+			if requestID != "" {
+				completeApproval(requestID, identity, result)
+			}
+			audit := AuditEvent{
+				Action: AuditMigrationRun, Target: target.Name, Identity: identity, RequestID: requestID,
+				Direction: result.Direction, Steps: steps, Success: result.Success,
+				Detail: strings.Join(result.Applied, ","),
+			}
+			if result.Backup != nil {
+				audit.Backup = result.Backup.Path
+			}
+			RecordAudit(audit)
+		}
+		if err != nil {
+			logger.Error(
+				"Migration failed",
+				zap.Error(err))
+			EndSpan(span, err)
+		}
+
+		if events != nil {
+			events.send(EventResult, result)
+			return
+		}
+
+		status := http.StatusOK
+		if err != nil {
+			status = errorStatus(err)
+		}
+		write(w, status, result)
+	}
+}
+
+// checkSchedule 対象のマイグレーションを今実行できるかを確認する。
+// 実行できない場合は、クエリパラメータoverrideで理由を指定した許可された利用者だけ実行でき、監査記録に残す。
+// 実行できない場合はレスポンスを書き込んでfalseを返す
+func checkSchedule(w http.ResponseWriter, r *http.Request, target *Target) bool {
+	logger, _ := zap.NewProduction()
+	defer logger.Sync()
+
+	err := EnforceSchedule(r, target, IdentityFromContext(r.Context()), r.URL.Query().Get("override"))
+	if err == nil {
+		return true
+	}
+
+	logger.Warn(
+		"Migration rejected",
+		zap.String("target", target.Name),
+		zap.Error(err))
+	response := ErrorResponse{Error: err.Error()}
+	var scheduleError *ScheduleError
+	if errors.As(err, &scheduleError) {
+		response.NextAllowed = scheduleError.NextAllowed
+	}
+	writeJSON(w, errorStatus(err), response)
+	return false
+}
+
+// statusHandler マイグレーションの適用状況を返す。
+// スキーマごとに適用する対象の場合はクエリパラメータschemaでスキーマを指定する。
+// 使用しているソースはX-Migration-Sourceヘッダで返す
+func statusHandler(w http.ResponseWriter, r *http.Request, target *Target) {
+	ctx, span := StartRequestSpan(r, "migrate status")
+	defer span.End()
+
+	r, ok := authorize(w, r.WithContext(ctx), target.AllowedNetworks())
+	if !ok {
+		return
+	}
+
+	// どのソースのマイグレーションと比較したかをヘッダで返す
+	if source, err := target.SourceInfo(); err == nil {
+		w.Header().Set(MigrationSourceHeader, source.String())
+	}
+
+	statuses, err := GetMigrationStatus(r.Context(), target, r.URL.Query().Get("schema"))
+	if err != nil {
+		EndSpan(span, err)
+		writeJSON(w, errorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+// planHandler マイグレーションを実行せずに、実行予定のマイグレーションを返す。
+// スキーマごとに適用する対象の場合はクエリパラメータschemaでスキーマを指定する
+func planHandler(w http.ResponseWriter, r *http.Request, target *Target) {
+	ctx, span := StartRequestSpan(r, "migrate plan")
+	defer span.End()
+
+	r, ok := authorize(w, r.WithContext(ctx), target.AllowedNetworks())
+	if !ok {
+		return
+	}
+
+	direction, err := ParseDirection(r.URL.Query().Get("direction"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	steps, err := parseSteps(r, 0)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	plan, err := GetMigrationPlan(r.Context(), target, r.URL.Query().Get("schema"), direction, steps)
+	if err != nil {
+		EndSpan(span, err)
+		writeJSON(w, errorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, plan)
+}
+
+// verifyHandler 適用済みのマイグレーションが適用後に変更または削除されていないかを返す。
+// スキーマごとに適用する対象の場合はクエリパラメータschemaでスキーマを指定する
+func verifyHandler(w http.ResponseWriter, r *http.Request, target *Target) {
+	ctx, span := StartRequestSpan(r, "migrate verify")
+	defer span.End()
+
+	r, ok := authorize(w, r.WithContext(ctx), target.AllowedNetworks())
+	if !ok {
+		return
+	}
+
+	report, err := VerifyChecksums(r.Context(), target, r.URL.Query().Get("schema"))
+	if err != nil {
+		EndSpan(span, err)
+		writeJSON(w, errorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// lintHandler 対象のソースのマイグレーションに含まれる危険なSQLの指摘を返す
+func lintHandler(w http.ResponseWriter, r *http.Request, target *Target) {
+	ctx, span := StartRequestSpan(r, "migrate lint")
+	defer span.End()
+
+	r, ok := authorize(w, r.WithContext(ctx), target.AllowedNetworks())
+	if !ok {
+		return
+	}
+
+	report, err := LintTarget(r.Context(), target)
+	if err != nil {
+		EndSpan(span, err)
+		writeJSON(w, errorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// notifyMigration マイグレーションの実行結果を設定されたWebhookに通知する
+func notifyMigration(target string, requester string, result MigrationResult) {
+
+	logger, _ := zap.NewProduction()
+	defer logger.Sync()
+
+	notifier, err := NewNotifier(NotificationConfig)
+	if err != nil {
+		logger.Error(
+			"Notifier setup failed",
+			zap.Error(err))
+		return
+	}
+	if notifier == nil {
+		return
+	}
+
+	notification := Notification{
+		Target:    target,
+		Direction: result.Direction,
+		Applied:   result.Applied,
+		Duration:  time.Duration(result.DurationMillis) * time.Millisecond,
+		Requester: requester,
+		Success:   result.Success,
+		Error:     result.Error,
+	}
+
+	// 通知の失敗やリトライでレスポンスを遅らせないように非同期で送る
+	go func() {
+		if err := notifier.Notify(notification); err != nil {
+			logger.Error(
+				"Notification failed",
+				zap.String("url", notifier.URL),
+				zap.Error(err))
+		}
+	}()
+}
+
+// bundleRoute /bundles以下のパスに対応するハンドラを返す。対応するハンドラがない場合はnilを返す
+func bundleRoute(parts []string) targetHandler {
+	switch {
+	case len(parts) == 0:
+		return bundlesHandler
+	case len(parts) == 2 && parts[1] == "activate":
+		version := parts[0]
+		return func(w http.ResponseWriter, r *http.Request, target *Target) {
+			activateBundleHandler(w, r, target, version)
+		}
+	}
+	return nil
+}
+
+// bundlesHandler GETの場合は格納されているバンドルの一覧を返し、POSTの場合はバンドルを受け付ける
+func bundlesHandler(w http.ResponseWriter, r *http.Request, target *Target) {
+	switch r.Method {
+	case http.MethodGet:
+		listBundlesHandler(w, r, target)
+	case http.MethodPost:
+		uploadBundleHandler(w, r, target)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "Method not allowed"})
+	}
+}
+
+// listBundlesHandler 格納されているバンドルを新しい順に返す
+func listBundlesHandler(w http.ResponseWriter, r *http.Request, target *Target) {
+	ctx, span := StartRequestSpan(r, "bundle list")
+	defer span.End()
+
+	r, ok := authorize(w, r.WithContext(ctx), target.AllowedNetworks())
+	if !ok {
+		return
+	}
+
+	bundles, err := ListBundles(target)
+	if err != nil {
+		EndSpan(span, err)
+		writeJSON(w, errorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, bundles)
+}
+
+// uploadBundleHandler tar.gzまたはzipのバンドルを受け付けて検証し、有効なバンドルとして格納する。
+// クエリパラメータapplyにtrueを指定した場合は、格納したバンドルのマイグレーションをそのまま適用する。
+// 適用に失敗した場合は、アップロード前に有効だったバンドルに戻す。
+// 適用に確認が必要な場合は202と確認トークンを返す。
+// X-Bundle-Checksumヘッダが指定された場合は、バンドル全体のSHA-256と一致することを確認する
+func uploadBundleHandler(w http.ResponseWriter, r *http.Request, target *Target) {
+
+	logger, _ := zap.NewProduction()
+	defer logger.Sync()
+
+	ctx, span := StartRequestSpan(r, "bundle upload")
+	defer span.End()
+	span.SetAttributes(attribute.String("migration.target", target.Name))
+
+	r, ok := authorize(w, r.WithContext(ctx), target.AllowedNetworks())
+	if !ok {
+		return
+	}
+	// バンドルは任意のSQLを実行できるため、接続元のアドレスだけでは受け付けない
+	if !HasCredentials(r, AuthConfig) {
+		writeJSON(w, http.StatusUnauthorized, ErrorResponse{Error: CredentialsRequiredErrorMessage})
+		return
+	}
+
+	apply := false
+	if value := r.URL.Query().Get("apply"); value != "" {
+		var err error
+		if apply, err = strconv.ParseBool(value); err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "apply should be true or false: " + value})
+			return
+		}
+	}
+	// 承認が必要な対象では、アップロードしたバンドルは承認依頼を通して適用する
+	if required, err := target.ApprovalRequired(); apply && (required || err != nil) {
+		writeJSON(w, http.StatusForbidden, ErrorResponse{Error: ErrApprovalRequired.Error()})
+		return
+	}
+	if apply && !checkSchedule(w, r, target) {
+		return
+	}
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxBundleSize))
+	if err != nil {
+		writeJSON(w, http.StatusRequestEntityTooLarge, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if checksum := r.Header.Get(BundleChecksumHeader); checksum != "" && !strings.EqualFold(checksum, ChecksumBundle(data)) {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: "Bundle checksum mismatch"})
+		return
+	}
+
+	// マイグレーションの実行中にソースを差し替えないように、実行権を取得してから格納する
+	if err := target.TryLock(); err != nil {
+		writeJSON(w, http.StatusConflict, ErrorResponse{Error: err.Error()})
+		return
+	}
+	defer target.Unlock()
+
+	identity := IdentityFromContext(r.Context())
+	previous, _ := target.activeBundle()
+	info, err := StoreBundle(target, data, identity)
+	if err != nil {
+		logger.Warn(
+			"Bundle rejected",
+			zap.String("target", target.Name),
+			zap.Error(err))
+		EndSpan(span, err)
+		writeJSON(w, errorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	upload := BundleUpload{Bundle: info}
+	status := http.StatusCreated
+	if apply {
+		// データを失う文を含む場合は適用せずに確認トークンを返す。
+		// 確認トークンはアップロードしたバンドルの実行予定に対して発行するため、バンドルは有効なままにする
+		confirmation, err := CheckConfirmation(r.Context(), target, identity, sqlmigrate.Up, 0, "")
+		switch {
+		case err != nil:
+			result := NewMigrationResult(sqlmigrate.Up)
+			result.Finish(err)
+			upload.Result = &result
+			RecordAudit(AuditEvent{
+				Action: AuditMigrationRun, Target: target.Name, Identity: identity,
+				Direction: result.Direction, Detail: "bundle " + info.Version + ": " + err.Error(),
+			})
+		case confirmation != nil:
+			upload.Confirmation = confirmation
+			status = http.StatusAccepted
+		default:
+			var result MigrationResult
+			result, err = execMigrate(r.Context(), target, sqlmigrate.Up, 0, nil)
+			notifyMigration(target.Name, identity, result)
+			upload.Result = &result
+			audit := AuditEvent{
+				Action: AuditMigrationRun, Target: target.Name, Identity: identity,
+				Direction: result.Direction, Success: result.Success,
+				Detail: "bundle " + info.Version + ": " + strings.Join(result.Applied, ","),
+			}
+			if result.Backup != nil {
+				audit.Backup = result.Backup.Path
+			}
+			RecordAudit(audit)
+		}
+		if err != nil {
+			logger.Error(
+				"Migration failed",
+				zap.String("target", target.Name),
+				zap.String("version", info.Version),
+				zap.Error(err))
+			EndSpan(span, err)
+			status = errorStatus(err)
+
+			// 適用に失敗したバンドルは有効にせず、アップロード前のバンドルに戻す
+			if restoreErr := restoreBundle(target, previous); restoreErr != nil {
+				logger.Error(
+					"Bundle restore failed",
+					zap.String("target", target.Name),
+					zap.String("version", previous),
+					zap.Error(restoreErr))
+			} else {
+				upload.Bundle.Active = false
+			}
+		}
+	}
+	writeJSON(w, status, upload)
+}
+
+// activateBundleHandler 格納済みのバンドルを有効なバンドルにする。以前のバンドルに戻す場合に使う
+func activateBundleHandler(w http.ResponseWriter, r *http.Request, target *Target, version string) {
+	ctx, span := StartRequestSpan(r, "bundle activate")
+	defer span.End()
+	span.SetAttributes(attribute.String("migration.target", target.Name))
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "Method not allowed"})
+		return
+	}
+
+	r, ok := authorize(w, r.WithContext(ctx), target.AllowedNetworks())
+	if !ok {
+		return
+	}
+	if !HasCredentials(r, AuthConfig) {
+		writeJSON(w, http.StatusUnauthorized, ErrorResponse{Error: CredentialsRequiredErrorMessage})
+		return
+	}
+
+	if err := target.TryLock(); err != nil {
+		writeJSON(w, http.StatusConflict, ErrorResponse{Error: err.Error()})
+		return
+	}
+	defer target.Unlock()
+
+	info, err := ActivateBundle(target, version)
+	if err != nil {
+		EndSpan(span, err)
+		writeJSON(w, errorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// approvalRoute /requests以下のパスに対応するハンドラを返す。対応するハンドラがない場合はnilを返す
+func approvalRoute(parts []string) targetHandler {
+	switch {
+	case len(parts) == 0:
+		return approvalsHandler
+	case len(parts) == 2 && (parts[1] == "approve" || parts[1] == "reject"):
+		id, approve := parts[0], parts[1] == "approve"
+		return func(w http.ResponseWriter, r *http.Request, target *Target) {
+			reviewApprovalHandler(w, r, target, id, approve)
+		}
+	}
+	return nil
+}
+
+// approvalsHandler GETの場合は承認依頼の一覧を返し、POSTの場合は承認依頼を登録する
+func approvalsHandler(w http.ResponseWriter, r *http.Request, target *Target) {
+	switch r.Method {
+	case http.MethodGet:
+		listApprovalsHandler(w, r, target)
+	case http.MethodPost:
+		submitApprovalHandler(w, r, target)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "Method not allowed"})
+	}
+}
+
+// listApprovalsHandler 対象の承認依頼を新しい順に返す
+func listApprovalsHandler(w http.ResponseWriter, r *http.Request, target *Target) {
+	ctx, span := StartRequestSpan(r, "request list")
+	defer span.End()
+
+	if _, ok := authorize(w, r.WithContext(ctx), target.AllowedNetworks()); !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, ListApprovals(target))
+}
+
+// submitApprovalHandler クエリパラメータdirectionとstepsで指定したマイグレーションの承認依頼を登録する
+func submitApprovalHandler(w http.ResponseWriter, r *http.Request, target *Target) {
+	ctx, span := StartRequestSpan(r, "request submit")
+	defer span.End()
+	span.SetAttributes(attribute.String("migration.target", target.Name))
+
+	r, ok := authorize(w, r.WithContext(ctx), target.AllowedNetworks())
+	if !ok {
+		return
+	}
+	// 依頼者と承認者を区別するため、接続元のアドレスだけでは受け付けない
+	if !HasCredentials(r, AuthConfig) {
+		writeJSON(w, http.StatusUnauthorized, ErrorResponse{Error: CredentialsRequiredErrorMessage})
+		return
+	}
+
+	direction, err := ParseDirection(r.URL.Query().Get("direction"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	steps, err := parseSteps(r, 0)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	request, err := SubmitApproval(r.Context(), target, IdentityFromContext(r.Context()), direction, steps)
+	if err != nil {
+		EndSpan(span, err)
+		writeJSON(w, errorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusCreated, request)
+}
+
+// reviewApprovalHandler 承認依頼を承認または却下する。依頼者とは別の認証された利用者だけが操作できる
+func reviewApprovalHandler(w http.ResponseWriter, r *http.Request, target *Target, id string, approve bool) {
+	ctx, span := StartRequestSpan(r, "request review")
+	defer span.End()
+	span.SetAttributes(attribute.String("migration.target", target.Name))
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "Method not allowed"})
+		return
+	}
+
+	r, ok := authorize(w, r.WithContext(ctx), target.AllowedNetworks())
+	if !ok {
+		return
+	}
+	if !HasCredentials(r, AuthConfig) {
+		writeJSON(w, http.StatusUnauthorized, ErrorResponse{Error: CredentialsRequiredErrorMessage})
+		return
+	}
+
+	request, err := ReviewApproval(target, id, IdentityFromContext(r.Context()), approve)
+	if err != nil {
+		EndSpan(span, err)
+		writeJSON(w, errorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, request)
+}
+
+// scheduleHandler 対象のマイグレーションを実行できる時間帯と凍結の状況を返す
+func scheduleHandler(w http.ResponseWriter, r *http.Request, target *Target) {
+	ctx, span := StartRequestSpan(r, "schedule")
+	defer span.End()
+
+	if _, ok := authorize(w, r.WithContext(ctx), target.AllowedNetworks()); !ok {
+		return
+	}
+	status, err := CheckSchedule(target, time.Now())
+	var scheduleError *ScheduleError
+	if err != nil && !errors.As(err, &scheduleError) {
+		EndSpan(span, err)
+		writeJSON(w, errorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// freezeRoute /freezes以下のパスに対応するハンドラを返す。対応するハンドラがない場合はnilを返す
+func freezeRoute(parts []string) targetHandler {
+	switch {
+	case len(parts) == 0:
+		return freezesHandler
+	case len(parts) == 2 && parts[1] == "lift":
+		id := parts[0]
+		return func(w http.ResponseWriter, r *http.Request, target *Target) {
+			liftFreezeHandler(w, r, target, id)
+		}
+	}
+	return nil
+}
+
+// freezesHandler GETの場合は現在と今後の凍結を返し、POSTの場合は凍結を開始する
+func freezesHandler(w http.ResponseWriter, r *http.Request, target *Target) {
+	switch r.Method {
+	case http.MethodGet:
+		ctx, span := StartRequestSpan(r, "freeze list")
+		defer span.End()
+
+		if _, ok := authorize(w, r.WithContext(ctx), target.AllowedNetworks()); !ok {
+			return
+		}
+		list, err := targetFreezes(target, time.Now())
+		if err != nil {
+			EndSpan(span, err)
+			writeJSON(w, errorStatus(err), ErrorResponse{Error: err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, list)
+	case http.MethodPost:
+		startFreezeHandler(w, r, target)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "Method not allowed"})
+	}
+}
+
+// startFreezeHandler 対象のマイグレーションを凍結する。
+// 終了時刻はクエリパラメータuntil(RFC3339)またはduration、理由はreasonで指定する
+func startFreezeHandler(w http.ResponseWriter, r *http.Request, target *Target) {
+	ctx, span := StartRequestSpan(r, "freeze start")
+	defer span.End()
+	span.SetAttributes(attribute.String("migration.target", target.Name))
+
+	r, ok := authorize(w, r.WithContext(ctx), target.AllowedNetworks())
+	if !ok {
+		return
+	}
+	if !HasCredentials(r, AuthConfig) {
+		writeJSON(w, http.StatusUnauthorized, ErrorResponse{Error: CredentialsRequiredErrorMessage})
+		return
+	}
+
+	var end time.Time
+	query := r.URL.Query()
+	switch {
+	case query.Get("until") != "":
+		var err error
+		if end, err = time.Parse(time.RFC3339, query.Get("until")); err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: FreezePeriodErrorMessage})
+			return
+		}
+	case query.Get("duration") != "":
+		duration, err := time.ParseDuration(query.Get("duration"))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: FreezePeriodErrorMessage})
+			return
+		}
+		end = time.Now().Add(duration)
+	}
+
+	freeze, err := StartFreeze(target, IdentityFromContext(r.Context()), end, query.Get("reason"))
+	if err != nil {
+		EndSpan(span, err)
+		writeJSON(w, errorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusCreated, freeze)
+}
+
+// liftFreezeHandler APIで開始した凍結を解除する
+func liftFreezeHandler(w http.ResponseWriter, r *http.Request, target *Target, id string) {
+	ctx, span := StartRequestSpan(r, "freeze lift")
+	defer span.End()
+	span.SetAttributes(attribute.String("migration.target", target.Name))
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "Method not allowed"})
+		return
+	}
+
+	r, ok := authorize(w, r.WithContext(ctx), target.AllowedNetworks())
+	if !ok {
+		return
+	}
+	if !HasCredentials(r, AuthConfig) {
+		writeJSON(w, http.StatusUnauthorized, ErrorResponse{Error: CredentialsRequiredErrorMessage})
+		return
+	}
+
+	freeze, err := LiftFreeze(target, IdentityFromContext(r.Context()), id)
+	if err != nil {
+		EndSpan(span, err)
+		writeJSON(w, errorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, freeze)
+}
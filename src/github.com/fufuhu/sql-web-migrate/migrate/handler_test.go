@@ -0,0 +1,286 @@
+package migrate
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testMigrations テストで適用するマイグレーション
+var testMigrations = map[string]string{
+	"01-users.sql": "-- +migrate Up\nCREATE TABLE users (id integer primary key);\n" +
+		"-- +migrate Down\nDROP TABLE users;\n",
+	"02-posts.sql": "-- +migrate Up\nCREATE TABLE posts (id integer primary key, user_id integer references users(id));\n" +
+		"-- +migrate Down\nDROP TABLE posts;\n",
+}
+
+// setupSQLiteTargets SQLiteのDBファイルとマイグレーションを一時ディレクトリに用意し、
+// それを対象とするTargetsを返す。migrationsで追加のマイグレーションを指定できる
+func setupSQLiteTargets(t *testing.T, migrations map[string]string) (*Targets, func()) {
+	dir, err := ioutil.TempDir("", "handler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sourcePath := filepath.Join(dir, "migrations")
+	os.Mkdir(sourcePath, 0755)
+	for _, files := range []map[string]string{testMigrations, migrations} {
+		for name, content := range files {
+			if err := ioutil.WriteFile(filepath.Join(sourcePath, name), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	file := map[string]interface{}{
+		"targets": []map[string]interface{}{{
+			"name":            "local",
+			"dialect":         DialectSQLite,
+			"dbname":          filepath.Join(dir, "local.db"),
+			"sourcePath":      sourcePath,
+			"allowedNetworks": []string{"192.0.2.0/24"},
+		}},
+	}
+	bytes, _ := json.Marshal(file)
+	path := writeTargetsFile(t, string(bytes))
+	defer os.Remove(path)
+
+	targets, err := LoadTargets(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return targets, func() {
+		targets.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// serve ServeMuxにリクエストを送り、レスポンスを返す
+func serve(mux *http.ServeMux, method string, path string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	for key, values := range header {
+		r.Header[key] = values
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+// serveConfirmed 確認が必要な操作をPOSTし、返された確認トークンを付けてもう一度POSTする
+func serveConfirmed(t *testing.T, mux *http.ServeMux, path string) *httptest.ResponseRecorder {
+	w := serve(mux, http.MethodPost, path, nil)
+	if w.Code != http.StatusPreconditionRequired {
+		return w
+	}
+	var confirmation Confirmation
+	decode(t, w, &confirmation)
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+	return serve(mux, http.MethodPost, path+separator+"confirm="+confirmation.Token, nil)
+}
+
+// decode レスポンスのJSONをvに格納する
+func decode(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatal(w.Body.String(), err)
+	}
+}
+
+// TestHandlerLegacyMigrateResponse 対象の前置きのない/migrate/up,downは
+// 従来通り適用記録の配列を返すことを確認する。
+func TestHandlerLegacyMigrateResponse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "handler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sourcePath := filepath.Join(dir, "migrations")
+	os.Mkdir(sourcePath, 0755)
+	for name, content := range testMigrations {
+		ioutil.WriteFile(filepath.Join(sourcePath, name), []byte(content), 0644)
+	}
+	path := writeTargetsFile(t, `{"targets": [{"name": "`+DefaultTargetName+`", "dialect": "`+DialectSQLite+
+		`", "dbname": "`+filepath.Join(dir, "default.db")+`", "sourcePath": "`+sourcePath+
+		`", "allowedNetworks": ["192.0.2.0/24"]}]}`)
+	defer os.Remove(path)
+	targets, err := LoadTargets(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer targets.Close()
+	mux := NewServeMux(targets)
+
+	w := serve(mux, http.MethodPost, "/migrate/up", nil)
+	var records []LogRecord
+	decode(t, w, &records)
+	if w.Code != http.StatusOK || len(records) != 2 || records[0].ID != "01-users.sql" ||
+		!strings.Contains(w.Body.String(), `"AppliedAt":`) {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+
+	w = serveConfirmed(t, mux, "/migrate/down?steps=1")
+	records = nil
+	decode(t, w, &records)
+	if w.Code != http.StatusOK || len(records) != 1 || records[0].ID != "01-users.sql" {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+
+	// 対象を指定したパスはMigrationResultを返す
+	w = serve(mux, http.MethodPost, "/targets/"+DefaultTargetName+"/migrate/up", nil)
+	var result MigrationResult
+	decode(t, w, &result)
+	if w.Code != http.StatusOK || len(result.Applied) != 1 || result.Applied[0] != "02-posts.sql" {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+}
+
+// TestHandlerUpStatusDown マイグレーションの適用、適用状況、実行予定、
+// 指定件数のロールバックがHTTP経由で一通り動くことを確認する。
+func TestHandlerUpStatusDown(t *testing.T) {
+	targets, cleanup := setupSQLiteTargets(t, nil)
+	defer cleanup()
+	mux := NewServeMux(targets)
+
+	w := serve(mux, http.MethodPost, "/targets/local/migrate/up", nil)
+	body := w.Body.String()
+	var result MigrationResult
+	decode(t, w, &result)
+	if w.Code != http.StatusOK || !result.Success || len(result.Applied) != 2 || len(result.Records) != 2 {
+		t.Log(body)
+		t.Fail()
+	}
+	// 適用記録のキーは既存のクライアントが使っているフィールド名のままにする
+	if !strings.Contains(body, `"ID":"01-users.sql"`) || !strings.Contains(body, `"AppliedAt":`) {
+		t.Log(body)
+		t.Fail()
+	}
+
+	w = serve(mux, http.MethodGet, "/targets/local/migrate/status", nil)
+	var statuses []MigrationStatus
+	decode(t, w, &statuses)
+	if w.Code != http.StatusOK || len(statuses) != 2 || !statuses[0].Applied || !statuses[1].Applied {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+
+	w = serve(mux, http.MethodGet, "/targets/local/migrate/plan?direction=down&steps=1", nil)
+	var plan MigrationPlan
+	decode(t, w, &plan)
+	if w.Code != http.StatusOK || len(plan.Migrations) != 1 || plan.Migrations[0].ID != "02-posts.sql" ||
+		plan.Migrations[0].Statements[0] != "DROP TABLE posts;\n" {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+
+	// downは確認トークンを付けた2回目のリクエストで実行される
+	w = serve(mux, http.MethodPost, "/targets/local/migrate/down?steps=1", nil)
+	var confirmation Confirmation
+	decode(t, w, &confirmation)
+	if w.Code != http.StatusPreconditionRequired || confirmation.Token == "" || len(confirmation.Migrations) != 1 {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+
+	w = serve(mux, http.MethodPost, "/targets/local/migrate/down?steps=1&confirm="+confirmation.Token, nil)
+	result = MigrationResult{}
+	decode(t, w, &result)
+	if w.Code != http.StatusOK || len(result.Applied) != 1 || result.Applied[0] != "02-posts.sql" {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+
+	w = serve(mux, http.MethodGet, "/targets/local/migrate/status", nil)
+	statuses = nil
+	decode(t, w, &statuses)
+	if len(statuses) != 2 || !statuses[0].Applied || statuses[1].Applied {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+}
+
+// TestHandlerUpEventStream Server-Sent Eventsで1件ごとの進捗と実行結果が送られることを確認する。
+func TestHandlerUpEventStream(t *testing.T) {
+	targets, cleanup := setupSQLiteTargets(t, nil)
+	defer cleanup()
+
+	w := serve(NewServeMux(targets), http.MethodPost, "/targets/local/migrate/up",
+		http.Header{"Accept": {"text/event-stream"}})
+
+	body := w.Body.String()
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") ||
+		strings.Count(body, "event: "+EventMigration+"\n") != 2 ||
+		strings.Index(body, "01-users.sql") > strings.Index(body, "02-posts.sql") ||
+		!strings.Contains(body, "event: "+EventResult+"\n") {
+		t.Log(body)
+		t.Fail()
+	}
+}
+
+// TestHandlerMigrationError 途中のマイグレーションが失敗した場合に500と、
+// 失敗までに適用したマイグレーションが返ることを確認する。
+func TestHandlerMigrationError(t *testing.T) {
+	targets, cleanup := setupSQLiteTargets(t, map[string]string{
+		"03-broken.sql": "-- +migrate Up\nCREATE TABLE broken (;\n-- +migrate Down\n",
+	})
+	defer cleanup()
+
+	w := serve(NewServeMux(targets), http.MethodPost, "/targets/local/migrate/up", nil)
+	var result MigrationResult
+	decode(t, w, &result)
+	if w.Code != http.StatusInternalServerError || result.Success || len(result.Applied) != 2 || result.Error == "" {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+}
+
+// TestHandlerMigrationInProgress 同じ対象のマイグレーションが実行中の場合に409が返ることを確認する。
+func TestHandlerMigrationInProgress(t *testing.T) {
+	targets, cleanup := setupSQLiteTargets(t, nil)
+	defer cleanup()
+
+	target, _ := targets.Get("local")
+	target.TryLock()
+	defer target.Unlock()
+
+	w := serve(NewServeMux(targets), http.MethodPost, "/targets/local/migrate/up", nil)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), MigrationInProgressErrorMessage) {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+}
+
+// TestHandlerTargets 対象の一覧と、存在しない対象やパスへのリクエストを確認する。
+func TestHandlerTargets(t *testing.T) {
+	targets, cleanup := setupSQLiteTargets(t, nil)
+	defer cleanup()
+	mux := NewServeMux(targets)
+
+	w := serve(mux, http.MethodGet, "/targets", nil)
+	var infos []TargetInfo
+	decode(t, w, &infos)
+	if w.Code != http.StatusOK || len(infos) != 1 || infos[0].Name != "local" || infos[0].Dialect != DialectSQLite {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+
+	for path, expected := range map[string]int{
+		"/targets/missing/migrate/status": http.StatusNotFound,
+		"/targets/local/migrate/unknown":  http.StatusNotFound,
+		"/targets/local":                  http.StatusNotFound,
+		"/migrate/status":                 http.StatusNotFound,
+	} {
+		if w := serve(mux, http.MethodGet, path, nil); w.Code != expected {
+			t.Log(path, w.Code)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+	sqlmigrate "github.com/rubenv/sql-migrate"
+)
+
+const (
+	// MigrationTable マイグレーションの適用記録を格納するテーブル名を指定するための環境変数
+	MigrationTable = "SQL_MIGRATE_TABLE"
+	// MigrationSchema マイグレーションの適用記録を格納するテーブルのスキーマを指定するための環境変数
+	MigrationSchema = "SQL_MIGRATE_SCHEMA"
+)
+
+const (
+	// DefaultMigrationTable デフォルトの適用記録のテーブル名(sql-migrateのデフォルト)
+	DefaultMigrationTable = "gorp_migrations"
+	// DefaultMigrationSchema デフォルトの適用記録のスキーマ(空文字の場合はsearch_pathに従う)
+	DefaultMigrationSchema = ""
+)
+
+// GetMigrationTable 適用記録のテーブル名を取得する。
+// 環境変数が設定されていない場合は、DefaultMigrationTableの値を返す
+func GetMigrationTable() string {
+	return getValue(MigrationTable, DefaultMigrationTable)
+}
+
+// GetMigrationSchema 適用記録のテーブルのスキーマを取得する。
+// 環境変数が設定されていない場合は、DefaultMigrationSchemaの値を返す
+func GetMigrationSchema() string {
+	return getValue(MigrationSchema, DefaultMigrationSchema)
+}
+
+// HistoryConfigStruct 適用記録のテーブルの設定
+// Table テーブル名
+// Schema テーブルのスキーマ
+type HistoryConfigStruct struct {
+	Table  func() string
+	Schema func() string
+}
+
+// HistoryConfig 適用記録のテーブルの設定です
+var HistoryConfig HistoryConfigStruct
+
+// historySchemaQuery 適用記録のスキーマを作成するためのDBの種類ごとのクエリ
+// exists スキーマの存在を確認するクエリ
+// quote スキーマ名を識別子として引用符で囲む関数
+type historySchemaQuery struct {
+	exists string
+	quote  func(name string) string
+}
+
+// historySchemaQueries DBの種類ごとの適用記録のスキーマを作成するためのクエリ
+var historySchemaQueries = map[string]historySchemaQuery{
+	DialectPostgres: {
+		exists: "select count(*) from pg_namespace where nspname = $1",
+		quote:  pq.QuoteIdentifier,
+	},
+	DialectMySQL: {
+		exists: "select count(*) from information_schema.schemata where schema_name = ?",
+		quote: func(name string) string {
+			return "`" + strings.Replace(name, "`", "``", -1) + "`"
+		},
+	},
+}
+
+// migrationSet 対象の適用記録のテーブルを使うMigrationSetを返す。
+// スキーマごとに適用する場合は、適用記録のテーブルを設定したスキーマではなくschemaに作成する
+func (target *Target) migrationSet(schema string) sqlmigrate.MigrationSet {
+	set := sqlmigrate.MigrationSet{}
+	if target.History.Table != nil {
+		set.TableName = target.History.Table()
+		set.SchemaName = target.History.Schema()
+	}
+	if schema != "" {
+		set.SchemaName = schema
+	}
+	return set
+}
+
+// historyTable setの適用記録のテーブル名を返す
+func historyTable(dialect string, set sqlmigrate.MigrationSet) string {
+	table := set.TableName
+	if table == "" {
+		table = DefaultMigrationTable
+	}
+	name := quoteIdentifier(dialect, table)
+	if set.SchemaName != "" {
+		name = quoteIdentifier(dialect, set.SchemaName) + "." + name
+	}
+	return name
+}
+
+// ensureHistorySchema 適用記録のテーブルのスキーマが存在しない場合は作成する
+func ensureHistorySchema(ctx context.Context, db *sql.DB, dialect string, set sqlmigrate.MigrationSet) (err error) {
+	if set.SchemaName == "" {
+		return nil
+	}
+
+	ctx, span := Tracer().Start(ctx, "create history schema")
+	defer func() { EndSpan(span, err) }()
+
+	queries, ok := historySchemaQueries[dialect]
+	if !ok {
+		return fmt.Errorf("history schema is not supported by %s", dialect)
+	}
+
+	// CREATE権限のないユーザでも既存のスキーマは使えるように、先に存在を確認する
+	var count int
+	err = db.QueryRowContext(ctx, queries.exists, set.SchemaName).Scan(&count)
+	if err != nil || count > 0 {
+		return err
+	}
+
+	_, err = db.ExecContext(ctx, "create schema if not exists "+queries.quote(set.SchemaName))
+	return err
+}
+
+func init() {
+	HistoryConfig = HistoryConfigStruct{
+		Table:  GetMigrationTable,
+		Schema: GetMigrationSchema,
+	}
+}
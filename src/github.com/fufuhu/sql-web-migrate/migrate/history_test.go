@@ -0,0 +1,76 @@
+package migrate
+
+import (
+	"os"
+	"testing"
+)
+
+// TestGetMigrationHistorySettings 適用記録のテーブル名とスキーマの設定値と
+// デフォルト値を確認する。
+func TestGetMigrationHistorySettings(t *testing.T) {
+	if GetMigrationTable() != DefaultMigrationTable || GetMigrationSchema() != DefaultMigrationSchema {
+		t.Fail()
+	}
+
+	os.Setenv(MigrationTable, "schema_history")
+	os.Setenv(MigrationSchema, "migrate")
+	defer os.Unsetenv(MigrationTable)
+	defer os.Unsetenv(MigrationSchema)
+
+	if GetMigrationTable() != "schema_history" || GetMigrationSchema() != "migrate" {
+		t.Fail()
+	}
+}
+
+// TestMigrationSet 対象の適用記録の設定がMigrationSetに渡され、
+// スキーマごとに適用する場合はそのスキーマが使われることを確認する。
+func TestMigrationSet(t *testing.T) {
+	os.Setenv(MigrationTable, "schema_history")
+	os.Setenv(MigrationSchema, "migrate")
+	defer os.Unsetenv(MigrationTable)
+	defer os.Unsetenv(MigrationSchema)
+
+	target := NewDefaultTarget()
+	set := target.migrationSet("")
+	if set.TableName != "schema_history" || set.SchemaName != "migrate" {
+		t.Log(set)
+		t.Fail()
+	}
+
+	set = target.migrationSet("tenant_a")
+	if set.TableName != "schema_history" || set.SchemaName != "tenant_a" {
+		t.Log(set)
+		t.Fail()
+	}
+
+	set = (&Target{}).migrationSet("")
+	if set.TableName != "" || set.SchemaName != "" {
+		t.Fail()
+	}
+}
+
+// TestLoadTargetsHistory ファイルで対象ごとに適用記録のテーブルを設定でき、
+// 省略した場合はデフォルト値が使われることを確認する。
+func TestLoadTargetsHistory(t *testing.T) {
+	path := writeTargetsFile(t, `{"targets": [
+		{"name": "shared", "sourcePath": "/a", "migrationTable": "app_migrations", "migrationSchema": "ops"},
+		{"name": "plain", "sourcePath": "/b"}
+	]}`)
+	defer os.Remove(path)
+
+	targets, err := LoadTargets(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shared, _ := targets.Get("shared")
+	if set := shared.migrationSet(""); set.TableName != "app_migrations" || set.SchemaName != "ops" {
+		t.Log(set)
+		t.Fail()
+	}
+	plain, _ := targets.Get("plain")
+	if set := plain.migrationSet(""); set.TableName != DefaultMigrationTable || set.SchemaName != "" {
+		t.Log(set)
+		t.Fail()
+	}
+}
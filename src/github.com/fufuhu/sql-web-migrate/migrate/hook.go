@@ -0,0 +1,289 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	sqlmigrate "github.com/rubenv/sql-migrate"
+	"go.uber.org/zap"
+)
+
+const (
+	// HooksDir マイグレーションの前後に実行するフックを格納するディレクトリを指定するための環境変数。
+	// ディレクトリの下のpre-run、post-run、pre-migration、post-migrationのディレクトリにある
+	// .sqlのファイルと実行可能なファイルを名前順に実行する
+	HooksDir = "SQL_MIGRATE_HOOKS_DIR"
+	// HookTimeout フック1件の実行時間の上限を指定するための環境変数
+	HookTimeout = "SQL_MIGRATE_HOOK_TIMEOUT"
+)
+
+const (
+	// DefaultHooksDir デフォルトのフックのディレクトリ(空文字の場合はフックを実行しない)
+	DefaultHooksDir = ""
+	// DefaultHookTimeout デフォルトのフック1件の実行時間の上限
+	DefaultHookTimeout = 5 * time.Minute
+	// MaxHookOutput レスポンスに含めるフックの出力の上限(バイト)
+	MaxHookOutput = 64 * 1024
+)
+
+const (
+	// HookPreRun 実行の前(失敗した場合は実行しない)
+	HookPreRun = "pre-run"
+	// HookPostRun 実行が成功した後
+	HookPostRun = "post-run"
+	// HookPreMigration マイグレーション1件ごとの前(失敗した場合はそのマイグレーションから実行しない)
+	HookPreMigration = "pre-migration"
+	// HookPostMigration マイグレーション1件ごとの適用が成功した後
+	HookPostMigration = "post-migration"
+)
+
+// GetHooksDir フックを格納するディレクトリを取得する。
+// 環境変数が設定されていない場合は、DefaultHooksDirの値を返す
+func GetHooksDir() string {
+	return getValue(HooksDir, DefaultHooksDir)
+}
+
+// GetHookTimeout フック1件の実行時間の上限を取得する。
+// 環境変数が設定されていない場合は、DefaultHookTimeoutの値を返す
+func GetHookTimeout() (time.Duration, error) {
+	return getDuration(HookTimeout, DefaultHookTimeout)
+}
+
+// HookConfigStruct マイグレーションの前後に実行するフックの設定
+// Dir フックを格納するディレクトリ(空文字の場合はフックを実行しない)
+// Timeout フック1件の実行時間の上限
+type HookConfigStruct struct {
+	Dir     func() string
+	Timeout func() (time.Duration, error)
+}
+
+// HookConfig 環境変数で設定した対象(default)のフックの設定です
+var HookConfig HookConfigStruct
+
+// HookResult フック1件の実行結果
+// Phase 実行した時点(pre-run/post-run/pre-migration/post-migration)
+// Name フックのファイル名
+// Schema スキーマごとに適用する場合のスキーマ
+// Migration マイグレーション1件ごとのフックの場合のマイグレーションのID
+// Success 成功したかどうか
+// Output 標準出力と標準エラー出力(SQLのフックの場合は空)
+// DurationMillis 所要時間(ミリ秒)
+// Error 失敗した場合のエラーメッセージ
+type HookResult struct {
+	Phase          string `json:"phase"`
+	Name           string `json:"name"`
+	Schema         string `json:"schema,omitempty"`
+	Migration      string `json:"migration,omitempty"`
+	Success        bool   `json:"success"`
+	Output         string `json:"output,omitempty"`
+	DurationMillis int64  `json:"durationMillis"`
+	Error          string `json:"error,omitempty"`
+}
+
+// hookRunner 1回の実行でフックを実行し、その結果を集める。nilの場合は何もしない
+type hookRunner struct {
+	target    *Target
+	dialect   string
+	direction sqlmigrate.MigrationDirection
+	max       int
+	dir       string
+	timeout   time.Duration
+
+	mutex   sync.Mutex
+	results []HookResult
+}
+
+// newHookRunner 対象のフックを実行するhookRunnerを返す。フックが設定されていない場合はnilを返す
+func newHookRunner(target *Target, dialect string, direction sqlmigrate.MigrationDirection, max int) (*hookRunner, error) {
+	if target.Hooks.Dir == nil || target.Hooks.Dir() == "" {
+		return nil, nil
+	}
+	dir := target.Hooks.Dir()
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("hooks directory %s is not a directory", dir)
+	}
+	timeout, err := target.Hooks.Timeout()
+	if err != nil {
+		return nil, err
+	}
+	return &hookRunner{target: target, dialect: dialect, direction: direction, max: max, dir: dir, timeout: timeout}, nil
+}
+
+// Results 実行したフックの結果を実行順に返す
+func (runner *hookRunner) Results() []HookResult {
+	if runner == nil {
+		return nil
+	}
+	runner.mutex.Lock()
+	defer runner.mutex.Unlock()
+	return append([]HookResult{}, runner.results...)
+}
+
+// run phaseのフックを名前順に実行する。フックが失敗した場合は残りを実行せずにエラーを返す。
+// schemaはスキーマごとに適用する場合のスキーマ、migrationはマイグレーション1件ごとのフックの場合のIDで、
+// appliedはそれまでに適用したマイグレーションのID
+func (runner *hookRunner) run(ctx context.Context, phase string, schema string, migration string, applied []string) error {
+	if runner == nil {
+		return nil
+	}
+	logger, _ := zap.NewProduction()
+	defer logger.Sync()
+
+	entries, err := ioutil.ReadDir(filepath.Join(runner.dir, phase))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	for _, entry := range entries {
+		isSQL := strings.HasSuffix(entry.Name(), ".sql")
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || (!isSQL && entry.Mode()&0111 == 0) {
+			continue
+		}
+
+		hookCtx, span := Tracer().Start(ctx, "hook "+phase+" "+entry.Name())
+		hookCtx, cancel := context.WithTimeout(hookCtx, runner.timeout)
+		startedAt := time.Now()
+		path := filepath.Join(runner.dir, phase, entry.Name())
+		var output string
+		if isSQL {
+			err = runner.runSQL(hookCtx, path, schema)
+		} else {
+			output, err = runner.runExecutable(hookCtx, path, phase, schema, migration, applied)
+		}
+		cancel()
+		EndSpan(span, err)
+
+		result := HookResult{
+			Phase:          phase,
+			Name:           entry.Name(),
+			Schema:         schema,
+			Migration:      migration,
+			Success:        err == nil,
+			Output:         output,
+			DurationMillis: int64(time.Since(startedAt) / time.Millisecond),
+		}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		runner.mutex.Lock()
+		runner.results = append(runner.results, result)
+		runner.mutex.Unlock()
+
+		if err != nil {
+			logger.Error(
+				"Hook failed",
+				zap.String("target", runner.target.Name),
+				zap.String("phase", phase),
+				zap.String("hook", entry.Name()),
+				zap.Error(err))
+			return fmt.Errorf("%s hook %s failed: %v", phase, entry.Name(), err)
+		}
+	}
+	return nil
+}
+
+// migrationHooks スキーマ1件にマイグレーションを適用する際の、マイグレーション1件ごとのフック
+type migrationHooks struct {
+	runner *hookRunner
+	schema string
+}
+
+// forSchema schemaに適用する際のマイグレーション1件ごとのフックを返す
+func (runner *hookRunner) forSchema(schema string) migrationHooks {
+	return migrationHooks{runner: runner, schema: schema}
+}
+
+// before マイグレーション1件の前のフックを実行する
+func (hooks migrationHooks) before(ctx context.Context, id string, applied []string) error {
+	return hooks.runner.run(ctx, HookPreMigration, hooks.schema, id, applied)
+}
+
+// after マイグレーション1件の適用が成功した後のフックを実行する
+func (hooks migrationHooks) after(ctx context.Context, id string, applied []string) error {
+	return hooks.runner.run(ctx, HookPostMigration, hooks.schema, id, applied)
+}
+
+// runSQL SQLのフックを対象のDBで実行する。
+// 確認に使う場合は、条件を満たさないときにエラーになるSQL(PostgreSQLのRAISE EXCEPTIONなど)を書く
+func (runner *hookRunner) runSQL(ctx context.Context, path string, schema string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	db, release, err := runner.target.schemaDB(ctx, runner.dialect, schema, false)
+	if err != nil {
+		return err
+	}
+	defer release()
+	_, err = db.ExecContext(ctx, string(content))
+	return err
+}
+
+// runExecutable 実行可能なフックを、マイグレーションの情報を環境変数に設定して実行する
+func (runner *hookRunner) runExecutable(ctx context.Context, path string, phase string, schema string,
+	migration string, applied []string) (string, error) {
+
+	env := append(os.Environ(),
+		"SQL_MIGRATE_HOOK_PHASE="+phase,
+		"SQL_MIGRATE_HOOK_TARGET="+runner.target.Name,
+		"SQL_MIGRATE_HOOK_DIRECTION="+DirectionName(runner.direction),
+		"SQL_MIGRATE_HOOK_STEPS="+strconv.Itoa(runner.max),
+		"SQL_MIGRATE_HOOK_SCHEMA="+schema,
+		"SQL_MIGRATE_HOOK_MIGRATION="+migration,
+		"SQL_MIGRATE_HOOK_APPLIED="+strings.Join(applied, ","),
+		"SQL_MIGRATE_HOOK_DIALECT="+runner.dialect,
+		"SQL_MIGRATE_HOOK_DBNAME="+runner.target.Connection.DBName(),
+	)
+	// psqlなどで接続できるように、PostgreSQLの接続先は標準の環境変数で渡す
+	if runner.dialect == DialectPostgres {
+		port, _ := runner.target.Connection.Port()
+		env = append(env,
+			"PGHOST="+runner.target.Connection.Host(),
+			"PGPORT="+strconv.Itoa(port),
+			"PGUSER="+runner.target.Connection.User(),
+			"PGPASSWORD="+runner.target.Connection.Password(),
+			"PGDATABASE="+runner.target.Connection.DBName(),
+		)
+		if sslMode, err := runner.target.Connection.SSLMode(); err == nil {
+			env = append(env, "PGSSLMODE="+sslMode)
+		}
+		if schema != "" {
+			env = append(env, "PGOPTIONS=-c search_path="+schema)
+		}
+	}
+
+	command := exec.CommandContext(ctx, path)
+	command.Dir = filepath.Dir(path)
+	command.Env = env
+	var output bytes.Buffer
+	command.Stdout = &output
+	command.Stderr = &output
+	err := command.Run()
+
+	text := output.String()
+	if len(text) > MaxHookOutput {
+		text = text[:MaxHookOutput] + "\n(output truncated)"
+	}
+	return text, err
+}
+
+func init() {
+	HookConfig = HookConfigStruct{
+		Dir:     GetHooksDir,
+		Timeout: GetHookTimeout,
+	}
+}
@@ -0,0 +1,152 @@
+package migrate
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupHooks 一時ディレクトリにフックを用意し、対象にそのディレクトリを設定する。
+// hooksのキーは"phase/name"の形式で、.sql以外は実行可能なファイルとして作成する
+func setupHooks(t *testing.T, target *Target, hooks map[string]string) (string, func()) {
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range hooks {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		mode := os.FileMode(0755)
+		if strings.HasSuffix(name, ".sql") {
+			mode = 0644
+		}
+		if err := ioutil.WriteFile(path, []byte(content), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	target.Hooks = HookConfigStruct{
+		Dir:     func() string { return dir },
+		Timeout: func() (time.Duration, error) { return 10 * time.Second, nil },
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// TestHandlerHooks 実行の前後とマイグレーション1件ごとにフックを名前順に実行し、
+// マイグレーションの情報を環境変数で渡して、結果をレスポンスに含めることを確認する。
+func TestHandlerHooks(t *testing.T) {
+	targets, cleanup := setupSQLiteTargets(t, nil)
+	defer cleanup()
+	target, _ := targets.Get("local")
+	dir, cleanupHooks := setupHooks(t, target, map[string]string{
+		"pre-run/01-check.sh":          "#!/bin/sh\necho \"$SQL_MIGRATE_HOOK_TARGET $SQL_MIGRATE_HOOK_DIRECTION $SQL_MIGRATE_HOOK_DIALECT\"\n",
+		"pre-migration/log.sh":         "#!/bin/sh\necho \"$SQL_MIGRATE_HOOK_PHASE $SQL_MIGRATE_HOOK_MIGRATION\" >> ../calls\n",
+		"post-migration/log.sh":        "#!/bin/sh\necho \"$SQL_MIGRATE_HOOK_PHASE $SQL_MIGRATE_HOOK_MIGRATION $SQL_MIGRATE_HOOK_APPLIED\" >> ../calls\n",
+		"post-run/verify.sql":          "SELECT count(*) FROM posts;",
+		"pre-run/.disabled-cleanup.sh": "#!/bin/sh\nexit 1\n",
+	})
+	defer cleanupHooks()
+	mux := NewServeMux(targets)
+
+	w := serve(mux, http.MethodPost, "/targets/local/migrate/up", nil)
+	var result MigrationResult
+	decode(t, w, &result)
+	if w.Code != http.StatusOK || len(result.Applied) != 2 || len(result.Hooks) != 6 {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	if result.Hooks[0].Phase != HookPreRun || strings.TrimSpace(result.Hooks[0].Output) != "local up sqlite3" ||
+		result.Hooks[5].Phase != HookPostRun || result.Hooks[5].Name != "verify.sql" || !result.Hooks[5].Success {
+		t.Log(result.Hooks)
+		t.Fail()
+	}
+
+	calls, _ := ioutil.ReadFile(filepath.Join(dir, "calls"))
+	expected := "pre-migration 01-users.sql\n" +
+		"post-migration 01-users.sql 01-users.sql\n" +
+		"pre-migration 02-posts.sql\n" +
+		"post-migration 02-posts.sql 01-users.sql,02-posts.sql\n"
+	if string(calls) != expected {
+		t.Log(string(calls))
+		t.Fail()
+	}
+}
+
+// TestHandlerPreRunHookFailure 実行前のフックが失敗した場合は、マイグレーションを適用せずに
+// フックの出力を含むエラーを返すことを確認する。
+func TestHandlerPreRunHookFailure(t *testing.T) {
+	targets, cleanup := setupSQLiteTargets(t, nil)
+	defer cleanup()
+	target, _ := targets.Get("local")
+	_, cleanupHooks := setupHooks(t, target, map[string]string{
+		"pre-run/replication.sh": "#!/bin/sh\necho 'replication lag too high'\nexit 1\n",
+	})
+	defer cleanupHooks()
+	mux := NewServeMux(targets)
+
+	w := serve(mux, http.MethodPost, "/targets/local/migrate/up", nil)
+	var result MigrationResult
+	decode(t, w, &result)
+	if w.Code != http.StatusInternalServerError || len(result.Applied) != 0 || len(result.Hooks) != 1 ||
+		result.Hooks[0].Success || !strings.Contains(result.Hooks[0].Output, "replication lag too high") ||
+		!strings.Contains(result.Error, "pre-run hook replication.sh failed") {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+
+	w = serve(mux, http.MethodGet, "/targets/local/migrate/status", nil)
+	var statuses []MigrationStatus
+	decode(t, w, &statuses)
+	for _, status := range statuses {
+		if status.Applied {
+			t.Log(w.Body.String())
+			t.Fail()
+		}
+	}
+}
+
+// TestHandlerPreMigrationHookFailure マイグレーション1件ごとの前のフックが失敗した場合は、
+// それまでに適用したマイグレーションだけを返して残りを実行しないことを確認する。
+func TestHandlerPreMigrationHookFailure(t *testing.T) {
+	targets, cleanup := setupSQLiteTargets(t, nil)
+	defer cleanup()
+	target, _ := targets.Get("local")
+	_, cleanupHooks := setupHooks(t, target, map[string]string{
+		"pre-migration/guard.sh": "#!/bin/sh\n[ \"$SQL_MIGRATE_HOOK_MIGRATION\" != 02-posts.sql ]\n",
+		"post-run/never.sh":      "#!/bin/sh\nexit 0\n",
+	})
+	defer cleanupHooks()
+	mux := NewServeMux(targets)
+
+	w := serve(mux, http.MethodPost, "/targets/local/migrate/up", nil)
+	var result MigrationResult
+	decode(t, w, &result)
+	if w.Code != http.StatusInternalServerError || len(result.Applied) != 1 || result.Applied[0] != "01-users.sql" ||
+		len(result.Hooks) != 2 || result.Hooks[1].Migration != "02-posts.sql" || result.Hooks[1].Success {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+}
+
+// TestNewHookRunner フックのディレクトリが設定されていない場合は何もせず、
+// 存在しない場合はエラーになることを確認する。
+func TestNewHookRunner(t *testing.T) {
+	target := &Target{Name: "local", Hooks: HookConfigStruct{Dir: func() string { return "" }}}
+	if runner, err := newHookRunner(target, DialectSQLite, 0, 0); runner != nil || err != nil {
+		t.Log(runner, err)
+		t.Fail()
+	}
+	var runner *hookRunner
+	if err := runner.run(context.Background(), HookPreRun, "", "", nil); err != nil || runner.Results() != nil {
+		t.Log(err)
+		t.Fail()
+	}
+
+	target.Hooks.Dir = func() string { return filepath.Join(os.TempDir(), "no-such-hooks") }
+	if _, err := newHookRunner(target, DialectSQLite, 0, 0); err == nil {
+		t.Fail()
+	}
+}
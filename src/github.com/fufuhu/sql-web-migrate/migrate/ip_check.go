@@ -25,6 +25,7 @@ func (networks *AllowedNetworks) IsAllowed(ip net.IP) bool {
 // NetworkConfigStruct Struct to get NetworkConfig
 type NetworkConfigStruct struct {
 	AllowedNetworks func() AllowedNetworks
+	TrustedProxies  func() AllowedNetworks
 }
 
 // NetworkConfig Global Instance of NetworkConfigStruct
@@ -33,17 +34,32 @@ var NetworkConfig NetworkConfigStruct
 const (
 	// SQLMigrateAllowedNetworks 許可されたIPネットワークを表す環境変数(SQL_MIGRATE_ALLOWD_NETWORKS)
 	SQLMigrateAllowedNetworks = "SQL_MIGRATE_ALLOWED_NETWORKS"
+	// SQLMigrateTrustedProxies X-Forwarded-Forを信頼するプロキシのネットワークを表す環境変数
+	SQLMigrateTrustedProxies = "SQL_MIGRATE_TRUSTED_PROXIES"
 )
 
 // GetAllowedNetworks 許可されたネットワークのリストを取得する
 func GetAllowedNetworks() AllowedNetworks {
+	return parseNetworks(os.Getenv(SQLMigrateAllowedNetworks))
+}
+
+// GetTrustedProxies X-Forwarded-Forを信頼するプロキシのネットワークのリストを取得する。
+// 環境変数が設定されていない場合はどのプロキシも信頼しない
+func GetTrustedProxies() AllowedNetworks {
+	value := os.Getenv(SQLMigrateTrustedProxies)
+	if value == "" {
+		return nil
+	}
+	return parseNetworks(value)
+}
+
+// parseNetworks カンマ区切りのCIDR表記をネットワークのリストに変換する
+func parseNetworks(value string) AllowedNetworks {
 	var networks AllowedNetworks
 
 	logger, _ := zap.NewProduction()
 	defer logger.Sync()
 
-	value := os.Getenv(SQLMigrateAllowedNetworks)
-
 	networkStrings := strings.Split(value, ",")
 
 	for _, networkString := range networkStrings {
@@ -73,6 +89,9 @@ func getRemoteAddr(r *http.Request) net.IP {
 	defer logger.Sync()
 
 	remote := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
 	ip := net.ParseIP(remote)
 	logger.Info(
 		"Checking HTTP Request Header, RemoteAddr",
@@ -94,13 +113,62 @@ func getXForwardedFor(r *http.Request) []net.IP {
 
 	var ips []net.IP
 	for _, address := range strings.Split(addresses, ",") {
-		ips = append(ips, net.ParseIP(address))
+		ips = append(ips, net.ParseIP(strings.TrimSpace(address)))
 	}
 	return ips
 }
 
+// IsAllowedRequest X-Forwarded-ForとRemoteAddrのいずれかが
+// 許可されたネットワークに含まれているかを確認する
+func IsAllowedRequest(r *http.Request, networks AllowedNetworks) bool {
+	logger, _ := zap.NewProduction()
+	defer logger.Sync()
+
+	ips := append(getXForwardedFor(r), getRemoteAddr(r))
+	for _, ip := range ips {
+		if ip == nil {
+			continue
+		}
+		logger.Info("Checking IP Addresss", zap.String("IPAddress", ip.String()))
+		if networks.IsAllowed(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// getRequester マイグレーションを要求したクライアントのアドレスを返す。
+// 接続元が信頼するプロキシの場合に限り、X-Forwarded-Forを右から辿って
+// 最初の信頼しないアドレスを採用する
+func getRequester(r *http.Request) string {
+	requester := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(requester); err == nil {
+		requester = host
+	}
+
+	proxies := NetworkConfig.TrustedProxies()
+	if ip := net.ParseIP(requester); ip == nil || !proxies.IsAllowed(ip) {
+		return requester
+	}
+
+	addresses := strings.Split(r.Header.Get(XForwardedFor), ",")
+	for i := len(addresses) - 1; i >= 0; i-- {
+		address := strings.TrimSpace(addresses[i])
+		ip := net.ParseIP(address)
+		if ip == nil {
+			break
+		}
+		requester = address
+		if !proxies.IsAllowed(ip) {
+			break
+		}
+	}
+	return requester
+}
+
 func init() {
 	NetworkConfig = NetworkConfigStruct{
 		AllowedNetworks: GetAllowedNetworks,
+		TrustedProxies:  GetTrustedProxies,
 	}
 }
@@ -2,6 +2,7 @@ package migrate
 
 import (
 	"net"
+	"net/http/httptest"
 	"os"
 	"testing"
 )
@@ -52,3 +53,25 @@ func TestGetAllowedNetworks(t *testing.T) {
 		}
 	}
 }
+
+func TestIsAllowedRequest(t *testing.T) {
+	os.Setenv(SQLMigrateAllowedNetworks, "10.0.0.0/8")
+	defer os.Unsetenv(SQLMigrateAllowedNetworks)
+
+	r := httptest.NewRequest("POST", "/migrate/up", nil)
+	r.RemoteAddr = "192.168.0.1:54321"
+	if IsAllowedRequest(r, GetAllowedNetworks()) {
+		t.Fail()
+	}
+
+	r.RemoteAddr = "10.1.2.3:54321"
+	if !IsAllowedRequest(r, GetAllowedNetworks()) {
+		t.Fail()
+	}
+
+	r.RemoteAddr = "192.168.0.1:54321"
+	r.Header.Set(XForwardedFor, "172.16.0.1, 10.1.2.3")
+	if !IsAllowedRequest(r, GetAllowedNetworks()) {
+		t.Fail()
+	}
+}
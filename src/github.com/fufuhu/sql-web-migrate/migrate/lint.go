@@ -0,0 +1,362 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+
+	sqlmigrate "github.com/rubenv/sql-migrate"
+	"go.uber.org/zap"
+)
+
+const (
+	// LintLargeTableRows CREATE INDEXを大きなテーブルとして警告する行数を指定するための環境変数
+	LintLargeTableRows = "SQL_MIGRATE_LINT_LARGE_TABLE_ROWS"
+)
+
+const (
+	// DefaultLintLargeTableRows デフォルトの大きなテーブルとみなす行数
+	DefaultLintLargeTableRows = 100000
+)
+
+const (
+	// LintLargeTableRowsSettingFormatErrorMessage 大きなテーブルとみなす行数の設定値が不正な場合のエラーメッセージです
+	LintLargeTableRowsSettingFormatErrorMessage = "Lint large table rows should be a non-negative integer"
+)
+
+const (
+	// SeverityError 実行すると失敗する、またはデータを失う可能性が高い
+	SeverityError = "error"
+	// SeverityWarning 実行前に確認が必要
+	SeverityWarning = "warning"
+	// SeverityInfo 判断に必要な情報がないため確認できなかった
+	SeverityInfo = "info"
+)
+
+const (
+	// RuleDropTable DROP TABLE
+	RuleDropTable = "drop-table"
+	// RuleDropColumn ALTER TABLE ... DROP COLUMN
+	RuleDropColumn = "drop-column"
+	// RuleIndexNotConcurrent 大きなテーブルへのCONCURRENTLYのないCREATE INDEX
+	RuleIndexNotConcurrent = "index-not-concurrent"
+	// RuleConcurrentIndexInTransaction notransactionのないCREATE INDEX CONCURRENTLY
+	RuleConcurrentIndexInTransaction = "concurrent-index-in-transaction"
+	// RuleAlterType 列の型の変更とALTER TYPE
+	RuleAlterType = "alter-type"
+	// RuleMissingDown Downのないマイグレーション
+	RuleMissingDown = "missing-down"
+	// RuleNotNullWithoutDefault デフォルト値のないNOT NULLの列の追加
+	RuleNotNullWithoutDefault = "not-null-without-default"
+)
+
+// lintIgnorePattern 文の末尾に書いたコメントで指摘を抑止する(-- lint:ignore rule[,rule])。
+// 行全体のコメントはsql-migrateが取り除くため、文と同じ行に書く
+var lintIgnorePattern = regexp.MustCompile(`lint:ignore\s+([\w,-]+)`)
+
+var (
+	sqlLineComment  = regexp.MustCompile(`--[^\n]*`)
+	sqlBlockComment = regexp.MustCompile(`(?s)/\*.*?\*/`)
+	sqlWhitespace   = regexp.MustCompile(`\s+`)
+
+	dropTablePattern     = regexp.MustCompile(`(?i)^DROP\s+TABLE\b`)
+	alterTablePattern    = regexp.MustCompile(`(?i)^ALTER\s+TABLE\b`)
+	alterDropPattern     = regexp.MustCompile(`(?i)\bDROP\s+(\w+)`)
+	alterColumnType      = regexp.MustCompile(`(?i)\bALTER\s+(?:COLUMN\s+)?\S+\s+(?:SET\s+DATA\s+)?TYPE\b|\bMODIFY\s+(?:COLUMN\s+)?\S+`)
+	alterTypePattern     = regexp.MustCompile(`(?i)^ALTER\s+TYPE\b`)
+	addClausePattern     = regexp.MustCompile(`(?i)\bADD\s+`)
+	addConstraintPattern = regexp.MustCompile(`(?i)^ADD\s+(?:CONSTRAINT|PRIMARY|FOREIGN|UNIQUE|CHECK|INDEX|KEY)\b`)
+	notNullPattern       = regexp.MustCompile(`(?i)\bNOT\s+NULL\b`)
+	defaultPattern       = regexp.MustCompile(`(?i)\bDEFAULT\b|\bGENERATED\b`)
+	createTablePattern   = regexp.MustCompile(`(?i)^CREATE\s+(?:TEMP(?:ORARY)?\s+)?TABLE\s+(?:IF\s+NOT\s+EXISTS\s+)?([^\s(]+)`)
+	createIndexPattern   = regexp.MustCompile(`(?i)^CREATE\s+(?:UNIQUE\s+)?INDEX\s+(CONCURRENTLY\s+)?(?:IF\s+NOT\s+EXISTS\s+)?(?:[^\s(]+\s+)?ON\s+(?:ONLY\s+)?([^\s(]+)`)
+)
+
+// alterDropNotColumn ALTER TABLE ... DROPのうち列の削除ではないもの
+var alterDropNotColumn = map[string]bool{
+	"CONSTRAINT": true, "DEFAULT": true, "NOT": true, "IDENTITY": true, "EXPRESSION": true,
+	"INDEX": true, "KEY": true, "PRIMARY": true, "FOREIGN": true, "CHECK": true, "PARTITION": true,
+}
+
+// tableStatsQuery PostgreSQLのテーブルごとの推定行数を取得するクエリ
+const tableStatsQuery = "select relname, reltuples::bigint from pg_class where relkind in ('r', 'p')"
+
+// GetLintLargeTableRows 大きなテーブルとみなす行数を取得する。
+// 環境変数が設定されていない場合は、DefaultLintLargeTableRowsの値を返す。
+// 不正な値が設定されている場合はエラーとDefaultLintLargeTableRowsの値を返す
+func GetLintLargeTableRows() (int64, error) {
+	rows, err := strconv.ParseInt(getValue(LintLargeTableRows, strconv.Itoa(DefaultLintLargeTableRows)), 10, 64)
+	if err != nil || rows < 0 {
+		return DefaultLintLargeTableRows, errors.New(LintLargeTableRowsSettingFormatErrorMessage)
+	}
+	return rows, nil
+}
+
+// LintConfigStruct マイグレーションの検査の設定
+// LargeTableRows 大きなテーブルとみなす行数
+type LintConfigStruct struct {
+	LargeTableRows func() (int64, error)
+}
+
+// LintConfig マイグレーションの検査の設定です
+var LintConfig LintConfigStruct
+
+// LintFinding 危険なSQLの指摘1件分
+// ID 指摘したマイグレーションのID
+// Direction 指摘した文の方向(up/down)
+// Rule 指摘の規則
+// Severity 重要度(error/warning/info)
+// Message 指摘の内容
+// Statement 指摘した文
+type LintFinding struct {
+	ID        string `json:"id"`
+	Direction string `json:"direction"`
+	Rule      string `json:"rule"`
+	Severity  string `json:"severity"`
+	Message   string `json:"message"`
+	Statement string `json:"statement,omitempty"`
+}
+
+// LintReport マイグレーションの検査結果
+// OK 重要度errorの指摘がないかどうか
+// TableStats 大きなテーブルの判定にDBの統計情報を使ったかどうか
+// Findings 指摘(マイグレーションの実行順)
+type LintReport struct {
+	OK         bool          `json:"ok"`
+	TableStats bool          `json:"tableStats"`
+	Findings   []LintFinding `json:"findings"`
+}
+
+// LintOptions 検査の設定
+// TableRows テーブル名と推定行数の対応(nilの場合はテーブルの大きさがわからないものとして扱う)
+// LargeTableRows 大きなテーブルとみなす行数
+type LintOptions struct {
+	TableRows      map[string]int64
+	LargeTableRows int64
+}
+
+// normalizeStatement コメントを取り除き、空白をまとめた文を返す
+func normalizeStatement(statement string) string {
+	statement = sqlBlockComment.ReplaceAllString(statement, " ")
+	statement = sqlLineComment.ReplaceAllString(statement, " ")
+	statement = sqlWhitespace.ReplaceAllString(statement, " ")
+	return strings.TrimSuffix(strings.TrimSpace(statement), ";")
+}
+
+// tableName 引用符とスキーマを取り除いた小文字のテーブル名を返す
+func tableName(name string) string {
+	name = strings.ToLower(strings.NewReplacer(`"`, "", "`", "").Replace(name))
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+// ignoredRules 文のコメントで抑止された規則を返す
+func ignoredRules(statement string) map[string]bool {
+	ignored := map[string]bool{}
+	for _, match := range lintIgnorePattern.FindAllStringSubmatch(statement, -1) {
+		for _, rule := range strings.Split(match[1], ",") {
+			ignored[rule] = true
+		}
+	}
+	return ignored
+}
+
+// LintMigrations マイグレーションに含まれる危険なSQLを検査する
+func LintMigrations(migrations []*sqlmigrate.Migration, options LintOptions) LintReport {
+	report := LintReport{OK: true, TableStats: options.TableRows != nil, Findings: []LintFinding{}}
+
+	// 同じソースで作成したテーブルは空なので、インデックスの作成を指摘しない
+	created := map[string]bool{}
+
+	for _, migration := range migrations {
+		if len(migration.Down) == 0 {
+			report.Findings = append(report.Findings, LintFinding{
+				ID: migration.Id, Direction: "down", Rule: RuleMissingDown, Severity: SeverityWarning,
+				Message: "migration has no Down section and cannot be rolled back",
+			})
+		}
+
+		for _, direction := range []sqlmigrate.MigrationDirection{sqlmigrate.Up, sqlmigrate.Down} {
+			statements, noTransaction := migration.Up, migration.DisableTransactionUp
+			if direction == sqlmigrate.Down {
+				statements, noTransaction = migration.Down, migration.DisableTransactionDown
+			}
+			report.Findings = append(report.Findings,
+				lintStatements(migration.Id, direction, statements, noTransaction, created, options)...)
+		}
+	}
+
+	for _, finding := range report.Findings {
+		if finding.Severity == SeverityError {
+			report.OK = false
+		}
+	}
+	return report
+}
+
+// lintStatements マイグレーション1件の一方向分の文を検査する。
+// Upで作成したテーブルをcreatedに記録する
+func lintStatements(id string, direction sqlmigrate.MigrationDirection, statements []string, noTransaction bool,
+	created map[string]bool, options LintOptions) []LintFinding {
+
+	findings := []LintFinding{}
+	for _, raw := range statements {
+		statement := normalizeStatement(raw)
+		ignored := ignoredRules(raw)
+		for _, finding := range lintStatement(statement, direction, noTransaction, created, options) {
+			if ignored[finding.Rule] {
+				continue
+			}
+			finding.ID = id
+			finding.Direction = DirectionName(direction)
+			finding.Statement = statement
+			findings = append(findings, finding)
+		}
+		if match := createTablePattern.FindStringSubmatch(statement); match != nil && direction == sqlmigrate.Up {
+			created[tableName(match[1])] = true
+		}
+	}
+	return findings
+}
+
+// Destructive テーブルや列を削除してデータを失う指摘かどうかを返す
+func (finding LintFinding) Destructive() bool {
+	return finding.Rule == RuleDropTable || finding.Rule == RuleDropColumn
+}
+
+// lintStatement 文1件を検査する。
+// テーブルやデータを削除する文は、ロールバックでもデータを失うためUpとDownのどちらもerrorとする。
+// 意図した削除であれば、文の末尾のコメント(-- lint:ignore drop-table)で抑止する
+func lintStatement(statement string, direction sqlmigrate.MigrationDirection, noTransaction bool,
+	created map[string]bool, options LintOptions) []LintFinding {
+
+	findings := []LintFinding{}
+
+	if dropTablePattern.MatchString(statement) {
+		findings = append(findings, LintFinding{Rule: RuleDropTable, Severity: SeverityError,
+			Message: "DROP TABLE deletes the table and all of its data"})
+	}
+
+	if alterTablePattern.MatchString(statement) {
+		for _, match := range alterDropPattern.FindAllStringSubmatch(statement, -1) {
+			if !alterDropNotColumn[strings.ToUpper(match[1])] {
+				findings = append(findings, LintFinding{Rule: RuleDropColumn, Severity: SeverityError,
+					Message: "DROP COLUMN deletes the column and its data"})
+				break
+			}
+		}
+		if alterColumnType.MatchString(statement) {
+			findings = append(findings, LintFinding{Rule: RuleAlterType, Severity: SeverityWarning,
+				Message: "changing a column type may rewrite the table while holding an exclusive lock"})
+		}
+		clauses := addClausePattern.Split(statement, -1)
+		for _, clause := range clauses[1:] {
+			if addConstraintPattern.MatchString("ADD " + clause) {
+				continue
+			}
+			if notNullPattern.MatchString(clause) && !defaultPattern.MatchString(clause) {
+				findings = append(findings, LintFinding{Rule: RuleNotNullWithoutDefault, Severity: SeverityError,
+					Message: "adding a NOT NULL column without a DEFAULT fails on tables that already have rows"})
+				break
+			}
+		}
+	}
+
+	if alterTypePattern.MatchString(statement) {
+		findings = append(findings, LintFinding{Rule: RuleAlterType, Severity: SeverityWarning,
+			Message: "ALTER TYPE cannot always run inside a transaction and may block queries using the type"})
+	}
+
+	if match := createIndexPattern.FindStringSubmatch(statement); match != nil {
+		table := tableName(match[2])
+		switch {
+		case match[1] != "" && !noTransaction:
+			findings = append(findings, LintFinding{Rule: RuleConcurrentIndexInTransaction, Severity: SeverityError,
+				Message: "CREATE INDEX CONCURRENTLY cannot run inside a transaction; add notransaction to the +migrate annotation"})
+		case match[1] != "" || created[table]:
+		case options.TableRows == nil:
+			findings = append(findings, LintFinding{Rule: RuleIndexNotConcurrent, Severity: SeverityInfo,
+				Message: "CREATE INDEX without CONCURRENTLY blocks writes to " + table + "; table size is unknown"})
+		case options.TableRows[table] >= options.LargeTableRows:
+			findings = append(findings, LintFinding{Rule: RuleIndexNotConcurrent, Severity: SeverityWarning,
+				Message: "CREATE INDEX without CONCURRENTLY blocks writes to " + table +
+					" (about " + strconv.FormatInt(options.TableRows[table], 10) + " rows) while the index is built"})
+		}
+	}
+
+	return findings
+}
+
+// LintTarget 対象のソースのマイグレーションを検査する。
+// PostgreSQLに接続できる場合は、テーブルの推定行数から大きなテーブルを判定する
+func LintTarget(ctx context.Context, target *Target) (LintReport, error) {
+
+	logger, _ := zap.NewProduction()
+	defer logger.Sync()
+
+	source, err := target.Source()
+	if err != nil {
+		return LintReport{}, err
+	}
+	migrations, err := source.FindMigrations()
+	if err != nil {
+		return LintReport{}, err
+	}
+	largeTableRows, err := LintConfig.LargeTableRows()
+	if err != nil {
+		return LintReport{}, err
+	}
+
+	options := LintOptions{LargeTableRows: largeTableRows}
+	if dialect, _ := target.Dialect(); dialect == DialectPostgres {
+		if options.TableRows, err = getTableRows(ctx, target, dialect); err != nil {
+			logger.Warn(
+				"Table statistics unavailable for lint",
+				zap.String("target", target.Name),
+				zap.Error(err))
+		}
+	}
+
+	return LintMigrations(migrations, options), nil
+}
+
+// getTableRows PostgreSQLの統計情報からテーブルごとの推定行数を取得する
+func getTableRows(ctx context.Context, target *Target, dialect string) (tableRows map[string]int64, err error) {
+	ctx, span := Tracer().Start(ctx, "table stats query")
+	defer func() { EndSpan(span, err) }()
+
+	db, err := target.DB(ctx, dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, tableStatsQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tableRows = map[string]int64{}
+	for rows.Next() {
+		var name string
+		var count int64
+		if err := rows.Scan(&name, &count); err != nil {
+			return nil, err
+		}
+		// 同じ名前のテーブルが複数のスキーマにある場合は大きい方を使う
+		if count > tableRows[name] {
+			tableRows[name] = count
+		}
+	}
+	return tableRows, rows.Err()
+}
+
+func init() {
+	LintConfig = LintConfigStruct{
+		LargeTableRows: GetLintLargeTableRows,
+	}
+}
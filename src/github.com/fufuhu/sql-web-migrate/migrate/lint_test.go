@@ -0,0 +1,175 @@
+package migrate
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	sqlmigrate "github.com/rubenv/sql-migrate"
+)
+
+// parseTestMigration テスト用のマイグレーションを解釈する
+func parseTestMigration(t *testing.T, id string, content string) *sqlmigrate.Migration {
+	migration, err := sqlmigrate.ParseMigration(id, strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return migration
+}
+
+// findingRules 指摘を"ID direction rule severity"の形式で返す
+func findingRules(report LintReport) []string {
+	rules := []string{}
+	for _, finding := range report.Findings {
+		rules = append(rules, finding.ID+" "+finding.Direction+" "+finding.Rule+" "+finding.Severity)
+	}
+	return rules
+}
+
+// TestGetLintLargeTableRows 大きなテーブルとみなす行数の既定値と、不正な値がエラーになることを確認する。
+func TestGetLintLargeTableRows(t *testing.T) {
+	os.Unsetenv(LintLargeTableRows)
+	if rows, err := GetLintLargeTableRows(); err != nil || rows != DefaultLintLargeTableRows {
+		t.Log(rows, err)
+		t.Fail()
+	}
+
+	defer os.Unsetenv(LintLargeTableRows)
+	for _, value := range []string{"many", "-1"} {
+		os.Setenv(LintLargeTableRows, value)
+		if rows, err := GetLintLargeTableRows(); err == nil || rows != DefaultLintLargeTableRows {
+			t.Log(value, rows, err)
+			t.Fail()
+		}
+	}
+}
+
+// TestLintMigrations 規則ごとに危険な文を指摘し、安全な文や抑止した文を指摘しないことを確認する。
+func TestLintMigrations(t *testing.T) {
+	migrations := []*sqlmigrate.Migration{
+		parseTestMigration(t, "01-users.sql", `-- +migrate Up
+CREATE TABLE users (id integer primary key, name text NOT NULL);
+CREATE INDEX users_name ON users (name);
+-- +migrate Down
+DROP TABLE users;
+`),
+		parseTestMigration(t, "02-orders.sql", `-- +migrate Up
+ALTER TABLE orders ADD COLUMN status text NOT NULL, ADD COLUMN note text NOT NULL DEFAULT '';
+ALTER TABLE orders DROP COLUMN legacy, DROP CONSTRAINT orders_legacy_check;
+ALTER TABLE orders ALTER COLUMN total TYPE numeric(12, 2);
+CREATE INDEX orders_status ON orders (status);
+`),
+		parseTestMigration(t, "03-index.sql", `-- +migrate Up
+CREATE INDEX CONCURRENTLY orders_created ON orders (created_at);
+-- +migrate Down
+ALTER TABLE orders DROP created_at; -- lint:ignore drop-column
+`),
+		parseTestMigration(t, "04-index.sql", `-- +migrate Up notransaction
+CREATE UNIQUE INDEX CONCURRENTLY IF NOT EXISTS orders_code ON public.orders (code);
+ALTER TYPE order_state ADD VALUE 'refunded';
+-- +migrate Down
+DROP INDEX orders_code;
+ALTER TABLE orders ALTER COLUMN status DROP NOT NULL;
+`),
+	}
+
+	report := LintMigrations(migrations, LintOptions{TableRows: map[string]int64{"orders": 500000}, LargeTableRows: 100000})
+	expected := []string{
+		"01-users.sql down drop-table error",
+		"02-orders.sql down missing-down warning",
+		"02-orders.sql up not-null-without-default error",
+		"02-orders.sql up drop-column error",
+		"02-orders.sql up alter-type warning",
+		"02-orders.sql up index-not-concurrent warning",
+		"03-index.sql up concurrent-index-in-transaction error",
+		"04-index.sql up alter-type warning",
+	}
+	rules := findingRules(report)
+	if report.OK || !report.TableStats || strings.Join(rules, "\n") != strings.Join(expected, "\n") {
+		t.Log(strings.Join(rules, "\n"))
+		t.Fail()
+	}
+
+	// 統計情報がない場合、作成済みでないテーブルへのインデックスは確認できなかったことを伝える
+	report = LintMigrations(migrations[1:2], LintOptions{LargeTableRows: 100000})
+	for _, finding := range report.Findings {
+		if finding.Rule == RuleIndexNotConcurrent && finding.Severity != SeverityInfo {
+			t.Log(finding)
+			t.Fail()
+		}
+	}
+
+	// 小さなテーブルへのインデックスは指摘しない
+	report = LintMigrations(migrations[1:2], LintOptions{TableRows: map[string]int64{"orders": 10}, LargeTableRows: 100000})
+	for _, finding := range report.Findings {
+		if finding.Rule == RuleIndexNotConcurrent {
+			t.Log(finding)
+			t.Fail()
+		}
+	}
+}
+
+// TestLintSampleMigration 同梱のサンプルのマイグレーションを検査し、
+// DownのDROP TABLEがerrorとして指摘されることを確認する。
+func TestLintSampleMigration(t *testing.T) {
+	content, err := ioutil.ReadFile(filepath.Join("..", "..", "..", "..", "..", "conf.d", "00-test.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := LintMigrations([]*sqlmigrate.Migration{parseTestMigration(t, "00-test.sql", string(content))},
+		LintOptions{LargeTableRows: DefaultLintLargeTableRows})
+
+	rules := findingRules(report)
+	if report.OK || strings.Join(rules, "\n") != "00-test.sql down drop-table error" ||
+		report.Findings[0].Statement != "DROP TABLE test" {
+		t.Log(strings.Join(rules, "\n"))
+		t.Fail()
+	}
+}
+
+// TestHandlerLint ソースのマイグレーションの指摘を返し、
+// 指摘に重要度errorがある場合はokがfalseになることを確認する。
+func TestHandlerLint(t *testing.T) {
+	targets, cleanup := setupSQLiteTargets(t, nil)
+	defer cleanup()
+	target, _ := targets.Get("local")
+	mux := NewServeMux(targets)
+
+	// DownのDROP TABLEもロールバックでデータを失うためerrorになる
+	w := serve(mux, http.MethodGet, "/targets/local/migrate/lint", nil)
+	var report LintReport
+	decode(t, w, &report)
+	rules := findingRules(report)
+	if w.Code != http.StatusOK || report.OK || report.TableStats ||
+		!strings.Contains(strings.Join(rules, "\n"), "01-users.sql down drop-table error") {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+
+	// 意図した削除を抑止すれば指摘はなくなる
+	for name, table := range map[string]string{"01-users.sql": "users", "02-posts.sql": "posts"} {
+		ioutil.WriteFile(filepath.Join(target.SourcePath(), name), []byte("-- +migrate Up\nCREATE TABLE "+table+
+			" (id integer primary key);\n-- +migrate Down\nDROP TABLE "+table+"; -- lint:ignore drop-table\n"), 0644)
+	}
+	w = serve(mux, http.MethodGet, "/targets/local/migrate/lint", nil)
+	report = LintReport{}
+	decode(t, w, &report)
+	if w.Code != http.StatusOK || !report.OK || len(report.Findings) != 0 {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+
+	ioutil.WriteFile(filepath.Join(target.SourcePath(), "03-drop.sql"),
+		[]byte("-- +migrate Up\nDROP TABLE posts;\n"), 0644)
+	w = serve(mux, http.MethodGet, "/targets/local/migrate/lint", nil)
+	report = LintReport{}
+	decode(t, w, &report)
+	rules = findingRules(report)
+	if w.Code != http.StatusOK || report.OK || !strings.Contains(strings.Join(rules, "\n"), "03-drop.sql up drop-table error") {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+}
@@ -0,0 +1,317 @@
+package migrate
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// NotifyURL マイグレーション実行後に通知を送るWebhookのURLを指定するための環境変数
+	NotifyURL = "SQL_MIGRATE_NOTIFY_URL"
+	// NotifyFormat 通知のペイロード形式(generic/slack)を指定するための環境変数
+	NotifyFormat = "SQL_MIGRATE_NOTIFY_FORMAT"
+	// NotifyTemplatePath 通知ペイロードのテンプレートファイルのパスを指定するための環境変数
+	NotifyTemplatePath = "SQL_MIGRATE_NOTIFY_TEMPLATE_PATH"
+	// NotifyRetries 通知失敗時のリトライ回数を指定するための環境変数
+	NotifyRetries = "SQL_MIGRATE_NOTIFY_RETRIES"
+	// NotifyBackoff 通知リトライの初回待ち時間を指定するための環境変数
+	NotifyBackoff = "SQL_MIGRATE_NOTIFY_BACKOFF"
+)
+
+const (
+	// NotifyFormatGeneric 汎用的なWebhook向けのペイロード形式
+	NotifyFormatGeneric = "generic"
+	// NotifyFormatSlack Slack互換のIncoming Webhook向けのペイロード形式
+	NotifyFormatSlack = "slack"
+)
+
+const (
+	// DefaultNotifyURL デフォルトの通知先URL(空の場合は通知しない)
+	DefaultNotifyURL = ""
+	// DefaultNotifyFormat デフォルトのペイロード形式
+	DefaultNotifyFormat = NotifyFormatGeneric
+	// DefaultNotifyTemplatePath デフォルトのテンプレートファイルのパス(空の場合は組み込みテンプレートを使う)
+	DefaultNotifyTemplatePath = ""
+	// DefaultNotifyRetries デフォルトのリトライ回数
+	DefaultNotifyRetries = 3
+	// DefaultNotifyBackoff デフォルトのリトライ初回待ち時間
+	DefaultNotifyBackoff = time.Second
+)
+
+const (
+	// NotifyFormatSettingFormatErrorMessage 通知のペイロード形式の設定を誤っている際のエラーメッセージです
+	NotifyFormatSettingFormatErrorMessage = "Notify format should be generic or slack"
+)
+
+// genericNotifyTemplate 汎用Webhook向けの組み込みテンプレート
+const genericNotifyTemplate = `{
+  "target": {{json .Target}},
+  "direction": {{json .Direction}},
+  "applied": {{json .Applied}},
+  "duration": {{json .Duration.String}},
+  "durationMillis": {{json .DurationMillis}},
+  "requester": {{json .Requester}},
+  "success": {{json .Success}},
+  "error": {{json .Error}}
+}`
+
+// slackNotifyTemplate Slack互換のIncoming Webhook向けの組み込みテンプレート
+const slackNotifyTemplate = `{
+  "text": {{json (printf "%s migrate %s by %s: %d migration(s) applied to %s in %s%s" .Status .Direction .Requester (len .Applied) .Target .Duration (errorSuffix .Error))}}
+}`
+
+// GetNotifyURL 通知先のURLを取得する。
+// 環境変数が設定されていない場合は、DefaultNotifyURLの値を返す
+func GetNotifyURL() string {
+	return getValue(NotifyURL, DefaultNotifyURL)
+}
+
+// GetNotifyFormat 通知のペイロード形式を取得する。
+// 環境変数が設定されていない場合は、DefaultNotifyFormatの値を返す
+// 不正な値(generic/slack以外)が設定されている場合はエラーとDefaultNotifyFormatの値を返す
+func GetNotifyFormat() (string, error) {
+	format := getValue(NotifyFormat, DefaultNotifyFormat)
+
+	if format != NotifyFormatGeneric && format != NotifyFormatSlack {
+		return DefaultNotifyFormat, errors.New(NotifyFormatSettingFormatErrorMessage)
+	}
+	return format, nil
+}
+
+// GetNotifyTemplatePath 通知ペイロードのテンプレートファイルのパスを取得する。
+// 環境変数が設定されていない場合は、DefaultNotifyTemplatePathの値を返す
+func GetNotifyTemplatePath() string {
+	return getValue(NotifyTemplatePath, DefaultNotifyTemplatePath)
+}
+
+// GetNotifyRetries 通知失敗時のリトライ回数を取得する。
+// 環境変数が設定されていない場合は、DefaultNotifyRetriesの値を返す
+// 環境変数に0以上の数字以外が設定されている場合はerrorとDefaultNotifyRetriesの値を返す
+func GetNotifyRetries() (int, error) {
+	retries, err := strconv.Atoi(getValue(NotifyRetries, strconv.Itoa(DefaultNotifyRetries)))
+	if err != nil {
+		return DefaultNotifyRetries, err
+	}
+	if retries < 0 {
+		return DefaultNotifyRetries, fmt.Errorf("%s should not be negative: %d", NotifyRetries, retries)
+	}
+	return retries, nil
+}
+
+// GetNotifyBackoff 通知リトライの初回待ち時間を取得する。
+// 待ち時間はリトライのたびに倍になる。
+// 環境変数が設定されていない場合は、DefaultNotifyBackoffの値を返す
+// 環境変数の値がtime.ParseDurationで解釈できない場合はerrorとDefaultNotifyBackoffの値を返す
+func GetNotifyBackoff() (time.Duration, error) {
+	backoff, err := time.ParseDuration(getValue(NotifyBackoff, DefaultNotifyBackoff.String()))
+	if err != nil {
+		return DefaultNotifyBackoff, err
+	}
+	return backoff, nil
+}
+
+// NotificationConfigStruct 通知の設定を格納したもの
+type NotificationConfigStruct struct {
+	URL          func() string
+	Format       func() (string, error)
+	TemplatePath func() string
+	Retries      func() (int, error)
+	Backoff      func() (time.Duration, error)
+}
+
+// NotificationConfig 通知の設定です
+var NotificationConfig NotificationConfigStruct
+
+// Notification マイグレーション実行結果の通知内容
+// Target マイグレーション対象の名前
+// Direction マイグレーションの方向(up/down)
+// Applied 今回適用したマイグレーションのID
+// Duration マイグレーションの所要時間
+// Requester マイグレーションを要求したクライアント
+// Success マイグレーションが成功したかどうか
+// Error 失敗した場合のエラーメッセージ
+type Notification struct {
+	Target    string
+	Direction string
+	Applied   []string
+	Duration  time.Duration
+	Requester string
+	Success   bool
+	Error     string
+}
+
+// DurationMillis 所要時間をミリ秒で返す
+func (n Notification) DurationMillis() int64 {
+	return int64(n.Duration / time.Millisecond)
+}
+
+// Status 成功/失敗を表す文字列を返す
+func (n Notification) Status() string {
+	if n.Success {
+		return "[SUCCESS]"
+	}
+	return "[FAILURE]"
+}
+
+// Notifier マイグレーションの実行結果をWebhookにPOSTする
+type Notifier struct {
+	URL      string
+	Template *template.Template
+	Retries  int
+	Backoff  time.Duration
+	Client   *http.Client
+}
+
+// notifyTemplateFuncs 通知テンプレートで使える関数
+var notifyTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		bytes, err := json.Marshal(v)
+		return string(bytes), err
+	},
+	"errorSuffix": func(message string) string {
+		if message == "" {
+			return ""
+		}
+		return " (" + message + ")"
+	},
+}
+
+// ParseNotifyTemplate 通知ペイロードのテンプレートを解釈する
+func ParseNotifyTemplate(text string) (*template.Template, error) {
+	return template.New("notify").Funcs(notifyTemplateFuncs).Parse(text)
+}
+
+// NewNotifier 通知の設定からNotifierを生成する。
+// 通知先のURLが設定されていない場合はnilを返す
+func NewNotifier(notificationConfig NotificationConfigStruct) (*Notifier, error) {
+	url := notificationConfig.URL()
+	if url == "" {
+		return nil, nil
+	}
+
+	retries, err := notificationConfig.Retries()
+	if err != nil {
+		return nil, err
+	}
+	backoff, err := notificationConfig.Backoff()
+	if err != nil {
+		return nil, err
+	}
+
+	var text string
+	if path := notificationConfig.TemplatePath(); path != "" {
+		bytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		text = string(bytes)
+	} else {
+		format, err := notificationConfig.Format()
+		if err != nil {
+			return nil, err
+		}
+		text = genericNotifyTemplate
+		if format == NotifyFormatSlack {
+			text = slackNotifyTemplate
+		}
+	}
+
+	tmpl, err := ParseNotifyTemplate(text)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Notifier{
+		URL:      url,
+		Template: tmpl,
+		Retries:  retries,
+		Backoff:  backoff,
+		Client:   &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// Payload 通知内容をテンプレートに適用してJSONのペイロードを生成する
+func (notifier *Notifier) Payload(notification Notification) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := notifier.Template.Execute(&buffer, notification); err != nil {
+		return nil, err
+	}
+
+	payload := buffer.Bytes()
+	if !json.Valid(payload) {
+		return nil, fmt.Errorf("notify template rendered invalid JSON: %s", strings.TrimSpace(buffer.String()))
+	}
+	return payload, nil
+}
+
+// Notify 通知内容をWebhookにPOSTする。
+// 失敗した場合はBackoffを倍にしながらRetries回までリトライする
+func (notifier *Notifier) Notify(notification Notification) error {
+	logger, _ := zap.NewProduction()
+	defer logger.Sync()
+
+	payload, err := notifier.Payload(notification)
+	if err != nil {
+		return err
+	}
+
+	backoff := notifier.Backoff
+	for attempt := 0; ; attempt++ {
+		err = notifier.post(payload)
+		if err == nil {
+			return nil
+		}
+		if attempt >= notifier.Retries {
+			return err
+		}
+
+		logger.Warn(
+			"Notification failed, retrying",
+			zap.String("url", notifier.URL),
+			zap.Int("attempt", attempt+1),
+			zap.Duration("backoff", backoff),
+			zap.Error(err))
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post ペイロードを1回だけPOSTする
+func (notifier *Notifier) post(payload []byte) error {
+	client := notifier.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	response, err := client.Post(notifier.URL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	ioutil.ReadAll(response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("notification endpoint responded %s", response.Status)
+	}
+	return nil
+}
+
+func init() {
+	NotificationConfig = NotificationConfigStruct{
+		URL:          GetNotifyURL,
+		Format:       GetNotifyFormat,
+		TemplatePath: GetNotifyTemplatePath,
+		Retries:      GetNotifyRetries,
+		Backoff:      GetNotifyBackoff,
+	}
+}
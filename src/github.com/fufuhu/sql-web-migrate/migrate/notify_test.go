@@ -0,0 +1,245 @@
+package migrate
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestNotifier テスト用にhttptestサーバへ通知するNotifierを生成する
+func newTestNotifier(t *testing.T, url string, format string) *Notifier {
+	os.Setenv(NotifyURL, url)
+	os.Setenv(NotifyFormat, format)
+	os.Setenv(NotifyRetries, "2")
+	os.Setenv(NotifyBackoff, "1ms")
+	os.Unsetenv(NotifyTemplatePath)
+	defer os.Unsetenv(NotifyURL)
+	defer os.Unsetenv(NotifyFormat)
+	defer os.Unsetenv(NotifyRetries)
+	defer os.Unsetenv(NotifyBackoff)
+
+	notifier, err := NewNotifier(NotificationConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return notifier
+}
+
+var testNotification = Notification{
+	Direction: "up",
+	Applied:   []string{"00-test.sql", "01-test.sql"},
+	Duration:  1500 * time.Millisecond,
+	Requester: "127.0.0.1",
+	Success:   true,
+}
+
+// TestNewNotifierWithoutURL 通知先のURLが設定されていない場合に
+// Notifierが生成されないことを確認する。
+func TestNewNotifierWithoutURL(t *testing.T) {
+	os.Unsetenv(NotifyURL)
+
+	notifier, err := NewNotifier(NotificationConfig)
+
+	if err != nil || notifier != nil {
+		t.Fail()
+	}
+}
+
+// TestNotifyGeneric 汎用形式のペイロードに
+// 方向、適用したID、所要時間、要求者、成否が含まれることを確認する。
+func TestNotifyGeneric(t *testing.T) {
+	var payload map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			t.Error(r.Header.Get("Content-Type"))
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	notifier := newTestNotifier(t, server.URL, NotifyFormatGeneric)
+	if err := notifier.Notify(testNotification); err != nil {
+		t.Fatal(err)
+	}
+
+	if payload["direction"] != "up" ||
+		payload["requester"] != "127.0.0.1" ||
+		payload["success"] != true ||
+		payload["durationMillis"] != float64(1500) ||
+		payload["error"] != "" {
+		t.Log(payload)
+		t.Fail()
+	}
+	applied, _ := payload["applied"].([]interface{})
+	if len(applied) != 2 || applied[0] != "00-test.sql" {
+		t.Log(payload)
+		t.Fail()
+	}
+}
+
+// TestNotifySlack Slack互換形式のペイロードがtextを持ち、
+// 失敗時にエラーメッセージが含まれることを確認する。
+func TestNotifySlack(t *testing.T) {
+	var payload map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	notification := testNotification
+	notification.Success = false
+	notification.Error = `pq: relation "test" already exists`
+
+	notifier := newTestNotifier(t, server.URL, NotifyFormatSlack)
+	if err := notifier.Notify(notification); err != nil {
+		t.Fatal(err)
+	}
+
+	text := payload["text"]
+	if !strings.HasPrefix(text, "[FAILURE] migrate up by 127.0.0.1") ||
+		!strings.Contains(text, notification.Error) {
+		t.Log(text)
+		t.Fail()
+	}
+}
+
+// TestNotifyRetry 通知先がエラーを返した場合に
+// リトライして成功することを確認する。
+func TestNotifyRetry(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	notifier := newTestNotifier(t, server.URL, NotifyFormatGeneric)
+	if err := notifier.Notify(testNotification); err != nil {
+		t.Fatal(err)
+	}
+
+	if attempts != 3 {
+		t.Log(attempts)
+		t.Fail()
+	}
+}
+
+// TestNotifyGiveUp リトライ回数を超えて失敗した場合に
+// エラーが返ることを確認する。
+func TestNotifyGiveUp(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	notifier := newTestNotifier(t, server.URL, NotifyFormatGeneric)
+	if err := notifier.Notify(testNotification); err == nil {
+		t.Fail()
+	}
+
+	if attempts != 3 {
+		t.Log(attempts)
+		t.Fail()
+	}
+}
+
+// TestNotifyTemplatePath テンプレートファイルを指定した場合に
+// その内容でペイロードが生成されることを確認する。
+func TestNotifyTemplatePath(t *testing.T) {
+	file, err := ioutil.TempFile("", "notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`{"msg": {{json .Direction}}, "count": {{len .Applied}}}`)
+	file.Close()
+
+	os.Setenv(NotifyURL, "http://localhost")
+	os.Setenv(NotifyTemplatePath, file.Name())
+	defer os.Unsetenv(NotifyURL)
+	defer os.Unsetenv(NotifyTemplatePath)
+
+	notifier, err := NewNotifier(NotificationConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := notifier.Payload(testNotification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(payload) != `{"msg": "up", "count": 2}` {
+		t.Log(string(payload))
+		t.Fail()
+	}
+}
+
+// TestNotifyInvalidPayload テンプレートがJSONとして不正な値を
+// 生成した場合にエラーとなることを確認する。
+func TestNotifyInvalidPayload(t *testing.T) {
+	tmpl, err := ParseNotifyTemplate(`{"direction": {{.Direction}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notifier := Notifier{Template: tmpl}
+
+	if _, err := notifier.Payload(testNotification); err == nil {
+		t.Fail()
+	}
+}
+
+// TestGetNotifyFormatError 通知のペイロード形式として
+// 不正な値が設定されてる場合にエラーとデフォルトの値がかえってくることを確認する。
+func TestGetNotifyFormatError(t *testing.T) {
+	os.Setenv(NotifyFormat, "hogehoge")
+	defer os.Unsetenv(NotifyFormat)
+
+	format, err := GetNotifyFormat()
+
+	if err == nil || err.Error() != NotifyFormatSettingFormatErrorMessage {
+		t.Fail()
+	}
+	if format != DefaultNotifyFormat {
+		t.Fail()
+	}
+}
+
+// TestGetNotifyRetriesDefaultValue 通知のリトライ回数として
+// 環境変数が指定されていない場合にデフォルト値が取得できることを確認する。
+func TestGetNotifyRetriesDefaultValue(t *testing.T) {
+	os.Unsetenv(NotifyRetries)
+
+	retries, err := GetNotifyRetries()
+
+	if err != nil || retries != DefaultNotifyRetries {
+		t.Fail()
+	}
+}
+
+// TestGetNotifyBackoffError 通知リトライの待ち時間として
+// 不正な値が設定されている場合にエラーが返ることを確認する。
+func TestGetNotifyBackoffError(t *testing.T) {
+	os.Setenv(NotifyBackoff, "hogehoge")
+	defer os.Unsetenv(NotifyBackoff)
+
+	backoff, err := GetNotifyBackoff()
+
+	if err == nil || backoff != DefaultNotifyBackoff {
+		t.Fail()
+	}
+}
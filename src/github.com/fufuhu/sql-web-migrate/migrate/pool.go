@@ -0,0 +1,280 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// DBMaxOpenConns 対象ごとに使い回す接続の最大数を指定するための環境変数
+	DBMaxOpenConns = "SQL_MIGRATE_DB_MAX_OPEN_CONNS"
+	// DBMaxIdleConns 対象ごとに保持するアイドル状態の接続の最大数を指定するための環境変数
+	DBMaxIdleConns = "SQL_MIGRATE_DB_MAX_IDLE_CONNS"
+	// DBConnMaxLifetime 接続を使い回す時間の上限を指定するための環境変数
+	DBConnMaxLifetime = "SQL_MIGRATE_DB_CONN_MAX_LIFETIME"
+)
+
+const (
+	// DefaultDBMaxOpenConns デフォルトの接続の最大数
+	DefaultDBMaxOpenConns = 10
+	// DefaultDBMaxIdleConns デフォルトのアイドル状態の接続の最大数
+	DefaultDBMaxIdleConns = 2
+	// DefaultDBConnMaxLifetime デフォルトの接続を使い回す時間の上限(0の場合は上限なし)
+	DefaultDBConnMaxLifetime = 30 * time.Minute
+)
+
+const (
+	// DBMaxOpenConnsSettingFormatErrorMessage 接続の最大数の設定値が不正な場合のエラーメッセージです
+	DBMaxOpenConnsSettingFormatErrorMessage = "DB max open connections should be a positive integer"
+	// DBMaxIdleConnsSettingFormatErrorMessage アイドル状態の接続の最大数の設定値が不正な場合のエラーメッセージです
+	DBMaxIdleConnsSettingFormatErrorMessage = "DB max idle connections should be a non-negative integer"
+)
+
+// GetDBMaxOpenConns 対象ごとに使い回す接続の最大数を取得する。
+// 不正な値が設定されている場合はエラーとDefaultDBMaxOpenConnsの値を返す
+func GetDBMaxOpenConns() (int, error) {
+	conns, err := strconv.Atoi(getValue(DBMaxOpenConns, strconv.Itoa(DefaultDBMaxOpenConns)))
+	if err != nil || conns < 1 {
+		return DefaultDBMaxOpenConns, errors.New(DBMaxOpenConnsSettingFormatErrorMessage)
+	}
+	return conns, nil
+}
+
+// GetDBMaxIdleConns 対象ごとに保持するアイドル状態の接続の最大数を取得する。
+// 不正な値が設定されている場合はエラーとDefaultDBMaxIdleConnsの値を返す
+func GetDBMaxIdleConns() (int, error) {
+	conns, err := strconv.Atoi(getValue(DBMaxIdleConns, strconv.Itoa(DefaultDBMaxIdleConns)))
+	if err != nil || conns < 0 {
+		return DefaultDBMaxIdleConns, errors.New(DBMaxIdleConnsSettingFormatErrorMessage)
+	}
+	return conns, nil
+}
+
+// GetDBConnMaxLifetime 接続を使い回す時間の上限を取得する。
+// 環境変数が設定されていない場合は、DefaultDBConnMaxLifetimeの値を返す
+func GetDBConnMaxLifetime() (time.Duration, error) {
+	return getDuration(DBConnMaxLifetime, DefaultDBConnMaxLifetime)
+}
+
+// PoolConfigStruct 対象ごとに使い回すDBへの接続の設定
+// MaxOpenConns 接続の最大数
+// MaxIdleConns アイドル状態の接続の最大数
+// ConnMaxLifetime 接続を使い回す時間の上限(0の場合は上限なし)
+type PoolConfigStruct struct {
+	MaxOpenConns    func() (int, error)
+	MaxIdleConns    func() (int, error)
+	ConnMaxLifetime func() (time.Duration, error)
+}
+
+// PoolConfig 環境変数で設定した対象(default)の接続の設定です
+var PoolConfig PoolConfigStruct
+
+// poolKey 使い回す接続を区別するキー
+// session マイグレーションの実行に使う、接続が1本だけのものかどうか
+type poolKey struct {
+	session bool
+}
+
+// dbPool 対象のDBへの使い回す接続。
+// テナントのスキーマは数百になることがあるため、スキーマごとの接続は使い回さない
+type dbPool struct {
+	mutex sync.Mutex
+	dbs   map[poolKey]*sql.DB
+}
+
+// DB 対象のDBへの接続を返す。初回に開いた接続を使い回し、使うたびに疎通を確認する。
+// 返した接続は呼び出し元で閉じずに、終了時にCloseで閉じる
+func (target *Target) DB(ctx context.Context, dialect string) (*sql.DB, error) {
+	return target.pooledDB(ctx, dialect, poolKey{})
+}
+
+// sessionDB マイグレーションの実行に使う、接続が1本だけのDBへの接続を返す。
+// セッションに設定したタイムアウトが実行中のマイグレーションで有効になるように、DBとは別に使い回す
+func (target *Target) sessionDB(ctx context.Context, dialect string) (*sql.DB, error) {
+	return target.pooledDB(ctx, dialect, poolKey{session: true})
+}
+
+// schemaDB search_pathをschemaにしたDBへの接続を開いて疎通を確認する。sessionがtrueの場合は接続を1本だけにする。
+// スキーマの数だけ接続が残らないように使い回さず、返したreleaseで閉じる。
+// schemaが空文字の場合はsessionがtrueならsessionDB、falseならDBの接続を返し、releaseは何もしない
+func (target *Target) schemaDB(ctx context.Context, dialect string, schema string,
+	session bool) (db *sql.DB, release func(), err error) {
+
+	release = func() {}
+	if schema == "" {
+		if session {
+			db, err = target.sessionDB(ctx, dialect)
+		} else {
+			db, err = target.DB(ctx, dialect)
+		}
+		return db, release, err
+	}
+
+	db, err = GetSchemaConnection(ctx, target.Connection, dialect, schema)
+	if err != nil {
+		return nil, release, err
+	}
+	if session {
+		db.SetMaxOpenConns(1)
+	}
+	if err := pingDB(ctx, db); err != nil {
+		db.Close()
+		return nil, release, fmt.Errorf("cannot connect to target %s (schema %s): %w", target.Name, schema, err)
+	}
+	return db, func() { db.Close() }, nil
+}
+
+// pooledDB keyに対応する接続を返す。接続できない場合はエラーを返す
+func (target *Target) pooledDB(ctx context.Context, dialect string, key poolKey) (*sql.DB, error) {
+	db, err := target.openedDB(ctx, dialect, key)
+	if err != nil {
+		return nil, err
+	}
+	if err := pingDB(ctx, db); err != nil {
+		return nil, fmt.Errorf("cannot connect to target %s: %w", target.Name, err)
+	}
+	return db, nil
+}
+
+// openedDB keyに対応する接続を返す。まだ開いていない場合は開いて設定する
+func (target *Target) openedDB(ctx context.Context, dialect string, key poolKey) (*sql.DB, error) {
+	target.pool.mutex.Lock()
+	defer target.pool.mutex.Unlock()
+
+	if db, ok := target.pool.dbs[key]; ok {
+		return db, nil
+	}
+	db, err := target.openPool(ctx, dialect, key)
+	if err != nil {
+		return nil, err
+	}
+	if target.pool.dbs == nil {
+		target.pool.dbs = map[poolKey]*sql.DB{}
+	}
+	target.pool.dbs[key] = db
+	return db, nil
+}
+
+// openPool 対象の接続の設定に従って接続を開く
+func (target *Target) openPool(ctx context.Context, dialect string, key poolKey) (*sql.DB, error) {
+	config := target.Pool
+	if config.MaxOpenConns == nil {
+		config = PoolConfig
+	}
+	maxOpen, err := config.MaxOpenConns()
+	if err != nil {
+		return nil, err
+	}
+	maxIdle, err := config.MaxIdleConns()
+	if err != nil {
+		return nil, err
+	}
+	lifetime, err := config.ConnMaxLifetime()
+	if err != nil {
+		return nil, err
+	}
+	if key.session {
+		maxOpen, maxIdle = 1, 1
+	}
+	// インメモリDBはすべての接続を閉じると消えるため、接続を閉じない
+	if dialect == DialectSQLite && target.Connection.DBName() == SQLiteMemoryPath {
+		lifetime = 0
+		if maxIdle < 1 {
+			maxIdle = 1
+		}
+	}
+
+	db, err := GetConnection(ctx, target.Connection, dialect)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(maxOpen)
+	db.SetMaxIdleConns(maxIdle)
+	db.SetConnMaxLifetime(lifetime)
+	return db, nil
+}
+
+// pingDB DBに接続できるかを確認する。sql.Openは接続しないため、接続にかかる時間はここでトレースする。
+// WaitTimeoutが設定されている場合は、その間待ち時間を倍にしながら再試行する
+func pingDB(ctx context.Context, db *sql.DB) (err error) {
+	ctx, span := Tracer().Start(ctx, "connect")
+	defer func() { EndSpan(span, err) }()
+
+	timeout, err := GetWaitTimeout()
+	if err != nil {
+		return err
+	}
+	if timeout == 0 {
+		return db.PingContext(ctx)
+	}
+	backoff, err := GetWaitBackoff()
+	if err != nil {
+		return err
+	}
+	return WaitFor(ctx, timeout, backoff, db.PingContext)
+}
+
+// Close 対象の使い回している接続をすべて閉じる
+func (target *Target) Close() error {
+	target.pool.mutex.Lock()
+	defer target.pool.mutex.Unlock()
+
+	var closeErr error
+	for key, db := range target.pool.dbs {
+		if err := db.Close(); err != nil && closeErr == nil {
+			closeErr = err
+		}
+		delete(target.pool.dbs, key)
+	}
+	return closeErr
+}
+
+// Close すべての対象の使い回している接続を閉じる
+func (targets *Targets) Close() error {
+	var closeErr error
+	for _, target := range targets.List() {
+		if err := target.Close(); err != nil && closeErr == nil {
+			closeErr = err
+		}
+	}
+	return closeErr
+}
+
+// ConnectTargets 起動時にすべての対象の接続を開き、接続できるかを確認する。
+// 接続できない対象があっても起動は続け、使う際に改めて接続を確認する
+func ConnectTargets(ctx context.Context, targets *Targets) {
+	logger, _ := zap.NewProduction()
+	defer logger.Sync()
+
+	for _, target := range targets.List() {
+		dialect, err := target.Dialect()
+		if err == nil {
+			_, err = target.DB(ctx, dialect)
+		}
+		if err != nil {
+			logger.Warn(
+				"Target is not reachable",
+				zap.String("target", target.Name),
+				zap.Error(err))
+			continue
+		}
+		logger.Info(
+			"Connected to target",
+			zap.String("target", target.Name))
+	}
+}
+
+func init() {
+	PoolConfig = PoolConfigStruct{
+		MaxOpenConns:    GetDBMaxOpenConns,
+		MaxIdleConns:    GetDBMaxIdleConns,
+		ConnMaxLifetime: GetDBConnMaxLifetime,
+	}
+}
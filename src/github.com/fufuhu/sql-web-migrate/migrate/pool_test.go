@@ -0,0 +1,161 @@
+package migrate
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestGetDBPoolSettings 接続の設定の既定値と、不正な値がエラーになることを確認する。
+func TestGetDBPoolSettings(t *testing.T) {
+	os.Unsetenv(DBMaxOpenConns)
+	os.Unsetenv(DBMaxIdleConns)
+	os.Unsetenv(DBConnMaxLifetime)
+	if conns, err := GetDBMaxOpenConns(); err != nil || conns != DefaultDBMaxOpenConns {
+		t.Log(conns, err)
+		t.Fail()
+	}
+	if conns, err := GetDBMaxIdleConns(); err != nil || conns != DefaultDBMaxIdleConns {
+		t.Log(conns, err)
+		t.Fail()
+	}
+	if lifetime, err := GetDBConnMaxLifetime(); err != nil || lifetime != DefaultDBConnMaxLifetime {
+		t.Log(lifetime, err)
+		t.Fail()
+	}
+
+	defer os.Unsetenv(DBMaxOpenConns)
+	defer os.Unsetenv(DBMaxIdleConns)
+	for _, value := range []string{"hogehoge", "0"} {
+		os.Setenv(DBMaxOpenConns, value)
+		if conns, err := GetDBMaxOpenConns(); err == nil || conns != DefaultDBMaxOpenConns {
+			t.Log(value, conns, err)
+			t.Fail()
+		}
+	}
+	os.Setenv(DBMaxIdleConns, "-1")
+	if conns, err := GetDBMaxIdleConns(); err == nil || conns != DefaultDBMaxIdleConns {
+		t.Log(conns, err)
+		t.Fail()
+	}
+}
+
+// TestTargetDB スキーマごとに同じ接続を使い回し、マイグレーションの実行に使う接続は別にして、
+// Closeで閉じた後は新しく開くことを確認する。
+func TestTargetDB(t *testing.T) {
+	targets, cleanup := setupSQLiteTargets(t, nil)
+	defer cleanup()
+	target, _ := targets.Get("local")
+	ctx := context.Background()
+
+	db, err := target.DB(ctx, DialectSQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := target.DB(ctx, DialectSQLite); err != nil || again != db {
+		t.Log(err)
+		t.Fail()
+	}
+	session, err := target.sessionDB(ctx, DialectSQLite)
+	if err != nil || session == db || session.Stats().MaxOpenConnections != 1 {
+		t.Log(err)
+		t.Fail()
+	}
+	if db.Stats().MaxOpenConnections != DefaultDBMaxOpenConns {
+		t.Log(db.Stats())
+		t.Fail()
+	}
+
+	if err := target.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PingContext(ctx); err == nil {
+		t.Log("closed handle is still usable")
+		t.Fail()
+	}
+	if reopened, err := target.DB(ctx, DialectSQLite); err != nil || reopened == db {
+		t.Log(err)
+		t.Fail()
+	}
+}
+
+// TestTargetSchemaDB スキーマを指定しない場合は使い回す接続を返し、
+// スキーマを指定した接続はスキーマの数だけ接続が残らないように使い回さないことを確認する。
+func TestTargetSchemaDB(t *testing.T) {
+	targets, cleanup := setupSQLiteTargets(t, nil)
+	defer cleanup()
+	target, _ := targets.Get("local")
+	ctx := context.Background()
+
+	db, err := target.DB(ctx, DialectSQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pooled, release, err := target.schemaDB(ctx, DialectSQLite, "", false)
+	release()
+	if err != nil || pooled != db || db.PingContext(ctx) != nil {
+		t.Log(err)
+		t.Fail()
+	}
+
+	// SQLiteはsearch_pathを指定できないためエラーになり、スキーマの接続は使い回す接続に加わらない
+	if _, release, err := target.schemaDB(ctx, DialectSQLite, "tenant_a", true); err == nil {
+		release()
+		t.Fail()
+	}
+	if len(target.pool.dbs) != 1 {
+		t.Log(target.pool.dbs)
+		t.Fail()
+	}
+}
+
+// TestTargetDBUnreachable 接続できない対象の場合は、WaitTimeoutの間再試行してから
+// 対象の名前を含むエラーを返すことを確認する。
+func TestTargetDBUnreachable(t *testing.T) {
+	targets, cleanup := setupSQLiteTargets(t, nil)
+	defer cleanup()
+	target, _ := targets.Get("local")
+	// 存在しないディレクトリのDBは開けない
+	target.Connection.DBName = func() string { return filepath.Join(os.TempDir(), "no-such-dir", "app.db") }
+
+	defer os.Unsetenv(WaitTimeout)
+	defer os.Unsetenv(WaitBackoff)
+	os.Setenv(WaitTimeout, "300ms")
+	os.Setenv(WaitBackoff, "50ms")
+
+	startedAt := time.Now()
+	_, err := target.DB(context.Background(), DialectSQLite)
+	if err == nil || !strings.Contains(err.Error(), "target local") || time.Since(startedAt) < 300*time.Millisecond {
+		t.Log(err, time.Since(startedAt))
+		t.Fail()
+	}
+}
+
+// TestTargetDBConnectSpan 接続の確認にかかった時間が、接続を開くスパンとは別のスパンとして
+// トレースに書き出されることを確認する。
+func TestTargetDBConnectSpan(t *testing.T) {
+	path, shutdown := setupFileTracing(t)
+	defer os.Remove(path)
+	targets, cleanup := setupSQLiteTargets(t, nil)
+	defer cleanup()
+	target, _ := targets.Get("local")
+
+	if _, err := target.DB(context.Background(), DialectSQLite); err != nil {
+		t.Fatal(err)
+	}
+	shutdown(context.Background())
+
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := string(bytes)
+	if !strings.Contains(output, `"Name":"getConnection"`) || !strings.Contains(output, `"Name":"connect"`) {
+		t.Log(output)
+		t.Fail()
+	}
+}
@@ -0,0 +1,295 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	sqlmigrate "github.com/rubenv/sql-migrate"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultRedoSteps デフォルトの戻して再適用するマイグレーションの数
+	DefaultRedoSteps = 1
+)
+
+const (
+	// RedoStepsErrorMessage 戻して再適用するマイグレーションの数が不正な場合のエラーメッセージです
+	RedoStepsErrorMessage = "steps should be a positive integer for redo"
+	// NotEnoughAppliedErrorMessage 適用済みのマイグレーションが指定された数より少ない場合のエラーメッセージです
+	NotEnoughAppliedErrorMessage = "Fewer migrations are applied than the steps to redo"
+	// RedoOrderErrorMessage 戻したマイグレーションより古い未適用のマイグレーションがあり、再適用で別のものを適用してしまう場合のエラーメッセージです
+	RedoOrderErrorMessage = "Older migrations are pending, so redo would not reapply the migrations it rolls back"
+)
+
+var (
+	// ErrRedoSteps 戻して再適用するマイグレーションの数が不正であることを表すエラー
+	ErrRedoSteps = errors.New(RedoStepsErrorMessage)
+	// ErrNotEnoughApplied 適用済みのマイグレーションが指定された数より少ないことを表すエラー
+	ErrNotEnoughApplied = errors.New(NotEnoughAppliedErrorMessage)
+	// ErrRedoOrder 再適用で戻したものとは別のマイグレーションを適用してしまうことを表すエラー
+	ErrRedoOrder = errors.New(RedoOrderErrorMessage)
+)
+
+// RedoResult 最後に適用したマイグレーションを戻して再適用した結果を格納するための構造体
+// Steps 戻して再適用するマイグレーションの数
+// Success 戻して再適用するまで成功したかどうか
+// RolledBack 戻した際の実行結果(実行前に失敗した場合は空)
+// Reapplied 再適用した際の実行結果(戻すまでに失敗した場合は空)
+// StartedAt 開始時刻
+// DurationMillis 所要時間(ミリ秒)
+// Error 失敗した場合のエラーメッセージ
+type RedoResult struct {
+	Steps          int              `json:"steps"`
+	Success        bool             `json:"success"`
+	RolledBack     *MigrationResult `json:"rolledBack,omitempty"`
+	Reapplied      *MigrationResult `json:"reapplied,omitempty"`
+	StartedAt      time.Time        `json:"startedAt"`
+	DurationMillis int64            `json:"durationMillis"`
+	Error          string           `json:"error,omitempty"`
+}
+
+// Finish 所要時間と成否を記録する
+func (result *RedoResult) Finish(err error) {
+	result.DurationMillis = int64(time.Since(result.StartedAt) / time.Millisecond)
+	result.Success = err == nil
+	if err != nil {
+		result.Error = err.Error()
+	}
+}
+
+// ExecRedo 対象に最後に適用したsteps件のマイグレーションを戻し、現在のファイルから再適用する。
+// 戻してから再適用するまで対象の実行権を持ち続ける。
+// 同じ対象のマイグレーションが実行中の場合はErrMigrationInProgressを返す
+func ExecRedo(ctx context.Context, target *Target, steps int) (RedoResult, error) {
+	if err := target.TryLock(); err != nil {
+		result := RedoResult{Steps: steps, StartedAt: time.Now()}
+		result.Finish(err)
+		return result, err
+	}
+	defer target.Unlock()
+
+	return execRedo(ctx, target, steps)
+}
+
+// execRedo 対象に最後に適用したsteps件のマイグレーションを戻して再適用する。
+// 適用済みのマイグレーションがsteps件より少ない場合(スキーマごとに適用する対象ではいずれかのスキーマで少ない場合)は
+// 何もせずにErrNotEnoughAppliedを返す。呼び出し元で対象の実行権(TryLock)を取得しておくこと
+func execRedo(ctx context.Context, target *Target, steps int) (result RedoResult, err error) {
+	logger, _ := zap.NewProduction()
+	defer logger.Sync()
+
+	result = RedoResult{Steps: steps, StartedAt: time.Now()}
+	defer func() { result.Finish(err) }()
+
+	if steps < 1 {
+		return result, ErrRedoSteps
+	}
+	if err = checkRedoSteps(ctx, target, steps); err != nil {
+		return result, err
+	}
+
+	rolledBack, err := execMigrate(ctx, target, sqlmigrate.Down, steps, nil)
+	result.RolledBack = &rolledBack
+	if err != nil {
+		return result, err
+	}
+
+	// checkRedoStepsで、戻したマイグレーションが未適用の先頭になることを確認している
+	reapplied, err := execMigrate(ctx, target, sqlmigrate.Up, steps, nil)
+	result.Reapplied = &reapplied
+	if err != nil {
+		logger.Error(
+			"Reapplying migrations failed after rolling them back",
+			zap.String("target", target.Name),
+			zap.Strings("rolledBack", rolledBack.Applied),
+			zap.Error(err))
+	}
+	return result, err
+}
+
+// checkRedoSteps 対象(スキーマごとに適用する対象ではすべてのスキーマ)でsteps件のマイグレーションを戻し、
+// 同じものを再適用できるかを確認する
+func checkRedoSteps(ctx context.Context, target *Target, steps int) error {
+	source, err := target.Source()
+	if err != nil {
+		return err
+	}
+	dialect, err := target.Dialect()
+	if err != nil {
+		return err
+	}
+	plans, err := planTarget(ctx, target, dialect, source, sqlmigrate.Down, steps)
+	if err != nil {
+		return err
+	}
+	pendingPlans, err := planTarget(ctx, target, dialect, source, sqlmigrate.Up, 0)
+	if err != nil {
+		return err
+	}
+	pending := map[string][]*sqlmigrate.PlannedMigration{}
+	for _, plan := range pendingPlans {
+		pending[plan.schema] = plan.planned
+	}
+
+	for _, plan := range plans {
+		if len(plan.planned) < steps {
+			err = fmt.Errorf("%w: %d applied", ErrNotEnoughApplied, len(plan.planned))
+		} else {
+			err = checkRedoOrder(plan.planned, pending[plan.schema], steps)
+		}
+		if err != nil && plan.schema != "" {
+			return fmt.Errorf("%w in schema %s", err, plan.schema)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRedoOrder 戻した後のupの先頭steps件が、戻すマイグレーションを古い順にしたものと一致するかを確認する。
+// upは古い未適用のマイグレーションから適用するため、戻すものより古い未適用のマイグレーション
+// (適用記録を消したものや後からマージしたもの)があると、戻したものとは別のものを適用してしまう
+func checkRedoOrder(down []*sqlmigrate.PlannedMigration, pending []*sqlmigrate.PlannedMigration, steps int) error {
+	// downの実行予定の先頭には、古い未適用のマイグレーションを適用する予定が含まれることがある
+	pendingIDs := map[string]bool{}
+	for _, planned := range pending {
+		pendingIDs[planned.Id] = true
+	}
+	rolledBack := []string{}
+	for i := len(down) - 1; i >= 0; i-- {
+		if !pendingIDs[down[i].Id] {
+			rolledBack = append(rolledBack, down[i].Id)
+		}
+	}
+
+	// 戻した後は、戻したものと未適用のものをまとめて古い順に適用する
+	seen := map[string]bool{}
+	migrations := []*sqlmigrate.Migration{}
+	for _, planned := range append(append([]*sqlmigrate.PlannedMigration{}, down...), pending...) {
+		if !seen[planned.Id] {
+			seen[planned.Id] = true
+			migrations = append(migrations, planned.Migration)
+		}
+	}
+	sort.SliceStable(migrations, func(i, j int) bool { return migrations[i].Less(migrations[j]) })
+	reapplied := []string{}
+	for _, migration := range migrations[:min(steps, len(migrations))] {
+		reapplied = append(reapplied, migration.Id)
+	}
+
+	if strings.Join(reapplied, ",") != strings.Join(rolledBack, ",") {
+		return fmt.Errorf("%w: rolling back %s would reapply %s", ErrRedoOrder,
+			strings.Join(rolledBack, ","), strings.Join(reapplied, ","))
+	}
+	return nil
+}
+
+// redoHandler 最後に適用したマイグレーションをクエリパラメータstepsの数(デフォルトは1)だけ戻して再適用するハンドラ。
+// 実行できる時間帯や確認はdownと同じように扱い、確認では再適用するUpの文も検査して示す。
+// 承認が必要な対象ではdownとupを個別に承認依頼する
+func redoHandler(w http.ResponseWriter, r *http.Request, target *Target) {
+	logger, _ := zap.NewProduction()
+	defer logger.Sync()
+
+	ctx, span := StartRequestSpan(r, "migrate redo")
+	defer span.End()
+	span.SetAttributes(attribute.String("migration.target", target.Name))
+
+	r, ok := authorize(w, r.WithContext(ctx), target.AllowedNetworks())
+	if !ok {
+		return
+	}
+
+	steps, err := parseSteps(r, DefaultRedoSteps)
+	if err == nil && steps < 1 {
+		err = ErrRedoSteps
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	if err := target.TryLock(); err != nil {
+		logger.Warn(
+			"Migration rejected",
+			zap.String("target", target.Name),
+			zap.Error(err))
+		result := RedoResult{Steps: steps, StartedAt: time.Now()}
+		result.Finish(err)
+		writeJSON(w, http.StatusConflict, result)
+		return
+	}
+	defer target.Unlock()
+
+	if !checkSchedule(w, r, target) {
+		return
+	}
+
+	identity := IdentityFromContext(r.Context())
+	required, err := target.ApprovalRequired()
+	if err == nil && required {
+		err = fmt.Errorf("%w: redo cannot be approved as one request; request down and up separately", ErrApprovalRequired)
+	}
+	if err == nil {
+		err = checkRedoSteps(r.Context(), target, steps)
+	}
+	if err != nil {
+		logger.Warn(
+			"Migration rejected",
+			zap.String("target", target.Name),
+			zap.Error(err))
+		RecordAudit(AuditEvent{
+			Action: AuditMigrationRun, Target: target.Name, Identity: identity,
+			Direction: "redo", Steps: steps, Detail: err.Error(),
+		})
+		writeJSON(w, errorStatus(err), ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	// 戻す操作はdownと同じ実行予定で、再適用する操作はUpの文で確認する
+	confirmation, err := CheckRedoConfirmation(r.Context(), target, identity, steps, r.URL.Query().Get("confirm"))
+	if confirmation != nil {
+		writeJSON(w, http.StatusPreconditionRequired, confirmation)
+		return
+	}
+
+	result := RedoResult{Steps: steps, StartedAt: time.Now()}
+	if err != nil {
+		result.Finish(err)
+	} else {
+		result, err = execRedo(r.Context(), target, steps)
+		for _, phase := range []*MigrationResult{result.RolledBack, result.Reapplied} {
+			if phase == nil {
+				continue
+			}
+			notifyMigration(target.Name, identity, *phase)
+			audit := AuditEvent{
+				Action: AuditMigrationRun, Target: target.Name, Identity: identity,
+				Direction: phase.Direction, Steps: steps, Success: phase.Success,
+				Detail: "redo: " + strings.Join(phase.Applied, ","),
+			}
+			if phase.Backup != nil {
+				audit.Backup = phase.Backup.Path
+			}
+			RecordAudit(audit)
+		}
+	}
+
+	status := http.StatusOK
+	if err != nil {
+		logger.Error(
+			"Migration failed",
+			zap.Error(err))
+		EndSpan(span, err)
+		status = errorStatus(err)
+	}
+	writeJSON(w, status, result)
+}
@@ -0,0 +1,159 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestHandlerRedo 最後に適用したマイグレーションだけを戻し、
+// 変更後のファイルで再適用して、それぞれの結果を返すことを確認する。
+func TestHandlerRedo(t *testing.T) {
+	targets, cleanup := setupSQLiteTargets(t, nil)
+	defer cleanup()
+	target, _ := targets.Get("local")
+	mux := NewServeMux(targets)
+
+	if w := serve(mux, http.MethodPost, "/targets/local/migrate/up", nil); w.Code != http.StatusOK {
+		t.Fatal(w.Body.String())
+	}
+	ioutil.WriteFile(filepath.Join(target.SourcePath(), "02-posts.sql"),
+		[]byte("-- +migrate Up\nCREATE TABLE posts (id integer primary key, title text);\n"+
+			"-- +migrate Down\nDROP TABLE posts;\n"), 0644)
+
+	// 戻す操作は確認が必要
+	if w := serve(mux, http.MethodPost, "/targets/local/migrate/redo", nil); w.Code != http.StatusPreconditionRequired {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	w := serveConfirmed(t, mux, "/targets/local/migrate/redo")
+	var result RedoResult
+	decode(t, w, &result)
+	if w.Code != http.StatusOK || !result.Success || result.Steps != 1 ||
+		result.RolledBack == nil || len(result.RolledBack.Applied) != 1 || result.RolledBack.Applied[0] != "02-posts.sql" ||
+		result.Reapplied == nil || len(result.Reapplied.Applied) != 1 || result.Reapplied.Applied[0] != "02-posts.sql" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+
+	db, err := target.DB(context.Background(), DialectSQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO posts (id, title) VALUES (1, 'redo')"); err != nil {
+		t.Log(err)
+		t.Fail()
+	}
+}
+
+// TestHandlerRedoConfirmation redoの確認に再適用するUpの文とその検査の指摘が含まれ、
+// downの確認トークンではredoを実行できないことを確認する。
+func TestHandlerRedoConfirmation(t *testing.T) {
+	targets, cleanup := setupSQLiteTargets(t, nil)
+	defer cleanup()
+	target, _ := targets.Get("local")
+	mux := NewServeMux(targets)
+
+	if w := serve(mux, http.MethodPost, "/targets/local/migrate/up", nil); w.Code != http.StatusOK {
+		t.Fatal(w.Body.String())
+	}
+	ioutil.WriteFile(filepath.Join(target.SourcePath(), "02-posts.sql"),
+		[]byte("-- +migrate Up\nCREATE TABLE posts (id integer primary key);\nALTER TABLE users DROP COLUMN name;\n"+
+			"-- +migrate Down\nDROP TABLE posts;\n"), 0644)
+
+	w := serve(mux, http.MethodPost, "/targets/local/migrate/redo", nil)
+	var confirmation Confirmation
+	decode(t, w, &confirmation)
+	if w.Code != http.StatusPreconditionRequired || len(confirmation.Migrations) != 1 ||
+		len(confirmation.Reapply) != 1 || confirmation.Reapply[0].ID != "02-posts.sql" ||
+		len(confirmation.Reapply[0].Statements) != 2 {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	rules := []string{}
+	for _, finding := range confirmation.Findings {
+		rules = append(rules, finding.ID+" "+finding.Direction+" "+finding.Rule)
+	}
+	if strings.Join(rules, ",") != "02-posts.sql down drop-table,02-posts.sql up drop-column" {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+
+	// 同じ件数のdownの確認トークンはredoには使えない
+	w = serve(mux, http.MethodPost, "/targets/local/migrate/down?steps=1", nil)
+	var down Confirmation
+	decode(t, w, &down)
+	if down.PlanHash == confirmation.PlanHash {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+	if w := serve(mux, http.MethodPost, "/targets/local/migrate/redo?confirm="+down.Token, nil); w.Code != http.StatusConflict ||
+		!strings.Contains(w.Body.String(), ConfirmationInvalidErrorMessage) {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+}
+
+// TestHandlerRedoSteps stepsが正の整数でない場合は400を、
+// 適用済みのマイグレーションがstepsより少ない場合は何もせずに409を返すことを確認する。
+func TestHandlerRedoSteps(t *testing.T) {
+	targets, cleanup := setupSQLiteTargets(t, nil)
+	defer cleanup()
+	mux := NewServeMux(targets)
+
+	if w := serve(mux, http.MethodPost, "/targets/local/migrate/redo?steps=0", nil); w.Code != http.StatusBadRequest {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+
+	if w := serve(mux, http.MethodPost, "/targets/local/migrate/up?steps=1", nil); w.Code != http.StatusOK {
+		t.Fatal(w.Body.String())
+	}
+	if w := serve(mux, http.MethodPost, "/targets/local/migrate/redo?steps=2", nil); w.Code != http.StatusConflict {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+
+	w := serve(mux, http.MethodGet, "/targets/local/migrate/status", nil)
+	var statuses []MigrationStatus
+	decode(t, w, &statuses)
+	if len(statuses) != 2 || !statuses[0].Applied || statuses[1].Applied {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+}
+
+// TestHandlerRedoOlderPending 戻すマイグレーションより古い未適用のマイグレーションがある場合は、
+// 再適用で別のものを適用してしまうため、何も戻さずに409を返すことを確認する。
+func TestHandlerRedoOlderPending(t *testing.T) {
+	targets, cleanup := setupSQLiteTargets(t, nil)
+	defer cleanup()
+	target, _ := targets.Get("local")
+	mux := NewServeMux(targets)
+
+	if w := serve(mux, http.MethodPost, "/targets/local/migrate/up", nil); w.Code != http.StatusOK {
+		t.Fatal(w.Body.String())
+	}
+	// 後からマージされた、01-users.sqlと02-posts.sqlの間のマイグレーション
+	ioutil.WriteFile(filepath.Join(target.SourcePath(), "01a-tags.sql"),
+		[]byte("-- +migrate Up\nCREATE TABLE tags (id integer);\n-- +migrate Down\nDROP TABLE tags;\n"), 0644)
+
+	w := serve(mux, http.MethodPost, "/targets/local/migrate/redo", nil)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "would reapply 01a-tags.sql") {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+	if _, err := ExecRedo(context.Background(), target, 1); !errors.Is(err, ErrRedoOrder) {
+		t.Log(err)
+		t.Fail()
+	}
+
+	w = serve(mux, http.MethodGet, "/targets/local/migrate/status", nil)
+	var statuses []MigrationStatus
+	decode(t, w, &statuses)
+	if len(statuses) != 3 || !statuses[0].Applied || statuses[1].Applied || !statuses[2].Applied {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+}
@@ -0,0 +1,45 @@
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// MigrationFileTimestampFormat マイグレーションファイル名の先頭に付けるタイムスタンプの書式
+	MigrationFileTimestampFormat = "20060102150405"
+	// MigrationFileTemplate 新しく作成するマイグレーションファイルの雛形
+	MigrationFileTemplate = "-- +migrate Up\n\n\n-- +migrate Down\n\n"
+)
+
+const (
+	// MigrationNameFormatErrorMessage マイグレーション名を誤っている際のエラーメッセージです
+	MigrationNameFormatErrorMessage = "Migration name should not be empty or contain path separators"
+)
+
+// NewMigrationFile dirにタイムスタンプ付きのマイグレーションファイルの雛形を作成し、そのパスを返す。
+// 同じ名前のファイルが既に存在する場合はエラーを返す
+func NewMigrationFile(dir string, name string, now time.Time) (string, error) {
+	name = strings.TrimSuffix(strings.TrimSpace(name), ".sql")
+	if name == "" || strings.ContainsAny(name, `/\`) {
+		return "", errors.New(MigrationNameFormatErrorMessage)
+	}
+	name = strings.Join(strings.Fields(name), "_")
+
+	path := filepath.Join(dir, fmt.Sprintf("%s-%s.sql", now.Format(MigrationFileTimestampFormat), name))
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	if _, err := file.WriteString(MigrationFileTemplate); err != nil {
+		return "", err
+	}
+	return path, nil
+}
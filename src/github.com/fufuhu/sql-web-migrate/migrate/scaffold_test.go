@@ -0,0 +1,79 @@
+package migrate
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	sqlmigrate "github.com/rubenv/sql-migrate"
+)
+
+// TestNewMigrationFile タイムスタンプ付きのファイル名で
+// sql-migrateが解釈できる雛形が作成されることを確認する。
+func TestNewMigrationFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scaffold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2019, 10, 1, 12, 34, 56, 0, time.UTC)
+	path, err := NewMigrationFile(dir, "add users table", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if filepath.Base(path) != "20191001123456-add_users_table.sql" {
+		t.Log(path)
+		t.Fail()
+	}
+
+	migrations, err := sqlmigrate.FileMigrationSource{Dir: dir}.FindMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) != 1 || migrations[0].Id != filepath.Base(path) {
+		t.Fail()
+	}
+}
+
+// TestNewMigrationFileExists 同じ名前のファイルが既に存在する場合に
+// 上書きせずにエラーとなることを確認する。
+func TestNewMigrationFileExists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scaffold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	path, err := NewMigrationFile(dir, "init", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(path, []byte("-- edited"), 0644)
+
+	if _, err := NewMigrationFile(dir, "init.sql", now); err == nil {
+		t.Fail()
+	}
+
+	bytes, _ := ioutil.ReadFile(path)
+	if !strings.HasPrefix(string(bytes), "-- edited") {
+		t.Fail()
+	}
+}
+
+// TestNewMigrationFileInvalidName マイグレーション名が空、
+// またはパス区切り文字を含む場合にエラーとなることを確認する。
+func TestNewMigrationFileInvalidName(t *testing.T) {
+	for _, name := range []string{"", "  ", "../etc/passwd", `a\b`} {
+		_, err := NewMigrationFile(os.TempDir(), name, time.Now())
+		if err == nil || err.Error() != MigrationNameFormatErrorMessage {
+			t.Log(name)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,656 @@
+package migrate
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// MaintenanceWindows マイグレーションを実行できる時間帯をセミコロン区切りで指定するための環境変数。
+	// 1件は「曜日 開始-終了」の形式(例: "Mon-Fri 22:00-06:00; Sat,Sun 00:00-24:00")で、
+	// 終了が開始以前の場合は翌日の終了時刻までとする
+	MaintenanceWindows = "SQL_MIGRATE_MAINTENANCE_WINDOWS"
+	// MaintenanceTimeZone 実行できる時間帯のタイムゾーンを指定するための環境変数
+	MaintenanceTimeZone = "SQL_MIGRATE_MAINTENANCE_TIMEZONE"
+	// MigrationFreezes マイグレーションを凍結する期間をセミコロン区切りで指定するための環境変数。
+	// 1件は「開始/終了 理由」の形式(開始と終了はRFC3339、理由は省略可)
+	MigrationFreezes = "SQL_MIGRATE_FREEZES"
+	// EmergencyOverriders 時間帯と凍結(CLIやrun-onceでは承認)を無視して緊急に実行できる利用者名をカンマ区切りで指定するための環境変数
+	EmergencyOverriders = "SQL_MIGRATE_EMERGENCY_OVERRIDERS"
+	// FreezeFile APIで開始した凍結を保存するファイルのパスを指定するための環境変数
+	FreezeFile = "SQL_MIGRATE_FREEZE_FILE"
+)
+
+const (
+	// DefaultMaintenanceTimeZone デフォルトの実行できる時間帯のタイムゾーン
+	DefaultMaintenanceTimeZone = "UTC"
+	// DefaultFreezeFile デフォルトのAPIで開始した凍結を保存するファイルのパス
+	DefaultFreezeFile = "/var/lib/sql-web-migrate/freezes.json"
+)
+
+const (
+	// MaintenanceWindowSettingFormatErrorMessage 実行できる時間帯の設定値が不正な場合のエラーメッセージです
+	MaintenanceWindowSettingFormatErrorMessage = "Maintenance window should look like 'Mon-Fri 22:00-06:00'"
+	// MigrationFreezeSettingFormatErrorMessage 凍結期間の設定値が不正な場合のエラーメッセージです
+	MigrationFreezeSettingFormatErrorMessage = "Migration freeze should look like '2006-01-02T15:04:05Z/2006-01-03T15:04:05Z reason'"
+	// FreezeNotFoundErrorMessage 凍結が見つからない場合のエラーメッセージです
+	FreezeNotFoundErrorMessage = "Migration freeze not found"
+	// FreezeConfiguredErrorMessage 設定で指定した凍結を解除しようとした場合のエラーメッセージです
+	FreezeConfiguredErrorMessage = "This freeze comes from the server configuration and cannot be lifted through the API"
+	// FreezePeriodErrorMessage 凍結の終了時刻が指定されていないか過去の場合のエラーメッセージです
+	FreezePeriodErrorMessage = "Specify a future end time with until (RFC3339) or duration"
+	// OverrideNotAuthorizedErrorMessage 緊急実行を許可されていない利用者が時間帯外に実行しようとした場合のエラーメッセージです
+	OverrideNotAuthorizedErrorMessage = "You are not authorized to override the migration schedule"
+)
+
+var (
+	// ErrFreezeNotFound 凍結が見つからないことを表すエラー
+	ErrFreezeNotFound = errors.New(FreezeNotFoundErrorMessage)
+	// ErrFreezeConfigured 設定で指定した凍結は解除できないことを表すエラー
+	ErrFreezeConfigured = errors.New(FreezeConfiguredErrorMessage)
+	// ErrFreezePeriod 凍結の期間が不正であることを表すエラー
+	ErrFreezePeriod = errors.New(FreezePeriodErrorMessage)
+	// ErrOverrideNotAuthorized 緊急実行が許可されていないことを表すエラー
+	ErrOverrideNotAuthorized = errors.New(OverrideNotAuthorizedErrorMessage)
+)
+
+// weekdayNames 曜日の表記
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// MaintenanceWindow マイグレーションを実行できる時間帯
+// Spec 設定した表記
+// Days 開始する曜日
+// Start 開始時刻(0時からの分)
+// End 終了時刻(0時からの分)。Start以前の場合は翌日の時刻
+type MaintenanceWindow struct {
+	Spec  string
+	Days  [7]bool
+	Start int
+	End   int
+}
+
+// overnight 日をまたぐ時間帯かを返す
+func (window MaintenanceWindow) overnight() bool {
+	return window.End <= window.Start
+}
+
+// contains 時刻が時間帯に含まれるかを返す
+func (window MaintenanceWindow) contains(t time.Time) bool {
+	day, minute := t.Weekday(), t.Hour()*60+t.Minute()
+	if !window.overnight() {
+		return window.Days[day] && window.Start <= minute && minute < window.End
+	}
+	return (window.Days[day] && minute >= window.Start) || (window.Days[(day+6)%7] && minute < window.End)
+}
+
+// ParseMaintenanceWindows セミコロン区切りの実行できる時間帯を解釈する
+func ParseMaintenanceWindows(value string) ([]MaintenanceWindow, error) {
+	windows := []MaintenanceWindow{}
+	for _, spec := range strings.Split(value, ";") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		window, err := parseMaintenanceWindow(spec)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
+
+// parseMaintenanceWindow 「曜日 開始-終了」の形式の時間帯を解釈する。曜日は*、カンマ区切り、範囲(Fri-Mon)で指定できる
+func parseMaintenanceWindow(spec string) (MaintenanceWindow, error) {
+	invalid := fmt.Errorf("%s: %q", MaintenanceWindowSettingFormatErrorMessage, spec)
+	fields := strings.Fields(spec)
+	if len(fields) != 2 {
+		return MaintenanceWindow{}, invalid
+	}
+	window := MaintenanceWindow{Spec: spec}
+
+	for _, part := range strings.Split(fields[0], ",") {
+		if part == "*" {
+			for day := range window.Days {
+				window.Days[day] = true
+			}
+			continue
+		}
+		bounds := strings.SplitN(strings.ToLower(part), "-", 2)
+		first, ok := weekdayNames[bounds[0]]
+		last := first
+		if len(bounds) == 2 {
+			var lastOK bool
+			last, lastOK = weekdayNames[bounds[1]]
+			ok = ok && lastOK
+		}
+		if !ok {
+			return MaintenanceWindow{}, invalid
+		}
+		for day := first; ; day = (day + 1) % 7 {
+			window.Days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+
+	times := strings.SplitN(fields[1], "-", 2)
+	if len(times) != 2 {
+		return MaintenanceWindow{}, invalid
+	}
+	var err error
+	if window.Start, err = parseClock(times[0]); err != nil {
+		return MaintenanceWindow{}, invalid
+	}
+	if window.End, err = parseClock(times[1]); err != nil {
+		return MaintenanceWindow{}, invalid
+	}
+	return window, nil
+}
+
+// parseClock HH:MMの時刻を0時からの分に変換する。終了時刻として24:00も指定できる
+func parseClock(value string) (int, error) {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid time: %s", value)
+	}
+	hour, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, err
+	}
+	minute, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, err
+	}
+	if hour < 0 || minute < 0 || minute > 59 || hour*60+minute > 24*60 {
+		return 0, fmt.Errorf("invalid time: %s", value)
+	}
+	return hour*60 + minute, nil
+}
+
+// Freeze マイグレーションを凍結する期間
+// ID 凍結のID
+// Start 開始時刻
+// End 終了時刻
+// Reason 凍結する理由
+// CreatedBy APIで凍結した利用者
+// Configured サーバの設定で指定した凍結か(APIでは解除できない)
+type Freeze struct {
+	ID         string    `json:"id"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	Reason     string    `json:"reason,omitempty"`
+	CreatedBy  string    `json:"createdBy,omitempty"`
+	Configured bool      `json:"configured"`
+}
+
+// active 時刻が凍結期間に含まれるかを返す
+func (freeze Freeze) active(t time.Time) bool {
+	return !t.Before(freeze.Start) && t.Before(freeze.End)
+}
+
+// ParseFreezes セミコロン区切りの凍結期間を解釈する
+func ParseFreezes(value string) ([]Freeze, error) {
+	freezes := []Freeze{}
+	for _, spec := range strings.Split(value, ";") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		invalid := fmt.Errorf("%s: %q", MigrationFreezeSettingFormatErrorMessage, spec)
+		period := strings.Fields(spec)[0]
+		bounds := strings.SplitN(period, "/", 2)
+		if len(bounds) != 2 {
+			return nil, invalid
+		}
+		start, err := time.Parse(time.RFC3339, bounds[0])
+		if err != nil {
+			return nil, invalid
+		}
+		end, err := time.Parse(time.RFC3339, bounds[1])
+		if err != nil || !end.After(start) {
+			return nil, invalid
+		}
+		freezes = append(freezes, Freeze{
+			ID:         fmt.Sprintf("config-%d", len(freezes)+1),
+			Start:      start,
+			End:        end,
+			Reason:     strings.TrimSpace(strings.TrimPrefix(spec, period)),
+			Configured: true,
+		})
+	}
+	return freezes, nil
+}
+
+// GetMaintenanceWindows 実行できる時間帯を取得する。
+// 環境変数が設定されていない場合は空のスライスを返し、いつでも実行できる
+func GetMaintenanceWindows() ([]MaintenanceWindow, error) {
+	return ParseMaintenanceWindows(getValue(MaintenanceWindows, ""))
+}
+
+// GetMaintenanceTimeZone 実行できる時間帯のタイムゾーンを取得する。
+// 環境変数が設定されていない場合は、DefaultMaintenanceTimeZoneの値を返す
+func GetMaintenanceTimeZone() (*time.Location, error) {
+	return time.LoadLocation(getValue(MaintenanceTimeZone, DefaultMaintenanceTimeZone))
+}
+
+// GetMigrationFreezes 設定で指定した凍結期間を取得する
+func GetMigrationFreezes() ([]Freeze, error) {
+	return ParseFreezes(getValue(MigrationFreezes, ""))
+}
+
+// GetEmergencyOverriders 時間帯と凍結(CLIやrun-onceでは承認)を無視して実行できる利用者名を取得する。
+// 環境変数が設定されていない場合は空のスライスを返し、誰も緊急実行できない
+func GetEmergencyOverriders() []string {
+	overriders := []string{}
+	for _, name := range strings.Split(getValue(EmergencyOverriders, ""), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			overriders = append(overriders, name)
+		}
+	}
+	return overriders
+}
+
+// GetFreezeFile APIで開始した凍結を保存するファイルのパスを取得する。
+// 環境変数が設定されていない場合は、DefaultFreezeFileの値を返す
+func GetFreezeFile() string {
+	return getValue(FreezeFile, DefaultFreezeFile)
+}
+
+// ScheduleConfigStruct マイグレーションを実行できる時間帯の設定
+// Windows 実行できる時間帯(空の場合はいつでも実行できる)
+// TimeZone 時間帯のタイムゾーン
+// Freezes 設定で指定した凍結期間
+type ScheduleConfigStruct struct {
+	Windows  func() ([]MaintenanceWindow, error)
+	TimeZone func() (*time.Location, error)
+	Freezes  func() ([]Freeze, error)
+}
+
+// ScheduleConfig 環境変数で設定した対象(default)のマイグレーションを実行できる時間帯の設定です
+var ScheduleConfig ScheduleConfigStruct
+
+// OverrideConfigStruct 緊急実行の設定
+// Overriders 時間帯と凍結(CLIやrun-onceでは承認)を無視して実行できる利用者名
+type OverrideConfigStruct struct {
+	Overriders func() []string
+}
+
+// OverrideConfig 緊急実行の設定です
+var OverrideConfig OverrideConfigStruct
+
+// FreezeConfigStruct APIで開始した凍結の設定
+// File 凍結を保存するファイルのパス
+type FreezeConfigStruct struct {
+	File func() string
+}
+
+// FreezeConfig APIで開始した凍結の設定です
+var FreezeConfig FreezeConfigStruct
+
+// ScheduleError 時間帯の外や凍結中のためマイグレーションを実行できないことを表すエラー (423 Locked)
+// Reason 実行できない理由
+// NextAllowed 次に実行できる時刻(わからない場合はnil)
+type ScheduleError struct {
+	Reason      string
+	NextAllowed *time.Time
+}
+
+func (e *ScheduleError) Error() string {
+	if e.NextAllowed == nil {
+		return "Migrations are not allowed now: " + e.Reason
+	}
+	return fmt.Sprintf("Migrations are not allowed now: %s; next allowed at %s", e.Reason, e.NextAllowed.Format(time.RFC3339))
+}
+
+// ScheduleStatus 対象のマイグレーションを実行できる時間帯と凍結の状況 (GET /schedule)
+// Allowed 現在実行できるか
+// Reason 実行できない理由
+// NextAllowed 実行できない場合の、次に実行できる時刻
+// TimeZone 時間帯のタイムゾーン
+// Windows 実行できる時間帯(空の場合はいつでも実行できる)
+// Freezes 現在と今後の凍結期間
+type ScheduleStatus struct {
+	Allowed     bool       `json:"allowed"`
+	Reason      string     `json:"reason,omitempty"`
+	NextAllowed *time.Time `json:"nextAllowed,omitempty"`
+	TimeZone    string     `json:"timezone"`
+	Windows     []string   `json:"windows"`
+	Freezes     []Freeze   `json:"freezes"`
+}
+
+// freezeStore APIで開始した凍結。
+// サーバを再起動しても凍結が解けないように、変更するたびにファイルに保存する
+type freezeStore struct {
+	mu      sync.Mutex
+	loaded  bool
+	freezes map[string][]Freeze
+}
+
+// freezes APIで開始した凍結です(対象の名前ごと)
+var freezes = &freezeStore{freezes: map[string][]Freeze{}}
+
+// LoadFreezes APIで開始した凍結をファイルから読み込み直す。
+// ファイルが存在しない場合は凍結なしとする
+func LoadFreezes() error {
+	freezes.mu.Lock()
+	defer freezes.mu.Unlock()
+	freezes.loaded = false
+	return freezes.load()
+}
+
+// load まだ読み込んでいなければファイルから凍結を読み込む。呼び出し元でmuを取得しておくこと
+func (store *freezeStore) load() error {
+	if store.loaded {
+		return nil
+	}
+	loaded := map[string][]Freeze{}
+	content, err := ioutil.ReadFile(FreezeConfig.File())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(content, &loaded); err != nil {
+			return fmt.Errorf("%s: %v", FreezeConfig.File(), err)
+		}
+	}
+	store.freezes = loaded
+	store.loaded = true
+	return nil
+}
+
+// save 終了した凍結を取り除いてファイルに保存する。呼び出し元でmuを取得しておくこと。
+// 一時ファイルに書き込んでからリネームするため、書きかけの内容を読み込むことはない
+func (store *freezeStore) save() error {
+	now := time.Now()
+	for name, list := range store.freezes {
+		current := []Freeze{}
+		for _, freeze := range list {
+			if freeze.End.After(now) {
+				current = append(current, freeze)
+			}
+		}
+		store.freezes[name] = current
+	}
+
+	path := FreezeConfig.File()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	encoded, _ := json.MarshalIndent(store.freezes, "", "  ")
+	_, err = file.Write(encoded)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// StartFreeze 対象のマイグレーションを今からendまで凍結する
+func StartFreeze(target *Target, identity string, end time.Time, reason string) (Freeze, error) {
+	now := time.Now()
+	if !end.After(now) {
+		return Freeze{}, ErrFreezePeriod
+	}
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return Freeze{}, err
+	}
+	freeze := Freeze{ID: hex.EncodeToString(random), Start: now, End: end, Reason: reason, CreatedBy: identity}
+
+	freezes.mu.Lock()
+	err := freezes.load()
+	if err == nil {
+		list := freezes.freezes[target.Name]
+		freezes.freezes[target.Name] = append(list[:len(list):len(list)], freeze)
+		if err = freezes.save(); err != nil {
+			freezes.freezes[target.Name] = list
+		}
+	}
+	freezes.mu.Unlock()
+	if err != nil {
+		return Freeze{}, err
+	}
+
+	RecordAudit(AuditEvent{
+		Action: AuditFreezeStarted, Target: target.Name, Identity: identity, Success: true,
+		Detail: fmt.Sprintf("%s until %s: %s", freeze.ID, end.Format(time.RFC3339), reason),
+	})
+	return freeze, nil
+}
+
+// LiftFreeze APIで開始した凍結を解除する。設定で指定した凍結は解除できない
+func LiftFreeze(target *Target, identity string, id string) (Freeze, error) {
+	freeze, err := liftFreeze(target, id)
+	event := AuditEvent{Action: AuditFreezeLifted, Target: target.Name, Identity: identity, Success: err == nil, Detail: id}
+	if err != nil {
+		event.Detail = id + ": " + err.Error()
+	}
+	RecordAudit(event)
+	return freeze, err
+}
+
+// liftFreeze 凍結を一覧から取り除く
+func liftFreeze(target *Target, id string) (Freeze, error) {
+	if target.Schedule.Freezes != nil {
+		configured, err := target.Schedule.Freezes()
+		if err != nil {
+			return Freeze{}, err
+		}
+		for _, freeze := range configured {
+			if freeze.ID == id {
+				return freeze, ErrFreezeConfigured
+			}
+		}
+	}
+
+	freezes.mu.Lock()
+	defer freezes.mu.Unlock()
+	if err := freezes.load(); err != nil {
+		return Freeze{}, err
+	}
+	list := freezes.freezes[target.Name]
+	for i, freeze := range list {
+		if freeze.ID == id {
+			freezes.freezes[target.Name] = append(list[:i:i], list[i+1:]...)
+			if err := freezes.save(); err != nil {
+				freezes.freezes[target.Name] = list
+				return Freeze{}, err
+			}
+			return freeze, nil
+		}
+	}
+	return Freeze{}, ErrFreezeNotFound
+}
+
+// targetFreezes 設定とAPIで指定した凍結のうち、time以降に終わるものを開始順に返す
+func targetFreezes(target *Target, t time.Time) ([]Freeze, error) {
+	all := []Freeze{}
+	if target.Schedule.Freezes != nil {
+		configured, err := target.Schedule.Freezes()
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, configured...)
+	}
+	freezes.mu.Lock()
+	err := freezes.load()
+	all = append(all, freezes.freezes[target.Name]...)
+	freezes.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	list := []Freeze{}
+	for _, freeze := range all {
+		if freeze.End.After(t) {
+			list = append(list, freeze)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Start.Before(list[j].Start) })
+	return list, nil
+}
+
+// CheckSchedule 対象のマイグレーションを時刻nowに実行できるかを確認する。
+// 実行できない場合は、次に実行できる時刻を格納した*ScheduleErrorを返す
+func CheckSchedule(target *Target, now time.Time) (ScheduleStatus, error) {
+	windows := []MaintenanceWindow{}
+	location := time.UTC
+	var err error
+	if target.Schedule.Windows != nil {
+		if windows, err = target.Schedule.Windows(); err != nil {
+			return ScheduleStatus{}, err
+		}
+	}
+	if target.Schedule.TimeZone != nil {
+		if location, err = target.Schedule.TimeZone(); err != nil {
+			return ScheduleStatus{}, err
+		}
+	}
+	list, err := targetFreezes(target, now)
+	if err != nil {
+		return ScheduleStatus{}, err
+	}
+
+	status := ScheduleStatus{Allowed: true, TimeZone: location.String(), Windows: []string{}, Freezes: list}
+	for _, window := range windows {
+		status.Windows = append(status.Windows, window.Spec)
+	}
+
+	// 凍結中でなく、時間帯が設定されていないかいずれかの時間帯に含まれる場合に実行できる
+	blocked := func(t time.Time) string {
+		for _, freeze := range list {
+			if freeze.active(t) {
+				if freeze.Reason == "" {
+					return "migration freeze until " + freeze.End.Format(time.RFC3339)
+				}
+				return fmt.Sprintf("migration freeze until %s (%s)", freeze.End.Format(time.RFC3339), freeze.Reason)
+			}
+		}
+		if len(windows) == 0 {
+			return ""
+		}
+		local := t.In(location)
+		for _, window := range windows {
+			if window.contains(local) {
+				return ""
+			}
+		}
+		return "outside the maintenance windows"
+	}
+	if status.Reason = blocked(now); status.Reason == "" {
+		return status, nil
+	}
+	status.Allowed = false
+
+	// 次に実行できる時刻は、凍結の終了時刻と時間帯の開始時刻のいずれかになる
+	last := now
+	candidates := []time.Time{}
+	for _, freeze := range list {
+		candidates = append(candidates, freeze.End)
+		if freeze.End.After(last) {
+			last = freeze.End
+		}
+	}
+	local := now.In(location)
+	for day := -1; !local.AddDate(0, 0, day).After(last.AddDate(0, 0, 8)); day++ {
+		date := local.AddDate(0, 0, day)
+		for _, window := range windows {
+			if window.Days[date.Weekday()] {
+				candidates = append(candidates, time.Date(date.Year(), date.Month(), date.Day(),
+					window.Start/60, window.Start%60, 0, 0, location))
+			}
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Before(candidates[j]) })
+	for _, candidate := range candidates {
+		if candidate.After(now) && blocked(candidate) == "" {
+			next := candidate.In(location)
+			status.NextAllowed = &next
+			break
+		}
+	}
+	return status, &ScheduleError{Reason: status.Reason, NextAllowed: status.NextAllowed}
+}
+
+// EnforceSchedule 対象のマイグレーションをいま実行できるかを確認する。
+// 時間帯の外や凍結中でも、reasonが指定されAuthorizeOverrideで許可された場合は実行でき、緊急実行を監査記録に残す。
+// rがnilの場合はCLIやrun-onceからの実行として扱う
+func EnforceSchedule(r *http.Request, target *Target, identity string, reason string) error {
+	logger, _ := zap.NewProduction()
+	defer logger.Sync()
+
+	_, err := CheckSchedule(target, time.Now())
+	var scheduleError *ScheduleError
+	if err == nil || !errors.As(err, &scheduleError) || reason == "" {
+		return err
+	}
+
+	overrideErr := AuthorizeOverride(r, identity)
+	RecordAudit(AuditEvent{
+		Action: AuditScheduleOverride, Target: target.Name, Identity: identity, Success: overrideErr == nil,
+		Detail: reason + " (" + scheduleError.Reason + ")",
+	})
+	if overrideErr != nil {
+		return overrideErr
+	}
+	logger.Warn(
+		"Migration schedule overridden",
+		zap.String("target", target.Name),
+		zap.String("identity", identity),
+		zap.String("reason", reason))
+	return nil
+}
+
+// AuthorizeOverride 時間帯と凍結(CLIやrun-onceでは承認)を無視する緊急実行が許可された利用者かを確認する。
+// 接続元のアドレスだけで識別した利用者には許可しない。
+// rがnilの場合(CLIやrun-onceから実行する場合)は、identityをOSの利用者名として確認する
+func AuthorizeOverride(r *http.Request, identity string) error {
+	if r != nil && !HasCredentials(r, AuthConfig) {
+		return ErrOverrideNotAuthorized
+	}
+	for _, overrider := range OverrideConfig.Overriders() {
+		if overrider == identity {
+			return nil
+		}
+	}
+	return ErrOverrideNotAuthorized
+}
+
+func init() {
+	ScheduleConfig = ScheduleConfigStruct{
+		Windows:  GetMaintenanceWindows,
+		TimeZone: GetMaintenanceTimeZone,
+		Freezes:  GetMigrationFreezes,
+	}
+	OverrideConfig = OverrideConfigStruct{
+		Overriders: GetEmergencyOverriders,
+	}
+	FreezeConfig = FreezeConfigStruct{
+		File: GetFreezeFile,
+	}
+}
@@ -0,0 +1,352 @@
+package migrate
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestParseMaintenanceWindows 曜日の範囲、カンマ区切り、*と日をまたぐ時間帯を解釈でき、
+// 不正な表記がエラーになることを確認する。
+func TestParseMaintenanceWindows(t *testing.T) {
+	windows, err := ParseMaintenanceWindows("Mon-Fri 22:00-06:00; sat,sun 00:00-24:00;* 12:00-13:00")
+	if err != nil || len(windows) != 3 {
+		t.Fatal(windows, err)
+	}
+	if !windows[0].Days[time.Friday] || windows[0].Days[time.Saturday] || !windows[0].overnight() ||
+		windows[0].Start != 22*60 || windows[0].End != 6*60 {
+		t.Log(windows[0])
+		t.Fail()
+	}
+	if !windows[1].Days[time.Sunday] || windows[1].Days[time.Monday] || windows[1].End != 24*60 || windows[1].overnight() {
+		t.Log(windows[1])
+		t.Fail()
+	}
+	for _, day := range windows[2].Days {
+		if !day {
+			t.Log(windows[2])
+			t.Fail()
+		}
+	}
+
+	// 曜日の範囲は週をまたげる
+	windows, _ = ParseMaintenanceWindows("Fri-Mon 00:00-01:00")
+	if !windows[0].Days[time.Sunday] || windows[0].Days[time.Wednesday] {
+		t.Log(windows[0])
+		t.Fail()
+	}
+
+	for _, value := range []string{"Mon 22:00", "Funday 22:00-23:00", "Mon 25:00-26:00", "Mon 10:60-11:00", "Mon-Fri"} {
+		if _, err := ParseMaintenanceWindows(value); err == nil {
+			t.Log(value)
+			t.Fail()
+		}
+	}
+}
+
+// TestMaintenanceWindowContains 日をまたぐ時間帯が、開始した曜日の翌日の終了時刻まで含むことを確認する。
+func TestMaintenanceWindowContains(t *testing.T) {
+	windows, _ := ParseMaintenanceWindows("Fri 22:00-06:00")
+	window := windows[0]
+	cases := map[string]bool{
+		"2026-10-23T21:59:00Z": false, // 金曜
+		"2026-10-23T22:00:00Z": true,
+		"2026-10-24T05:59:00Z": true, // 土曜の早朝
+		"2026-10-24T06:00:00Z": false,
+		"2026-10-24T23:00:00Z": false,
+		"2026-10-22T23:00:00Z": false, // 木曜
+	}
+	for value, expected := range cases {
+		at, _ := time.Parse(time.RFC3339, value)
+		if window.contains(at) != expected {
+			t.Log(value, expected)
+			t.Fail()
+		}
+	}
+}
+
+// TestParseFreezes 凍結期間と理由を解釈でき、終了が開始以前の期間がエラーになることを確認する。
+func TestParseFreezes(t *testing.T) {
+	freezes, err := ParseFreezes("2026-12-20T00:00:00Z/2027-01-05T00:00:00Z year end release; 2027-02-01T00:00:00+09:00/2027-02-02T00:00:00+09:00")
+	if err != nil || len(freezes) != 2 || freezes[0].Reason != "year end release" || !freezes[0].Configured ||
+		freezes[0].ID != "config-1" || freezes[1].Reason != "" {
+		t.Fatal(freezes, err)
+	}
+
+	for _, value := range []string{"2026-12-20T00:00:00Z", "2026-12-20/2027-01-05", "2027-01-05T00:00:00Z/2026-12-20T00:00:00Z"} {
+		if _, err := ParseFreezes(value); err == nil {
+			t.Log(value)
+			t.Fail()
+		}
+	}
+}
+
+// scheduleTarget 時間帯と凍結期間を設定した対象を返す
+func scheduleTarget(t *testing.T, windows string, zone string, configured string) *Target {
+	parsedWindows, err := ParseMaintenanceWindows(windows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	location, err := time.LoadLocation(zone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsedFreezes, err := ParseFreezes(configured)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Target{
+		Name: "schedule",
+		Schedule: ScheduleConfigStruct{
+			Windows:  func() ([]MaintenanceWindow, error) { return parsedWindows, nil },
+			TimeZone: func() (*time.Location, error) { return location, nil },
+			Freezes:  func() ([]Freeze, error) { return parsedFreezes, nil },
+		},
+	}
+}
+
+// TestCheckSchedule 時間帯の外では次の時間帯の開始時刻を、凍結中は凍結後の最初の時間帯の開始時刻を
+// 次に実行できる時刻として返すことを確認する。
+func TestCheckSchedule(t *testing.T) {
+	// 2026-10-19は月曜
+	target := scheduleTarget(t, "Mon-Fri 22:00-06:00", "Asia/Tokyo",
+		"2026-10-20T13:00:00Z/2026-10-22T00:00:00Z release")
+	parse := func(value string) time.Time {
+		at, _ := time.Parse(time.RFC3339, value)
+		return at
+	}
+
+	status, err := CheckSchedule(target, parse("2026-10-19T22:30:00+09:00"))
+	if err != nil || !status.Allowed || status.TimeZone != "Asia/Tokyo" || len(status.Windows) != 1 || len(status.Freezes) != 1 {
+		t.Log(status, err)
+		t.Fail()
+	}
+
+	status, err = CheckSchedule(target, parse("2026-10-19T12:00:00+09:00"))
+	if _, ok := err.(*ScheduleError); !ok || status.Allowed || status.NextAllowed == nil ||
+		!status.NextAllowed.Equal(parse("2026-10-19T22:00:00+09:00")) {
+		t.Log(status, err)
+		t.Fail()
+	}
+
+	// 火曜22:00から木曜9:00(JST)までの凍結中は、木曜22:00が次に実行できる時刻になる
+	status, err = CheckSchedule(target, parse("2026-10-20T23:00:00+09:00"))
+	if err == nil || status.NextAllowed == nil || !status.NextAllowed.Equal(parse("2026-10-22T22:00:00+09:00")) {
+		t.Log(status, err)
+		t.Fail()
+	}
+
+	// 時間帯を設定しない場合は、凍結の終了時刻から実行できる
+	target = scheduleTarget(t, "", "UTC", "2026-10-20T13:00:00Z/2026-10-22T00:00:00Z")
+	status, err = CheckSchedule(target, parse("2026-10-21T00:00:00Z"))
+	if err == nil || status.NextAllowed == nil || !status.NextAllowed.Equal(parse("2026-10-22T00:00:00Z")) {
+		t.Log(status, err)
+		t.Fail()
+	}
+}
+
+// setupFreezeFile APIで開始した凍結を一時ディレクトリのファイルに保存するようにし、凍結を空にする
+func setupFreezeFile(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "freeze")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "freezes.json")
+	os.Setenv(FreezeFile, path)
+	freezes = &freezeStore{freezes: map[string][]Freeze{}}
+	return path, func() {
+		os.Unsetenv(FreezeFile)
+		os.RemoveAll(dir)
+	}
+}
+
+// setupScheduleTargets 時間帯の外にある対象と、利用者ごとのAPIトークンを用意する
+func setupScheduleTargets(t *testing.T) (*Targets, *http.ServeMux, func()) {
+	_, cleanupFreezes := setupFreezeFile(t)
+	targets, cleanup := setupSQLiteTargets(t, nil)
+	target, _ := targets.Get("local")
+	// 現在の曜日を含まない時間帯にする
+	today := time.Now().UTC().Weekday()
+	windows := []MaintenanceWindow{{Spec: "closed", Start: 0, End: 24 * 60}}
+	windows[0].Days[(today+3)%7] = true
+	target.Schedule = ScheduleConfigStruct{
+		Windows:  func() ([]MaintenanceWindow, error) { return windows, nil },
+		TimeZone: func() (*time.Location, error) { return time.UTC, nil },
+	}
+	os.Setenv(APITokens, "alice:token-a,bob:token-b")
+	return targets, NewServeMux(targets), func() {
+		os.Unsetenv(APITokens)
+		cleanup()
+		cleanupFreezes()
+	}
+}
+
+// TestHandlerScheduleLocked 時間帯の外では423と次に実行できる時刻が返り、
+// 許可された利用者だけが理由を指定して緊急実行できることを確認する。
+func TestHandlerScheduleLocked(t *testing.T) {
+	_, mux, cleanup := setupScheduleTargets(t)
+	defer cleanup()
+	os.Setenv(EmergencyOverriders, "bob")
+	defer os.Unsetenv(EmergencyOverriders)
+
+	w := serve(mux, http.MethodPost, "/targets/local/migrate/up", as("token-a"))
+	var response ErrorResponse
+	decode(t, w, &response)
+	if w.Code != http.StatusLocked || response.NextAllowed == nil || !response.NextAllowed.After(time.Now()) {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+
+	if w := serve(mux, http.MethodPost, "/targets/local/migrate/up?override=hotfix", as("token-a")); w.Code != http.StatusForbidden {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+	w = serve(mux, http.MethodPost, "/targets/local/migrate/up?override=hotfix", as("token-b"))
+	var result MigrationResult
+	decode(t, w, &result)
+	if w.Code != http.StatusOK || len(result.Applied) != 2 {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+
+	w = serve(mux, http.MethodGet, "/targets/local/schedule", as("token-a"))
+	var status ScheduleStatus
+	decode(t, w, &status)
+	if w.Code != http.StatusOK || status.Allowed || status.NextAllowed == nil || len(status.Windows) != 1 {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+}
+
+// TestEnforceScheduleLocal HTTP以外から実行する場合も時間帯の外では実行できず、
+// 緊急実行できる利用者として設定されたOSの利用者だけが理由を指定して実行できることを確認する。
+func TestEnforceScheduleLocal(t *testing.T) {
+	targets, _, cleanup := setupScheduleTargets(t)
+	defer cleanup()
+	target, _ := targets.Get("local")
+	os.Setenv(EmergencyOverriders, "bob")
+	defer os.Unsetenv(EmergencyOverriders)
+
+	var scheduleError *ScheduleError
+	if err := EnforceSchedule(nil, target, "bob", ""); !errors.As(err, &scheduleError) {
+		t.Log(err)
+		t.Fail()
+	}
+	if err := EnforceSchedule(nil, target, "alice", "hotfix"); !errors.Is(err, ErrOverrideNotAuthorized) {
+		t.Log(err)
+		t.Fail()
+	}
+	if err := EnforceSchedule(nil, target, "bob", "hotfix"); err != nil {
+		t.Log(err)
+		t.Fail()
+	}
+}
+
+// TestHandlerFreeze APIで凍結を開始すると実行できなくなり、解除すると実行でき、
+// 設定で指定した凍結は解除できないことを確認する。
+func TestHandlerFreeze(t *testing.T) {
+	_, cleanupFreezes := setupFreezeFile(t)
+	defer cleanupFreezes()
+	targets, cleanup := setupSQLiteTargets(t, nil)
+	defer cleanup()
+	target, _ := targets.Get("local")
+	target.Schedule.Freezes = func() ([]Freeze, error) {
+		return []Freeze{{ID: "config-1", Start: time.Now().Add(time.Hour), End: time.Now().Add(2 * time.Hour), Configured: true}}, nil
+	}
+	os.Setenv(APITokens, "alice:token-a")
+	defer os.Unsetenv(APITokens)
+	mux := NewServeMux(targets)
+
+	if w := serve(mux, http.MethodPost, "/targets/local/freezes?reason=incident", as("token-a")); w.Code != http.StatusBadRequest {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+	w := serve(mux, http.MethodPost, "/targets/local/freezes?duration=1h&reason=incident", as("token-a"))
+	var freeze Freeze
+	decode(t, w, &freeze)
+	if w.Code != http.StatusCreated || freeze.CreatedBy != "alice" || freeze.Reason != "incident" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+
+	if w := serve(mux, http.MethodPost, "/targets/local/migrate/up", as("token-a")); w.Code != http.StatusLocked {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+
+	w = serve(mux, http.MethodGet, "/targets/local/freezes", as("token-a"))
+	var list []Freeze
+	decode(t, w, &list)
+	if len(list) != 2 || list[0].ID != freeze.ID {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+
+	if w := serve(mux, http.MethodPost, "/targets/local/freezes/config-1/lift", as("token-a")); w.Code != http.StatusConflict {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+	if w := serve(mux, http.MethodPost, "/targets/local/freezes/"+freeze.ID+"/lift", as("token-a")); w.Code != http.StatusOK {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+	if w := serve(mux, http.MethodPost, "/targets/local/freezes/"+freeze.ID+"/lift", as("token-a")); w.Code != http.StatusNotFound {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+	if w := serve(mux, http.MethodPost, "/targets/local/migrate/up", as("token-a")); w.Code != http.StatusOK {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+}
+
+// TestFreezeReload APIで開始した凍結がファイルに保存され、
+// サーバを再起動して読み込み直しても有効なままで、解除も保存されることを確認する。
+func TestFreezeReload(t *testing.T) {
+	path, cleanupFreezes := setupFreezeFile(t)
+	defer cleanupFreezes()
+	targets, cleanup := setupSQLiteTargets(t, nil)
+	defer cleanup()
+	target, _ := targets.Get("local")
+
+	freeze, err := StartFreeze(target, "alice", time.Now().Add(time.Hour), "incident")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// 再起動した状態にする
+	freezes = &freezeStore{freezes: map[string][]Freeze{}}
+	if err := LoadFreezes(); err != nil {
+		t.Fatal(err)
+	}
+	status, err := CheckSchedule(target, time.Now())
+	if err == nil || status.Allowed || len(status.Freezes) != 1 || status.Freezes[0].ID != freeze.ID ||
+		status.Freezes[0].CreatedBy != "alice" || status.Freezes[0].Reason != "incident" {
+		t.Log(status, err)
+		t.Fail()
+	}
+
+	if _, err := LiftFreeze(target, "alice", freeze.ID); err != nil {
+		t.Fatal(err)
+	}
+	freezes = &freezeStore{freezes: map[string][]Freeze{}}
+	if err := LoadFreezes(); err != nil {
+		t.Fatal(err)
+	}
+	if status, err := CheckSchedule(target, time.Now()); err != nil || !status.Allowed || len(status.Freezes) != 0 {
+		t.Log(status, err)
+		t.Fail()
+	}
+
+	// 壊れたファイルは読み込めない
+	ioutil.WriteFile(path, []byte("{"), 0644)
+	if err := LoadFreezes(); err == nil {
+		t.Fail()
+	}
+}
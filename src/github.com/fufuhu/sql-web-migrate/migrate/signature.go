@@ -0,0 +1,266 @@
+package migrate
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// TrustedKeys マニフェストの署名を検証する公開鍵を利用者名と鍵の組(name:base64)のカンマ区切りで指定するための環境変数
+	TrustedKeys = "SQL_MIGRATE_TRUSTED_KEYS"
+)
+
+const (
+	// ManifestSignatureFile マニフェストの署名(base64)を格納するファイル名
+	ManifestSignatureFile = BundleManifestFile + ".sig"
+)
+
+const (
+	// TrustedKeysSettingFormatErrorMessage 公開鍵の設定を誤っている際のエラーメッセージです
+	TrustedKeysSettingFormatErrorMessage = "Trusted keys should be comma separated name:base64 ed25519 public keys"
+	// SignatureInvalidErrorMessage マニフェストの署名がどの公開鍵でも検証できない場合のエラーメッセージです
+	SignatureInvalidErrorMessage = "Manifest signature does not match any trusted key"
+)
+
+// ErrSignatureInvalid マニフェストの署名がどの公開鍵でも検証できないことを表すエラー
+var ErrSignatureInvalid = errors.New(SignatureInvalidErrorMessage)
+
+// TrustedKeyMap 鍵の名前と公開鍵の対応
+type TrustedKeyMap map[string]ed25519.PublicKey
+
+// GetTrustedKeys マニフェストの署名を検証する公開鍵を取得する。
+// 環境変数が設定されていない場合は空のTrustedKeyMapを返し、署名は検証しない
+func GetTrustedKeys() (TrustedKeyMap, error) {
+	return parseTrustedKeys(getValue(TrustedKeys, ""))
+}
+
+// parseTrustedKeys name:base64の組のカンマ区切りを解釈する
+func parseTrustedKeys(value string) (TrustedKeyMap, error) {
+	keys := TrustedKeyMap{}
+	if value == "" {
+		return keys, nil
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return TrustedKeyMap{}, errors.New(TrustedKeysSettingFormatErrorMessage)
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return TrustedKeyMap{}, errors.New(TrustedKeysSettingFormatErrorMessage)
+		}
+		keys[parts[0]] = ed25519.PublicKey(key)
+	}
+	return keys, nil
+}
+
+// SignatureConfigStruct 署名の検証の設定
+// TrustedKeys マニフェストの署名を検証する公開鍵
+type SignatureConfigStruct struct {
+	TrustedKeys func() (TrustedKeyMap, error)
+}
+
+// SignatureConfig 署名の検証の設定です
+var SignatureConfig SignatureConfigStruct
+
+// VerificationError マイグレーションのファイルが署名されたマニフェストと一致しないことを表すエラー
+// File 一致しなかったファイル名
+// Reason 一致しなかった理由
+type VerificationError struct {
+	File   string
+	Reason string
+}
+
+func (e *VerificationError) Error() string {
+	return fmt.Sprintf("%s does not match the manifest: %s", e.File, e.Reason)
+}
+
+// SignManifest マニフェストに署名し、署名ファイルの内容(base64)を返す
+func SignManifest(manifest []byte, key ed25519.PrivateKey) []byte {
+	return []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(key, manifest)) + "\n")
+}
+
+// VerifyManifestSignature マニフェストの署名をいずれかの公開鍵で検証し、検証できた鍵の名前を返す
+func VerifyManifestSignature(manifest []byte, signature []byte, keys TrustedKeyMap) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil {
+		return "", ErrSignatureInvalid
+	}
+
+	names := []string{}
+	for name := range keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if ed25519.Verify(keys[name], manifest, decoded) {
+			return name, nil
+		}
+	}
+	return "", ErrSignatureInvalid
+}
+
+// verifyManifestFiles マイグレーションのファイルがすべてマニフェストに記載され、
+// SHA-256が一致することを確認する。一致しなかったファイルをVerificationErrorで返す
+func verifyManifestFiles(manifest BundleManifest, files map[string][]byte) error {
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := manifest.Files[name]; !ok {
+			return &VerificationError{File: name, Reason: "not listed in " + BundleManifestFile}
+		}
+	}
+
+	names = names[:0]
+	for name := range manifest.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		content, ok := files[name]
+		if !ok {
+			return &VerificationError{File: name, Reason: "listed in " + BundleManifestFile + " but missing"}
+		}
+		if !strings.EqualFold(ChecksumBundle(content), manifest.Files[name]) {
+			return &VerificationError{File: name, Reason: "checksum mismatch"}
+		}
+	}
+	return nil
+}
+
+// verifySourceDir ディレクトリのマニフェストの署名を検証し、
+// ディレクトリの*.sqlがすべて署名されたマニフェストと一致することを確認する。
+// 検証できた鍵の名前を返す
+func verifySourceDir(dir string, keys TrustedKeyMap) (string, error) {
+	manifest, err := ioutil.ReadFile(filepath.Join(dir, BundleManifestFile))
+	if err != nil {
+		return "", &VerificationError{File: BundleManifestFile, Reason: "missing"}
+	}
+	signature, err := ioutil.ReadFile(filepath.Join(dir, ManifestSignatureFile))
+	if err != nil {
+		return "", &VerificationError{File: ManifestSignatureFile, Reason: "missing"}
+	}
+	signer, err := VerifyManifestSignature(manifest, signature, keys)
+	if err != nil {
+		return "", err
+	}
+
+	var parsed BundleManifest
+	if err := json.Unmarshal(manifest, &parsed); err != nil {
+		return "", &VerificationError{File: BundleManifestFile, Reason: err.Error()}
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	files := map[string][]byte{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".sql") {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return "", err
+		}
+		files[entry.Name()] = content
+	}
+
+	return signer, verifyManifestFiles(parsed, files)
+}
+
+// NewManifest ディレクトリの*.sqlのSHA-256を記載したマニフェストを生成する
+func NewManifest(dir string, version string) ([]byte, error) {
+	manifest := BundleManifest{Version: version, Files: map[string]string{}}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".sql") {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		manifest.Files[entry.Name()] = ChecksumBundle(content)
+	}
+	if len(manifest.Files) == 0 {
+		return nil, fmt.Errorf("no migrations found in %s", dir)
+	}
+
+	encoded, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(encoded, '\n'), nil
+}
+
+// SignSourceDir ディレクトリのマニフェストを生成して秘密鍵で署名し、
+// manifest.jsonとmanifest.json.sigとして書き込む
+func SignSourceDir(dir string, version string, key ed25519.PrivateKey) error {
+	manifest, err := NewManifest(dir, version)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, BundleManifestFile), manifest, 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, ManifestSignatureFile), SignManifest(manifest, key), 0644)
+}
+
+// ReadPrivateKey base64で書かれたed25519の秘密鍵(シードまたは秘密鍵全体)をファイルから読み込む
+func ReadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	switch len(key) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(key), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(key), nil
+	}
+	return nil, fmt.Errorf("%s: not an ed25519 private key", path)
+}
+
+// verifySource 公開鍵が設定されている場合は、外部から与えられたソース(filesystem/bundle)の
+// ファイルが署名されたマニフェストと一致することを確認する。
+// バイナリに埋め込んだソースは検証しない
+func verifySource(info SourceInfo) (string, error) {
+	if info.Kind == SourceEmbedded {
+		return "", nil
+	}
+	keys, err := SignatureConfig.TrustedKeys()
+	if err != nil || len(keys) == 0 {
+		return "", err
+	}
+	if _, err := os.Stat(info.Path); err != nil {
+		return "", err
+	}
+	return verifySourceDir(info.Path, keys)
+}
+
+func init() {
+	SignatureConfig = SignatureConfigStruct{
+		TrustedKeys: GetTrustedKeys,
+	}
+}
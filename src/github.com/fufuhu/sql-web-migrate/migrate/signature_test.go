@@ -0,0 +1,163 @@
+package migrate
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestKey テスト用の鍵を生成し、公開鍵をSQL_MIGRATE_TRUSTED_KEYSの形式で返す
+func newTestKey(t *testing.T, name string) (ed25519.PrivateKey, string) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return private, name + ":" + base64.StdEncoding.EncodeToString(public)
+}
+
+// TestGetTrustedKeys 名前と公開鍵の組を解釈し、不正な値がエラーになることを確認する。
+func TestGetTrustedKeys(t *testing.T) {
+	_, release := newTestKey(t, "release")
+	_, backup := newTestKey(t, "backup")
+
+	os.Setenv(TrustedKeys, release+", "+backup)
+	defer os.Unsetenv(TrustedKeys)
+	keys, err := GetTrustedKeys()
+	if err != nil || len(keys) != 2 || keys["release"] == nil || keys["backup"] == nil {
+		t.Log(keys, err)
+		t.Fail()
+	}
+
+	for _, value := range []string{"release", "release:not-base64!", "release:" + base64.StdEncoding.EncodeToString([]byte("short"))} {
+		os.Setenv(TrustedKeys, value)
+		if _, err := GetTrustedKeys(); err == nil {
+			t.Log(value)
+			t.Fail()
+		}
+	}
+}
+
+// TestVerifySourceDir 署名したディレクトリが検証でき、ファイルの改ざんや追加、
+// 信頼しない鍵での署名が、失敗したファイルとともにエラーになることを確認する。
+func TestVerifySourceDir(t *testing.T) {
+	private, trusted := newTestKey(t, "release")
+	keys, _ := parseTrustedKeys(trusted)
+
+	dir, err := ioutil.TempDir("", "signature")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, content := range testMigrations {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+	}
+	if err := SignSourceDir(dir, "v1", private); err != nil {
+		t.Fatal(err)
+	}
+
+	if signer, err := verifySourceDir(dir, keys); err != nil || signer != "release" {
+		t.Log(signer, err)
+		t.Fail()
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "03-extra.sql"), []byte("-- +migrate Up\n"), 0644)
+	var verificationError *VerificationError
+	if _, err := verifySourceDir(dir, keys); !errors.As(err, &verificationError) || verificationError.File != "03-extra.sql" {
+		t.Log(err)
+		t.Fail()
+	}
+	os.Remove(filepath.Join(dir, "03-extra.sql"))
+
+	ioutil.WriteFile(filepath.Join(dir, "02-posts.sql"), []byte("-- +migrate Up\nDROP TABLE users;\n"), 0644)
+	if _, err := verifySourceDir(dir, keys); !errors.As(err, &verificationError) || verificationError.File != "02-posts.sql" ||
+		!strings.Contains(err.Error(), "checksum mismatch") {
+		t.Log(err)
+		t.Fail()
+	}
+
+	other, _ := newTestKey(t, "other")
+	if err := SignSourceDir(dir, "v1", other); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifySourceDir(dir, keys); err != ErrSignatureInvalid {
+		t.Log(err)
+		t.Fail()
+	}
+}
+
+// TestHandlerUnsignedSource 公開鍵が設定されている場合に、署名されたマニフェストと
+// 一致しないソースへのマイグレーションが拒否され、失敗したファイルが返ることを確認する。
+func TestHandlerUnsignedSource(t *testing.T) {
+	targets, cleanup := setupSQLiteTargets(t, nil)
+	defer cleanup()
+	target, _ := targets.Get("local")
+
+	private, trusted := newTestKey(t, "release")
+	os.Setenv(TrustedKeys, trusted)
+	defer os.Unsetenv(TrustedKeys)
+
+	mux := NewServeMux(targets)
+	w := serve(mux, http.MethodPost, "/targets/local/migrate/up", nil)
+	if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), BundleManifestFile) {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+
+	if err := SignSourceDir(target.SourcePath(), "v1", private); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(target.SourcePath(), "03-unsigned.sql"),
+		[]byte("-- +migrate Up\nCREATE TABLE unsigned (id integer);\n"), 0644)
+
+	w = serve(mux, http.MethodPost, "/targets/local/migrate/up", nil)
+	var result MigrationResult
+	decode(t, w, &result)
+	if w.Code != http.StatusInternalServerError || len(result.Applied) != 0 || !strings.Contains(result.Error, "03-unsigned.sql") {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+
+	os.Remove(filepath.Join(target.SourcePath(), "03-unsigned.sql"))
+	w = serve(mux, http.MethodPost, "/targets/local/migrate/up", nil)
+	if w.Code != http.StatusOK {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+}
+
+// TestValidateBundleSignature 公開鍵が設定されている場合に、署名のないバンドルや
+// 信頼しない鍵で署名したバンドルが拒否されることを確認する。
+func TestValidateBundleSignature(t *testing.T) {
+	private, trusted := newTestKey(t, "release")
+	other, _ := newTestKey(t, "other")
+	os.Setenv(TrustedKeys, trusted)
+	defer os.Unsetenv(TrustedKeys)
+
+	signed := func(key ed25519.PrivateKey) map[string][]byte {
+		files := map[string][]byte{}
+		for name, content := range bundleFiles("v1", testMigrations) {
+			files[name] = []byte(content)
+		}
+		files[ManifestSignatureFile] = SignManifest(files[BundleManifestFile], key)
+		return files
+	}
+
+	if _, _, err := validateBundle(signed(private)); err != nil {
+		t.Log(err)
+		t.Fail()
+	}
+
+	unsigned := signed(private)
+	delete(unsigned, ManifestSignatureFile)
+	for _, files := range []map[string][]byte{unsigned, signed(other)} {
+		if _, _, err := validateBundle(files); err == nil {
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	sqlmigrate "github.com/rubenv/sql-migrate"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+)
+
+const (
+	// HistoryEditors マイグレーションを実行せずに適用記録を編集できる利用者名をカンマ区切りで指定するための環境変数
+	HistoryEditors = "SQL_MIGRATE_HISTORY_EDITORS"
+)
+
+const (
+	// HistorySkip マイグレーションを実行せずに適用済みにする
+	HistorySkip = "skip"
+	// HistoryUnskip マイグレーションを実行せずに適用記録を削除する
+	HistoryUnskip = "unskip"
+)
+
+const (
+	// HistoryEditNotAuthorizedErrorMessage 適用記録の編集を許可されていない利用者が編集しようとした場合のエラーメッセージです
+	HistoryEditNotAuthorizedErrorMessage = "You are not authorized to edit the migration history"
+	// HistoryEditMigrationsErrorMessage 編集するマイグレーションの指定が不正な場合のエラーメッセージです
+	HistoryEditMigrationsErrorMessage = "Specify the migrations either by ids or, for skip, by to"
+	// MigrationNotPendingErrorMessage 適用済みにするマイグレーションが未適用でない場合のエラーメッセージです
+	MigrationNotPendingErrorMessage = "Migration is not pending"
+	// MigrationNotAppliedErrorMessage 適用記録を削除するマイグレーションが適用済みでない場合のエラーメッセージです
+	MigrationNotAppliedErrorMessage = "Migration is not applied"
+)
+
+var (
+	// ErrHistoryEditNotAuthorized 適用記録の編集が許可されていないことを表すエラー
+	ErrHistoryEditNotAuthorized = errors.New(HistoryEditNotAuthorizedErrorMessage)
+	// ErrHistoryEditMigrations 編集するマイグレーションの指定が不正であることを表すエラー
+	ErrHistoryEditMigrations = errors.New(HistoryEditMigrationsErrorMessage)
+	// ErrMigrationNotPending 適用済みにするマイグレーションが未適用でないことを表すエラー
+	ErrMigrationNotPending = errors.New(MigrationNotPendingErrorMessage)
+	// ErrMigrationNotApplied 適用記録を削除するマイグレーションが適用済みでないことを表すエラー
+	ErrMigrationNotApplied = errors.New(MigrationNotAppliedErrorMessage)
+)
+
+// GetHistoryEditors マイグレーションを実行せずに適用記録を編集できる利用者名を取得する。
+// 環境変数が設定されていない場合は空のスライスを返し、誰も編集できない
+func GetHistoryEditors() []string {
+	editors := []string{}
+	for _, name := range strings.Split(getValue(HistoryEditors, ""), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			editors = append(editors, name)
+		}
+	}
+	return editors
+}
+
+// HistoryEditConfigStruct 適用記録の編集の設定
+// Editors マイグレーションを実行せずに適用記録を編集できる利用者名
+type HistoryEditConfigStruct struct {
+	Editors func() []string
+}
+
+// HistoryEditConfig 適用記録の編集の設定です
+var HistoryEditConfig HistoryEditConfigStruct
+
+// HistoryEdit マイグレーションを実行せずに適用記録を編集した結果
+// Action 操作(skip/unskip)
+// Schema スキーマごとに適用する対象の場合のスキーマ
+// Migrations 適用済みにした、または適用記録を削除したマイグレーションのID
+// Records 編集後の適用記録
+type HistoryEdit struct {
+	Action     string      `json:"action"`
+	Schema     string      `json:"schema,omitempty"`
+	Migrations []string    `json:"migrations"`
+	Records    []LogRecord `json:"records"`
+}
+
+// AuthorizeHistoryEdit マイグレーションを実行せずに適用記録を編集できる利用者かを確認する。
+// 接続元のアドレスだけで識別した利用者には許可しない
+func AuthorizeHistoryEdit(r *http.Request, identity string) error {
+	if !HasCredentials(r, AuthConfig) {
+		return ErrHistoryEditNotAuthorized
+	}
+	for _, editor := range HistoryEditConfig.Editors() {
+		if editor == identity {
+			return nil
+		}
+	}
+	return ErrHistoryEditNotAuthorized
+}
+
+// SkipMigrations マイグレーションのSQLを実行せずに適用済みとして記録する。
+// idsで指定したマイグレーションか、toで指定したマイグレーションまでの未適用のマイグレーションをすべて記録する。
+// スキーマごとに適用する対象の場合はschemaでスキーマを指定する。
+// 同じ対象のマイグレーションが実行中の場合はErrMigrationInProgressを返す
+func SkipMigrations(ctx context.Context, target *Target, schema string, ids []string, to string) (edit HistoryEdit, err error) {
+	edit = HistoryEdit{Action: HistorySkip, Schema: schema, Migrations: []string{}, Records: []LogRecord{}}
+	if (len(ids) == 0) == (to == "") {
+		return edit, ErrHistoryEditMigrations
+	}
+	if err = target.TryLock(); err != nil {
+		return edit, err
+	}
+	defer target.Unlock()
+
+	source, err := target.Source()
+	if err != nil {
+		return edit, err
+	}
+	dialect, err := target.Dialect()
+	if err != nil {
+		return edit, err
+	}
+	db, set, release, err := connectSchema(ctx, target, dialect, schema)
+	if err != nil {
+		return edit, err
+	}
+	defer release()
+
+	planned, _, err := set.PlanMigration(db, dialect, source, sqlmigrate.Up, 0)
+	if err != nil {
+		return edit, err
+	}
+	var skipped []*sqlmigrate.PlannedMigration
+	if to != "" {
+		for i, migration := range planned {
+			if migration.Id == to {
+				skipped = planned[:i+1]
+				break
+			}
+		}
+		if skipped == nil {
+			return edit, fmt.Errorf("%w: %s", ErrMigrationNotPending, to)
+		}
+	} else {
+		pending := map[string]*sqlmigrate.PlannedMigration{}
+		for _, migration := range planned {
+			pending[migration.Id] = migration
+		}
+		for _, id := range ids {
+			migration, ok := pending[id]
+			if !ok {
+				return edit, fmt.Errorf("%w: %s", ErrMigrationNotPending, id)
+			}
+			skipped = append(skipped, migration)
+			delete(pending, id)
+		}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return edit, err
+	}
+	query := "insert into " + historyTable(dialect, set) + " (id, applied_at) values (" +
+		placeholder(dialect, 1) + ", " + placeholder(dialect, 2) + ")"
+	for _, migration := range skipped {
+		if _, err = tx.ExecContext(ctx, query, migration.Id, time.Now()); err != nil {
+			tx.Rollback()
+			return edit, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return edit, err
+	}
+
+	migrations := []*sqlmigrate.Migration{}
+	for _, migration := range skipped {
+		edit.Migrations = append(edit.Migrations, migration.Id)
+		migrations = append(migrations, migration.Migration)
+	}
+	recordHistoryChecksums(ctx, db, dialect, set, migrations, sqlmigrate.Up)
+
+	edit.Records, err = getLogRecords(ctx, db, dialect, set)
+	return edit, err
+}
+
+// UnskipMigrations マイグレーションのSQLを実行せずにidsの適用記録を削除する。
+// 手動で戻したマイグレーションの記録を消すために使う。
+// スキーマごとに適用する対象の場合はschemaでスキーマを指定する。
+// 同じ対象のマイグレーションが実行中の場合はErrMigrationInProgressを返す
+func UnskipMigrations(ctx context.Context, target *Target, schema string, ids []string) (edit HistoryEdit, err error) {
+	edit = HistoryEdit{Action: HistoryUnskip, Schema: schema, Migrations: []string{}, Records: []LogRecord{}}
+	if len(ids) == 0 {
+		return edit, ErrHistoryEditMigrations
+	}
+	if err = target.TryLock(); err != nil {
+		return edit, err
+	}
+	defer target.Unlock()
+
+	dialect, err := target.Dialect()
+	if err != nil {
+		return edit, err
+	}
+	db, set, release, err := connectSchema(ctx, target, dialect, schema)
+	if err != nil {
+		return edit, err
+	}
+	defer release()
+
+	// ファイルを削除したマイグレーションの記録も消せるように、ソースではなく適用記録と照合する
+	records, err := set.GetMigrationRecords(db, dialect)
+	if err != nil {
+		return edit, err
+	}
+	applied := map[string]bool{}
+	for _, record := range records {
+		applied[record.Id] = true
+	}
+	for _, id := range ids {
+		if !applied[id] {
+			return edit, fmt.Errorf("%w: %s", ErrMigrationNotApplied, id)
+		}
+		applied[id] = false
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return edit, err
+	}
+	query := "delete from " + historyTable(dialect, set) + " where id = " + placeholder(dialect, 1)
+	for _, id := range ids {
+		if _, err = tx.ExecContext(ctx, query, id); err != nil {
+			tx.Rollback()
+			return edit, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return edit, err
+	}
+
+	migrations := []*sqlmigrate.Migration{}
+	for _, id := range ids {
+		edit.Migrations = append(edit.Migrations, id)
+		migrations = append(migrations, &sqlmigrate.Migration{Id: id})
+	}
+	recordHistoryChecksums(ctx, db, dialect, set, migrations, sqlmigrate.Down)
+
+	edit.Records, err = getLogRecords(ctx, db, dialect, set)
+	return edit, err
+}
+
+// recordHistoryChecksums 適用記録を編集したマイグレーションのチェックサムの記録を合わせる。
+// 記録に失敗しても適用記録の編集は取り消さず、警告をログに出力する
+func recordHistoryChecksums(ctx context.Context, db *sql.DB, dialect string, set sqlmigrate.MigrationSet,
+	migrations []*sqlmigrate.Migration, direction sqlmigrate.MigrationDirection) {
+
+	logger, _ := zap.NewProduction()
+	defer logger.Sync()
+
+	mode, err := DriftConfig.Mode()
+	if err != nil || mode == DriftCheckOff {
+		return
+	}
+	if err := ensureChecksumTable(ctx, db, dialect, set); err != nil {
+		logger.Warn(
+			"Checksum record failed",
+			zap.Error(err))
+		return
+	}
+	for _, migration := range migrations {
+		if err := recordChecksum(ctx, db, dialect, set, migration, direction); err != nil {
+			logger.Warn(
+				"Checksum record failed",
+				zap.String("id", migration.Id),
+				zap.Error(err))
+		}
+	}
+}
+
+// parseMigrationIDs クエリパラメータidsをカンマ区切りのマイグレーションのIDとして解釈する。重複は取り除く
+func parseMigrationIDs(r *http.Request) []string {
+	ids := []string{}
+	seen := map[string]bool{}
+	for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		if id = strings.TrimSpace(id); id != "" && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// RecordHistoryEdit 適用記録の編集を、失敗した場合も含めて監査記録に残す。
+// HTTPとCLIのどちらから編集した場合も記録する
+func RecordHistoryEdit(target *Target, identity string, edit HistoryEdit, err error) {
+	action := AuditHistorySkip
+	if edit.Action == HistoryUnskip {
+		action = AuditHistoryUnskip
+	}
+	audit := AuditEvent{Action: action, Target: target.Name, Identity: identity, Success: err == nil}
+	switch {
+	case err != nil:
+		audit.Detail = err.Error()
+	case edit.Schema != "":
+		audit.Detail = edit.Schema + ": " + strings.Join(edit.Migrations, ",")
+	default:
+		audit.Detail = strings.Join(edit.Migrations, ",")
+	}
+	RecordAudit(audit)
+}
+
+// historyEditHandler マイグレーションを実行せずに適用記録を編集するハンドラを返す。
+// skipはクエリパラメータids(カンマ区切り)またはtoで、unskipはidsでマイグレーションを指定する。
+// スキーマごとに適用する対象の場合はクエリパラメータschemaでスキーマを指定する。
+// HistoryEditConfigで許可された利用者だけが実行でき、結果を監査記録に残す
+func historyEditHandler(action string) targetHandler {
+	return func(w http.ResponseWriter, r *http.Request, target *Target) {
+		logger, _ := zap.NewProduction()
+		defer logger.Sync()
+
+		ctx, span := StartRequestSpan(r, "migrate "+action)
+		defer span.End()
+		span.SetAttributes(attribute.String("migration.target", target.Name))
+
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			writeJSON(w, http.StatusMethodNotAllowed, ErrorResponse{Error: "Method not allowed"})
+			return
+		}
+
+		r, ok := authorize(w, r.WithContext(ctx), target.AllowedNetworks())
+		if !ok {
+			return
+		}
+
+		identity := IdentityFromContext(r.Context())
+		schema := r.URL.Query().Get("schema")
+		ids := parseMigrationIDs(r)
+
+		err := AuthorizeHistoryEdit(r, identity)
+		edit := HistoryEdit{Action: action, Schema: schema}
+		if err == nil {
+			if action == HistorySkip {
+				edit, err = SkipMigrations(r.Context(), target, schema, ids, r.URL.Query().Get("to"))
+			} else {
+				edit, err = UnskipMigrations(r.Context(), target, schema, ids)
+			}
+		}
+		RecordHistoryEdit(target, identity, edit, err)
+
+		if err != nil {
+			logger.Warn(
+				"Migration history edit failed",
+				zap.String("target", target.Name),
+				zap.String("action", action),
+				zap.Error(err))
+			EndSpan(span, err)
+			writeJSON(w, errorStatus(err), ErrorResponse{Error: err.Error()})
+			return
+		}
+		logger.Info(
+			"Migration history edited",
+			zap.String("target", target.Name),
+			zap.String("action", action),
+			zap.String("identity", identity),
+			zap.Strings("migrations", edit.Migrations))
+		writeJSON(w, http.StatusOK, edit)
+	}
+}
+
+func init() {
+	HistoryEditConfig = HistoryEditConfigStruct{
+		Editors: GetHistoryEditors,
+	}
+}
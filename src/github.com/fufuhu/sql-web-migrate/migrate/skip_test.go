@@ -0,0 +1,126 @@
+package migrate
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+// setupHistoryEditTargets 適用記録を編集できる利用者と、利用者ごとのAPIトークンを用意する
+func setupHistoryEditTargets(t *testing.T) (*Targets, *http.ServeMux, func()) {
+	targets, cleanup := setupSQLiteTargets(t, nil)
+	os.Setenv(APITokens, "alice:token-a,bob:token-b")
+	os.Setenv(HistoryEditors, "bob")
+	return targets, NewServeMux(targets), func() {
+		os.Unsetenv(APITokens)
+		os.Unsetenv(HistoryEditors)
+		cleanup()
+	}
+}
+
+// TestHandlerSkip 許可された利用者だけが、指定したマイグレーションまでを実行せずに適用済みにでき、
+// その後のupでは残りだけを適用することを確認する。
+func TestHandlerSkip(t *testing.T) {
+	_, mux, cleanup := setupHistoryEditTargets(t)
+	defer cleanup()
+
+	if w := serve(mux, http.MethodPost, "/targets/local/migrate/skip?to=01-users.sql", as("token-a")); w.Code != http.StatusForbidden {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+	if w := serve(mux, http.MethodPost, "/targets/local/migrate/skip", as("token-b")); w.Code != http.StatusBadRequest {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+
+	w := serve(mux, http.MethodPost, "/targets/local/migrate/skip?to=01-users.sql", as("token-b"))
+	var edit HistoryEdit
+	decode(t, w, &edit)
+	if w.Code != http.StatusOK || edit.Action != HistorySkip || len(edit.Migrations) != 1 ||
+		len(edit.Records) != 1 || edit.Records[0].ID != "01-users.sql" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+
+	// 適用済みのマイグレーションはもう一度適用済みにできない
+	if w := serve(mux, http.MethodPost, "/targets/local/migrate/skip?ids=01-users.sql", as("token-b")); w.Code != http.StatusConflict {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+
+	// usersは作成していないため、postsの作成だけが実行される
+	w = serve(mux, http.MethodPost, "/targets/local/migrate/up", as("token-b"))
+	var result MigrationResult
+	decode(t, w, &result)
+	if w.Code != http.StatusOK || len(result.Applied) != 1 || result.Applied[0] != "02-posts.sql" {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+}
+
+// TestHandlerUnskip 指定したマイグレーションの適用記録だけを削除し、
+// 適用済みでないマイグレーションを指定した場合は何も削除せずに409を返すことを確認する。
+func TestHandlerUnskip(t *testing.T) {
+	_, mux, cleanup := setupHistoryEditTargets(t)
+	defer cleanup()
+
+	if w := serve(mux, http.MethodPost, "/targets/local/migrate/up?steps=1", as("token-b")); w.Code != http.StatusOK {
+		t.Fatal(w.Body.String())
+	}
+	if w := serve(mux, http.MethodPost, "/targets/local/migrate/unskip?ids=01-users.sql,02-posts.sql", as("token-b")); w.Code != http.StatusConflict {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+
+	w := serve(mux, http.MethodPost, "/targets/local/migrate/unskip?ids=01-users.sql", as("token-b"))
+	var edit HistoryEdit
+	decode(t, w, &edit)
+	if w.Code != http.StatusOK || edit.Action != HistoryUnskip || len(edit.Migrations) != 1 || len(edit.Records) != 0 {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+
+	if w := serve(mux, http.MethodGet, "/targets/local/migrate/unskip?ids=01-users.sql", as("token-b")); w.Code != http.StatusMethodNotAllowed {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+}
+
+// TestHandlerSkipAudit 適用記録の編集が、拒否した場合も含めて監査記録に残ることを確認する。
+func TestHandlerSkipAudit(t *testing.T) {
+	_, mux, cleanup := setupHistoryEditTargets(t)
+	defer cleanup()
+	file, err := ioutil.TempFile("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+	os.Setenv(AuditLog, file.Name())
+	defer os.Unsetenv(AuditLog)
+
+	serve(mux, http.MethodPost, "/targets/local/migrate/skip?ids=01-users.sql", as("token-a"))
+	serve(mux, http.MethodPost, "/targets/local/migrate/skip?ids=01-users.sql,02-posts.sql", as("token-b"))
+	serve(mux, http.MethodPost, "/targets/local/migrate/unskip?ids=02-posts.sql", as("token-b"))
+
+	file, _ = os.Open(file.Name())
+	defer file.Close()
+	events := []AuditEvent{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatal(scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+	if len(events) != 3 || events[0].Success || events[0].Identity != "alice" ||
+		events[1].Action != AuditHistorySkip || !events[1].Success || events[1].Detail != "01-users.sql,02-posts.sql" ||
+		events[2].Action != AuditHistoryUnskip || !strings.Contains(events[2].Detail, "02-posts.sql") {
+		t.Log(events)
+		t.Fail()
+	}
+}
@@ -0,0 +1,94 @@
+package migrate
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+
+	sqlmigrate "github.com/rubenv/sql-migrate"
+)
+
+const (
+	// MigrationSourceKind マイグレーションのソースの種類(filesystem/embedded/bundle)を指定するための環境変数
+	MigrationSourceKind = "SQL_MIGRATE_SOURCE"
+)
+
+const (
+	// SourceFilesystem 実行時にディレクトリからマイグレーションを読み込む
+	SourceFilesystem = "filesystem"
+	// SourceEmbedded ビルド時にバイナリに埋め込んだマイグレーションを使う
+	SourceEmbedded = "embedded"
+	// SourceBundle HTTPでアップロードしたバンドルのうち有効なものを使う
+	SourceBundle = "bundle"
+	// DefaultMigrationSourceKind デフォルトのマイグレーションのソースの種類
+	DefaultMigrationSourceKind = SourceFilesystem
+)
+
+const (
+	// SourceKindSettingFormatErrorMessage ソースの種類の設定を誤っている際のエラーメッセージです
+	SourceKindSettingFormatErrorMessage = "Migration source should be filesystem, embedded or bundle"
+	// NoEmbeddedMigrationsErrorMessage マイグレーションを埋め込まずにビルドしたバイナリで埋め込みのソースを指定した際のエラーメッセージです
+	NoEmbeddedMigrationsErrorMessage = "This binary was built without embedded migrations (build with -tags embed_migrations)"
+)
+
+// embeddedMigrations バイナリに埋め込まれたマイグレーション。埋め込まずにビルドした場合はnil
+var embeddedMigrations fs.FS
+
+// RegisterEmbeddedMigrations バイナリに埋め込んだマイグレーションを登録する。
+// fsysの直下(またはsourcePathで指定したディレクトリ)に*.sqlを格納する
+func RegisterEmbeddedMigrations(fsys fs.FS) {
+	embeddedMigrations = fsys
+}
+
+// HasEmbeddedMigrations バイナリにマイグレーションが埋め込まれているかを返す
+func HasEmbeddedMigrations() bool {
+	return embeddedMigrations != nil
+}
+
+// GetMigrationSourceKind マイグレーションのソースの種類を取得する。
+// 環境変数が設定されていない場合は、DefaultMigrationSourceKindの値を返す
+// 不正な値(filesystem/embedded/bundle以外)が設定されている場合はエラーとDefaultMigrationSourceKindの値を返す
+func GetMigrationSourceKind() (string, error) {
+	return parseMigrationSourceKind(getValue(MigrationSourceKind, DefaultMigrationSourceKind))
+}
+
+// parseMigrationSourceKind ソースの種類を解釈する
+func parseMigrationSourceKind(kind string) (string, error) {
+	if kind != SourceFilesystem && kind != SourceEmbedded && kind != SourceBundle {
+		return DefaultMigrationSourceKind, errors.New(SourceKindSettingFormatErrorMessage)
+	}
+	return kind, nil
+}
+
+// SourceInfo 使用しているマイグレーションのソース
+// Kind ソースの種類(filesystem/embedded/bundle)
+// Path ディレクトリパス(埋め込みの場合は埋め込んだファイルシステム内のパス、バンドルの場合は有効なバンドルのディレクトリ)
+type SourceInfo struct {
+	Kind string `json:"kind"`
+	Path string `json:"path"`
+}
+
+// String ソースを"kind:path"の形式で返す
+func (info SourceInfo) String() string {
+	return info.Kind + ":" + info.Path
+}
+
+// newMigrationSource ソースの種類とパスからマイグレーションのソースを生成する
+func newMigrationSource(info SourceInfo) (sqlmigrate.MigrationSource, error) {
+	if info.Kind == SourceFilesystem || info.Kind == SourceBundle {
+		return sqlmigrate.FileMigrationSource{
+			Dir: info.Path,
+		}, nil
+	}
+
+	if embeddedMigrations == nil {
+		return nil, errors.New(NoEmbeddedMigrationsErrorMessage)
+	}
+	fsys, err := fs.Sub(embeddedMigrations, info.Path)
+	if err != nil {
+		return nil, err
+	}
+	return sqlmigrate.HttpFileSystemMigrationSource{
+		FileSystem: http.FS(fsys),
+	}, nil
+}
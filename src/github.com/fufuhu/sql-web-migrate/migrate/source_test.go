@@ -0,0 +1,152 @@
+package migrate
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+// TestGetMigrationSourceKind ソースの種類の既定値と、不正な値がエラーになることを確認する。
+func TestGetMigrationSourceKind(t *testing.T) {
+	os.Unsetenv(MigrationSourceKind)
+	if kind, err := GetMigrationSourceKind(); err != nil || kind != SourceFilesystem {
+		t.Log(kind, err)
+		t.Fail()
+	}
+
+	os.Setenv(MigrationSourceKind, SourceEmbedded)
+	defer os.Unsetenv(MigrationSourceKind)
+	if kind, err := GetMigrationSourceKind(); err != nil || kind != SourceEmbedded {
+		t.Log(kind, err)
+		t.Fail()
+	}
+
+	os.Setenv(MigrationSourceKind, "s3")
+	if kind, err := GetMigrationSourceKind(); err == nil || kind != DefaultMigrationSourceKind {
+		t.Log(kind, err)
+		t.Fail()
+	}
+}
+
+// TestEmbeddedSource 埋め込んだファイルシステムのEmbeddedPath以下から
+// マイグレーションが読み込まれることを確認する。
+func TestEmbeddedSource(t *testing.T) {
+	RegisterEmbeddedMigrations(fstest.MapFS{
+		"orders/01-orders.sql": {Data: []byte("-- +migrate Up\nCREATE TABLE orders (id integer);\n-- +migrate Down\nDROP TABLE orders;\n")},
+		"orders/README.md":     {Data: []byte("not a migration")},
+		"billing/01-bills.sql": {Data: []byte("-- +migrate Up\nCREATE TABLE bills (id integer);\n")},
+	})
+	defer RegisterEmbeddedMigrations(nil)
+
+	target := &Target{
+		Name:         "orders",
+		SourcePath:   func() string { return "" },
+		SourceKind:   func() (string, error) { return SourceEmbedded, nil },
+		EmbeddedPath: "orders",
+	}
+
+	info, err := target.SourceInfo()
+	if err != nil || info.String() != "embedded:orders" {
+		t.Log(info, err)
+		t.Fail()
+	}
+
+	source, err := target.Source()
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrations, err := source.FindMigrations()
+	if err != nil || len(migrations) != 1 || migrations[0].Id != "01-orders.sql" {
+		t.Log(migrations, err)
+		t.Fail()
+	}
+}
+
+// TestEmbeddedSourceNotRegistered マイグレーションを埋め込まずにビルドした場合に
+// 埋め込みのソースを指定するとエラーになることを確認する。
+func TestEmbeddedSourceNotRegistered(t *testing.T) {
+	RegisterEmbeddedMigrations(nil)
+
+	target := &Target{
+		SourcePath: func() string { return "" },
+		SourceKind: func() (string, error) { return SourceEmbedded, nil },
+	}
+	if _, err := target.Source(); err == nil || err.Error() != NoEmbeddedMigrationsErrorMessage {
+		t.Log(err)
+		t.Fail()
+	}
+}
+
+// TestLoadTargetsEmbeddedSource 埋め込みのソースを使う対象はsourcePathを省略でき、
+// 不正なソースの種類はエラーになることを確認する。
+func TestLoadTargetsEmbeddedSource(t *testing.T) {
+	path := writeTargetsFile(t, `{"targets": [{"name": "a", "source": "embedded", "embeddedPath": "a"}]}`)
+	defer os.Remove(path)
+
+	targets, err := LoadTargets(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := targets.Get("a")
+	if info := a.Info(); info.Source != SourceEmbedded || info.SourcePath != "a" {
+		t.Log(info)
+		t.Fail()
+	}
+
+	invalid := writeTargetsFile(t, `{"targets": [{"name": "a", "source": "s3", "sourcePath": "/a"}]}`)
+	defer os.Remove(invalid)
+	if _, err := LoadTargets(invalid); err == nil {
+		t.Fail()
+	}
+}
+
+// TestHandlerStatusEmbeddedSource 埋め込みのソースを使う対象の適用状況が
+// 埋め込んだマイグレーションと比較され、X-Migration-Sourceヘッダで使用中のソースが返ることを確認する。
+func TestHandlerStatusEmbeddedSource(t *testing.T) {
+	files := fstest.MapFS{}
+	for name, content := range testMigrations {
+		files[name] = &fstest.MapFile{Data: []byte(content)}
+	}
+	RegisterEmbeddedMigrations(files)
+	defer RegisterEmbeddedMigrations(nil)
+
+	dir, err := ioutil.TempDir("", "source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bytes, _ := json.Marshal(map[string]interface{}{
+		"targets": []map[string]interface{}{{
+			"name":            "local",
+			"dialect":         DialectSQLite,
+			"dbname":          filepath.Join(dir, "local.db"),
+			"source":          SourceEmbedded,
+			"allowedNetworks": []string{"192.0.2.0/24"},
+		}},
+	})
+	path := writeTargetsFile(t, string(bytes))
+	defer os.Remove(path)
+
+	targets, err := LoadTargets(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := NewServeMux(targets)
+
+	if w := serve(mux, http.MethodPost, "/targets/local/migrate/up", nil); w.Code != http.StatusOK {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+
+	w := serve(mux, http.MethodGet, "/targets/local/migrate/status", nil)
+	var statuses []MigrationStatus
+	decode(t, w, &statuses)
+	if w.Header().Get(MigrationSourceHeader) != "embedded:." || len(statuses) != 2 || !statuses[1].Applied {
+		t.Log(w.Header(), w.Body.String())
+		t.Fail()
+	}
+}
@@ -0,0 +1,561 @@
+package migrate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	sqlmigrate "github.com/rubenv/sql-migrate"
+	"go.uber.org/zap"
+)
+
+const (
+	// TargetsFile 複数のマイグレーション対象を定義したJSONファイルのパスを指定するための環境変数
+	TargetsFile = "SQL_MIGRATE_TARGETS_FILE"
+	// DefaultTargetName 環境変数で設定したマイグレーション対象の名前
+	DefaultTargetName = "default"
+)
+
+const (
+	// MigrationInProgressErrorMessage 同じ対象のマイグレーションが実行中の際のエラーメッセージです
+	MigrationInProgressErrorMessage = "Another migration is in progress for this target"
+)
+
+// ErrMigrationInProgress 同じ対象のマイグレーションが実行中であることを表すエラー
+var ErrMigrationInProgress = errors.New(MigrationInProgressErrorMessage)
+
+// targetNamePattern 対象の名前として使える文字列(URLパスに含めるため)
+var targetNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// GetTargetsFile 複数のマイグレーション対象を定義したファイルのパスを取得する。
+// 環境変数が設定されていない場合は空文字を返し、環境変数の設定を唯一の対象とする
+func GetTargetsFile() string {
+	return getValue(TargetsFile, "")
+}
+
+// Target マイグレーション対象のDB
+// Name 対象の名前
+// Connection DBの接続設定
+// SourcePath マイグレーション用のSQLファイルを格納しているディレクトリパス
+// SourceKind マイグレーションのソースの種類(filesystem/embedded/bundle)
+// EmbeddedPath 埋め込みのソースを使う場合の、埋め込んだファイルシステム内のディレクトリパス
+// BundleDir アップロードしたバンドルを格納するディレクトリパス(空文字の場合はBundleConfigのディレクトリ/対象の名前)
+// AllowedNetworks 対象へのマイグレーションを許可するネットワーク
+// FanOut スキーマごとに適用する際の設定
+// History 適用記録のテーブルの設定
+// RequireApproval マイグレーションの実行に別の利用者が承認した承認依頼を必要とするか
+// Schedule マイグレーションを実行できる時間帯と凍結期間
+// Backup downの前のバックアップの設定
+// Hooks マイグレーションの前後に実行するフックの設定
+// Timeouts マイグレーション1件ごとにセッションに設定するタイムアウトの設定
+// Pool 使い回すDBへの接続の設定
+type Target struct {
+	Name            string
+	Connection      DBConnectionConfig
+	SourcePath      func() string
+	SourceKind      func() (string, error)
+	EmbeddedPath    string
+	BundleDir       string
+	AllowedNetworks func() AllowedNetworks
+	FanOut          FanOutConfigStruct
+	History         HistoryConfigStruct
+	RequireApproval func() (bool, error)
+	Schedule        ScheduleConfigStruct
+	Backup          BackupConfigStruct
+	Hooks           HookConfigStruct
+	Timeouts        TimeoutConfigStruct
+	Pool            PoolConfigStruct
+
+	lock sync.Mutex
+	pool dbPool
+}
+
+// TargetInfo 対象の一覧として返す情報(パスワードは含めない)
+type TargetInfo struct {
+	Name            string `json:"name"`
+	Dialect         string `json:"dialect"`
+	Host            string `json:"host"`
+	DBName          string `json:"dbname"`
+	Source          string `json:"source"`
+	SourcePath      string `json:"sourcePath"`
+	RequireApproval bool   `json:"requireApproval"`
+}
+
+// Info 対象の一覧として返す情報を返す
+func (target *Target) Info() TargetInfo {
+	dialect, _ := target.Dialect()
+	source, _ := target.SourceInfo()
+	requireApproval, _ := target.ApprovalRequired()
+	return TargetInfo{
+		Name:            target.Name,
+		Dialect:         dialect,
+		Host:            target.Connection.Host(),
+		DBName:          target.Connection.DBName(),
+		Source:          source.Kind,
+		SourcePath:      source.Path,
+		RequireApproval: requireApproval,
+	}
+}
+
+// ApprovalRequired 対象のマイグレーションの実行に承認が必要かを返す
+func (target *Target) ApprovalRequired() (bool, error) {
+	if target.RequireApproval == nil {
+		return false, nil
+	}
+	return target.RequireApproval()
+}
+
+// SourceInfo 対象が使うマイグレーションのソースの種類とパスを返す
+func (target *Target) SourceInfo() (SourceInfo, error) {
+	kind := DefaultMigrationSourceKind
+	if target.SourceKind != nil {
+		var err error
+		if kind, err = target.SourceKind(); err != nil {
+			return SourceInfo{Kind: kind, Path: target.SourcePath()}, err
+		}
+	}
+
+	if kind == SourceEmbedded {
+		path := target.EmbeddedPath
+		if path == "" {
+			path = "."
+		}
+		return SourceInfo{Kind: kind, Path: path}, nil
+	}
+	if kind == SourceBundle {
+		version, err := target.activeBundle()
+		if err != nil {
+			return SourceInfo{Kind: kind}, err
+		}
+		return SourceInfo{Kind: kind, Path: filepath.Join(target.bundleDir(), version)}, nil
+	}
+	return SourceInfo{Kind: kind, Path: target.SourcePath()}, nil
+}
+
+// Source 対象のマイグレーション用のSQLファイルのソースを返す
+func (target *Target) Source() (sqlmigrate.MigrationSource, error) {
+
+	info, err := target.SourceInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	logger, _ := zap.NewProduction()
+	defer logger.Sync()
+
+	// 署名されたマニフェストと一致しないファイルがある場合はマイグレーションを実行しない
+	signer, err := verifySource(info)
+	if err != nil {
+		logger.Error(
+			"Migration source verification failed",
+			zap.String("target", target.Name),
+			zap.String("sourcePath", info.Path),
+			zap.Error(err))
+		return nil, err
+	}
+
+	logger.Info(
+		"Setup source to migrate",
+		zap.String("target", target.Name),
+		zap.String("source", info.Kind),
+		zap.String("sourcePath", info.Path),
+		zap.String("signedBy", signer))
+
+	return newMigrationSource(info)
+}
+
+// Dialect 対象のDBの種類を返す。設定されていない場合はDefaultDBDialectを返す
+func (target *Target) Dialect() (string, error) {
+	if target.Connection.Dialect == nil {
+		return DefaultDBDialect, nil
+	}
+	return target.Connection.Dialect()
+}
+
+// TryLock 対象のマイグレーションの実行権を取得する。
+// 他のマイグレーションが実行中の場合はErrMigrationInProgressを返す
+func (target *Target) TryLock() error {
+	if !target.lock.TryLock() {
+		return ErrMigrationInProgress
+	}
+	return nil
+}
+
+// Unlock 対象のマイグレーションの実行権を解放する
+func (target *Target) Unlock() {
+	target.lock.Unlock()
+}
+
+// NewDefaultTarget 環境変数の設定(ConnectionConfig, NetworkConfig)を使う対象を生成する
+func NewDefaultTarget() *Target {
+	return &Target{
+		Name:            DefaultTargetName,
+		Connection:      ConnectionConfig,
+		SourcePath:      GetMigrationSourcePath,
+		SourceKind:      GetMigrationSourceKind,
+		AllowedNetworks: NetworkConfig.AllowedNetworks,
+		FanOut:          FanOutConfig,
+		History:         HistoryConfig,
+		RequireApproval: GetRequireApproval,
+		Schedule:        ScheduleConfig,
+		Backup:          BackupConfig,
+		Hooks:           HookConfig,
+		Timeouts:        TimeoutConfig,
+		Pool:            PoolConfig,
+	}
+}
+
+// Targets 名前で引けるマイグレーション対象の集まり
+type Targets struct {
+	targets map[string]*Target
+}
+
+// NewTargets 対象の集まりを生成する。名前が重複している場合はエラーを返す
+func NewTargets(targets ...*Target) (*Targets, error) {
+	registry := &Targets{targets: map[string]*Target{}}
+	for _, target := range targets {
+		if !targetNamePattern.MatchString(target.Name) {
+			return nil, fmt.Errorf("invalid target name: %q", target.Name)
+		}
+		if _, ok := registry.targets[target.Name]; ok {
+			return nil, fmt.Errorf("duplicate target name: %s", target.Name)
+		}
+		registry.targets[target.Name] = target
+	}
+	return registry, nil
+}
+
+// Get 名前に対応する対象を返す
+func (targets *Targets) Get(name string) (*Target, bool) {
+	target, ok := targets.targets[name]
+	return target, ok
+}
+
+// List 対象を名前順で返す
+func (targets *Targets) List() []*Target {
+	list := []*Target{}
+	for _, target := range targets.targets {
+		list = append(list, target)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// targetFile 対象を定義するJSONファイルの形式
+type targetFile struct {
+	Targets []targetFileEntry `json:"targets"`
+}
+
+// targetFileEntry 対象1件分の定義。
+// パスワードはファイルに直接書かずにPasswordEnvで環境変数名を指定することもできる
+type targetFileEntry struct {
+	Name            string   `json:"name"`
+	Dialect         string   `json:"dialect"`
+	Host            string   `json:"host"`
+	Port            int      `json:"port"`
+	User            string   `json:"user"`
+	Password        string   `json:"password"`
+	PasswordEnv     string   `json:"passwordEnv"`
+	DBName          string   `json:"dbname"`
+	SSLMode         string   `json:"sslMode"`
+	Pragmas         string   `json:"pragmas"`
+	SourcePath      string   `json:"sourcePath"`
+	Source          string   `json:"source"`
+	EmbeddedPath    string   `json:"embeddedPath"`
+	BundleDir       string   `json:"bundleDir"`
+	AllowedNetworks []string `json:"allowedNetworks"`
+	MigrationTable  string   `json:"migrationTable"`
+	MigrationSchema string   `json:"migrationSchema"`
+	RequireApproval bool     `json:"requireApproval"`
+	FanOut          struct {
+		SchemaPattern string `json:"schemaPattern"`
+		SchemaQuery   string `json:"schemaQuery"`
+		Parallelism   int    `json:"parallelism"`
+		OnError       string `json:"onError"`
+	} `json:"fanOut"`
+	Schedule struct {
+		Windows  []string `json:"windows"`
+		TimeZone string   `json:"timezone"`
+		Freezes  []string `json:"freezes"`
+	} `json:"schedule"`
+	Backup struct {
+		Dir       string `json:"dir"`
+		Scope     string `json:"scope"`
+		Retention *int   `json:"retention"`
+	} `json:"backup"`
+	Hooks struct {
+		Dir     string `json:"dir"`
+		Timeout string `json:"timeout"`
+	} `json:"hooks"`
+	Timeouts struct {
+		LockTimeout              string `json:"lockTimeout"`
+		StatementTimeout         string `json:"statementTimeout"`
+		IdleInTransactionTimeout string `json:"idleInTransactionSessionTimeout"`
+		LockRetries              int    `json:"lockRetries"`
+		LockRetryBackoff         string `json:"lockRetryBackoff"`
+		RunTimeout               string `json:"runTimeout"`
+	} `json:"timeouts"`
+	Pool struct {
+		MaxOpenConns    int    `json:"maxOpenConns"`
+		MaxIdleConns    *int   `json:"maxIdleConns"`
+		ConnMaxLifetime string `json:"connMaxLifetime"`
+	} `json:"pool"`
+}
+
+// newTarget ファイルの定義から対象を生成する
+func (entry targetFileEntry) newTarget() (*Target, error) {
+	dialect := entry.Dialect
+	if dialect == "" {
+		dialect = DefaultDBDialect
+	}
+	if _, err := parseDialect(dialect); err != nil {
+		return nil, fmt.Errorf("target %s: %v", entry.Name, err)
+	}
+	pragmas := entry.Pragmas
+	if pragmas == "" {
+		pragmas = DefaultDBSQLitePragmas
+	}
+	host := entry.Host
+	if host == "" {
+		host = DefaultDBHost
+	}
+	port := entry.Port
+	if port == 0 {
+		port = defaultPort(dialect)
+	}
+	sslMode := entry.SSLMode
+	if sslMode == "" {
+		sslMode = DefaultDBSSLMode
+	}
+	if sslMode != "require" && sslMode != "verify-full" && sslMode != "verify-ca" && sslMode != "disable" {
+		return nil, fmt.Errorf("target %s: %s", entry.Name, SSLModeSettingFormatErrorMessage)
+	}
+	sourceKind := entry.Source
+	if sourceKind == "" {
+		sourceKind = DefaultMigrationSourceKind
+	}
+	if _, err := parseMigrationSourceKind(sourceKind); err != nil {
+		return nil, fmt.Errorf("target %s: %v", entry.Name, err)
+	}
+	sourcePath := entry.SourcePath
+	if sourcePath == "" && sourceKind == SourceFilesystem {
+		return nil, fmt.Errorf("target %s: sourcePath is required", entry.Name)
+	}
+
+	var networks AllowedNetworks
+	for _, cidr := range entry.AllowedNetworks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("target %s: %v", entry.Name, err)
+		}
+		networks = append(networks, network)
+	}
+
+	parallelism := entry.FanOut.Parallelism
+	if parallelism == 0 {
+		parallelism = DefaultFanOutParallelism
+	}
+	if _, err := parseFanOutParallelism(strconv.Itoa(parallelism)); err != nil {
+		return nil, fmt.Errorf("target %s: %v", entry.Name, err)
+	}
+	onError := entry.FanOut.OnError
+	if onError == "" {
+		onError = DefaultFanOutOnError
+	}
+	if _, err := parseFanOutOnError(onError); err != nil {
+		return nil, fmt.Errorf("target %s: %v", entry.Name, err)
+	}
+
+	table := entry.MigrationTable
+	if table == "" {
+		table = DefaultMigrationTable
+	}
+
+	windows, err := ParseMaintenanceWindows(strings.Join(entry.Schedule.Windows, ";"))
+	if err != nil {
+		return nil, fmt.Errorf("target %s: %v", entry.Name, err)
+	}
+	timeZone := entry.Schedule.TimeZone
+	if timeZone == "" {
+		timeZone = DefaultMaintenanceTimeZone
+	}
+	location, err := time.LoadLocation(timeZone)
+	if err != nil {
+		return nil, fmt.Errorf("target %s: %v", entry.Name, err)
+	}
+	configuredFreezes, err := ParseFreezes(strings.Join(entry.Schedule.Freezes, ";"))
+	if err != nil {
+		return nil, fmt.Errorf("target %s: %v", entry.Name, err)
+	}
+
+	backupScope := entry.Backup.Scope
+	if backupScope == "" {
+		backupScope = DefaultBackupScope
+	}
+	if _, err := parseBackupScope(backupScope); err != nil {
+		return nil, fmt.Errorf("target %s: %v", entry.Name, err)
+	}
+	backupRetention := DefaultBackupRetention
+	if entry.Backup.Retention != nil {
+		backupRetention = *entry.Backup.Retention
+	}
+	if backupRetention < 0 {
+		return nil, fmt.Errorf("target %s: %s", entry.Name, BackupRetentionSettingFormatErrorMessage)
+	}
+
+	hookTimeout := DefaultHookTimeout
+	if entry.Hooks.Timeout != "" {
+		if hookTimeout, err = time.ParseDuration(entry.Hooks.Timeout); err != nil || hookTimeout <= 0 {
+			return nil, fmt.Errorf("target %s: invalid hooks timeout: %s", entry.Name, entry.Hooks.Timeout)
+		}
+	}
+
+	timeouts := map[string]time.Duration{}
+	for name, value := range map[string]string{
+		SettingLockTimeout:              entry.Timeouts.LockTimeout,
+		SettingStatementTimeout:         entry.Timeouts.StatementTimeout,
+		SettingIdleInTransactionTimeout: entry.Timeouts.IdleInTransactionTimeout,
+		"lockRetryBackoff":              entry.Timeouts.LockRetryBackoff,
+		"runTimeout":                    entry.Timeouts.RunTimeout,
+	} {
+		if value == "" {
+			continue
+		}
+		if timeouts[name], err = time.ParseDuration(value); err != nil || timeouts[name] < 0 {
+			return nil, fmt.Errorf("target %s: invalid %s: %s", entry.Name, name, value)
+		}
+	}
+	lockRetryBackoff, ok := timeouts["lockRetryBackoff"]
+	if !ok {
+		lockRetryBackoff = DefaultLockRetryBackoff
+	}
+	if entry.Timeouts.LockRetries < 0 {
+		return nil, fmt.Errorf("target %s: %s", entry.Name, LockRetriesSettingFormatErrorMessage)
+	}
+
+	maxOpenConns := entry.Pool.MaxOpenConns
+	if maxOpenConns == 0 {
+		maxOpenConns = DefaultDBMaxOpenConns
+	}
+	if maxOpenConns < 0 {
+		return nil, fmt.Errorf("target %s: %s", entry.Name, DBMaxOpenConnsSettingFormatErrorMessage)
+	}
+	maxIdleConns := DefaultDBMaxIdleConns
+	if entry.Pool.MaxIdleConns != nil {
+		maxIdleConns = *entry.Pool.MaxIdleConns
+	}
+	if maxIdleConns < 0 {
+		return nil, fmt.Errorf("target %s: %s", entry.Name, DBMaxIdleConnsSettingFormatErrorMessage)
+	}
+	connMaxLifetime := DefaultDBConnMaxLifetime
+	if entry.Pool.ConnMaxLifetime != "" {
+		if connMaxLifetime, err = time.ParseDuration(entry.Pool.ConnMaxLifetime); err != nil || connMaxLifetime < 0 {
+			return nil, fmt.Errorf("target %s: invalid connMaxLifetime: %s", entry.Name, entry.Pool.ConnMaxLifetime)
+		}
+	}
+
+	return &Target{
+		Name: entry.Name,
+		Connection: DBConnectionConfig{
+			Name: func() string { return entry.Name },
+			Host: func() string { return host },
+			Port: func() (int, error) { return port, nil },
+			User: func() string { return entry.User },
+			Password: func() string {
+				if entry.PasswordEnv != "" {
+					return os.Getenv(entry.PasswordEnv)
+				}
+				return entry.Password
+			},
+			DBName:  func() string { return entry.DBName },
+			SSLMode: func() (string, error) { return sslMode, nil },
+			Dialect: func() (string, error) { return dialect, nil },
+			Pragmas: func() string { return pragmas },
+		},
+		SourcePath:      func() string { return sourcePath },
+		SourceKind:      func() (string, error) { return sourceKind, nil },
+		EmbeddedPath:    entry.EmbeddedPath,
+		BundleDir:       entry.BundleDir,
+		AllowedNetworks: func() AllowedNetworks { return networks },
+		FanOut: FanOutConfigStruct{
+			SchemaPattern: func() string { return entry.FanOut.SchemaPattern },
+			SchemaQuery:   func() string { return entry.FanOut.SchemaQuery },
+			Parallelism:   func() (int, error) { return parallelism, nil },
+			OnError:       func() (string, error) { return onError, nil },
+		},
+		History: HistoryConfigStruct{
+			Table:  func() string { return table },
+			Schema: func() string { return entry.MigrationSchema },
+		},
+		RequireApproval: func() (bool, error) { return entry.RequireApproval, nil },
+		Schedule: ScheduleConfigStruct{
+			Windows:  func() ([]MaintenanceWindow, error) { return windows, nil },
+			TimeZone: func() (*time.Location, error) { return location, nil },
+			Freezes:  func() ([]Freeze, error) { return configuredFreezes, nil },
+		},
+		Backup: BackupConfigStruct{
+			Dir:       func() string { return entry.Backup.Dir },
+			Scope:     func() (string, error) { return backupScope, nil },
+			Retention: func() (int, error) { return backupRetention, nil },
+			Command:   GetPgDumpCommand,
+		},
+		Hooks: HookConfigStruct{
+			Dir:     func() string { return entry.Hooks.Dir },
+			Timeout: func() (time.Duration, error) { return hookTimeout, nil },
+		},
+		Timeouts: TimeoutConfigStruct{
+			LockTimeout:              func() (time.Duration, error) { return timeouts[SettingLockTimeout], nil },
+			StatementTimeout:         func() (time.Duration, error) { return timeouts[SettingStatementTimeout], nil },
+			IdleInTransactionTimeout: func() (time.Duration, error) { return timeouts[SettingIdleInTransactionTimeout], nil },
+			LockRetries:              func() (int, error) { return entry.Timeouts.LockRetries, nil },
+			LockRetryBackoff:         func() (time.Duration, error) { return lockRetryBackoff, nil },
+			RunTimeout:               func() (time.Duration, error) { return timeouts["runTimeout"], nil },
+		},
+		Pool: PoolConfigStruct{
+			MaxOpenConns:    func() (int, error) { return maxOpenConns, nil },
+			MaxIdleConns:    func() (int, error) { return maxIdleConns, nil },
+			ConnMaxLifetime: func() (time.Duration, error) { return connMaxLifetime, nil },
+		},
+	}, nil
+}
+
+// LoadTargets マイグレーション対象を読み込む。
+// pathが空の場合は環境変数で設定した対象(default)だけを返す
+func LoadTargets(path string) (*Targets, error) {
+	if path == "" {
+		return NewTargets(NewDefaultTarget())
+	}
+
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file targetFile
+	if err := json.Unmarshal(bytes, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(file.Targets) == 0 {
+		return nil, fmt.Errorf("%s: no targets defined", path)
+	}
+
+	var targets []*Target
+	for _, entry := range file.Targets {
+		target, err := entry.newTarget()
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+	return NewTargets(targets...)
+}
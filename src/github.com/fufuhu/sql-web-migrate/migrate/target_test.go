@@ -0,0 +1,189 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	sqlmigrate "github.com/rubenv/sql-migrate"
+)
+
+// writeTargetsFile 対象を定義したファイルを一時ファイルとして作成する
+func writeTargetsFile(t *testing.T, content string) string {
+	file, err := ioutil.TempFile("", "targets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	if _, err := file.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
+
+// TestLoadTargetsWithoutFile ファイルが指定されていない場合に
+// 環境変数の設定を使うdefaultの対象だけが返ることを確認する。
+func TestLoadTargetsWithoutFile(t *testing.T) {
+	os.Setenv(DBName, "envdb")
+	defer os.Unsetenv(DBName)
+
+	targets, err := LoadTargets("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list := targets.List()
+	if len(list) != 1 || list[0].Name != DefaultTargetName || list[0].Connection.DBName() != "envdb" {
+		t.Log(list)
+		t.Fail()
+	}
+}
+
+// TestLoadTargets ファイルに定義した対象ごとに接続設定、ソース、ネットワークが
+// 読み込まれ、省略した項目にはデフォルト値が使われることを確認する。
+func TestLoadTargets(t *testing.T) {
+	os.Setenv("ORDERS_DB_PASSWORD", "from-env")
+	defer os.Unsetenv("ORDERS_DB_PASSWORD")
+
+	path := writeTargetsFile(t, `{"targets": [
+		{"name": "orders", "host": "orders.db", "port": 15432, "user": "app",
+		 "passwordEnv": "ORDERS_DB_PASSWORD", "dbname": "orders", "sslMode": "require",
+		 "sourcePath": "/migrations/orders", "allowedNetworks": ["10.0.0.0/8"]},
+		{"name": "billing", "password": "inline", "dbname": "billing",
+		 "sourcePath": "/migrations/billing"}
+	]}`)
+	defer os.Remove(path)
+
+	targets, err := LoadTargets(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list := targets.List()
+	if len(list) != 2 || list[0].Name != "billing" || list[1].Name != "orders" {
+		t.Log(list)
+		t.Fail()
+	}
+
+	orders, ok := targets.Get("orders")
+	if !ok {
+		t.Fatal("orders not found")
+	}
+	port, _ := orders.Connection.Port()
+	sslMode, _ := orders.Connection.SSLMode()
+	if orders.Connection.Host() != "orders.db" || port != 15432 || orders.Connection.User() != "app" ||
+		orders.Connection.Password() != "from-env" || sslMode != "require" ||
+		orders.SourcePath() != "/migrations/orders" {
+		t.Log(orders.Info())
+		t.Fail()
+	}
+	networks := orders.AllowedNetworks()
+	if !networks.IsAllowed(net.ParseIP("10.1.2.3")) || networks.IsAllowed(net.ParseIP("192.168.0.1")) {
+		t.Fail()
+	}
+
+	billing, _ := targets.Get("billing")
+	port, _ = billing.Connection.Port()
+	sslMode, _ = billing.Connection.SSLMode()
+	if billing.Connection.Host() != DefaultDBHost || port != DefaultDBPort ||
+		sslMode != DefaultDBSSLMode || billing.Connection.Password() != "inline" {
+		t.Log(billing.Info())
+		t.Fail()
+	}
+
+	if _, ok := targets.Get(DefaultTargetName); ok {
+		t.Fail()
+	}
+}
+
+// TestLoadTargetsMySQLDefaultPort ポートを省略したMySQLの対象では、
+// MySQLのデフォルトのポート番号が使われることを確認する。
+func TestLoadTargetsMySQLDefaultPort(t *testing.T) {
+	path := writeTargetsFile(t, `{"targets": [
+		{"name": "shop", "dialect": "mysql", "dbname": "shop", "sourcePath": "/migrations/shop"}
+	]}`)
+	defer os.Remove(path)
+
+	targets, err := LoadTargets(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shop, _ := targets.Get("shop")
+	if port, _ := shop.Connection.Port(); port != DefaultDBMySQLPort {
+		t.Log(port)
+		t.Fail()
+	}
+}
+
+// TestLoadTargetsInvalid 不正な定義を含むファイルがエラーになることを確認する。
+func TestLoadTargetsInvalid(t *testing.T) {
+	for _, content := range []string{
+		`not json`,
+		`{"targets": []}`,
+		`{"targets": [{"name": "a", "sourcePath": "/a"}, {"name": "a", "sourcePath": "/b"}]}`,
+		`{"targets": [{"name": "a/b", "sourcePath": "/a"}]}`,
+		`{"targets": [{"name": "a"}]}`,
+		`{"targets": [{"name": "a", "sourcePath": "/a", "sslMode": "prefer"}]}`,
+		`{"targets": [{"name": "a", "sourcePath": "/a", "allowedNetworks": ["10.0.0.1"]}]}`,
+		`{"targets": [{"name": "a", "sourcePath": "/a", "dialect": "oracle"}]}`,
+		`{"targets": [{"name": "a", "sourcePath": "/a", "schedule": {"windows": ["Mon 22:00"]}}]}`,
+		`{"targets": [{"name": "a", "sourcePath": "/a", "schedule": {"timezone": "Mars/Olympus"}}]}`,
+		`{"targets": [{"name": "a", "sourcePath": "/a", "schedule": {"freezes": ["tomorrow"]}}]}`,
+		`{"targets": [{"name": "a", "sourcePath": "/a", "timeouts": {"lockTimeout": "5 seconds"}}]}`,
+		`{"targets": [{"name": "a", "sourcePath": "/a", "timeouts": {"lockRetries": -1}}]}`,
+		`{"targets": [{"name": "a", "sourcePath": "/a", "pool": {"maxOpenConns": -1}}]}`,
+		`{"targets": [{"name": "a", "sourcePath": "/a", "pool": {"connMaxLifetime": "forever"}}]}`,
+	} {
+		path := writeTargetsFile(t, content)
+		if _, err := LoadTargets(path); err == nil {
+			t.Log(content)
+			t.Fail()
+		}
+		os.Remove(path)
+	}
+
+	if _, err := LoadTargets("/nonexistent/targets.json"); err == nil {
+		t.Fail()
+	}
+}
+
+// TestExecMigrateInProgress 同じ対象のマイグレーションが実行中の場合は
+// DBに接続せずにErrMigrationInProgressが返り、他の対象は影響を受けないことを確認する。
+func TestExecMigrateInProgress(t *testing.T) {
+	path := writeTargetsFile(t, `{"targets": [
+		{"name": "a", "host": "127.0.0.1", "port": 1, "sourcePath": "/nonexistent"},
+		{"name": "b", "host": "127.0.0.1", "port": 1, "sourcePath": "/nonexistent"}
+	]}`)
+	defer os.Remove(path)
+
+	targets, err := LoadTargets(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := targets.Get("a")
+	b, _ := targets.Get("b")
+
+	if err := a.TryLock(); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Unlock()
+
+	result, err := ExecMigrate(context.Background(), a, sqlmigrate.Up, 0, nil)
+	if !errors.Is(err, ErrMigrationInProgress) || result.Success || result.Error != MigrationInProgressErrorMessage {
+		t.Log(result, err)
+		t.Fail()
+	}
+
+	if _, err := ExecMigrate(context.Background(), b, sqlmigrate.Up, 0, nil); err == nil || errors.Is(err, ErrMigrationInProgress) {
+		t.Log(err)
+		t.Fail()
+	}
+	if err := b.TryLock(); err != nil {
+		t.Log("lock of b should be released after ExecMigrate")
+		t.Fail()
+	}
+}
@@ -0,0 +1,325 @@
+package migrate
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	sqlmigrate "github.com/rubenv/sql-migrate"
+	"go.uber.org/zap"
+)
+
+const (
+	// LockTimeout マイグレーション1件ごとにセッションに設定するlock_timeoutを指定するための環境変数
+	LockTimeout = "SQL_MIGRATE_LOCK_TIMEOUT"
+	// StatementTimeout マイグレーション1件ごとにセッションに設定するstatement_timeoutを指定するための環境変数
+	StatementTimeout = "SQL_MIGRATE_STATEMENT_TIMEOUT"
+	// IdleInTransactionTimeout マイグレーション1件ごとにセッションに設定する
+	// idle_in_transaction_session_timeoutを指定するための環境変数
+	IdleInTransactionTimeout = "SQL_MIGRATE_IDLE_IN_TRANSACTION_TIMEOUT"
+	// LockRetries lock_timeoutで失敗したマイグレーションを再試行する回数を指定するための環境変数
+	LockRetries = "SQL_MIGRATE_LOCK_RETRIES"
+	// LockRetryBackoff lock_timeoutで失敗したマイグレーションを再試行するまでの初回待ち時間を指定するための環境変数
+	LockRetryBackoff = "SQL_MIGRATE_LOCK_RETRY_BACKOFF"
+	// RunTimeout 1回の実行(フックとバックアップを含む)の実行時間の上限を指定するための環境変数
+	RunTimeout = "SQL_MIGRATE_RUN_TIMEOUT"
+)
+
+const (
+	// SettingLockTimeout ロックの取得を待つ時間の上限
+	SettingLockTimeout = "lock_timeout"
+	// SettingStatementTimeout SQL文1件の実行時間の上限
+	SettingStatementTimeout = "statement_timeout"
+	// SettingIdleInTransactionTimeout トランザクション中に何もしない時間の上限
+	SettingIdleInTransactionTimeout = "idle_in_transaction_session_timeout"
+)
+
+const (
+	// DefaultLockTimeout デフォルトのlock_timeout(0の場合は設定しない)
+	DefaultLockTimeout = time.Duration(0)
+	// DefaultStatementTimeout デフォルトのstatement_timeout(0の場合は設定しない)
+	DefaultStatementTimeout = time.Duration(0)
+	// DefaultIdleInTransactionTimeout デフォルトのidle_in_transaction_session_timeout(0の場合は設定しない)
+	DefaultIdleInTransactionTimeout = time.Duration(0)
+	// DefaultLockRetries デフォルトのlock_timeoutで失敗した場合の再試行の回数(0の場合は再試行しない)
+	DefaultLockRetries = 0
+	// DefaultLockRetryBackoff デフォルトの再試行するまでの初回待ち時間
+	DefaultLockRetryBackoff = 5 * time.Second
+	// DefaultRunTimeout デフォルトの1回の実行の実行時間の上限(0の場合は上限なし)
+	DefaultRunTimeout = time.Duration(0)
+)
+
+const (
+	// LockRetriesSettingFormatErrorMessage 再試行の回数の設定値が不正な場合のエラーメッセージです
+	LockRetriesSettingFormatErrorMessage = "Lock retries should be a non-negative integer"
+	// SessionTimeoutsUnsupportedErrorMessage PostgreSQL以外の対象でタイムアウトが設定されている場合のエラーメッセージです
+	SessionTimeoutsUnsupportedErrorMessage = "Session timeouts are only supported for postgres targets"
+)
+
+// ErrSessionTimeoutsUnsupported PostgreSQL以外の対象ではタイムアウトを設定できないことを表すエラー
+var ErrSessionTimeoutsUnsupported = errors.New(SessionTimeoutsUnsupportedErrorMessage)
+
+// timeoutAnnotationPrefix マイグレーションごとのタイムアウトを指定する注釈。
+// SQLファイルの最初の-- +migrateより前に「-- +timeout lock_timeout=5s statement_timeout=10m」のように書く
+const timeoutAnnotationPrefix = "-- +timeout "
+
+// lockNotAvailable lock_timeoutでロックを取得できなかった場合のPostgreSQLのエラーコード
+const lockNotAvailable = "55P03"
+
+// sessionTimeoutNames セッションに設定するタイムアウトの設定名(設定する順)
+var sessionTimeoutNames = []string{SettingLockTimeout, SettingStatementTimeout, SettingIdleInTransactionTimeout}
+
+// GetLockTimeout マイグレーション1件ごとに設定するlock_timeoutを取得する。
+// 環境変数が設定されていない場合は、DefaultLockTimeoutの値を返す
+func GetLockTimeout() (time.Duration, error) {
+	return getDuration(LockTimeout, DefaultLockTimeout)
+}
+
+// GetStatementTimeout マイグレーション1件ごとに設定するstatement_timeoutを取得する。
+// 環境変数が設定されていない場合は、DefaultStatementTimeoutの値を返す
+func GetStatementTimeout() (time.Duration, error) {
+	return getDuration(StatementTimeout, DefaultStatementTimeout)
+}
+
+// GetIdleInTransactionTimeout マイグレーション1件ごとに設定するidle_in_transaction_session_timeoutを取得する。
+// 環境変数が設定されていない場合は、DefaultIdleInTransactionTimeoutの値を返す
+func GetIdleInTransactionTimeout() (time.Duration, error) {
+	return getDuration(IdleInTransactionTimeout, DefaultIdleInTransactionTimeout)
+}
+
+// GetLockRetries lock_timeoutで失敗したマイグレーションを再試行する回数を取得する。
+// 不正な値が設定されている場合はエラーとDefaultLockRetriesの値を返す
+func GetLockRetries() (int, error) {
+	retries, err := strconv.Atoi(getValue(LockRetries, strconv.Itoa(DefaultLockRetries)))
+	if err != nil || retries < 0 {
+		return DefaultLockRetries, errors.New(LockRetriesSettingFormatErrorMessage)
+	}
+	return retries, nil
+}
+
+// GetLockRetryBackoff lock_timeoutで失敗したマイグレーションを再試行するまでの初回待ち時間を取得する。
+// 環境変数が設定されていない場合は、DefaultLockRetryBackoffの値を返す
+func GetLockRetryBackoff() (time.Duration, error) {
+	return getDuration(LockRetryBackoff, DefaultLockRetryBackoff)
+}
+
+// GetRunTimeout 1回の実行の実行時間の上限を取得する。
+// 環境変数が設定されていない場合は、DefaultRunTimeoutの値を返す
+func GetRunTimeout() (time.Duration, error) {
+	return getDuration(RunTimeout, DefaultRunTimeout)
+}
+
+// TimeoutConfigStruct マイグレーション1件ごとにセッションに設定するタイムアウトと、ロック待ちの再試行の設定
+// LockTimeout lock_timeout(0の場合は設定しない)
+// StatementTimeout statement_timeout(0の場合は設定しない)
+// IdleInTransactionTimeout idle_in_transaction_session_timeout(0の場合は設定しない)
+// LockRetries lock_timeoutで失敗した場合に再試行する回数
+// LockRetryBackoff 再試行するまでの初回待ち時間(再試行ごとに倍にする)
+// RunTimeout 1回の実行の実行時間の上限。過ぎた場合は実行中のSQL文をキャンセルする(0の場合は上限なし)
+type TimeoutConfigStruct struct {
+	LockTimeout              func() (time.Duration, error)
+	StatementTimeout         func() (time.Duration, error)
+	IdleInTransactionTimeout func() (time.Duration, error)
+	LockRetries              func() (int, error)
+	LockRetryBackoff         func() (time.Duration, error)
+	RunTimeout               func() (time.Duration, error)
+}
+
+// TimeoutConfig 環境変数で設定した対象(default)のタイムアウトの設定です
+var TimeoutConfig TimeoutConfigStruct
+
+// SessionTimeouts 設定名ごとのセッションに設定するタイムアウト
+type SessionTimeouts map[string]time.Duration
+
+// ParseTimeoutAnnotations SQLファイルの最初の-- +migrateより前にある-- +timeoutの注釈から、
+// マイグレーションごとのタイムアウトを読み取る。0を指定した設定はタイムアウトしない
+func ParseTimeoutAnnotations(r io.Reader) (SessionTimeouts, error) {
+	timeouts := SessionTimeouts{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "-- +migrate ") {
+			break
+		}
+		if !strings.HasPrefix(line, timeoutAnnotationPrefix) {
+			continue
+		}
+		for _, field := range strings.Fields(line[len(timeoutAnnotationPrefix):]) {
+			parts := strings.SplitN(field, "=", 2)
+			if len(parts) != 2 || !isSessionTimeoutName(parts[0]) {
+				return nil, fmt.Errorf("invalid timeout annotation: %s", field)
+			}
+			timeout, err := time.ParseDuration(parts[1])
+			if err != nil || timeout < 0 {
+				return nil, fmt.Errorf("invalid timeout annotation: %s", field)
+			}
+			timeouts[parts[0]] = timeout
+		}
+	}
+	return timeouts, scanner.Err()
+}
+
+// isSessionTimeoutName セッションに設定できるタイムアウトの設定名かを返す
+func isSessionTimeoutName(name string) bool {
+	for _, candidate := range sessionTimeoutNames {
+		if name == candidate {
+			return true
+		}
+	}
+	return false
+}
+
+// openMigrationFile sourceからidのSQLファイルを開く。
+// ファイルを直接読めない種類のソースの場合はnilを返す
+func openMigrationFile(source sqlmigrate.MigrationSource, id string) (io.ReadCloser, error) {
+	switch source := source.(type) {
+	case sqlmigrate.FileMigrationSource:
+		return os.Open(filepath.Join(source.Dir, id))
+	case sqlmigrate.HttpFileSystemMigrationSource:
+		return source.FileSystem.Open("/" + id)
+	}
+	return nil, nil
+}
+
+// timeoutPolicy 1回の実行で、マイグレーション1件ごとにセッションに設定するタイムアウトと再試行の方針
+type timeoutPolicy struct {
+	dialect  string
+	source   sqlmigrate.MigrationSource
+	defaults SessionTimeouts
+	retries  int
+	backoff  time.Duration
+}
+
+// newTimeoutPolicy 対象の設定からtimeoutPolicyを生成する
+func newTimeoutPolicy(target *Target, dialect string, source sqlmigrate.MigrationSource) (*timeoutPolicy, error) {
+	policy := &timeoutPolicy{dialect: dialect, source: source, defaults: SessionTimeouts{}}
+	config := target.Timeouts
+	if config.LockTimeout == nil {
+		return policy, nil
+	}
+
+	settings := map[string]func() (time.Duration, error){
+		SettingLockTimeout:              config.LockTimeout,
+		SettingStatementTimeout:         config.StatementTimeout,
+		SettingIdleInTransactionTimeout: config.IdleInTransactionTimeout,
+	}
+	for name, get := range settings {
+		timeout, err := get()
+		if err != nil {
+			return nil, err
+		}
+		if timeout > 0 {
+			policy.defaults[name] = timeout
+		}
+	}
+	if len(policy.defaults) > 0 && dialect != DialectPostgres {
+		return nil, ErrSessionTimeoutsUnsupported
+	}
+
+	var err error
+	if policy.retries, err = config.LockRetries(); err != nil {
+		return nil, err
+	}
+	if policy.backoff, err = config.LockRetryBackoff(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// forMigration マイグレーション1件に設定するタイムアウトを、全体の設定にファイルの注釈を上書きして返す
+func (policy *timeoutPolicy) forMigration(id string) (SessionTimeouts, error) {
+	timeouts := SessionTimeouts{}
+	for name, timeout := range policy.defaults {
+		timeouts[name] = timeout
+	}
+
+	file, err := openMigrationFile(policy.source, id)
+	if err != nil || file == nil {
+		return timeouts, err
+	}
+	defer file.Close()
+	annotations, err := ParseTimeoutAnnotations(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", id, err)
+	}
+	if len(annotations) > 0 && policy.dialect != DialectPostgres {
+		return nil, ErrSessionTimeoutsUnsupported
+	}
+	for name, timeout := range annotations {
+		timeouts[name] = timeout
+	}
+	return timeouts, nil
+}
+
+// apply タイムアウトをセッションに設定する。設定しないものは前のマイグレーションの設定を戻すために既定値にする
+func (policy *timeoutPolicy) apply(ctx context.Context, db *sql.DB, timeouts SessionTimeouts) error {
+	for _, name := range sessionTimeoutNames {
+		statement := "SET " + name + " TO DEFAULT"
+		if timeout, ok := timeouts[name]; ok {
+			statement = fmt.Sprintf("SET %s = '%dms'", name, int64(timeout/time.Millisecond))
+		}
+		if _, err := db.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retry lock_timeoutで失敗したトランザクション内のマイグレーションを再試行できる場合に、待ち時間の後にtrueを返す。
+// attemptは何回目の再試行か
+func (policy *timeoutPolicy) retry(ctx context.Context, migration *sqlmigrate.PlannedMigration, attempt int, err error) bool {
+	if attempt > policy.retries || migration.DisableTransaction || !isLockTimeout(err) {
+		return false
+	}
+
+	backoff := policy.backoff << uint(attempt-1)
+	if backoff > MaxWaitBackoff || backoff <= 0 {
+		backoff = MaxWaitBackoff
+	}
+	logger, _ := zap.NewProduction()
+	defer logger.Sync()
+	logger.Warn(
+		"Migration hit lock timeout, retrying",
+		zap.String("id", migration.Id),
+		zap.Int("attempt", attempt),
+		zap.Duration("backoff", backoff),
+		zap.Error(err))
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(backoff):
+		return true
+	}
+}
+
+// isLockTimeout lock_timeoutでロックを取得できなかったエラーかを返す
+func isLockTimeout(err error) bool {
+	var txError *sqlmigrate.TxError
+	if errors.As(err, &txError) {
+		err = txError.Err
+	}
+	var pqError *pq.Error
+	return errors.As(err, &pqError) && pqError.Code == lockNotAvailable
+}
+
+func init() {
+	TimeoutConfig = TimeoutConfigStruct{
+		LockTimeout:              GetLockTimeout,
+		StatementTimeout:         GetStatementTimeout,
+		IdleInTransactionTimeout: GetIdleInTransactionTimeout,
+		LockRetries:              GetLockRetries,
+		LockRetryBackoff:         GetLockRetryBackoff,
+		RunTimeout:               GetRunTimeout,
+	}
+}
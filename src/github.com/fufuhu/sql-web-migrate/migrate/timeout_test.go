@@ -0,0 +1,203 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	sqlmigrate "github.com/rubenv/sql-migrate"
+)
+
+// TestParseTimeoutAnnotations 最初の-- +migrateより前の注釈だけを読み取り、
+// 不正な設定名や値がエラーになることを確認する。
+func TestParseTimeoutAnnotations(t *testing.T) {
+	timeouts, err := ParseTimeoutAnnotations(strings.NewReader(
+		"-- add an index to orders\n" +
+			"-- +timeout lock_timeout=5s statement_timeout=10m\n" +
+			"-- +timeout idle_in_transaction_session_timeout=0\n" +
+			"-- +migrate Up\n" +
+			"-- +timeout lock_timeout=1h\n" +
+			"CREATE INDEX orders_user ON orders (user_id);\n"))
+	if err != nil || len(timeouts) != 3 || timeouts[SettingLockTimeout] != 5*time.Second ||
+		timeouts[SettingStatementTimeout] != 10*time.Minute || timeouts[SettingIdleInTransactionTimeout] != 0 {
+		t.Log(timeouts, err)
+		t.Fail()
+	}
+
+	for _, content := range []string{
+		"-- +timeout work_mem=64MB\n",
+		"-- +timeout lock_timeout\n",
+		"-- +timeout lock_timeout=5\n",
+		"-- +timeout lock_timeout=-1s\n",
+	} {
+		if _, err := ParseTimeoutAnnotations(strings.NewReader(content)); err == nil {
+			t.Log(content)
+			t.Fail()
+		}
+	}
+}
+
+// timeoutTarget タイムアウトを設定した対象を返す
+func timeoutTarget(lockTimeout time.Duration, retries int) *Target {
+	return &Target{
+		Name: "timeouts",
+		Timeouts: TimeoutConfigStruct{
+			LockTimeout:              func() (time.Duration, error) { return lockTimeout, nil },
+			StatementTimeout:         func() (time.Duration, error) { return time.Minute, nil },
+			IdleInTransactionTimeout: func() (time.Duration, error) { return 0, nil },
+			LockRetries:              func() (int, error) { return retries, nil },
+			LockRetryBackoff:         func() (time.Duration, error) { return time.Millisecond, nil },
+		},
+	}
+}
+
+// TestTimeoutPolicy 全体の設定をファイルの注釈で上書きし、
+// PostgreSQL以外の対象ではタイムアウトを設定できないことを確認する。
+func TestTimeoutPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timeouts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "01-index.sql"), []byte("-- +timeout lock_timeout=2s\n-- +migrate Up\nSELECT 1;\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "02-plain.sql"), []byte("-- +migrate Up\nSELECT 1;\n"), 0644)
+	source := sqlmigrate.FileMigrationSource{Dir: dir}
+
+	policy, err := newTimeoutPolicy(timeoutTarget(5*time.Second, 0), DialectPostgres, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeouts, err := policy.forMigration("01-index.sql")
+	if err != nil || len(timeouts) != 2 || timeouts[SettingLockTimeout] != 2*time.Second || timeouts[SettingStatementTimeout] != time.Minute {
+		t.Log(timeouts, err)
+		t.Fail()
+	}
+	if timeouts, err := policy.forMigration("02-plain.sql"); err != nil || timeouts[SettingLockTimeout] != 5*time.Second {
+		t.Log(timeouts, err)
+		t.Fail()
+	}
+
+	if _, err := newTimeoutPolicy(timeoutTarget(5*time.Second, 0), DialectSQLite, source); err != ErrSessionTimeoutsUnsupported {
+		t.Log(err)
+		t.Fail()
+	}
+	target := timeoutTarget(0, 0)
+	target.Timeouts.StatementTimeout = func() (time.Duration, error) { return 0, nil }
+	policy, err = newTimeoutPolicy(target, DialectSQLite, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := policy.forMigration("01-index.sql"); err != ErrSessionTimeoutsUnsupported {
+		t.Log(err)
+		t.Fail()
+	}
+}
+
+// TestTimeoutPolicyRetry lock_timeoutで失敗したトランザクション内のマイグレーションだけを、
+// 設定した回数まで再試行することを確認する。
+func TestTimeoutPolicyRetry(t *testing.T) {
+	policy, err := newTimeoutPolicy(timeoutTarget(time.Second, 2), DialectPostgres, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migration := &sqlmigrate.PlannedMigration{Migration: &sqlmigrate.Migration{Id: "01-index.sql"}}
+	lockError := &sqlmigrate.TxError{Migration: migration.Migration, Err: &pq.Error{Code: lockNotAvailable}}
+
+	if !policy.retry(context.Background(), migration, 1, lockError) || !policy.retry(context.Background(), migration, 2, lockError) {
+		t.Fail()
+	}
+	if policy.retry(context.Background(), migration, 3, lockError) {
+		t.Fail()
+	}
+	if policy.retry(context.Background(), migration, 1, errors.New("syntax error")) {
+		t.Fail()
+	}
+	migration.DisableTransaction = true
+	if policy.retry(context.Background(), migration, 1, lockError) {
+		t.Fail()
+	}
+}
+
+// TestHandlerTimeoutAnnotationUnsupported SQLiteの対象でタイムアウトの注釈があるマイグレーションは、
+// 実行せずに失敗することを確認する。
+func TestHandlerTimeoutAnnotationUnsupported(t *testing.T) {
+	targets, cleanup := setupSQLiteTargets(t, map[string]string{
+		"03-comments.sql": "-- +timeout lock_timeout=5s\n-- +migrate Up\nCREATE TABLE comments (id integer primary key);\n" +
+			"-- +migrate Down\nDROP TABLE comments;\n",
+	})
+	defer cleanup()
+	mux := NewServeMux(targets)
+
+	w := serve(mux, http.MethodPost, "/targets/local/migrate/up", nil)
+	var result MigrationResult
+	decode(t, w, &result)
+	if w.Code != http.StatusInternalServerError || result.Error != SessionTimeoutsUnsupportedErrorMessage ||
+		len(result.Applied) != 2 {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+}
+
+// slowMigration SQLiteで時間のかかるINSERTを含むマイグレーション
+var slowMigration = map[string]string{
+	"03-numbers.sql": "-- +migrate Up\nCREATE TABLE numbers (n integer);\n" +
+		"INSERT INTO numbers WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x + 1 FROM c WHERE x < 1000000000) SELECT x FROM c;\n" +
+		"-- +migrate Down\nDROP TABLE numbers;\n",
+}
+
+// TestHandlerRunTimeout 実行時間の上限を過ぎた場合は実行中のSQL文をキャンセルし、
+// 中断したマイグレーションとロールバックしたことを返すことを確認する。
+func TestHandlerRunTimeout(t *testing.T) {
+	targets, cleanup := setupSQLiteTargets(t, slowMigration)
+	defer cleanup()
+	target, _ := targets.Get("local")
+	target.Timeouts.RunTimeout = func() (time.Duration, error) { return 500 * time.Millisecond, nil }
+	mux := NewServeMux(targets)
+
+	startedAt := time.Now()
+	w := serve(mux, http.MethodPost, "/targets/local/migrate/up", nil)
+	var result MigrationResult
+	decode(t, w, &result)
+	if w.Code != http.StatusGatewayTimeout || len(result.Applied) != 2 || result.Interrupted == nil ||
+		result.Interrupted.Migration != "03-numbers.sql" || result.Interrupted.Reason != InterruptReasonDeadline ||
+		!result.Interrupted.RolledBack || time.Since(startedAt) > 10*time.Second {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+
+	// ロールバックしたため、numbersは作成されていない
+	target.Timeouts.RunTimeout = func() (time.Duration, error) { return 0, nil }
+	plan, err := GetMigrationPlan(context.Background(), target, "", sqlmigrate.Up, 0)
+	if err != nil || len(plan.Migrations) != 1 || plan.Migrations[0].ID != "03-numbers.sql" {
+		t.Log(plan, err)
+		t.Fail()
+	}
+}
+
+// TestExecMigrateCanceled 呼び出し元のコンテキストがキャンセルされた場合は、
+// 中断した理由をcanceledとして返すことを確認する。
+func TestExecMigrateCanceled(t *testing.T) {
+	targets, cleanup := setupSQLiteTargets(t, slowMigration)
+	defer cleanup()
+	target, _ := targets.Get("local")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result, err := ExecMigrate(ctx, target, sqlmigrate.Up, 0, func(id string) {
+		if id == "02-posts.sql" {
+			time.AfterFunc(200*time.Millisecond, cancel)
+		}
+	})
+	var interrupted *InterruptedError
+	if !errors.As(err, &interrupted) || !errors.Is(err, context.Canceled) || result.Interrupted == nil ||
+		result.Interrupted.Reason != InterruptReasonCanceled || errorStatus(err) != http.StatusServiceUnavailable {
+		t.Log(result, err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,196 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/exporters/zipkin"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// TraceExporter トレースの出力先(none/stdout/file/zipkin)を指定するための環境変数
+	TraceExporter = "SQL_MIGRATE_TRACE_EXPORTER"
+	// TraceFilePath トレースの出力先がfileの場合の出力ファイルパスを指定するための環境変数
+	TraceFilePath = "SQL_MIGRATE_TRACE_FILE"
+	// TraceZipkinURL トレースの出力先がzipkinの場合の送信先URLを指定するための環境変数
+	TraceZipkinURL = "SQL_MIGRATE_TRACE_ZIPKIN_URL"
+	// TraceServiceName トレースに付与するサービス名を指定するための環境変数
+	TraceServiceName = "SQL_MIGRATE_TRACE_SERVICE_NAME"
+)
+
+const (
+	// TraceExporterNone トレースを出力しない
+	TraceExporterNone = "none"
+	// TraceExporterStdout トレースを標準出力に出力する
+	TraceExporterStdout = "stdout"
+	// TraceExporterFile トレースをファイルに出力する
+	TraceExporterFile = "file"
+	// TraceExporterZipkin トレースをZipkin形式で送信する。
+	// Jaegerなど多くのコレクタもこの形式を受け付ける
+	TraceExporterZipkin = "zipkin"
+)
+
+const (
+	// DefaultTraceExporter デフォルトのトレースの出力先
+	DefaultTraceExporter = TraceExporterNone
+	// DefaultTraceFilePath デフォルトのトレースの出力ファイルパス
+	DefaultTraceFilePath = "/tmp/sql-web-migrate-trace.json"
+	// DefaultTraceZipkinURL デフォルトのZipkinの送信先URL
+	DefaultTraceZipkinURL = "http://localhost:9411/api/v2/spans"
+	// DefaultTraceServiceName デフォルトのサービス名
+	DefaultTraceServiceName = "sql-web-migrate"
+)
+
+const (
+	// TraceExporterSettingFormatErrorMessage トレースの出力先の設定を誤っている際のエラーメッセージです
+	TraceExporterSettingFormatErrorMessage = "Trace exporter should be none, stdout, file, or zipkin"
+)
+
+// TracerName このアプリケーションのスパンを生成するTracerの名前
+const TracerName = "github.com/fufuhu/sql-web-migrate"
+
+// GetTraceExporter トレースの出力先を取得する。
+// 環境変数が設定されていない場合は、DefaultTraceExporterの値を返す
+// 不正な値が設定されている場合はエラーとDefaultTraceExporterの値を返す
+func GetTraceExporter() (string, error) {
+	exporter := getValue(TraceExporter, DefaultTraceExporter)
+
+	switch exporter {
+	case TraceExporterNone, TraceExporterStdout, TraceExporterFile, TraceExporterZipkin:
+		return exporter, nil
+	}
+	return DefaultTraceExporter, errors.New(TraceExporterSettingFormatErrorMessage)
+}
+
+// GetTraceFilePath トレースの出力ファイルパスを取得する。
+// 環境変数が設定されていない場合は、DefaultTraceFilePathの値を返す
+func GetTraceFilePath() string {
+	return getValue(TraceFilePath, DefaultTraceFilePath)
+}
+
+// GetTraceZipkinURL Zipkinの送信先URLを取得する。
+// 環境変数が設定されていない場合は、DefaultTraceZipkinURLの値を返す
+func GetTraceZipkinURL() string {
+	return getValue(TraceZipkinURL, DefaultTraceZipkinURL)
+}
+
+// GetTraceServiceName トレースに付与するサービス名を取得する。
+// 環境変数が設定されていない場合は、DefaultTraceServiceNameの値を返す
+func GetTraceServiceName() string {
+	return getValue(TraceServiceName, DefaultTraceServiceName)
+}
+
+// TraceConfigStruct トレースの設定を格納したもの
+type TraceConfigStruct struct {
+	Exporter    func() (string, error)
+	FilePath    func() string
+	ZipkinURL   func() string
+	ServiceName func() string
+}
+
+// TraceConfig トレースの設定です
+var TraceConfig TraceConfigStruct
+
+// SetupTracing トレースの設定に従ってTracerProviderとW3C Trace Contextの
+// プロパゲータをグローバルに登録する。
+// 戻り値の関数はバッファされたスパンを出力して終了するためのもの
+func SetupTracing(traceConfig TraceConfigStruct) (func(context.Context) error, error) {
+	// 出力先にかかわらずtraceparentは引き継ぐ
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	exporterName, err := traceConfig.Exporter()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		exporter sdktrace.SpanExporter
+		closer   io.Closer
+	)
+	switch exporterName {
+	case TraceExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case TraceExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case TraceExporterFile:
+		var file *os.File
+		file, err = os.OpenFile(traceConfig.FilePath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		closer = file
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(file))
+	case TraceExporterZipkin:
+		exporter, err = zipkin.New(traceConfig.ZipkinURL())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// stdout/fileは手元での確認用なので、終了を待たずにすぐ書き出す
+	processor := sdktrace.WithBatcher(exporter)
+	if exporterName != TraceExporterZipkin {
+		processor = sdktrace.WithSyncer(exporter)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		processor,
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", traceConfig.ServiceName()))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closer != nil {
+			closer.Close()
+		}
+		return err
+	}, nil
+}
+
+// Tracer このアプリケーションのスパンを生成するTracerを返す
+func Tracer() trace.Tracer {
+	return otel.Tracer(TracerName)
+}
+
+// StartRequestSpan HTTPリクエストのtraceparentを引き継いでスパンを開始する
+func StartRequestSpan(r *http.Request, name string) (context.Context, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+	return Tracer().Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.method", r.Method),
+			attribute.String("http.target", r.URL.Path),
+		))
+}
+
+// EndSpan エラーがあればスパンに記録してからスパンを終了する
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func init() {
+	TraceConfig = TraceConfigStruct{
+		Exporter:    GetTraceExporter,
+		FilePath:    GetTraceFilePath,
+		ZipkinURL:   GetTraceZipkinURL,
+		ServiceName: GetTraceServiceName,
+	}
+}
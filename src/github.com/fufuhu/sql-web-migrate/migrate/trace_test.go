@@ -0,0 +1,101 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// setupFileTracing テスト用に一時ファイルへトレースを出力する設定を行う
+func setupFileTracing(t *testing.T) (string, func(context.Context) error) {
+	file, err := ioutil.TempFile("", "trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	os.Setenv(TraceExporter, TraceExporterFile)
+	os.Setenv(TraceFilePath, file.Name())
+	defer os.Unsetenv(TraceExporter)
+	defer os.Unsetenv(TraceFilePath)
+
+	shutdown, err := SetupTracing(TraceConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file.Name(), shutdown
+}
+
+// TestSetupTracingFile ファイル出力を指定した場合に
+// 終了したスパンがファイルに書き出されることを確認する。
+func TestSetupTracingFile(t *testing.T) {
+	path, shutdown := setupFileTracing(t)
+	defer os.Remove(path)
+
+	_, span := Tracer().Start(context.Background(), "migration 00-test.sql")
+	EndSpan(span, errors.New("pq: syntax error"))
+	shutdown(context.Background())
+
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := string(bytes)
+	if !strings.Contains(output, "migration 00-test.sql") ||
+		!strings.Contains(output, "pq: syntax error") {
+		t.Log(output)
+		t.Fail()
+	}
+}
+
+// TestStartRequestSpan traceparentヘッダを持つリクエストから開始したスパンが
+// 呼び出し元のトレースIDを引き継ぐことを確認する。
+func TestStartRequestSpan(t *testing.T) {
+	path, shutdown := setupFileTracing(t)
+	defer os.Remove(path)
+	defer shutdown(context.Background())
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	r := httptest.NewRequest("POST", "/migrate/up", nil)
+	r.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+
+	_, span := StartRequestSpan(r, "migrate up")
+	defer span.End()
+
+	if span.SpanContext().TraceID().String() != traceID {
+		t.Log(span.SpanContext().TraceID())
+		t.Fail()
+	}
+}
+
+// TestGetTraceExporterDefaultValue トレースの出力先として
+// 環境変数が指定されていない場合にデフォルト値が取得できることを確認する。
+func TestGetTraceExporterDefaultValue(t *testing.T) {
+	os.Unsetenv(TraceExporter)
+
+	exporter, err := GetTraceExporter()
+
+	if err != nil || exporter != DefaultTraceExporter {
+		t.Fail()
+	}
+}
+
+// TestGetTraceExporterError トレースの出力先として
+// 不正な値が設定されている場合にエラーとデフォルト値がかえってくることを確認する。
+func TestGetTraceExporterError(t *testing.T) {
+	os.Setenv(TraceExporter, "hogehoge")
+	defer os.Unsetenv(TraceExporter)
+
+	exporter, err := GetTraceExporter()
+
+	if err == nil || err.Error() != TraceExporterSettingFormatErrorMessage {
+		t.Fail()
+	}
+	if exporter != DefaultTraceExporter {
+		t.Fail()
+	}
+}
@@ -0,0 +1,88 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// WaitTimeout DBへの接続を待つ最大時間を指定するための環境変数
+	WaitTimeout = "SQL_MIGRATE_WAIT_TIMEOUT"
+	// WaitBackoff DBへの接続を再試行するまでの初回待ち時間を指定するための環境変数
+	WaitBackoff = "SQL_MIGRATE_WAIT_BACKOFF"
+)
+
+const (
+	// DefaultWaitTimeout デフォルトの接続待ち時間(0の場合は待たない)
+	DefaultWaitTimeout = time.Duration(0)
+	// DefaultWaitBackoff デフォルトの再試行までの初回待ち時間
+	DefaultWaitBackoff = time.Second
+	// MaxWaitBackoff 再試行までの待ち時間の上限
+	MaxWaitBackoff = 30 * time.Second
+)
+
+// GetWaitTimeout DBへの接続を待つ最大時間を取得する。
+// 環境変数が設定されていない場合は、DefaultWaitTimeoutの値を返す
+// 環境変数の値がtime.ParseDurationで解釈できない場合はerrorとDefaultWaitTimeoutの値を返す
+func GetWaitTimeout() (time.Duration, error) {
+	return getDuration(WaitTimeout, DefaultWaitTimeout)
+}
+
+// GetWaitBackoff DBへの接続を再試行するまでの初回待ち時間を取得する。
+// 環境変数が設定されていない場合は、DefaultWaitBackoffの値を返す
+// 環境変数の値がtime.ParseDurationで解釈できない場合はerrorとDefaultWaitBackoffの値を返す
+func GetWaitBackoff() (time.Duration, error) {
+	return getDuration(WaitBackoff, DefaultWaitBackoff)
+}
+
+// getDuration envKeyに指定された環境変数の値を時間として返す。
+// 未定義の場合はdefaultValueを、解釈できない場合はerrorとdefaultValueを返す
+func getDuration(envKey string, defaultValue time.Duration) (time.Duration, error) {
+	duration, err := time.ParseDuration(getValue(envKey, defaultValue.String()))
+	if err != nil {
+		return defaultValue, err
+	}
+	if duration < 0 {
+		return defaultValue, fmt.Errorf("%s should not be negative: %s", envKey, duration)
+	}
+	return duration, nil
+}
+
+// WaitFor checkが成功するまで待ち時間を倍にしながら(上限MaxWaitBackoff)再試行する。
+// timeoutを過ぎても成功しない場合は最後のエラーを返す
+func WaitFor(ctx context.Context, timeout time.Duration, backoff time.Duration,
+	check func(context.Context) error) error {
+
+	logger, _ := zap.NewProduction()
+	defer logger.Sync()
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for attempt := 1; ; attempt++ {
+		err := check(ctx)
+		if err == nil {
+			return nil
+		}
+
+		logger.Warn(
+			"Waiting for database",
+			zap.Int("attempt", attempt),
+			zap.Duration("backoff", backoff),
+			zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("gave up waiting after %d attempt(s): %v", attempt, err)
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > MaxWaitBackoff {
+			backoff = MaxWaitBackoff
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestWaitFor 数回失敗した後に成功する場合に
+// エラーなく待ち終わることを確認する。
+func TestWaitFor(t *testing.T) {
+	attempts := 0
+	check := func(ctx context.Context) error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+
+	err := WaitFor(context.Background(), time.Second, time.Millisecond, check)
+
+	if err != nil || attempts != 3 {
+		t.Log(attempts, err)
+		t.Fail()
+	}
+}
+
+// TestWaitForTimeout 成功しないまま最大時間を過ぎた場合に
+// エラーが返ることを確認する。
+func TestWaitForTimeout(t *testing.T) {
+	check := func(ctx context.Context) error {
+		return errors.New("connection refused")
+	}
+
+	start := time.Now()
+	err := WaitFor(context.Background(), 50*time.Millisecond, 10*time.Millisecond, check)
+
+	if err == nil {
+		t.Fail()
+	}
+	if time.Since(start) > time.Second {
+		t.Log(time.Since(start))
+		t.Fail()
+	}
+}
+
+// TestGetWaitTimeoutDefaultValue 接続待ち時間として
+// 環境変数が指定されていない場合にデフォルト値が取得できることを確認する。
+func TestGetWaitTimeoutDefaultValue(t *testing.T) {
+	os.Unsetenv(WaitTimeout)
+
+	timeout, err := GetWaitTimeout()
+
+	if err != nil || timeout != DefaultWaitTimeout {
+		t.Fail()
+	}
+}
+
+// TestGetWaitTimeoutError 接続待ち時間として
+// 不正な値が設定されている場合にエラーが返ることを確認する。
+func TestGetWaitTimeoutError(t *testing.T) {
+	for _, value := range []string{"hogehoge", "-1s"} {
+		os.Setenv(WaitTimeout, value)
+
+		timeout, err := GetWaitTimeout()
+
+		if err == nil || timeout != DefaultWaitTimeout {
+			t.Log(value)
+			t.Fail()
+		}
+	}
+	os.Unsetenv(WaitTimeout)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	config "github.com/fufuhu/sql-web-migrate/migrate"
+	migrate "github.com/rubenv/sql-migrate"
+)
+
+// runOnceCommand DBの起動を待ってからマイグレーションを適用し、
+// 実行結果をJSONで出力して終了する。Kubernetesのinit containerやJobで使うことを想定している
+func runOnceCommand(args []string) int {
+	defaultTimeout, err := config.GetWaitTimeout()
+	if err != nil {
+		return exitWithError(err)
+	}
+	defaultBackoff, err := config.GetWaitBackoff()
+	if err != nil {
+		return exitWithError(err)
+	}
+
+	flags := newFlagSet("run-once")
+	output := flags.String("output", config.GetSummaryPath(), `file to write the JSON summary to ("-" for stdout)`)
+	wait := flags.Duration("wait", defaultTimeout, "how long to wait for the database to become reachable (0 disables)")
+	backoff := flags.Duration("wait-backoff", defaultBackoff, "initial delay between connection attempts")
+	override := addOverrideFlag(flags)
+	targetName := addTargetFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	target, err := lookupTarget(*targetName)
+	if err != nil {
+		return exitWithError(err)
+	}
+	defer target.Close()
+
+	ctx, stop := interruptContext()
+	defer stop()
+
+	// デプロイのたびに実行されるため、時間帯の外や凍結中、承認が必要な対象では待たずに失敗する
+	var result config.MigrationResult
+	err = enforcePolicies(target, *override)
+	if err == nil {
+		err = waitForDatabase(ctx, target, *wait, *backoff)
+	}
+	if err == nil {
+		result, err = config.ExecMigrate(ctx, target, migrate.Up, 0, nil)
+	} else {
+		result = config.NewMigrationResult(migrate.Up)
+		result.Finish(err)
+	}
+
+	if writeErr := writeSummary(*output, result); writeErr != nil {
+		return exitWithError(writeErr)
+	}
+	if err != nil {
+		return exitWithError(err)
+	}
+	return 0
+}
+
+// waitForDatabase 対象のDBに接続できるようになるまでtimeoutの間待つ。
+// timeoutが0の場合は待たない
+func waitForDatabase(ctx context.Context, target *config.Target, timeout time.Duration, backoff time.Duration) error {
+	if timeout == 0 {
+		return nil
+	}
+
+	dialect, err := target.Dialect()
+	if err != nil {
+		return err
+	}
+
+	db, err := config.GetConnection(ctx, target.Connection, dialect)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return config.WaitFor(ctx, timeout, backoff, db.PingContext)
+}
+
+// writeSummary 実行結果をJSONでpathに書き出す。pathが"-"の場合は標準出力に書き出す
+func writeSummary(path string, result config.MigrationResult) error {
+	bytes, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	bytes = append(bytes, '\n')
+
+	if path == "-" {
+		_, err = os.Stdout.Write(bytes)
+		return err
+	}
+	return ioutil.WriteFile(path, bytes, 0644)
+}